@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/middleware"
+	FrappeInvoiceService "github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+)
+
+// runCLI executes an administrative command instead of starting the server
+//
+//	gaps      -company <id>
+//	disable   -company <id> -serie <n> -from <n> -to <n> -reason "<justification>"
+//	reconcile -from <YYYY-MM-DD> -to <YYYY-MM-DD> -format json|csv
+//
+// The running bridge owns the store, so the commands go through its admin API
+// (BRIDGE_URL), signed with WEBHOOK_SECRET like any admin request
+func runCLI(args []string, adminURL string) error {
+	admin := &adminClient{baseURL: strings.TrimRight(adminURL, "/"), httpClient: http.DefaultClient}
+
+	// Ctrl+C cancels the request in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	switch args[0] {
+	case "gaps":
+		fs := flag.NewFlagSet("gaps", flag.ExitOnError)
+		company := fs.String("company", "", "NFe.io company ID (defaults to the default company)")
+		fs.Parse(args[1:])
+
+		var resp struct {
+			Gaps []FrappeInvoiceService.NumberRange `json:"gaps"`
+		}
+		query := url.Values{}
+		if *company != "" {
+			query.Set("company", *company)
+		}
+		if err := admin.call(ctx, http.MethodGet, "/api/v1/disablements/gaps?"+query.Encode(), nil, &resp); err != nil {
+			return err
+		}
+		if len(resp.Gaps) == 0 {
+			fmt.Println("No numbering gaps found")
+		}
+		for _, gap := range resp.Gaps {
+			fmt.Printf("serie %d: %d-%d\n", gap.Serie, gap.Begin, gap.End)
+		}
+		return nil
+
+	case "disable":
+		fs := flag.NewFlagSet("disable", flag.ExitOnError)
+		company := fs.String("company", "", "NFe.io company ID (defaults to the default company)")
+		serie := fs.Int("serie", 1, "NF-e serie")
+		from := fs.Int("from", 0, "first number of the range")
+		to := fs.Int("to", 0, "last number of the range (defaults to -from)")
+		reason := fs.String("reason", "", "justification (15 to 255 characters)")
+		fs.Parse(args[1:])
+
+		if *to == 0 {
+			*to = *from
+		}
+
+		var resp struct {
+			DisablementID string `json:"disablement_id"`
+			Status        string `json:"status"`
+		}
+		err := admin.call(ctx, http.MethodPost, "/api/v1/disablements", map[string]interface{}{
+			"company": *company,
+			"serie":   *serie,
+			"begin":   *from,
+			"end":     *to,
+			"reason":  *reason,
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Disablement %s: %s\n", resp.DisablementID, resp.Status)
+		return nil
+
+	case "reconcile":
+		fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		from := fs.String("from", "", "first day of the range (defaults to yesterday)")
+		to := fs.String("to", "", "last day of the range (defaults to -from)")
+		format := fs.String("format", "csv", "output format: json or csv")
+		fs.Parse(args[1:])
+
+		if *format != "csv" && *format != "json" {
+			return fmt.Errorf("unknown format %q (available: json, csv)", *format)
+		}
+		query := url.Values{"from": {*from}, "to": {*to}, "format": {*format}}
+		var report bytes.Buffer
+		if err := admin.call(ctx, http.MethodGet, "/api/v1/reports/reconciliation?"+query.Encode(), nil, &report); err != nil {
+			return err
+		}
+		_, err := report.WriteTo(os.Stdout)
+		return err
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s (available: gaps, disable, reconcile)\n", args[0])
+		os.Exit(2)
+	}
+
+	return nil
+}
+
+// adminClient calls the admin API of a running bridge
+type adminClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// call sends payload as JSON (none when nil) and decodes the answer into out,
+// or copies it as is when out is a *bytes.Buffer. An answer other than 2xx is
+// returned as an error with its body
+func (a *adminClient) call(ctx context.Context, method, path string, payload interface{}, out interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if header := os.Getenv("WEBHOOK_SIGNATURE"); header != "" {
+		req.Header.Set(header, middleware.SignBody(body))
+	}
+
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the bridge at %s (is the server running?): %w", a.baseURL, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the answer of the bridge: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bridge returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(raw)))
+	}
+
+	if buf, ok := out.(*bytes.Buffer); ok {
+		_, err := buf.Write(raw)
+		return err
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("failed to decode the answer of the bridge: %w", err)
+	}
+	return nil
+}
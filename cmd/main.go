@@ -1,48 +1,197 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/joho/godotenv"
 
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/handler"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/middleware"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
 	FrappeInvoiceService "github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
 	NfeIoInvoiceService "github.com/AnyGridTech/frappe-nfe-bridge/internal/service/nfeio_invoice"
 )
 
 func main() {
-	// 1. Load Configuration (Fail fast if missing)
+	// 1. Load Configuration (Fail fast if missing or invalid)
 	cfg := loadConfig()
 
+	// Command line mode (e.g. "disable"): calls the admin API of the running
+	// server and exits
+	if len(os.Args) > 1 {
+		if err := runCLI(os.Args[1:], cfg.Server.AdminURL); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// 2. Initialize Repositories
-	// Note: We inject the specific Custom DocType name here
-	// This keeps the repo generic enough to handle other DocTypes if needed later.
-	frappeRepo := repository.NewFrappeRepo(
-		cfg.FrappeURL,
-		cfg.FrappeKey,
-		cfg.FrappeSecret,
-		cfg.CustomDoctype, // exact name of your custom doctype
+	// Shared clients per upstream: retries with backoff and a circuit breaker
+	retryPolicy := repository.RetryPolicy{
+		MaxAttempts: cfg.Retry.MaxAttempts,
+		BaseDelay:   cfg.Retry.BaseDelay,
+		MaxDelay:    cfg.Retry.MaxDelay,
+	}
+	frappeBreaker := repository.NewCircuitBreaker("frappe", cfg.Breaker.Threshold, cfg.Breaker.Cooldown)
+	nfeBreaker := repository.NewCircuitBreaker("nfeio", cfg.Breaker.Threshold, cfg.Breaker.Cooldown)
+	frappeHTTPClient := repository.NewHTTPClient(retryPolicy, frappeBreaker)
+	nfeHTTPClient := repository.NewHTTPClient(retryPolicy, nfeBreaker)
+
+	// Generic Frappe REST client, shared by every DocType helper
+	// FRAPPE_AUTH_MODE selects API key (default), OAuth2 or session login
+	frappeAuth, err := newFrappeAuth(cfg.Frappe, frappeHTTPClient)
+	if err != nil {
+		log.Fatalf("CRITICAL: Invalid Frappe authentication: %v", err)
+	}
+	frappeClient := repository.NewFrappeClientWithAuth(
+		cfg.Frappe.URL,
+		frappeAuth,
+		cfg.Frappe.Timeout,
+		frappeHTTPClient,
 	)
 
-	nfeRepo := repository.NewNFeRepo(
-		cfg.NFeEndpoint,
-		cfg.NFeEndpointConsult,
-		cfg.NFeAPIKey,
+	// The invoices DocType comes from CUSTOM_DOCTYPE ("Invoices" by default);
+	// the other DocTypes (Tax, Customer, Item...) are the standard ones
+	frappeRepo := repository.NewFrappeRepo(
+		frappeClient,
+		cfg.Frappe.Doctype,
 	)
 
+	// Company registry: one NFe.io repository per company API key
+	// Companies come from the config file; without them the single company
+	// from NFE_COMPANY_ID/NFE_API_KEY is used
+	nfeRepoFactory := func(apiKey string) repository.NFeRepository {
+		return repository.NewNFeRepo(cfg.NFe.Endpoint, cfg.NFe.EndpointConsult, apiKey, cfg.NFe.Timeout, nfeHTTPClient)
+	}
+	companies, err := FrappeInvoiceService.NewCompanyRegistry(cfg.CompanyConfigs(), cfg.DefaultCompany, cfg.NFe.APIKey, nfeRepoFactory)
+	if err != nil {
+		log.Fatalf("CRITICAL: Failed to load companies: %v", err)
+	}
+	// A non-production Frappe site (staging copy, development) may only use
+	// homologation companies
+	companies.SetSiteEnvironment(cfg.Frappe.SiteEnvironment)
+
+	// Default NFe.io company for admin endpoints that do not inform one
+	defaultCompanyID := ""
+	if company, err := companies.Resolve(""); err == nil {
+		defaultCompanyID = company.NFeCompanyID
+	}
+
+	// Embedded store: numbering ledger (numbers used per company and serie)
+	// and every issuance attempt
+	store, err := repository.OpenStore(cfg.Store.Path)
+	if err != nil {
+		log.Fatalf("CRITICAL: Failed to open store: %v", err)
+	}
+	defer store.Close()
+	ledgerRepo := repository.NewStoreLedgerRepo(store)
+	issuanceRepo := repository.NewIssuanceRepo(store)
+	// Frappe write-backs waiting for delivery (same store: recorded together
+	// with the issuance result)
+	outboxRepo := repository.NewOutboxRepo(store)
+
+	// The environment of each company must match its state registration at
+	// NFe.io; companies NFe.io could not confirm are checked again on first use
+	verifyCtx, cancelVerify := context.WithTimeout(context.Background(), cfg.NFe.Timeout)
+	if err := companies.VerifyEnvironments(verifyCtx); errors.Is(err, FrappeInvoiceService.ErrEnvironmentMismatch) {
+		log.Fatalf("CRITICAL: %v", err)
+	} else if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	cancelVerify()
+
+	// Queue depths exposed on /metrics, read on each scrape
+	metrics.RegisterQueue("outbox", func() (int, error) {
+		pending, err := outboxRepo.ListPending()
+		return len(pending), err
+	})
+	metrics.RegisterQueue("dead_letters", func() (int, error) {
+		letters, err := issuanceRepo.ListDeadLetters()
+		return len(letters), err
+	})
+	metrics.RegisterQueue("sefaz_pending", func() (int, error) {
+		waiting, err := issuanceRepo.List(repository.IssuanceFilter{
+			Statuses: []string{models.IssuanceStatusProcessing, models.IssuanceStatusCancelling},
+		})
+		return len(waiting), err
+	})
+
+	// Series policy per company, operation type and natureza
+	seriesPolicy, err := FrappeInvoiceService.NewSeriesPolicy(cfg.Series)
+	if err != nil {
+		log.Fatalf("CRITICAL: Failed to load series policy: %v", err)
+	}
+	seriesPolicy.Rules = append(seriesPolicy.Rules, companies.SeriesRules()...)
+
+	// CFOP rules per natureza and tax codes of items without a tax template
+	fiscalRules, err := FrappeInvoiceService.NewFiscalRules(cfg.CFOPRules, cfg.TaxDefaults)
+	if err != nil {
+		log.Fatalf("CRITICAL: Invalid fiscal rules: %v", err)
+	}
+
 	// 3. Initialize Services
-	// We inject the NFe Company ID here as it's a business rule constant for the issuer
-	frappe_invoice_service := FrappeInvoiceService.NewIssuerService(frappeRepo, nfeRepo, cfg.NFeCompanyID)
+	numbering_service := FrappeInvoiceService.NewNumberingService(seriesPolicy, ledgerRepo)
+	// Delivers the write-backs with retries; dead-letters after OUTBOX_MAX_ATTEMPTS
+	outbox_dispatcher := FrappeInvoiceService.NewOutboxDispatcher(frappeRepo, outboxRepo, repository.RetryPolicy{
+		MaxAttempts: cfg.Outbox.MaxAttempts,
+		BaseDelay:   cfg.Outbox.BaseDelay,
+		MaxDelay:    cfg.Outbox.MaxDelay,
+	}, cfg.Outbox.Interval)
+	// We inject the company registry here: each invoice is routed to its NFe.io company
+	frappe_invoice_service := FrappeInvoiceService.NewIssuerService(frappeRepo, companies, numbering_service, issuanceRepo, outbox_dispatcher, fiscalRules)
+	return_invoice_service := FrappeInvoiceService.NewReturnService(companies, numbering_service, issuanceRepo)
+	complement_invoice_service := FrappeInvoiceService.NewComplementService(frappeRepo, companies, numbering_service, issuanceRepo, outbox_dispatcher)
+	disablement_service := FrappeInvoiceService.NewDisablementService(companies, ledgerRepo, issuanceRepo)
+	archive_service := FrappeInvoiceService.NewArchiveService(frappeRepo, companies, outbox_dispatcher)
+	invoice_event_service := FrappeInvoiceService.NewInvoiceEventService(frappeRepo, companies, issuanceRepo)
+	// Polls NFe.io for the notes still waiting for SEFAZ (lost webhooks)
+	reconciler_service := FrappeInvoiceService.NewReconciler(frappeRepo, companies, issuanceRepo, outbox_dispatcher, numbering_service, repository.RetryPolicy{
+		BaseDelay: cfg.Reconcile.BaseDelay,
+		MaxDelay:  cfg.Reconcile.MaxDelay,
+	}, cfg.Reconcile.Interval, cfg.Reconcile.PendingAlertAfter)
+	report_service := FrappeInvoiceService.NewReportService(frappeRepo, companies, issuanceRepo)
+	dead_letter_service := FrappeInvoiceService.NewDeadLetterService(frappeRepo, issuanceRepo, frappe_invoice_service, return_invoice_service, complement_invoice_service)
+	// Frappe and NFe.io reachability, store and write-back queue for /readyz,
+	// probed with plain clients: no retries and no circuit breaker
+	probeHTTPClient := &http.Client{Timeout: cfg.Server.ReadinessTimeout}
+	probeFrappeRepo := repository.NewFrappeRepo(
+		repository.NewFrappeClientWithAuth(cfg.Frappe.URL, frappeAuth, cfg.Server.ReadinessTimeout, probeHTTPClient),
+		cfg.Frappe.Doctype,
+	)
+	probeNFeRepoFactory := func(apiKey string) repository.NFeRepository {
+		return repository.NewNFeRepo(cfg.NFe.Endpoint, cfg.NFe.EndpointConsult, apiKey, cfg.Server.ReadinessTimeout, probeHTTPClient)
+	}
+	readiness_service := FrappeInvoiceService.NewReadinessService(probeFrappeRepo, companies, probeNFeRepoFactory, store, outboxRepo, cfg.Outbox.MaxQueueDepth, cfg.Server.ReadinessTimeout)
 	nfeio_invoice_service := NfeIoInvoiceService.NewFrappeService()
 
 	// 4. Initialize Handlers
 	FrappeInvoice := handler.NewFrappeInvoiceHandler(frappe_invoice_service)
+	ReturnInvoice := handler.NewReturnInvoiceHandler(return_invoice_service)
+	ComplementInvoice := handler.NewComplementInvoiceHandler(complement_invoice_service)
+	Disablement := handler.NewDisablementHandler(disablement_service, defaultCompanyID)
+	Archive := handler.NewArchiveHandler(archive_service)
+	InvoiceEvent := handler.NewInvoiceEventHandler(invoice_event_service)
+	Reconcile := handler.NewReconcileHandler(reconciler_service)
+	Report := handler.NewReportHandler(report_service)
+	DeadLetter := handler.NewDeadLetterHandler(dead_letter_service)
 	NfeIoInvoice := handler.NewNfeIoInvoiceHandler(nfeio_invoice_service)
+	Health := handler.NewHealthHandler(readiness_service, frappeBreaker, nfeBreaker)
 
 	// 5. Setup Fiber
 	app := fiber.New(fiber.Config{
@@ -52,6 +201,10 @@ func main() {
 	// Middleware
 	app.Use(logger.New())  // Request logging
 	app.Use(recover.New()) // Prevent crashes from panics
+	// Per-request deadline, canceled when the shutdown drain deadline passes
+	stop, forceStop := context.WithCancel(context.Background())
+	defer forceStop()
+	app.Use(middleware.RequestContext(stop, cfg.Server.RequestTimeout))
 
 	// 6. Define Routes
 	// Grouping routes is good practice for versioning
@@ -61,62 +214,158 @@ func main() {
 	v1.Post("/webhook/invoices/issue", FrappeInvoice.CreateWebhook)
 	v1.Post("/webhook/nfeio/response", NfeIoInvoice.ProcessResponseWebhook)
 
-	// Health check (always good to have)
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.SendString("OK")
-	})
+	// Admin endpoints, signed like the webhooks (WEBHOOK_SECRET). The group
+	// guards every /api/v1 route registered after it, so keep it last
+	admin := v1.Group("", middleware.WebhookAuth)
+
+	// Numbering gaps and number range disablement (inutilização)
+	admin.Get("/disablements/gaps", Disablement.ListGaps)
+	admin.Post("/disablements", Disablement.DisableRange)
+
+	// Cancellation and correction letter (CC-e) of the NF-e of an invoice
+	admin.Post("/invoices/:name/cancel", InvoiceEvent.Cancel)
+	admin.Post("/invoices/:name/correction-letter", InvoiceEvent.CorrectionLetter)
+
+	// Notes pending at SEFAZ and on-demand reconciliation with NFe.io
+	admin.Get("/issuances/pending", Reconcile.ListPending)
+	admin.Post("/issuances/reconcile", Reconcile.Reconcile)
+
+	// Discrepancies between Frappe invoices and NFe.io notes (JSON or CSV)
+	admin.Get("/reports/reconciliation", Report.Reconciliation)
+
+	// Return (devolução) notes mirroring an original NF-e
+	admin.Post("/invoices/returns", ReturnInvoice.CreateReturn)
+
+	// Complementary notes for underbilled price or taxes
+	admin.Post("/invoices/complements", ComplementInvoice.CreateComplement)
+
+	// Dry run: the payload, totals and warnings issuing the invoice would produce
+	admin.Post("/invoices/:name/preview", FrappeInvoice.Preview)
+
+	// Archive the authorized XML and DANFE as private attachments of the invoice
+	admin.Post("/invoices/:name/attachments", Archive.ArchiveDocuments)
+
+	// Failed and rejected issuances: inspect, edit-and-replay or discard
+	admin.Get("/dead-letters", DeadLetter.List)
+	admin.Get("/dead-letters/:id", DeadLetter.Get)
+	admin.Post("/dead-letters/:id/replay", DeadLetter.Replay)
+	admin.Post("/dead-letters/:id/discard", DeadLetter.Discard)
+
+	// Liveness (process up) and readiness (dependencies reachable, not draining)
+	app.Get("/livez", Health.Livez)
+	app.Get("/readyz", Health.Readyz)
+	app.Get("/health", Health.Livez)
+	// Circuit breaker state of each upstream (503 while one is open)
+	app.Get("/health/upstreams", Health.Upstreams)
+
+	// Prometheus metrics: issuances, upstream calls, retries, queues
+	app.Get("/metrics", adaptor.HTTPHandler(metrics.Handler()))
 
 	// 7. Start Server
-	log.Printf("Starting server on port %s...", cfg.Port)
-	if err := app.Listen(":" + cfg.Port); err != nil {
+	// Background outbox delivery and reconciliation, stopped after the drain
+	var workers sync.WaitGroup
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		outbox_dispatcher.Run(stop)
+	}()
+	go func() {
+		defer workers.Done()
+		reconciler_service.Run(stop)
+	}()
+	// SIGHUP reloads the series, CFOP rules and tax defaults
+	go reloadConfig(cfg, companies, numbering_service, fiscalRules)
+
+	// SIGINT/SIGTERM: /readyz fails, no new connections are accepted and the
+	// requests in flight get SHUTDOWN_TIMEOUT to finish before being canceled
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+
+		log.Printf("Received %s, draining requests for up to %s...", sig, cfg.Server.ShutdownTimeout)
+		readiness_service.Drain()
+		if err := app.ShutdownWithTimeout(cfg.Server.ShutdownTimeout); err != nil {
+			log.Printf("Warning: Drain deadline passed, canceling the requests still running: %v", err)
+		}
+		forceStop()
+		workers.Wait()
+	}()
+
+	log.Printf("Starting server on port %s...", cfg.Server.Port)
+	if err := app.Listen(":" + cfg.Server.Port); err != nil {
 		log.Fatal(err)
 	}
+	<-drained
+	log.Printf("Server stopped")
 }
 
 // --- Configuration Helper ---
 
-type Config struct {
-	Port               string
-	FrappeURL          string
-	FrappeKey          string
-	FrappeSecret       string
-	NFeAPIKey          string
-	NFeCompanyID       string
-	NFeEndpoint        string
-	NFeEndpointConsult string
-	CustomDoctype      string
+// loadConfig reads CONFIG_FILE (optional) and the environment; every invalid
+// setting is reported at once
+func loadConfig() *config.Config {
+	loadEnv()
+
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"), os.LookupEnv)
+	if err != nil {
+		log.Fatalf("CRITICAL: %v", err)
+	}
+	return cfg
 }
 
-func loadConfig() Config {
-	loadEnv()
-	// Helper to get env with default
-	get := func(key, fallback string) string {
-		if val, ok := os.LookupEnv(key); ok {
-			return val
+// reloadConfig applies the series, CFOP rules and tax defaults of the
+// configuration on SIGHUP. Other changes are reported and need a restart
+func reloadConfig(current *config.Config, companies *FrappeInvoiceService.CompanyRegistry, numbering *FrappeInvoiceService.NumberingService, rules *FrappeInvoiceService.FiscalRules) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		next, err := config.Load(os.Getenv("CONFIG_FILE"), os.LookupEnv)
+		if err != nil {
+			log.Printf("Warning: Configuration not reloaded, keeping the current settings: %v", err)
+			continue
 		}
-		return fallback
-	}
 
-	// In a real production app, consider using "github.com/spf13/viper"
-	// or "github.com/joho/godotenv" here.
-	cfg := Config{
-		Port:               get("PORT", "3000"),
-		FrappeURL:          os.Getenv("FRAPPE_URL"),
-		FrappeKey:          os.Getenv("FRAPPE_API_KEY"),
-		FrappeSecret:       os.Getenv("FRAPPE_API_SECRET"),
-		NFeAPIKey:          os.Getenv("NFE_API_KEY"),
-		NFeCompanyID:       os.Getenv("NFE_COMPANY_ID"),
-		NFeEndpoint:        get("NFE_ENDPOINT", "https://api.nfe.io/v2"),
-		NFeEndpointConsult: get("NFE_ENDPOINT_CONSULT", "https://api.nfe.io/v2"),
-		CustomDoctype:      os.Getenv("CUSTOM_DOCTYPE"),
-	}
+		seriesPolicy, err := FrappeInvoiceService.NewSeriesPolicy(next.Series)
+		if err != nil {
+			log.Printf("Warning: Configuration not reloaded, keeping the current settings: %v", err)
+			continue
+		}
+		if err := rules.Update(next.CFOPRules, next.TaxDefaults); err != nil {
+			log.Printf("Warning: Configuration not reloaded, keeping the current settings: %v", err)
+			continue
+		}
+		seriesPolicy.Rules = append(seriesPolicy.Rules, companies.SeriesRules()...)
+		numbering.SetPolicy(seriesPolicy)
 
-	// Basic validation
-	if cfg.FrappeURL == "" || cfg.NFeAPIKey == "" {
-		log.Fatal("CRITICAL: Missing environment variables (FRAPPE_URL or NFE_API_KEY)")
+		if changed := current.StructuralChanges(next); len(changed) > 0 {
+			log.Printf("Warning: Restart to apply the changes to %s", strings.Join(changed, ", "))
+		}
+		log.Printf("Configuration reloaded: series, CFOP rules and tax defaults")
 	}
+}
 
-	return cfg
+// newFrappeAuth builds the Frappe authentication selected by FRAPPE_AUTH_MODE
+func newFrappeAuth(cfg config.FrappeConfig, httpClient *http.Client) (repository.FrappeAuth, error) {
+	switch cfg.AuthMode {
+	case repository.FrappeAuthToken:
+		return repository.NewAPIKeyAuth(cfg.APIKey, cfg.APISecret), nil
+	case repository.FrappeAuthOAuth2:
+		return repository.NewOAuth2Auth(repository.OAuth2Config{
+			TokenURL:     cfg.OAuth.TokenURL,
+			ClientID:     cfg.OAuth.ClientID,
+			ClientSecret: cfg.OAuth.ClientSecret,
+			Scope:        cfg.OAuth.Scope,
+			AccessToken:  cfg.OAuth.AccessToken,
+		}, httpClient), nil
+	case repository.FrappeAuthSession:
+		return repository.NewSessionAuth(cfg.URL, cfg.Username, cfg.Password, httpClient), nil
+	default:
+		return nil, fmt.Errorf("unknown FRAPPE_AUTH_MODE %q", cfg.AuthMode)
+	}
 }
 
 func loadEnv() {
@@ -0,0 +1,476 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// envReference matches a secret taken from the environment, e.g. ${NFE_API_KEY}
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Config is the bridge configuration: the defaults, then the YAML file, then
+// the environment variables. Fields tagged reload:"true" are applied again on
+// SIGHUP; every other change needs a restart
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Frappe    FrappeConfig    `yaml:"frappe"`
+	NFe       NFeConfig       `yaml:"nfe"`
+	Store     StoreConfig     `yaml:"store"`
+	Retry     RetryConfig     `yaml:"retry"`
+	Breaker   BreakerConfig   `yaml:"breaker"`
+	Outbox    OutboxConfig    `yaml:"outbox"`
+	Reconcile ReconcileConfig `yaml:"reconcile"`
+
+	DefaultCompany string          `yaml:"default_company"` // Used for invoices without company
+	Companies      []CompanyConfig `yaml:"companies"`
+
+	Series      []SeriesRule `yaml:"series" reload:"true"`
+	CFOPRules   []CFOPRule   `yaml:"cfop_rules" reload:"true"`
+	TaxDefaults TaxDefaults  `yaml:"tax_defaults" reload:"true"`
+}
+
+type ServerConfig struct {
+	Port             string        `yaml:"port"`
+	RequestTimeout   time.Duration `yaml:"request_timeout"`   // Whole request, all upstream calls included
+	ShutdownTimeout  time.Duration `yaml:"shutdown_timeout"`  // Drain of the requests in flight on SIGTERM
+	ReadinessTimeout time.Duration `yaml:"readiness_timeout"` // Each /readyz check
+	AdminURL         string        `yaml:"admin_url"`         // Server the command line calls, http://localhost:<port> by default
+}
+
+type FrappeConfig struct {
+	URL             string        `yaml:"url"`
+	AuthMode        string        `yaml:"auth_mode"` // token, oauth2 or session
+	APIKey          string        `yaml:"api_key"`
+	APISecret       string        `yaml:"api_secret"`
+	Username        string        `yaml:"username"` // Session login
+	Password        string        `yaml:"password"`
+	OAuth           OAuthConfig   `yaml:"oauth"`
+	Doctype         string        `yaml:"doctype"`          // DocType of the invoices
+	SiteEnvironment string        `yaml:"site_environment"` // production, staging, development...
+	Timeout         time.Duration `yaml:"timeout"`          // Each Frappe call
+}
+
+type OAuthConfig struct {
+	TokenURL     string `yaml:"token_url"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	Scope        string `yaml:"scope"`
+	AccessToken  string `yaml:"access_token"` // Static bearer token
+}
+
+type NFeConfig struct {
+	APIKey          string        `yaml:"api_key"`
+	CompanyID       string        `yaml:"company_id"`   // Single company, without companies
+	IssuerState     string        `yaml:"issuer_state"` // Single company
+	Environment     string        `yaml:"environment"`  // Single company: production or homologation
+	Endpoint        string        `yaml:"endpoint"`
+	EndpointConsult string        `yaml:"endpoint_consult"`
+	Timeout         time.Duration `yaml:"timeout"` // Each NFe.io call
+}
+
+type StoreConfig struct {
+	Path string `yaml:"path"`
+}
+
+type RetryConfig struct {
+	MaxAttempts int           `yaml:"max_attempts"` // Attempts per idempotent call
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+}
+
+type BreakerConfig struct {
+	Threshold int           `yaml:"threshold"` // Consecutive failures that open the circuit
+	Cooldown  time.Duration `yaml:"cooldown"`
+}
+
+type OutboxConfig struct {
+	Interval      time.Duration `yaml:"interval"`     // Pause between background rounds
+	MaxAttempts   int           `yaml:"max_attempts"` // Deliveries before a write-back is dead-lettered
+	BaseDelay     time.Duration `yaml:"base_delay"`
+	MaxDelay      time.Duration `yaml:"max_delay"`
+	MaxQueueDepth int           `yaml:"max_queue_depth"` // Pending write-backs above which /readyz fails (0: no limit)
+}
+
+type ReconcileConfig struct {
+	Interval          time.Duration `yaml:"interval"`   // Pause between background rounds
+	BaseDelay         time.Duration `yaml:"base_delay"` // Backoff between lookups of the same note
+	MaxDelay          time.Duration `yaml:"max_delay"`
+	PendingAlertAfter time.Duration `yaml:"pending_alert_after"` // Age from which a pending note is reported
+}
+
+// Default returns the configuration used for everything the file and the
+// environment leave unset
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{Port: "3000", RequestTimeout: 60 * time.Second, ShutdownTimeout: 30 * time.Second, ReadinessTimeout: 5 * time.Second},
+		Frappe: FrappeConfig{
+			AuthMode: repository.FrappeAuthToken,
+			Doctype:  "Invoices",
+			Timeout:  15 * time.Second,
+		},
+		NFe: NFeConfig{
+			Endpoint:        "https://api.nfe.io/v2",
+			EndpointConsult: "https://api.nfe.io/v2",
+			Timeout:         30 * time.Second,
+		},
+		Store: StoreConfig{Path: "data/bridge.db"},
+		Retry: RetryConfig{
+			MaxAttempts: repository.DefaultRetryPolicy.MaxAttempts,
+			BaseDelay:   repository.DefaultRetryPolicy.BaseDelay,
+			MaxDelay:    repository.DefaultRetryPolicy.MaxDelay,
+		},
+		Breaker: BreakerConfig{Threshold: 5, Cooldown: 30 * time.Second},
+		Outbox:  OutboxConfig{Interval: 5 * time.Second, MaxAttempts: 10, BaseDelay: 10 * time.Second, MaxDelay: 15 * time.Minute, MaxQueueDepth: 1000},
+		Reconcile: ReconcileConfig{
+			Interval:          time.Minute,
+			BaseDelay:         30 * time.Second,
+			MaxDelay:          30 * time.Minute,
+			PendingAlertAfter: time.Hour,
+		},
+	}
+}
+
+// Load builds the configuration from the YAML file (none when path is empty)
+// and the environment, and validates it. Every problem found is reported
+func Load(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.decodeFile(path, lookupEnv); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	if cfg.Server.AdminURL == "" {
+		cfg.Server.AdminURL = "http://localhost:" + cfg.Server.Port
+	}
+	if cfg.Frappe.OAuth.TokenURL == "" && cfg.Frappe.URL != "" {
+		cfg.Frappe.OAuth.TokenURL = strings.TrimRight(cfg.Frappe.URL, "/") + "/api/method/frappe.integrations.oauth2.get_token"
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeFile reads the YAML file over the defaults, replacing ${VAR} references
+// in its values with the environment. The references are expanded after the
+// file is parsed, so a secret holding YAML syntax (#, ": ", quotes, newlines)
+// is taken verbatim. Unknown keys are errors, so typos do not go unnoticed
+func (c *Config) decodeFile(path string, lookupEnv func(string) (string, bool)) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		return nil // Empty file
+	}
+
+	var missing []string
+	expandValues(&doc, func(name string) string {
+		value, ok := lookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return fmt.Errorf("config %s references unset environment variables: %s", path, strings.Join(missing, ", "))
+	}
+
+	// yaml.Node.Decode cannot reject unknown keys: decode the expanded document
+	// again with a strict decoder
+	expanded, err := yaml.Marshal(&doc)
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(expanded))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return nil
+}
+
+// expandValues replaces the ${VAR} references of every scalar value (not the
+// keys) under node. An unquoted value is typed again once expanded, so
+// "port: ${PORT}" still reads as a number, except that it never becomes null
+func expandValues(node *yaml.Node, lookup func(name string) string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !envReference.MatchString(node.Value) {
+			return
+		}
+		node.Value = envReference.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			return lookup(envReference.FindStringSubmatch(ref)[1])
+		})
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+			if node.ShortTag() == "!!null" {
+				node.Tag = "!!str"
+			}
+		}
+	case yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			expandValues(node.Content[i], lookup)
+		}
+	default:
+		for _, child := range node.Content {
+			expandValues(child, lookup)
+		}
+	}
+}
+
+// applyEnv overrides the file with the environment variables that are set
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	str := func(key string, dst *string) {
+		if val, ok := lookupEnv(key); ok {
+			*dst = val
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if val, ok := lookupEnv(key); ok {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", key, val))
+				return
+			}
+			*dst = d
+		}
+	}
+	number := func(key string, dst *int) {
+		if val, ok := lookupEnv(key); ok {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", key, val))
+				return
+			}
+			*dst = n
+		}
+	}
+
+	str("PORT", &c.Server.Port)
+	duration("REQUEST_TIMEOUT", &c.Server.RequestTimeout)
+	duration("SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	duration("READINESS_TIMEOUT", &c.Server.ReadinessTimeout)
+	str("BRIDGE_URL", &c.Server.AdminURL)
+
+	str("FRAPPE_URL", &c.Frappe.URL)
+	str("FRAPPE_AUTH_MODE", &c.Frappe.AuthMode)
+	str("FRAPPE_API_KEY", &c.Frappe.APIKey)
+	str("FRAPPE_API_SECRET", &c.Frappe.APISecret)
+	str("FRAPPE_USERNAME", &c.Frappe.Username)
+	str("FRAPPE_PASSWORD", &c.Frappe.Password)
+	str("FRAPPE_OAUTH_TOKEN_URL", &c.Frappe.OAuth.TokenURL)
+	str("FRAPPE_OAUTH_CLIENT_ID", &c.Frappe.OAuth.ClientID)
+	str("FRAPPE_OAUTH_CLIENT_SECRET", &c.Frappe.OAuth.ClientSecret)
+	str("FRAPPE_OAUTH_SCOPE", &c.Frappe.OAuth.Scope)
+	str("FRAPPE_ACCESS_TOKEN", &c.Frappe.OAuth.AccessToken)
+	str("CUSTOM_DOCTYPE", &c.Frappe.Doctype)
+	str("FRAPPE_SITE_ENVIRONMENT", &c.Frappe.SiteEnvironment)
+	duration("FRAPPE_TIMEOUT", &c.Frappe.Timeout)
+
+	str("NFE_API_KEY", &c.NFe.APIKey)
+	str("NFE_COMPANY_ID", &c.NFe.CompanyID)
+	str("NFE_ISSUER_STATE", &c.NFe.IssuerState)
+	str("NFE_ENVIRONMENT", &c.NFe.Environment)
+	str("NFE_ENDPOINT", &c.NFe.Endpoint)
+	str("NFE_ENDPOINT_CONSULT", &c.NFe.EndpointConsult)
+	duration("NFE_TIMEOUT", &c.NFe.Timeout)
+
+	str("STORE_PATH", &c.Store.Path)
+
+	number("RETRY_MAX_ATTEMPTS", &c.Retry.MaxAttempts)
+	duration("RETRY_BASE_DELAY", &c.Retry.BaseDelay)
+	duration("RETRY_MAX_DELAY", &c.Retry.MaxDelay)
+	number("BREAKER_THRESHOLD", &c.Breaker.Threshold)
+	duration("BREAKER_COOLDOWN", &c.Breaker.Cooldown)
+
+	duration("OUTBOX_INTERVAL", &c.Outbox.Interval)
+	number("OUTBOX_MAX_ATTEMPTS", &c.Outbox.MaxAttempts)
+	duration("OUTBOX_BASE_DELAY", &c.Outbox.BaseDelay)
+	duration("OUTBOX_MAX_DELAY", &c.Outbox.MaxDelay)
+	number("OUTBOX_MAX_QUEUE_DEPTH", &c.Outbox.MaxQueueDepth)
+	duration("RECONCILE_INTERVAL", &c.Reconcile.Interval)
+	duration("RECONCILE_BASE_DELAY", &c.Reconcile.BaseDelay)
+	duration("RECONCILE_MAX_DELAY", &c.Reconcile.MaxDelay)
+	duration("PENDING_ALERT_AFTER", &c.Reconcile.PendingAlertAfter)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Validate checks the whole configuration and reports every problem found
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	positive := func(name string, d time.Duration) {
+		if d <= 0 {
+			fail("%s must be a positive duration", name)
+		}
+	}
+	atLeastOne := func(name string, n int) {
+		if n < 1 {
+			fail("%s must be at least 1", name)
+		}
+	}
+
+	if port, err := strconv.Atoi(c.Server.Port); err != nil || port <= 0 || port > 65535 {
+		fail("server.port (PORT): invalid port %q", c.Server.Port)
+	}
+	positive("server.request_timeout (REQUEST_TIMEOUT)", c.Server.RequestTimeout)
+	positive("server.shutdown_timeout (SHUTDOWN_TIMEOUT)", c.Server.ShutdownTimeout)
+	positive("server.readiness_timeout (READINESS_TIMEOUT)", c.Server.ReadinessTimeout)
+	if !isHTTPURL(c.Server.AdminURL) {
+		fail("server.admin_url (BRIDGE_URL): %q is not an http(s) URL", c.Server.AdminURL)
+	}
+
+	if c.Frappe.URL == "" {
+		fail("frappe.url (FRAPPE_URL) is required")
+	} else if !isHTTPURL(c.Frappe.URL) {
+		fail("frappe.url (FRAPPE_URL): %q is not an http(s) URL", c.Frappe.URL)
+	}
+	switch c.Frappe.AuthMode {
+	case repository.FrappeAuthToken:
+		if c.Frappe.APIKey == "" || c.Frappe.APISecret == "" {
+			fail("token mode needs frappe.api_key and frappe.api_secret (FRAPPE_API_KEY, FRAPPE_API_SECRET)")
+		}
+	case repository.FrappeAuthOAuth2:
+		if c.Frappe.OAuth.AccessToken == "" && (c.Frappe.OAuth.ClientID == "" || c.Frappe.OAuth.ClientSecret == "") {
+			fail("oauth2 mode needs frappe.oauth.access_token or frappe.oauth.client_id and client_secret (FRAPPE_ACCESS_TOKEN or FRAPPE_OAUTH_CLIENT_ID and FRAPPE_OAUTH_CLIENT_SECRET)")
+		}
+	case repository.FrappeAuthSession:
+		if c.Frappe.Username == "" || c.Frappe.Password == "" {
+			fail("session mode needs frappe.username and frappe.password (FRAPPE_USERNAME, FRAPPE_PASSWORD)")
+		}
+	default:
+		fail("frappe.auth_mode (FRAPPE_AUTH_MODE): unknown mode %q (token, oauth2 or session)", c.Frappe.AuthMode)
+	}
+	if c.Frappe.Doctype == "" {
+		fail("frappe.doctype (CUSTOM_DOCTYPE) must not be empty")
+	}
+	if c.Frappe.SiteEnvironment == "" {
+		fail("frappe.site_environment (FRAPPE_SITE_ENVIRONMENT) is required")
+	}
+	positive("frappe.timeout (FRAPPE_TIMEOUT)", c.Frappe.Timeout)
+
+	for name, endpoint := range map[string]string{"nfe.endpoint (NFE_ENDPOINT)": c.NFe.Endpoint, "nfe.endpoint_consult (NFE_ENDPOINT_CONSULT)": c.NFe.EndpointConsult} {
+		if !isHTTPURL(endpoint) {
+			fail("%s: %q is not an http(s) URL", name, endpoint)
+		}
+	}
+	positive("nfe.timeout (NFE_TIMEOUT)", c.NFe.Timeout)
+
+	if len(c.Companies) > 0 {
+		for i, company := range c.Companies {
+			if company.Name == "" || company.NFeCompanyID == "" {
+				fail("companies[%d]: name and nfe_company_id are required", i)
+			}
+			if company.NFeAPIKey == "" && c.NFe.APIKey == "" {
+				fail("companies[%d] (%s): nfe_api_key is required without nfe.api_key (NFE_API_KEY)", i, company.Name)
+			}
+		}
+	} else {
+		// Single company from the nfe section
+		if c.NFe.APIKey == "" {
+			fail("nfe.api_key (NFE_API_KEY) is required")
+		}
+		if c.NFe.CompanyID == "" {
+			fail("nfe.company_id (NFE_COMPANY_ID) is required without companies")
+		}
+	}
+
+	if c.Store.Path == "" {
+		fail("store.path (STORE_PATH) is required")
+	}
+	atLeastOne("retry.max_attempts (RETRY_MAX_ATTEMPTS)", c.Retry.MaxAttempts)
+	positive("retry.base_delay (RETRY_BASE_DELAY)", c.Retry.BaseDelay)
+	positive("retry.max_delay (RETRY_MAX_DELAY)", c.Retry.MaxDelay)
+	atLeastOne("breaker.threshold (BREAKER_THRESHOLD)", c.Breaker.Threshold)
+	positive("breaker.cooldown (BREAKER_COOLDOWN)", c.Breaker.Cooldown)
+	positive("outbox.interval (OUTBOX_INTERVAL)", c.Outbox.Interval)
+	atLeastOne("outbox.max_attempts (OUTBOX_MAX_ATTEMPTS)", c.Outbox.MaxAttempts)
+	positive("outbox.base_delay (OUTBOX_BASE_DELAY)", c.Outbox.BaseDelay)
+	positive("outbox.max_delay (OUTBOX_MAX_DELAY)", c.Outbox.MaxDelay)
+	if c.Outbox.MaxQueueDepth < 0 {
+		fail("outbox.max_queue_depth (OUTBOX_MAX_QUEUE_DEPTH) must not be negative")
+	}
+	positive("reconcile.interval (RECONCILE_INTERVAL)", c.Reconcile.Interval)
+	positive("reconcile.base_delay (RECONCILE_BASE_DELAY)", c.Reconcile.BaseDelay)
+	positive("reconcile.max_delay (RECONCILE_MAX_DELAY)", c.Reconcile.MaxDelay)
+	positive("reconcile.pending_alert_after (PENDING_ALERT_AFTER)", c.Reconcile.PendingAlertAfter)
+
+	if err := ValidateSeriesRules(c.Series); err != nil {
+		fail("series: %v", err)
+	}
+	if err := ValidateCFOPRules(c.CFOPRules); err != nil {
+		fail("cfop_rules: %v", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// CompanyConfigs returns the companies of the file or, without them, the
+// single company of the nfe section
+func (c *Config) CompanyConfigs() []CompanyConfig {
+	if len(c.Companies) > 0 {
+		return c.Companies
+	}
+	return []CompanyConfig{{
+		NFeCompanyID: c.NFe.CompanyID,
+		NFeAPIKey:    c.NFe.APIKey,
+		State:        c.NFe.IssuerState,
+		Environment:  c.NFe.Environment,
+	}}
+}
+
+// StructuralChanges lists the settings that differ in next and are only
+// applied on restart (everything not tagged reload:"true")
+func (c *Config) StructuralChanges(next *Config) []string {
+	var changed []string
+	current, updated := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if field.Tag.Get("reload") == "true" {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			changed = append(changed, strings.Split(field.Tag.Get("yaml"), ",")[0])
+		}
+	}
+	return changed
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func lookupIn(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		val, ok := env[key]
+		return val, ok
+	}
+}
+
+const validConfig = `
+frappe:
+  url: https://erp.example.com
+  api_key: ${FRAPPE_KEY}
+  api_secret: ${FRAPPE_SECRET}
+  doctype: Frappe Invoices
+  site_environment: production
+  timeout: 20s
+nfe:
+  api_key: ${NFE_KEY}
+default_company: AnyGrid Matriz
+companies:
+  - name: AnyGrid Matriz
+    nfe_company_id: 123456
+    state: SP
+series:
+  - operation_type: outgoing
+    serie: 2
+cfop_rules:
+  - operation_nature: Remessa para conserto
+    cfop: x915
+tax_defaults:
+  cst_pis: "07"
+`
+
+func TestLoadFileWithSecretsAndOverrides(t *testing.T) {
+	path := writeConfig(t, validConfig)
+	cfg, err := Load(path, lookupIn(map[string]string{
+		"FRAPPE_KEY":    "key",
+		"FRAPPE_SECRET": "secret",
+		"NFE_KEY":       "nfe-key",
+		"FRAPPE_URL":    "https://override.example.com",
+		"NFE_TIMEOUT":   "45s",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Frappe.APIKey != "key" || cfg.NFe.APIKey != "nfe-key" {
+		t.Errorf("expected the secrets from the environment, got %q and %q", cfg.Frappe.APIKey, cfg.NFe.APIKey)
+	}
+	if cfg.Frappe.URL != "https://override.example.com" || cfg.NFe.Timeout != 45*time.Second {
+		t.Errorf("expected the environment to override the file, got %s and %s", cfg.Frappe.URL, cfg.NFe.Timeout)
+	}
+	if cfg.Frappe.Timeout != 20*time.Second || cfg.Server.Port != "3000" {
+		t.Errorf("expected the file and the defaults, got %s and %s", cfg.Frappe.Timeout, cfg.Server.Port)
+	}
+	if len(cfg.Companies) != 1 || cfg.Companies[0].NFeCompanyID != "123456" {
+		t.Errorf("expected the company of the file, got %+v", cfg.Companies)
+	}
+	if cfg.Frappe.OAuth.TokenURL != "https://override.example.com/api/method/frappe.integrations.oauth2.get_token" {
+		t.Errorf("expected the default token URL, got %s", cfg.Frappe.OAuth.TokenURL)
+	}
+	if len(cfg.Series) != 1 || len(cfg.CFOPRules) != 1 || cfg.TaxDefaults.CSTPis != "07" {
+		t.Errorf("expected the series and fiscal rules of the file, got %+v %+v %+v", cfg.Series, cfg.CFOPRules, cfg.TaxDefaults)
+	}
+}
+
+func TestLoadTakesSecretsVerbatim(t *testing.T) {
+	secrets := map[string]string{
+		"FRAPPE_KEY":    `k3y # not a comment`,
+		"FRAPPE_SECRET": "s3cr3t: with \"quotes\" and 'apostrophes'\nand a second line",
+		"NFE_KEY":       "null",
+		"THRESHOLD":     "7",
+	}
+	path := writeConfig(t, validConfig+`breaker:
+  threshold: ${THRESHOLD}
+`)
+	cfg, err := Load(path, lookupIn(secrets))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.Frappe.APIKey != secrets["FRAPPE_KEY"] || cfg.Frappe.APISecret != secrets["FRAPPE_SECRET"] || cfg.NFe.APIKey != "null" {
+		t.Errorf("expected the secrets verbatim, got %q, %q and %q", cfg.Frappe.APIKey, cfg.Frappe.APISecret, cfg.NFe.APIKey)
+	}
+	if cfg.Breaker.Threshold != 7 {
+		t.Errorf("expected a referenced number, got %d", cfg.Breaker.Threshold)
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	path := writeConfig(t, `
+frappe:
+  url: erp.example.com
+  doctype: ""
+nfe:
+  timeout: -1s
+cfop_rules:
+  - operation_nature: Venda
+    cfop: "51"
+`)
+	_, err := Load(path, lookupIn(map[string]string{"BREAKER_THRESHOLD": "0"}))
+	if err == nil {
+		t.Fatal("expected an invalid configuration")
+	}
+	for _, want := range []string{
+		"frappe.url (FRAPPE_URL)",
+		"token mode needs",
+		"frappe.doctype (CUSTOM_DOCTYPE) must not be empty",
+		"frappe.site_environment (FRAPPE_SITE_ENVIRONMENT) is required",
+		"nfe.api_key (NFE_API_KEY) is required",
+		"nfe.company_id (NFE_COMPANY_ID) is required",
+		"nfe.timeout (NFE_TIMEOUT)",
+		"breaker.threshold (BREAKER_THRESHOLD)",
+		"cfop_rules: cfop rule 0",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestLoadRejectsUnknownKeysAndUnsetSecrets(t *testing.T) {
+	if _, err := Load(writeConfig(t, "frappe:\n  urll: https://erp.example.com\n"), lookupIn(nil)); err == nil || !strings.Contains(err.Error(), "urll") {
+		t.Errorf("expected the unknown key to be reported, got %v", err)
+	}
+	if _, err := Load(writeConfig(t, validConfig), lookupIn(map[string]string{"NFE_KEY": "nfe-key"})); err == nil || !strings.Contains(err.Error(), "FRAPPE_KEY, FRAPPE_SECRET") {
+		t.Errorf("expected the unset references to be reported, got %v", err)
+	}
+	if _, err := Load("", lookupIn(map[string]string{"FRAPPE_URL": "https://erp.example.com", "RETRY_MAX_DELAY": "soon"})); err == nil || !strings.Contains(err.Error(), "RETRY_MAX_DELAY") {
+		t.Errorf("expected the invalid duration to be reported, got %v", err)
+	}
+}
+
+func TestStructuralChanges(t *testing.T) {
+	env := lookupIn(map[string]string{"FRAPPE_KEY": "key", "FRAPPE_SECRET": "secret", "NFE_KEY": "nfe-key"})
+	current, err := Load(writeConfig(t, validConfig), env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next, err := Load(writeConfig(t, strings.Replace(strings.Replace(validConfig, "timeout: 20s", "timeout: 25s", 1), "serie: 2", "serie: 3", 1)), env)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if changed := current.StructuralChanges(next); len(changed) != 1 || changed[0] != "frappe" {
+		t.Errorf("expected only the frappe section to need a restart, got %v", changed)
+	}
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Operation types of the series and CFOP rules
+const (
+	operationOutgoing = "outgoing"
+	operationIncoming = "incoming"
+)
+
+// cfopPattern accepts a fixed CFOP ("5102") or a template whose first digit is
+// derived from the direction and the states ("x102")
+var cfopPattern = regexp.MustCompile(`^[1-7x]\d{3}$`)
+
+// CompanyConfig maps a Frappe `company` value (matriz or filial) to its NFe.io
+// account and fiscal data
+type CompanyConfig struct {
+	Name         string       `yaml:"name"`           // Frappe company value
+	NFeCompanyID string       `yaml:"nfe_company_id"` // Company ID in NFe.io
+	NFeAPIKey    string       `yaml:"nfe_api_key"`    // Falls back to nfe.api_key when empty
+	State        string       `yaml:"state"`          // Issuer UF (e.g. "SP")
+	TaxRegime    string       `yaml:"tax_regime"`     // "normal" or "simplesNacional"
+	Environment  string       `yaml:"environment"`    // "production" (default) or "homologation"
+	Series       []SeriesRule `yaml:"series"`         // Company specific series rules
+}
+
+// SeriesRule selects the serie (and numbering mode) for invoices matching a
+// company, operation type and natureza. Empty fields match anything.
+type SeriesRule struct {
+	Company           string `yaml:"company"`            // NFe.io company ID
+	OperationType     string `yaml:"operation_type"`     // "outgoing" or "incoming"
+	OperationNature   string `yaml:"operation_nature"`   // Natureza de Operação (case insensitive)
+	Serie             int    `yaml:"serie"`              // Serie to use
+	ExplicitNumbering bool   `yaml:"explicit_numbering"` // Send Number from the local ledger instead of letting NFe.io assign it
+}
+
+// CFOPRule sets the CFOP of a natureza de operação, taking precedence over the
+// built-in table
+type CFOPRule struct {
+	OperationNature string `yaml:"operation_nature"` // Case insensitive
+	OperationType   string `yaml:"operation_type"`   // "outgoing", "incoming" or empty for both
+	CFOP            string `yaml:"cfop"`             // "5102" or "x102"
+}
+
+// TaxDefaults are the tax codes used for items of invoices without a tax template
+type TaxDefaults struct {
+	CSTICMS     string `yaml:"cst_icms"`
+	OrigemICMS  string `yaml:"origem_icms"`
+	ModDetermBC string `yaml:"mod_determ_bc"`
+	CSTPis      string `yaml:"cst_pis"`
+	CSTCofins   string `yaml:"cst_cofins"`
+	CSTIPI      string `yaml:"cst_ipi"`
+}
+
+// ValidateSeriesRules checks the serie and operation type of each rule
+func ValidateSeriesRules(rules []SeriesRule) error {
+	for i, rule := range rules {
+		if rule.Serie < 0 || rule.Serie > 999 {
+			return fmt.Errorf("series policy rule %d: invalid serie %d", i, rule.Serie)
+		}
+		if rule.OperationType != "" && rule.OperationType != operationOutgoing && rule.OperationType != operationIncoming {
+			return fmt.Errorf("series policy rule %d: invalid operation type %s", i, rule.OperationType)
+		}
+	}
+	return nil
+}
+
+// ValidateCFOPRules checks the natureza, operation type and CFOP of each rule
+func ValidateCFOPRules(rules []CFOPRule) error {
+	for i, rule := range rules {
+		if strings.TrimSpace(rule.OperationNature) == "" {
+			return fmt.Errorf("cfop rule %d: missing operation_nature", i)
+		}
+		if rule.OperationType != "" && rule.OperationType != operationOutgoing && rule.OperationType != operationIncoming {
+			return fmt.Errorf("cfop rule %d: invalid operation type %s", i, rule.OperationType)
+		}
+		if !cfopPattern.MatchString(strings.ToLower(rule.CFOP)) {
+			return fmt.Errorf("cfop rule %d: invalid cfop %q (e.g. 5102 or x102)", i, rule.CFOP)
+		}
+	}
+	return nil
+}
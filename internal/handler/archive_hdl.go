@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ArchiveHandler struct {
+	svc service.ArchiveService
+}
+
+func NewArchiveHandler(svc service.ArchiveService) *ArchiveHandler {
+	return &ArchiveHandler{svc: svc}
+}
+
+// ArchiveDocuments attaches the authorized XML and DANFE to the Frappe invoice
+// POST /invoices/:name/attachments
+func (h *ArchiveHandler) ArchiveDocuments(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invoice name is required"})
+	}
+
+	archived, err := h.svc.ArchiveInvoiceDocuments(c.UserContext(), name)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":    "Documents Archived",
+		"access_key": archived.AccessKey,
+		"xml_url":    archived.XMLURL,
+		"pdf_url":    archived.PDFURL,
+	})
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ComplementInvoiceHandler struct {
+	svc service.ComplementService
+}
+
+func NewComplementInvoiceHandler(svc service.ComplementService) *ComplementInvoiceHandler {
+	return &ComplementInvoiceHandler{svc: svc}
+}
+
+// CreateComplement issues a complementary NF-e (nota complementar) for an original note
+// POST /invoices/complements
+func (h *ComplementInvoiceHandler) CreateComplement(c *fiber.Ctx) error {
+	var req service.ComplementInput
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+
+	if req.AccessKey == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "access_key is required"})
+	}
+
+	resp, err := h.svc.IssueComplementInvoice(c.UserContext(), req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Complementary Invoice Issued",
+		"nfe_id":  resp.ID,
+		"status":  resp.Status,
+	})
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"strconv"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DeadLetterHandler struct {
+	svc service.DeadLetterService
+}
+
+func NewDeadLetterHandler(svc service.DeadLetterService) *DeadLetterHandler {
+	return &DeadLetterHandler{svc: svc}
+}
+
+// List returns the failed and rejected issuances waiting for an operator
+// GET /dead-letters
+func (h *DeadLetterHandler) List(c *fiber.Ctx) error {
+	letters, err := h.svc.List()
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"count":        len(letters),
+		"dead_letters": letters,
+	})
+}
+
+// Get returns a dead letter with its full error and payload
+// GET /dead-letters/:id
+func (h *DeadLetterHandler) Get(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter id"})
+	}
+
+	letter, err := h.svc.Get(id)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(letter)
+}
+
+// Replay issues a dead letter again; the optional body edits the Frappe invoice
+// fields and/or the stored request first
+// POST /dead-letters/:id/replay
+func (h *DeadLetterHandler) Replay(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter id"})
+	}
+
+	var edits service.ReplayEdits
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&edits); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+		}
+	}
+
+	resp, err := h.svc.Replay(c.UserContext(), id, edits)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Dead Letter Replayed",
+		"nfe_id":  resp.ID,
+		"status":  resp.Status,
+	})
+}
+
+// Discard drops a dead letter that will not be issued again
+// POST /dead-letters/:id/discard
+func (h *DeadLetterHandler) Discard(c *fiber.Ctx) error {
+	type DiscardPayload struct {
+		Reason string `json:"reason"`
+	}
+
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid dead letter id"})
+	}
+
+	var req DiscardPayload
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+	if req.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	letter, err := h.svc.Discard(id, req.Reason)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":     "Dead Letter Discarded",
+		"dead_letter": letter,
+	})
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type DisablementHandler struct {
+	svc            service.DisablementService
+	defaultCompany string
+}
+
+func NewDisablementHandler(svc service.DisablementService, defaultCompany string) *DisablementHandler {
+	return &DisablementHandler{svc: svc, defaultCompany: defaultCompany}
+}
+
+// ListGaps reports numbering gaps per serie found in the local ledger
+// GET /disablements/gaps?company=
+func (h *DisablementHandler) ListGaps(c *fiber.Ctx) error {
+	company := c.Query("company", h.defaultCompany)
+
+	gaps, err := h.svc.DetectGaps(company)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"company": company,
+		"gaps":    gaps,
+	})
+}
+
+// DisableRange disables (inutiliza) a number range at SEFAZ
+// POST /disablements
+func (h *DisablementHandler) DisableRange(c *fiber.Ctx) error {
+	type DisablementPayload struct {
+		Company string `json:"company"`
+		Serie   int    `json:"serie"`
+		Begin   int    `json:"begin"`
+		End     int    `json:"end"`
+		Reason  string `json:"reason"`
+	}
+
+	var req DisablementPayload
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+	if req.Company == "" {
+		req.Company = h.defaultCompany
+	}
+
+	resp, err := h.svc.DisableRange(c.UserContext(), req.Company, service.NumberRange{
+		Serie: req.Serie,
+		Begin: req.Begin,
+		End:   req.End,
+	}, req.Reason)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message":        "Number Range Disabled",
+		"disablement_id": resp.ID,
+		"status":         resp.Status,
+	})
+}
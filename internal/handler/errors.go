@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"errors"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// errorStatus maps a service error to the status returned to the caller: a
+// note sent without an answer may exist and must be reconciled, never sent
+// again (202), data rejected by NFe.io is the caller's to fix (422),
+// throttling and open circuits are temporary (503), any other NFe.io failure
+// is upstream (502), an
+// invoice that already has an NF-e or a dead letter already resolved conflicts
+// (409), a record missing from the local store is 404 and a production
+// operation from a non-production Frappe site or with a company whose
+// environment NFe.io does not confirm is forbidden (403)
+func errorStatus(err error) int {
+	if errors.Is(err, service.ErrOutcomeUnknown) {
+		return fiber.StatusAccepted
+	}
+	if errors.Is(err, service.ErrProductionBlocked) || errors.Is(err, service.ErrEnvironmentMismatch) {
+		return fiber.StatusForbidden
+	}
+	if errors.Is(err, service.ErrAlreadyIssued) || errors.Is(err, service.ErrNotDeadLetter) {
+		return fiber.StatusConflict
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		return fiber.StatusNotFound
+	}
+	var apiErr *repository.APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.IsValidation():
+			return fiber.StatusUnprocessableEntity
+		case apiErr.IsRateLimited():
+			return fiber.StatusServiceUnavailable
+		default:
+			return fiber.StatusBadGateway
+		}
+	}
+	if errors.Is(err, repository.ErrCircuitOpen) {
+		return fiber.StatusServiceUnavailable
+	}
+	return fiber.StatusInternalServerError
+}
+
+// errorResponse writes err as JSON, adding the NFe.io error code and messages
+// when the failure came from NFe.io, or the attempt to reconcile when NFe.io
+// did not answer
+func errorResponse(c *fiber.Ctx, err error) error {
+	body := fiber.Map{"error": err.Error()}
+
+	var unknown *service.OutcomeUnknownError
+	var apiErr *repository.APIError
+	if errors.As(err, &unknown) {
+		body["issuance_id"] = unknown.IssuanceID
+		body["status"] = models.IssuanceStatusUnknown
+		body["retryable"] = false
+		body["detail"] = "the NF-e may exist at NFe.io: do not send it again, the reconciler resolves the attempt (GET /api/v1/issuances/pending)"
+	} else if errors.As(err, &apiErr) {
+		body["nfe_status"] = apiErr.StatusCode
+		body["nfe_code"] = apiErr.Code
+		body["nfe_messages"] = apiErr.Messages
+		body["retryable"] = apiErr.Retryable
+	} else if errors.Is(err, repository.ErrCircuitOpen) {
+		body["retryable"] = true
+	}
+
+	return c.Status(errorStatus(err)).JSON(body)
+}
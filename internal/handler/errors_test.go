@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"validation", &repository.APIError{StatusCode: 400}, fiber.StatusUnprocessableEntity},
+		{"wrapped validation", fmt.Errorf("failed to get original invoice: %w", &repository.APIError{StatusCode: 404}), fiber.StatusUnprocessableEntity},
+		{"auth", &repository.APIError{StatusCode: 401}, fiber.StatusBadGateway},
+		{"rate limited", &repository.APIError{StatusCode: 429, Retryable: true}, fiber.StatusServiceUnavailable},
+		{"upstream failure", &repository.APIError{StatusCode: 500, Retryable: true}, fiber.StatusBadGateway},
+		{"circuit open", fmt.Errorf("nfeio: %w", repository.ErrCircuitOpen), fiber.StatusServiceUnavailable},
+		{"already issued", fmt.Errorf("%w: INV-0001 is issued as NF-e nfe-1", service.ErrAlreadyIssued), fiber.StatusConflict},
+		{"not a dead letter", fmt.Errorf("%w: issuance 3 is already replayed", service.ErrNotDeadLetter), fiber.StatusConflict},
+		{"not found", fmt.Errorf("issuance 7: %w", repository.ErrNotFound), fiber.StatusNotFound},
+		{"production blocked", fmt.Errorf("%w: company X is in production and the Frappe site is staging", service.ErrProductionBlocked), fiber.StatusForbidden},
+		{"outcome unknown", &service.OutcomeUnknownError{IssuanceID: 7, Err: fmt.Errorf("%w: %w", service.ErrOutcomeUnknown, &repository.APIError{StatusCode: 503, Retryable: true})}, fiber.StatusAccepted},
+		{"internal", errors.New("company X is not configured"), fiber.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorStatus(tt.err); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestErrorResponseNamesUnknownAttempt(t *testing.T) {
+	app := fiber.New()
+	app.Post("/", func(c *fiber.Ctx) error {
+		return errorResponse(c, &service.OutcomeUnknownError{
+			IssuanceID: 7,
+			Err:        fmt.Errorf("%w: %w", service.ErrOutcomeUnknown, &repository.APIError{StatusCode: 503, Retryable: true}),
+		})
+	})
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, "/", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var body map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != fiber.StatusAccepted || body["issuance_id"] != float64(7) || body["status"] != "unknown" || body["retryable"] != false {
+		t.Errorf("expected 202 naming attempt 7 as not retryable, got %d %v", resp.StatusCode, body)
+	}
+}
@@ -29,10 +29,13 @@ func (h *FrappeInvoiceHandler) CreateWebhook(c *fiber.Ctx) error {
 	}
 
 	// Call the service to process this invoice
-	resp, err := h.svc.IssueNoteForFrappeInvoice(req.Name)
+	resp, err := h.svc.IssueNoteForFrappeInvoice(c.UserContext(), req.Name)
 	if err != nil {
-		// Log error but maybe don't return 500 to Frappe if you want to avoid retries loops
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+		// 422 when NFe.io rejected the invoice data (fix it in Frappe), 503 when
+		// NFe.io is unavailable and the note was not sent (safe to retry later),
+		// 202 with the attempt when NFe.io did not answer (the NF-e may exist:
+		// it must be reconciled first, never sent again)
+		return errorResponse(c, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -41,3 +44,20 @@ func (h *FrappeInvoiceHandler) CreateWebhook(c *fiber.Ctx) error {
 		"status":  resp.Status,
 	})
 }
+
+// Preview returns the NFe.io payload, totals and validation findings of the
+// invoice without issuing it (e.g. for a client script button in Frappe)
+// POST /invoices/:name/preview
+func (h *FrappeInvoiceHandler) Preview(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invoice name is required"})
+	}
+
+	preview, err := h.svc.PreviewNoteForFrappeInvoice(c.UserContext(), name)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(preview)
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type HealthHandler struct {
+	readiness *service.ReadinessService
+	breakers  []*repository.CircuitBreaker
+}
+
+func NewHealthHandler(readiness *service.ReadinessService, breakers ...*repository.CircuitBreaker) *HealthHandler {
+	return &HealthHandler{readiness: readiness, breakers: breakers}
+}
+
+// Livez reports that the process is up; it does not look at dependencies
+// GET /livez
+func (h *HealthHandler) Livez(c *fiber.Ctx) error {
+	return c.SendString("OK")
+}
+
+// Readyz checks Frappe, NFe.io, the local store and the write-back queue
+// (503 when one fails or the server is shutting down)
+// GET /readyz
+func (h *HealthHandler) Readyz(c *fiber.Ctx) error {
+	readiness := h.readiness.Check(c.UserContext())
+
+	status := fiber.StatusOK
+	if !readiness.Ready {
+		status = fiber.StatusServiceUnavailable
+	}
+	return c.Status(status).JSON(readiness)
+}
+
+// Upstreams reports the circuit breaker state of Frappe and NFe.io
+// GET /health/upstreams
+func (h *HealthHandler) Upstreams(c *fiber.Ctx) error {
+	status := fiber.StatusOK
+	upstreams := make([]repository.BreakerStatus, 0, len(h.breakers))
+	for _, breaker := range h.breakers {
+		s := breaker.Status()
+		if s.State == repository.BreakerOpen {
+			status = fiber.StatusServiceUnavailable
+		}
+		upstreams = append(upstreams, s)
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"upstreams": upstreams,
+	})
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type InvoiceEventHandler struct {
+	svc service.InvoiceEventService
+}
+
+func NewInvoiceEventHandler(svc service.InvoiceEventService) *InvoiceEventHandler {
+	return &InvoiceEventHandler{svc: svc}
+}
+
+// invoiceEventRequest is the body of the cancellation and correction letter endpoints
+type invoiceEventRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Cancel cancels the NF-e of the Frappe invoice
+// POST /invoices/:name/cancel
+func (h *InvoiceEventHandler) Cancel(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invoice name is required"})
+	}
+
+	var req invoiceEventRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+	if req.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	if err := h.svc.CancelInvoice(c.UserContext(), name, req.Reason); err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "Cancellation Requested",
+	})
+}
+
+// CorrectionLetter issues a correction letter (CC-e) for the NF-e of the Frappe invoice
+// POST /invoices/:name/correction-letter
+func (h *InvoiceEventHandler) CorrectionLetter(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "invoice name is required"})
+	}
+
+	var req invoiceEventRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+	if req.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "reason is required"})
+	}
+
+	resp, err := h.svc.IssueCorrectionLetter(c.UserContext(), name, req.Reason)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Correction Letter Issued",
+		"nfe_id":  resp.ID,
+		"status":  resp.Status,
+	})
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReconcileHandler struct {
+	svc *service.Reconciler
+}
+
+func NewReconcileHandler(svc *service.Reconciler) *ReconcileHandler {
+	return &ReconcileHandler{svc: svc}
+}
+
+// ListPending reports the notes still waiting for SEFAZ (or for an NFe.io
+// answer) for longer than older_than, the reconciler threshold by default
+// GET /issuances/pending?older_than=2h
+func (h *ReconcileHandler) ListPending(c *fiber.Ctx) error {
+	var olderThan time.Duration
+	if value := c.Query("older_than"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "older_than must be a positive duration (e.g. 2h)"})
+		}
+		olderThan = d
+	}
+
+	pending, err := h.svc.PendingNotes(olderThan)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"count":   len(pending),
+		"pending": pending,
+	})
+}
+
+// Reconcile runs a reconciliation round right away instead of waiting for the
+// scheduled one
+// POST /issuances/reconcile
+func (h *ReconcileHandler) Reconcile(c *fiber.Ctx) error {
+	result, err := h.svc.ReconcileOnce(c.UserContext())
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Reconciliation Completed",
+		"checked": result.Checked,
+		"changed": result.Changed,
+		"failed":  result.Failed,
+	})
+}
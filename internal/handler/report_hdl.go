@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReportHandler struct {
+	svc service.ReportService
+}
+
+func NewReportHandler(svc service.ReportService) *ReportHandler {
+	return &ReportHandler{svc: svc}
+}
+
+// Reconciliation reports the discrepancies between the Frappe invoices and
+// the NFe.io notes of a date range (inclusive, yesterday by default) as JSON
+// or CSV
+// GET /reports/reconciliation?from=2026-01-01&to=2026-01-31&format=csv
+func (h *ReportHandler) Reconciliation(c *fiber.Ctx) error {
+	from, to, err := service.ReportRange(c.Query("from"), c.Query("to"), time.Now())
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	format := c.Query("format", "json")
+	if format != "json" && format != "csv" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "format must be json or csv"})
+	}
+
+	report, err := h.svc.Reconcile(c.UserContext(), from, to)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	if format == "csv" {
+		var buf bytes.Buffer
+		if err := report.WriteCSV(&buf); err != nil {
+			return errorResponse(c, err)
+		}
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="reconciliation-`+from.Format("2006-01-02")+`.csv"`)
+		return c.Status(fiber.StatusOK).Send(buf.Bytes())
+	}
+
+	return c.Status(fiber.StatusOK).JSON(report)
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/service/frappe_invoice"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReturnInvoiceHandler struct {
+	svc service.ReturnService
+}
+
+func NewReturnInvoiceHandler(svc service.ReturnService) *ReturnInvoiceHandler {
+	return &ReturnInvoiceHandler{svc: svc}
+}
+
+// CreateReturn issues a return (devolução) mirroring an original NF-e
+// POST /invoices/returns
+func (h *ReturnInvoiceHandler) CreateReturn(c *fiber.Ctx) error {
+	var req service.ReturnInput
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid JSON"})
+	}
+
+	if req.AccessKey == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "access_key is required"})
+	}
+
+	resp, err := h.svc.IssueReturnInvoice(c.UserContext(), req)
+	if err != nil {
+		return errorResponse(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"message": "Return Invoice Issued",
+		"nfe_id":  resp.ID,
+		"status":  resp.Status,
+	})
+}
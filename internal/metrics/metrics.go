@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds the bridge metrics, exposed on GET /metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Issuances counts the issuance attempts reaching each status
+	Issuances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfe_bridge_issuances_total",
+		Help: "Issuance attempts reaching each status, by kind and NFe.io company.",
+	}, []string{"kind", "company", "status"})
+
+	// IssuanceDuration times the issuance of a Frappe invoice, from the Frappe
+	// lookup to the NFe.io answer
+	IssuanceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nfe_bridge_issuance_duration_seconds",
+		Help:    "Time to issue the NF-e of a Frappe invoice, by NFe.io company and resulting status.",
+		Buckets: []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"company", "status"})
+
+	// SefazRejections counts the notes rejected by SEFAZ or refused by NFe.io
+	// validation, by reason code
+	SefazRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfe_bridge_sefaz_rejections_total",
+		Help: "Notes rejected by SEFAZ (cStat) or by NFe.io validation (error code), by NFe.io company.",
+	}, []string{"company", "reason"})
+
+	// UpstreamRequests times each call to Frappe and NFe.io (retries included)
+	UpstreamRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "nfe_bridge_upstream_request_duration_seconds",
+		Help:    "Duration of the Frappe and NFe.io calls, retries included, by HTTP status code (\"error\" without an answer).",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"upstream", "operation", "code"})
+
+	// UpstreamErrors counts the error codes answered by NFe.io and Frappe
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfe_bridge_upstream_errors_total",
+		Help: "Errors answered by Frappe (exc_type) and NFe.io (error code).",
+	}, []string{"upstream", "code"})
+
+	// UpstreamRetries counts the attempts sent again after a transient failure
+	UpstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfe_bridge_upstream_retries_total",
+		Help: "Calls to Frappe and NFe.io sent again after a 429, 5xx or network error.",
+	}, []string{"upstream"})
+
+	// ReconciliationDiscrepancies holds the discrepancies found by the last
+	// Frappe/NFe.io reconciliation report, set for every kind at its end
+	ReconciliationDiscrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfe_bridge_reconciliation_discrepancies",
+		Help: "Discrepancies found by the last Frappe/NFe.io reconciliation report, by kind.",
+	}, []string{"kind"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Issuances,
+		IssuanceDuration,
+		SefazRejections,
+		UpstreamRequests,
+		UpstreamErrors,
+		UpstreamRetries,
+		ReconciliationDiscrepancies,
+	)
+}
+
+// RegisterQueue exposes the depth of a queue, read on each scrape. A failed
+// read reports -1
+func RegisterQueue(name string, depth func() (int, error)) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "nfe_bridge_queue_depth",
+		Help:        "Items waiting in each queue of the bridge.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 {
+		n, err := depth()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}))
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a call to an upstream; status is 0 when no answer came
+func ObserveRequest(upstream, operation string, status int, start time.Time) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+	UpstreamRequests.WithLabelValues(upstream, operation, code).Observe(time.Since(start).Seconds())
+}
+
+// Label returns value, or "none" when it is empty
+func Label(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
@@ -0,0 +1,30 @@
+package metrics
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlerExposesQueueDepths(t *testing.T) {
+	RegisterQueue("test_queue", func() (int, error) { return 7, nil })
+	RegisterQueue("test_broken_queue", func() (int, error) { return 0, errors.New("store closed") })
+	Issuances.WithLabelValues("invoice", "company-1", "issued").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+
+	for _, want := range []string{
+		`nfe_bridge_queue_depth{queue="test_queue"} 7`,
+		`nfe_bridge_queue_depth{queue="test_broken_queue"} -1`,
+		`nfe_bridge_issuances_total{company="company-1",kind="invoice",status="issued"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %s in the metrics", want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func sign(secret, body string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(body))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func TestWebhookAuth(t *testing.T) {
+	app := fiber.New()
+	v1 := app.Group("/api/v1")
+	v1.Post("/webhook", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+	admin := v1.Group("", WebhookAuth)
+	admin.Post("/admin", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+	call := func(path, body, signature string) int {
+		t.Helper()
+		req := httptest.NewRequest(fiber.MethodPost, path, strings.NewReader(body))
+		if signature != "" {
+			req.Header.Set("X-Signature", signature)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	// Refused while authentication is not configured
+	t.Setenv("WEBHOOK_SECRET", "")
+	t.Setenv("WEBHOOK_SIGNATURE", "X-Signature")
+	if status := call("/api/v1/admin", "{}", sign("", "{}")); status != fiber.StatusUnauthorized {
+		t.Errorf("expected 401 without WEBHOOK_SECRET, got %d", status)
+	}
+
+	t.Setenv("WEBHOOK_SECRET", "s3cr3t")
+	if status := call("/api/v1/admin", "{}", ""); status != fiber.StatusUnauthorized {
+		t.Errorf("expected 401 without signature, got %d", status)
+	}
+	if status := call("/api/v1/admin", "{}", sign("other", "{}")); status != fiber.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong signature, got %d", status)
+	}
+	if status := call("/api/v1/admin", "{}", sign("s3cr3t", "{}")); status != fiber.StatusOK {
+		t.Errorf("expected 200 with a valid signature, got %d", status)
+	}
+
+	// Routes registered before the group are not guarded
+	if status := call("/api/v1/webhook", "{}", ""); status != fiber.StatusOK {
+		t.Errorf("expected the route before the group to stay open, got %d", status)
+	}
+}
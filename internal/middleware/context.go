@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// disconnectPoll is how often a request in flight checks whether its client
+// closed the connection
+const disconnectPoll = 500 * time.Millisecond
+
+// RequestContext sets c.UserContext() to a context bounded by timeout and
+// canceled with stop, so Frappe and NFe.io calls made on behalf of the request
+// cannot hang the handler forever.
+// app.Shutdown() closes c.Context() as soon as it is called, which would abort
+// the issuances in flight; stop is canceled instead when the drain deadline
+// passes. The context is also canceled when the client closes the connection
+// mid-request, detected by peeking at the socket every disconnectPoll; where
+// the connection cannot be peeked at (TLS terminated by the bridge, non-unix
+// platforms) such a request is only bounded by the timeout.
+func RequestContext(stop context.Context, timeout time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), timeout)
+		defer cancel()
+
+		release := context.AfterFunc(stop, cancel)
+		defer release()
+
+		if conn := c.Context().Conn(); canPeek(conn) {
+			done := make(chan struct{})
+			defer close(done)
+			go watchDisconnect(conn, done, cancel)
+		}
+
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
+// watchDisconnect cancels the request once its client closed the connection,
+// until done is closed
+func watchDisconnect(conn net.Conn, done <-chan struct{}, cancel context.CancelFunc) {
+	ticker := time.NewTicker(disconnectPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if peerClosed(conn) {
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+//go:build unix
+
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequestContextCanceledWhenClientDisconnects(t *testing.T) {
+	canceled := make(chan error, 1)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(RequestContext(context.Background(), time.Minute))
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		select {
+		case <-c.UserContext().Done():
+			canceled <- c.UserContext().Err()
+		case <-time.After(10 * time.Second):
+			canceled <- nil
+		}
+		return nil
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /slow HTTP/1.1\r\nHost: bridge\r\n\r\n")
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the request canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still running after the client disconnected")
+	}
+}
+
+func TestRequestContextKeptWhileClientWaits(t *testing.T) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(RequestContext(context.Background(), time.Minute))
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		time.Sleep(3 * disconnectPoll)
+		if err := c.UserContext().Err(); err != nil {
+			return c.SendString(err.Error())
+		}
+		return c.SendString("ok")
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go app.Listener(ln)
+	defer app.Shutdown()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /slow HTTP/1.1\r\nHost: bridge\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+		t.Errorf("expected the request context kept, got %q", body)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package middleware
+
+import "net"
+
+// canPeek reports whether peerClosed can inspect the connection's socket;
+// never on this platform
+func canPeek(conn net.Conn) bool {
+	return false
+}
+
+func peerClosed(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,38 @@
+//go:build unix
+
+package middleware
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// canPeek reports whether peerClosed can inspect the connection's socket
+func canPeek(conn net.Conn) bool {
+	_, ok := conn.(syscall.Conn)
+	return ok
+}
+
+// peerClosed peeks at the socket without blocking or consuming data (the
+// server reads the next request from it later): a zero-byte read means the
+// client closed the connection
+func peerClosed(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	closed := false
+	var buf [1]byte
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		closed = (n == 0 && err == nil) || errors.Is(err, syscall.ECONNRESET)
+		return true
+	})
+	return closed || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,30 @@
+package models
+
+// StateTax is a state tax registration (inscrição estadual) of an NFe.io
+// company: the UF it issues in and the SEFAZ environment of its notes
+type StateTax struct {
+	ID              string `json:"id"`
+	Code            string `json:"code"`            // UF, e.g. "SP"
+	TaxNumber       string `json:"taxNumber"`       // Inscrição estadual
+	Serie           int    `json:"serie"`           // Default serie
+	Number          int    `json:"number"`          // Last number used by NFe.io
+	EnvironmentType string `json:"environmentType"` // "Production" or "Test"
+	Status          string `json:"status"`
+}
+
+// StateTaxList is the NFe.io list of a company's state tax registrations
+type StateTaxList struct {
+	StateTaxes []StateTax `json:"stateTaxes"`
+}
+
+// NFeCompany is a company (issuer) registered at NFe.io
+type NFeCompany struct {
+	ID               string `json:"id"`
+	Name             string `json:"name"`
+	FederalTaxNumber int64  `json:"federalTaxNumber"` // CNPJ
+}
+
+// NFeCompanyResource is the NFe.io answer wrapping a single company
+type NFeCompanyResource struct {
+	Company NFeCompany `json:"companies"`
+}
@@ -5,12 +5,17 @@ type Invoices struct {
 	Name            string `json:"name"`              // Auto-generated: INV-YYYY-####
 	OperationType   string `json:"operation_type"`    // Natureza de Operação
 	ClientType      string `json:"client_type"`       // PF or PJ
+	Company         string `json:"company"`           // Issuing company (matriz/filial)
 	FreightModality string `json:"freight_modality"`  // Modalidade de Frete
 	NfRefSerie      string `json:"nf_ref_serie"`      // NF Ref. Série
 	NfRefNum        string `json:"nf_ref_num"`        // NF Ref. Número
 	NfRefAccessKey  string `json:"nf_ref_access_key"` // NF Ref. Chave de Acesso
 	NfDeRetorno     int    `json:"nf_de_retorno"`     // NF de Retorno? (checkbox)
 
+	// Additional referenced documents (child table), used when more than one
+	// NF-e must be referenced (e.g. a return covering several remessas)
+	NfReferences []InvoiceReference `json:"nf_references"`
+
 	// Client information
 	ClientName        string `json:"client_name"`        // Nome / Razão Social
 	ClientEmail       string `json:"client_email"`       // Email
@@ -57,6 +62,12 @@ type Invoices struct {
 	InvoiceSerie  string `json:"invoice_serie"`  // Invoice Serie
 	InvoiceLink   string `json:"invoice_link"`   // Invoice Link (PDF URL)
 	InvoiceNumber string `json:"invoice_number"` // Invoice Number
+	InvoiceXML    string `json:"invoice_xml"`    // Authorized XML attached to the document (private file URL)
+	InvoicePDF    string `json:"invoice_pdf"`    // DANFE PDF attached to the document (private file URL)
+
+	// Complementary NF-e issued against this invoice
+	ComplementaryInvoiceID   string `json:"complementary_invoice_id"`   // Complementary Invoice ID from NFe.io
+	ComplementaryInvoiceLink string `json:"complementary_invoice_link"` // Complementary Invoice Link (PDF URL)
 
 	// Errors/Logs
 	ErrorsField string `json:"errors_field"` // Logs
@@ -94,6 +105,30 @@ type ItemInvoice struct {
 	COFINSRate   string  `json:"cofins_rate"`   // COFINS %
 }
 
+// InvoiceReference represents the "Invoice Reference" child table (NFref)
+type InvoiceReference struct {
+	Name        string `json:"name"`
+	Parent      string `json:"parent"`
+	ParentField string `json:"parentfield"`
+	ParentType  string `json:"parenttype"`
+	Idx         int    `json:"idx"`
+
+	AccessKey string `json:"access_key"` // Chave de Acesso da NF-e referenciada
+	Serie     string `json:"serie"`      // Série
+	Number    string `json:"number"`     // Número
+}
+
+// FrappeFile represents the "File" DocType (attachments)
+type FrappeFile struct {
+	Name              string `json:"name"`
+	FileName          string `json:"file_name"`
+	FileURL           string `json:"file_url"`
+	IsPrivate         int    `json:"is_private"`
+	AttachedToDoctype string `json:"attached_to_doctype"`
+	AttachedToName    string `json:"attached_to_name"`
+	AttachedToField   string `json:"attached_to_field"`
+}
+
 // FrappeTax represents the "Tax" DocType with detailed tax configuration
 type FrappeTax struct {
 	Name string `json:"name"`
@@ -171,15 +206,54 @@ type Carrier struct {
 	Neighborhood      string `json:"neighborhood"`
 }
 
-// CustomFrappeInvoice kept for backward compatibility - maps to Invoices
-type CustomFrappeInvoice struct {
-	Name         string             `json:"name"`
-	CustomerName string             `json:"customer_name"`
-	CNPJ         string             `json:"cnpj_cpf"`
-	NaturezaOp   string             `json:"natureza_operacao"`
-	Status       string             `json:"status"`
-	GrandTotal   float64            `json:"grand_total"`
-	Items        []CustomFrappeItem `json:"items"`
+// FrappeCustomer represents the "Customer" DocType
+type FrappeCustomer struct {
+	Name                   string `json:"name"`
+	CustomerName           string `json:"customer_name"`
+	CustomerType           string `json:"customer_type"` // "Company" or "Individual"
+	TaxID                  string `json:"tax_id"`        // CNPJ or CPF
+	CustomerPrimaryAddress string `json:"customer_primary_address"`
+	EmailID                string `json:"email_id"`
+	MobileNo               string `json:"mobile_no"`
+}
+
+// FrappeAddress represents the "Address" DocType
+type FrappeAddress struct {
+	Name         string `json:"name"`
+	AddressTitle string `json:"address_title"`
+	AddressType  string `json:"address_type"`
+	AddressLine1 string `json:"address_line1"`
+	AddressLine2 string `json:"address_line2"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+	Pincode      string `json:"pincode"`
+	Country      string `json:"country"`
+	EmailID      string `json:"email_id"`
+	Phone        string `json:"phone"`
+}
+
+// FrappeItem represents the "Item" DocType
+type FrappeItem struct {
+	Name          string  `json:"name"`
+	ItemCode      string  `json:"item_code"`
+	ItemName      string  `json:"item_name"`
+	Description   string  `json:"description"`
+	StockUOM      string  `json:"stock_uom"`
+	WeightPerUnit float64 `json:"weight_per_unit"`
+	WeightUOM     string  `json:"weight_uom"`
+	Disabled      int     `json:"disabled"`
+}
+
+// FrappeCompany represents the "Company" DocType
+type FrappeCompany struct {
+	Name            string `json:"name"`
+	CompanyName     string `json:"company_name"`
+	Abbr            string `json:"abbr"`
+	TaxID           string `json:"tax_id"` // CNPJ
+	Country         string `json:"country"`
+	DefaultCurrency string `json:"default_currency"`
+	Email           string `json:"email"`
+	PhoneNo         string `json:"phone_no"`
 }
 
 // CustomFrappeItem kept for backward compatibility
@@ -202,9 +202,9 @@ type DocumentElectronicInvoice struct {
 }
 
 type TaxDocumentsReference struct {
-	TaxCouponInformation      []TaxCouponInformation    `json:"taxCouponInformation,omitempty"`
-	DocumentInvoiceReference  DocumentInvoiceReference  `json:"documentInvoiceReference,omitempty"`
-	DocumentElectronicInvoice DocumentElectronicInvoice `json:"documentElectronicInvoice,omitempty"`
+	TaxCouponInformation      []TaxCouponInformation     `json:"taxCouponInformation,omitempty"`
+	DocumentInvoiceReference  *DocumentInvoiceReference  `json:"documentInvoiceReference,omitempty"`
+	DocumentElectronicInvoice *DocumentElectronicInvoice `json:"documentElectronicInvoice,omitempty"`
 }
 type ReferencedProcess []struct {
 	IdentifierConcessory string `json:"identifierConcessory,omitempty"`
@@ -469,6 +469,63 @@ type ProductInvoiceResponse struct {
     Status          string `json:"status"`
     Environment     string `json:"environment"`
     FlowStatus      string `json:"flowStatus"`
+    FlowMessage     string `json:"flowMessage,omitempty"`
     PdfUrl          string `json:"pdf"`
     XmlUrl          string `json:"xml"`
-}
\ No newline at end of file
+    Serie           int           `json:"serie,omitempty"`
+    Number          int           `json:"number,omitempty"`
+    Authorization   Authorization `json:"authorization,omitempty"`
+    OperationNature string        `json:"operationNature,omitempty"`
+    OperationType   string        `json:"operationType,omitempty"`
+    PurposeType     string        `json:"purposeType,omitempty"`
+    ConsumerType    string        `json:"consumerType,omitempty"`
+    Destination     string        `json:"destination,omitempty"`
+    Issuer          InvoiceIssuer `json:"issuer,omitempty"`
+    Buyer           Buyer         `json:"buyer,omitempty"`
+    Items           []Items       `json:"items,omitempty"`
+    Totals          InvoiceTotals `json:"totals,omitempty"`
+    CreatedOn       time.Time     `json:"createdOn,omitempty"`
+}
+
+// InvoiceIssuer is the issuer (emitente) of a note
+type InvoiceIssuer struct {
+	Name             string  `json:"name,omitempty"`
+	TradeName        string  `json:"tradeName,omitempty"`
+	FederalTaxNumber int     `json:"federalTaxNumber,omitempty"` // CNPJ
+	StateTaxNumber   string  `json:"stateTaxNumber,omitempty"`
+	Email            string  `json:"email,omitempty"`
+	Address          Address `json:"address,omitempty"`
+}
+
+// InvoiceTotals are the totals of an issued note
+type InvoiceTotals struct {
+	Icms struct {
+		ProductAmount float64 `json:"productAmount,omitempty"`
+		InvoiceAmount float64 `json:"invoiceAmount,omitempty"` // Total of the NF-e (vNF)
+	} `json:"icms,omitempty"`
+}
+
+// ProductInvoiceList is a page of the notes of a company, newest first
+type ProductInvoiceList struct {
+	ProductInvoices []ProductInvoiceResponse `json:"productInvoices"`
+	HasMore         bool                     `json:"hasMore"`
+}
+// DisablementRequest asks SEFAZ (via NFe.io) to disable (inutilizar) a number range
+type DisablementRequest struct {
+	Serie       int    `json:"serie"`
+	BeginNumber int    `json:"beginNumber"`
+	LastNumber  int    `json:"lastNumber"`
+	Reason      string `json:"reason"`
+}
+
+// DisablementResponse is the NFe.io result of a number range disablement
+type DisablementResponse struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Serie          int    `json:"serie"`
+	BeginNumber    int    `json:"beginNumber"`
+	LastNumber     int    `json:"lastNumber"`
+	Reason         string `json:"reason"`
+	ProtocolNumber string `json:"protocolNumber,omitempty"`
+	Message        string `json:"message,omitempty"`
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of note recorded in the issuance ledger
+const (
+	IssuanceKindInvoice    = "invoice"    // NF-e of a Frappe invoice
+	IssuanceKindReturn     = "return"     // Devolução of an NF-e
+	IssuanceKindComplement = "complement" // Nota complementar
+)
+
+// Local status of an issuance attempt
+const (
+	IssuanceStatusPending    = "pending"    // Recorded, not answered by NFe.io yet
+	IssuanceStatusProcessing = "processing" // Accepted by NFe.io, waiting for SEFAZ
+	IssuanceStatusIssued     = "issued"     // Authorized by SEFAZ
+	IssuanceStatusRejected   = "rejected"   // Refused by NFe.io or SEFAZ
+	IssuanceStatusFailed     = "failed"     // Failed before reaching NFe.io or refused by it (4xx)
+	IssuanceStatusUnknown    = "unknown"    // Sent without an answer (network, timeout, 5xx): the note may exist
+	IssuanceStatusCancelling = "cancelling" // Cancellation requested
+	IssuanceStatusCancelled  = "cancelled"  // Cancelled at SEFAZ
+)
+
+// Resolution of a dead letter (failed or rejected attempt)
+const (
+	IssuanceResolutionReplaying = "replaying" // Being issued again: claimed by a replay
+	IssuanceResolutionReplayed  = "replayed"  // Issued again, possibly after edits
+	IssuanceResolutionDiscarded = "discarded" // Dropped by an operator
+)
+
+// Issuance is one attempt to issue an NF-e, kept in the local store. Failed
+// and rejected attempts form the dead-letter queue until they are resolved
+type Issuance struct {
+	ID             uint64          `json:"id"`
+	Kind           string          `json:"kind"`
+	InvoiceName    string          `json:"invoice_name,omitempty"` // Frappe Invoices document
+	CompanyID      string          `json:"company_id,omitempty"`   // NFe.io company
+	Environment    string          `json:"environment,omitempty"`  // "production" or "homologation"
+	Input          json.RawMessage `json:"input,omitempty"`        // Request that started the attempt, used to replay it
+	Payload        json.RawMessage `json:"payload,omitempty"`      // Request sent to NFe.io
+	NFeID          string          `json:"nfe_id,omitempty"`
+	Serie          int             `json:"serie,omitempty"`
+	Number         int             `json:"number,omitempty"`
+	Status         string          `json:"status"`
+	FlowStatus     string          `json:"flow_status,omitempty"` // Last NFe.io flow status
+	AccessKey      string          `json:"access_key,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	ErrorDetail    string          `json:"error_detail,omitempty"`    // Error with NFe.io's code and messages
+	Polls          int             `json:"polls,omitempty"`           // NFe.io lookups since the last status change
+	NextPollAt     time.Time       `json:"next_poll_at,omitempty"`    // Reconciler backoff
+	Resolution     string          `json:"resolution,omitempty"`      // Dead letter replayed or discarded
+	ResolutionNote string          `json:"resolution_note,omitempty"` // Outcome of the replay or discard reason
+	ResolvedAt     time.Time       `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// IsFinal reports whether the attempt will not change without a new event
+func (i *Issuance) IsFinal() bool {
+	switch i.Status {
+	case IssuanceStatusIssued, IssuanceStatusRejected, IssuanceStatusFailed, IssuanceStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsDeadLetter reports whether the attempt failed or was rejected and is still
+// waiting for an operator to replay or discard it
+func (i *Issuance) IsDeadLetter() bool {
+	return (i.Status == IssuanceStatusFailed || i.Status == IssuanceStatusRejected) && i.Resolution == ""
+}
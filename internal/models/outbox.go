@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Delivery status of an outbox message
+const (
+	OutboxStatusPending   = "pending"   // Waiting for (another) delivery attempt
+	OutboxStatusDelivered = "delivered" // Written to Frappe
+	OutboxStatusDead      = "dead"      // Gave up after the maximum attempts
+)
+
+// OutboxMessage is a Frappe write-back kept in the local store until it is
+// delivered, so an NF-e is never orphaned from its ERPNext invoice
+type OutboxMessage struct {
+	ID            uint64                 `json:"id"`
+	InvoiceName   string                 `json:"invoice_name"` // Frappe Invoices document to update
+	Data          map[string]interface{} `json:"data"`         // Fields written with UpdateInvoice
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	NextAttemptAt time.Time              `json:"next_attempt_at"`
+	CreatedAt     time.Time              `json:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+}
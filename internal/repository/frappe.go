@@ -1,181 +1,191 @@
 package repository
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
-	"net/http"
-	"net/url"
+	"time"
 
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
 )
 
 type FrappeRepository interface {
-	GetCustomInvoice(id string) (*models.CustomFrappeInvoice, error)
-	GetInvoice(id string) (*models.Invoices, error)
-	GetTax(id string) (*models.FrappeTax, error)
-	GetCarrier(id string) (*models.Carrier, error)
-	UpdateInvoice(id string, data map[string]interface{}) error
+	GetInvoice(ctx context.Context, id string) (*models.Invoices, error)
+	GetTax(ctx context.Context, id string) (*models.FrappeTax, error)
+	GetCarrier(ctx context.Context, id string) (*models.Carrier, error)
+	GetCustomer(ctx context.Context, id string) (*models.FrappeCustomer, error)
+	GetAddress(ctx context.Context, id string) (*models.FrappeAddress, error)
+	GetItem(ctx context.Context, id string) (*models.FrappeItem, error)
+	GetCompany(ctx context.Context, id string) (*models.FrappeCompany, error)
+	UpdateInvoice(ctx context.Context, id string, data map[string]interface{}) error
+
+	// ListInvoices lists the submitted and cancelled invoices created in
+	// [from, to) with the fields used to match them to their NF-e
+	ListInvoices(ctx context.Context, from, to time.Time) ([]models.Invoices, error)
+
+	// ReplaceInvoiceAttachment attaches content as a private file and deletes
+	// the previous attachments whose file name starts with replacePrefix
+	ReplaceInvoiceAttachment(ctx context.Context, id, fileName, replacePrefix string, content []byte) (*models.FrappeFile, error)
+
+	// AddInvoiceComment adds a Comment to the invoice timeline
+	AddInvoiceComment(ctx context.Context, id, content string) error
+
+	// LogInvoiceError creates an Error Log entry referencing the invoice
+	LogInvoiceError(ctx context.Context, id, title, message string) error
+
+	// Ping checks that Frappe is reachable and accepts the credentials
+	Ping(ctx context.Context) error
 }
 
+// frappeRepo holds the typed helpers used by the services on top of the
+// generic FrappeClient
 type frappeRepo struct {
-	client      *http.Client
-	baseURL     string
-	apiKey      string
-	apiSecret   string
-	docTypeName string // Default DocType name (e.g., "Invoices")
+	client      *FrappeClient
+	docTypeName string // DocType of the invoices (e.g., "Invoices" or "Brazil Invoice")
 }
 
-func NewFrappeRepo(baseURL, key, secret, docType string) FrappeRepository {
+func NewFrappeRepo(client *FrappeClient, docType string) FrappeRepository {
 	return &frappeRepo{
-		client:      &http.Client{},
-		baseURL:     baseURL,
-		apiKey:      key,
-		apiSecret:   secret,
+		client:      client,
 		docTypeName: docType,
 	}
 }
 
-// GetInvoice retrieves the full Invoices doctype
-func (r *frappeRepo) GetInvoice(id string) (*models.Invoices, error) {
-	escapedDocType := url.PathEscape("Invoices")
-	endpoint := fmt.Sprintf("%s/api/resource/%s/%s", r.baseURL, escapedDocType, id)
-
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", r.apiKey, r.apiSecret))
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("frappe returned status: %d", resp.StatusCode)
-	}
-
-	var result struct {
-		Data models.Invoices `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	return &result.Data, nil
+// GetInvoice retrieves the full invoice document
+func (r *frappeRepo) GetInvoice(ctx context.Context, id string) (*models.Invoices, error) {
+	return GetDocAs[models.Invoices](ctx, r.client, r.docTypeName, id)
 }
 
-// GetCustomInvoice for backward compatibility
-func (r *frappeRepo) GetCustomInvoice(id string) (*models.CustomFrappeInvoice, error) {
-	// Handle spaces in DocType names (e.g., "Brazil Invoice" -> "Brazil%20Invoice")
-	escapedDocType := url.PathEscape(r.docTypeName)
-	endpoint := fmt.Sprintf("%s/api/resource/%s/%s", r.baseURL, escapedDocType, id)
-
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", r.apiKey, r.apiSecret))
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("frappe returned status: %d", resp.StatusCode)
-	}
-
-	var result struct {
-		Data models.CustomFrappeInvoice `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	return &result.Data, nil
+// Ping asks Frappe for the logged user, which needs valid credentials
+func (r *frappeRepo) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx)
 }
 
 // GetTax retrieves a Tax template by name
-func (r *frappeRepo) GetTax(id string) (*models.FrappeTax, error) {
-	escapedDocType := url.PathEscape("Tax")
-	endpoint := fmt.Sprintf("%s/api/resource/%s/%s", r.baseURL, escapedDocType, id)
-
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", r.apiKey, r.apiSecret))
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("frappe returned status: %d", resp.StatusCode)
-	}
-
-	var result struct {
-		Data models.FrappeTax `json:"data"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
-
-	return &result.Data, nil
+func (r *frappeRepo) GetTax(ctx context.Context, id string) (*models.FrappeTax, error) {
+	return GetDocAs[models.FrappeTax](ctx, r.client, "Tax", id)
 }
 
 // GetCarrier retrieves carrier information
-func (r *frappeRepo) GetCarrier(id string) (*models.Carrier, error) {
-	escapedDocType := url.PathEscape("Carrier")
-	endpoint := fmt.Sprintf("%s/api/resource/%s/%s", r.baseURL, escapedDocType, id)
-
-	req, _ := http.NewRequest("GET", endpoint, nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", r.apiKey, r.apiSecret))
-
-	resp, err := r.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+func (r *frappeRepo) GetCarrier(ctx context.Context, id string) (*models.Carrier, error) {
+	return GetDocAs[models.Carrier](ctx, r.client, "Carrier", id)
+}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("frappe returned status: %d", resp.StatusCode)
-	}
+// GetCustomer retrieves a Customer by name
+func (r *frappeRepo) GetCustomer(ctx context.Context, id string) (*models.FrappeCustomer, error) {
+	return GetDocAs[models.FrappeCustomer](ctx, r.client, "Customer", id)
+}
 
-	var result struct {
-		Data models.Carrier `json:"data"`
-	}
+// GetAddress retrieves an Address by name
+func (r *frappeRepo) GetAddress(ctx context.Context, id string) (*models.FrappeAddress, error) {
+	return GetDocAs[models.FrappeAddress](ctx, r.client, "Address", id)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
+// GetItem retrieves an Item by item code
+func (r *frappeRepo) GetItem(ctx context.Context, id string) (*models.FrappeItem, error) {
+	return GetDocAs[models.FrappeItem](ctx, r.client, "Item", id)
+}
 
-	return &result.Data, nil
+// GetCompany retrieves a Company by name
+func (r *frappeRepo) GetCompany(ctx context.Context, id string) (*models.FrappeCompany, error) {
+	return GetDocAs[models.FrappeCompany](ctx, r.client, "Company", id)
 }
 
 // UpdateInvoice updates an invoice document with NFe.io response data
-func (r *frappeRepo) UpdateInvoice(id string, data map[string]interface{}) error {
-	escapedDocType := url.PathEscape("Invoices")
-	endpoint := fmt.Sprintf("%s/api/resource/%s/%s", r.baseURL, escapedDocType, id)
+func (r *frappeRepo) UpdateInvoice(ctx context.Context, id string, data map[string]interface{}) error {
+	return r.client.UpdateDoc(ctx, r.docTypeName, id, data, nil)
+}
 
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return err
+// invoiceListPage is the page size used to list invoices
+const invoiceListPage = 500
+
+// frappeDateTime is the layout of Frappe datetime fields and filters
+const frappeDateTime = "2006-01-02 15:04:05"
+
+// ListInvoices pages through the invoices of a creation range
+func (r *frappeRepo) ListInvoices(ctx context.Context, from, to time.Time) ([]models.Invoices, error) {
+	opts := ListOptions{
+		Fields: []string{
+			"name", "company", "docstatus", "creation", "total_tax",
+			"invoice_id", "invoice_serie", "invoice_number", "invoice_xml", "complementary_invoice_id",
+		},
+		Filters: []Filter{
+			{Field: "docstatus", Operator: "in", Value: []int{1, 2}},
+			{Field: "creation", Operator: ">=", Value: from.Format(frappeDateTime)},
+			{Field: "creation", Operator: "<", Value: to.Format(frappeDateTime)},
+		},
+		OrderBy: "creation asc",
+		Limit:   invoiceListPage,
+	}
+
+	var invoices []models.Invoices
+	for {
+		var page []models.Invoices
+		if err := r.client.GetList(ctx, r.docTypeName, opts, &page); err != nil {
+			return nil, fmt.Errorf("failed to list invoices: %w", err)
+		}
+		invoices = append(invoices, page...)
+		if len(page) < invoiceListPage {
+			return invoices, nil
+		}
+		opts.Start += len(page)
 	}
+}
 
-	req, _ := http.NewRequest("PUT", endpoint, bytes.NewBuffer(jsonData))
-	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", r.apiKey, r.apiSecret))
-	req.Header.Set("Content-Type", "application/json")
+// ReplaceInvoiceAttachment keeps a single attachment per document kind (e.g.
+// the XML of the current NF-e) so a re-issue does not leave stale files behind
+func (r *frappeRepo) ReplaceInvoiceAttachment(ctx context.Context, id, fileName, replacePrefix string, content []byte) (*models.FrappeFile, error) {
+	var existing []models.FrappeFile
+	err := r.client.GetList(ctx, "File", ListOptions{
+		Fields: []string{"name", "file_name"},
+		Filters: []Filter{
+			{Field: "attached_to_doctype", Operator: "=", Value: r.docTypeName},
+			{Field: "attached_to_name", Operator: "=", Value: id},
+			{Field: "file_name", Operator: "like", Value: replacePrefix + "%"},
+		},
+		Limit: -1,
+	}, &existing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attachments: %w", err)
+	}
 
-	resp, err := r.client.Do(req)
+	// Upload first: a failed upload must not leave the invoice without its file
+	uploaded, err := r.client.UploadFile(ctx, FileUpload{
+		DocType:   r.docTypeName,
+		DocName:   id,
+		FileName:  fileName,
+		Content:   content,
+		IsPrivate: true,
+	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to upload %s: %w", fileName, err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("frappe returned status: %d", resp.StatusCode)
+	for _, file := range existing {
+		if err := r.client.DeleteDoc(ctx, "File", file.Name); err != nil {
+			return nil, fmt.Errorf("failed to delete attachment %s: %w", file.FileName, err)
+		}
 	}
 
-	return nil
+	return uploaded, nil
+}
+
+// AddInvoiceComment adds a Comment to the timeline of an invoice
+func (r *frappeRepo) AddInvoiceComment(ctx context.Context, id, content string) error {
+	return r.client.InsertDoc(ctx, "Comment", map[string]interface{}{
+		"comment_type":      "Comment",
+		"reference_doctype": r.docTypeName,
+		"reference_name":    id,
+		"content":           content,
+	}, nil)
+}
+
+// LogInvoiceError creates an Error Log entry (Desk > Error Log) linked to an
+// invoice
+func (r *frappeRepo) LogInvoiceError(ctx context.Context, id, title, message string) error {
+	return r.client.InsertDoc(ctx, "Error Log", map[string]interface{}{
+		"method":            title,
+		"error":             message,
+		"reference_doctype": r.docTypeName,
+		"reference_name":    id,
+	}, nil)
 }
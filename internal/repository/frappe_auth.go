@@ -0,0 +1,308 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frappe authentication modes selected by configuration
+const (
+	FrappeAuthToken   = "token"   // API key and secret (default)
+	FrappeAuthOAuth2  = "oauth2"  // OAuth2 bearer token (static or client credentials)
+	FrappeAuthSession = "session" // Username/password login with the session cookie
+)
+
+// tokenExpiryMargin renews OAuth2 tokens this long before they expire
+const tokenExpiryMargin = 30 * time.Second
+
+// FrappeAuth authenticates the requests of a FrappeClient
+type FrappeAuth interface {
+	// Authorize adds the credentials to req, logging in or fetching a token
+	// first when needed
+	Authorize(ctx context.Context, req *http.Request) error
+
+	// Invalidate drops cached credentials after Frappe answered 401/403 and
+	// reports whether retrying with fresh credentials may succeed
+	Invalidate() bool
+
+	// Secrets are hidden from error messages
+	Secrets() []string
+}
+
+// apiKeyAuth sends "Authorization: token key:secret"
+type apiKeyAuth struct {
+	key    string
+	secret string
+}
+
+// NewAPIKeyAuth authenticates with a Frappe API key and secret
+func NewAPIKeyAuth(key, secret string) FrappeAuth {
+	return &apiKeyAuth{key: key, secret: secret}
+}
+
+func (a *apiKeyAuth) Authorize(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", fmt.Sprintf("token %s:%s", a.key, a.secret))
+	return nil
+}
+
+func (a *apiKeyAuth) Invalidate() bool { return false }
+
+func (a *apiKeyAuth) Secrets() []string { return []string{a.secret} }
+
+// OAuth2Config configures bearer token authentication. With AccessToken set
+// the token is sent as is; otherwise one is fetched from TokenURL with the
+// client credentials grant and refreshed before it expires
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+	AccessToken  string // Static bearer token, issued elsewhere
+}
+
+// oauth2Auth caches the current bearer token
+type oauth2Auth struct {
+	cfg    OAuth2Config
+	client *http.Client
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expiresAt    time.Time // Zero when the token does not expire
+	now          func() time.Time
+}
+
+// NewOAuth2Auth authenticates with OAuth2 bearer tokens; httpClient is used
+// for the token endpoint (nil uses a plain client)
+func NewOAuth2Auth(cfg OAuth2Config, httpClient *http.Client) FrappeAuth {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &oauth2Auth{
+		cfg:         cfg,
+		client:      httpClient,
+		accessToken: cfg.AccessToken,
+		now:         time.Now,
+	}
+}
+
+func (a *oauth2Auth) Authorize(ctx context.Context, req *http.Request) error {
+	token, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+func (a *oauth2Auth) Invalidate() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// A static token cannot be renewed
+	if a.cfg.ClientID == "" {
+		return false
+	}
+	a.accessToken = ""
+	return true
+}
+
+func (a *oauth2Auth) Secrets() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return []string{a.cfg.ClientSecret, a.cfg.AccessToken, a.accessToken, a.refreshToken}
+}
+
+// token returns the cached token, fetching a new one when it is missing or
+// about to expire. The token endpoint is called without the lock, so a slow
+// endpoint does not block the requests that still hold a valid token
+func (a *oauth2Auth) token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	accessToken, refreshToken, expiresAt := a.accessToken, a.refreshToken, a.expiresAt
+	a.mu.Unlock()
+
+	if accessToken != "" && (expiresAt.IsZero() || a.now().Before(expiresAt)) {
+		return accessToken, nil
+	}
+	if a.cfg.ClientID == "" {
+		return "", fmt.Errorf("no OAuth2 access token configured")
+	}
+
+	// Prefer the refresh token; fall back to a new client credentials grant
+	if refreshToken != "" {
+		token, err := a.requestToken(ctx, url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {refreshToken},
+		}, refreshToken)
+		if err == nil {
+			return a.store(token), nil
+		}
+		fmt.Printf("Warning: Failed to refresh Frappe OAuth2 token: %v\n", redactError(err, a.cfg.ClientSecret, refreshToken))
+		a.mu.Lock()
+		if a.refreshToken == refreshToken {
+			a.refreshToken = ""
+		}
+		a.mu.Unlock()
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if a.cfg.Scope != "" {
+		form.Set("scope", a.cfg.Scope)
+	}
+	token, err := a.requestToken(ctx, form)
+	if err != nil {
+		return "", err
+	}
+	return a.store(token), nil
+}
+
+// oauth2Token is the answer of the token endpoint
+type oauth2Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Seconds
+}
+
+// store caches a token fetched from the token endpoint and returns it
+func (a *oauth2Auth) store(token *oauth2Token) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.accessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		a.refreshToken = token.RefreshToken
+	}
+	a.expiresAt = time.Time{}
+	if token.ExpiresIn > 0 {
+		a.expiresAt = a.now().Add(time.Duration(token.ExpiresIn)*time.Second - tokenExpiryMargin)
+	}
+	return a.accessToken
+}
+
+// requestToken calls the token endpoint; secrets sent in form besides the
+// client secret are hidden from the errors
+func (a *oauth2Auth) requestToken(ctx context.Context, form url.Values, secrets ...string) (*oauth2Token, error) {
+	form.Set("client_id", a.cfg.ClientID)
+	form.Set("client_secret", a.cfg.ClientSecret)
+	secrets = append(secrets, a.cfg.ClientSecret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, redactError(fmt.Errorf("failed to get OAuth2 token: %w", err), secrets...)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("failed to get OAuth2 token: %w", newFrappeError(resp, secrets...))
+	}
+
+	var token oauth2Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode OAuth2 token: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("OAuth2 token response has no access_token")
+	}
+	return &token, nil
+}
+
+// sessionAuth logs in with username and password and sends the session cookies
+type sessionAuth struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+
+	mu      sync.Mutex
+	cookies []*http.Cookie
+}
+
+// NewSessionAuth authenticates with a Frappe user through /api/method/login,
+// logging in again when the session expires; httpClient is used for the login
+// call (nil uses a plain client)
+func NewSessionAuth(baseURL, username, password string, httpClient *http.Client) FrappeAuth {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &sessionAuth{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		client:   httpClient,
+	}
+}
+
+func (a *sessionAuth) Authorize(ctx context.Context, req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.cookies) == 0 {
+		if err := a.login(ctx); err != nil {
+			return err
+		}
+	}
+	for _, cookie := range a.cookies {
+		req.AddCookie(cookie)
+	}
+	return nil
+}
+
+func (a *sessionAuth) Invalidate() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cookies = nil
+	return true
+}
+
+func (a *sessionAuth) Secrets() []string { return []string{a.password} }
+
+// login opens a session and keeps the cookies Frappe sets (sid and user info)
+func (a *sessionAuth) login(ctx context.Context) error {
+	body, err := json.Marshal(map[string]string{"usr": a.username, "pwd": a.password})
+	if err != nil {
+		return fmt.Errorf("failed to marshal login: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.baseURL+"/api/method/login", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create login request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return redactError(fmt.Errorf("failed to log in to Frappe: %w", err), a.password)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to log in to Frappe: %w", newFrappeError(resp, a.password))
+	}
+
+	var cookies []*http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Value != "" {
+			cookies = append(cookies, &http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+	if len(cookies) == 0 {
+		return fmt.Errorf("frappe login returned no session cookie")
+	}
+	a.cookies = cookies
+	return nil
+}
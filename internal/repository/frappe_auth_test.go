@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrappeOAuth2ClientCredentialsAndRefresh(t *testing.T) {
+	var grants []string
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			r.ParseForm()
+			grants = append(grants, r.PostForm.Get("grant_type"))
+			if r.PostForm.Get("client_id") != "bridge" || r.PostForm.Get("client_secret") != "client-secret" {
+				t.Errorf("unexpected client credentials %v", r.PostForm)
+			}
+			if r.PostForm.Get("grant_type") == "refresh_token" {
+				w.Write([]byte(`{"access_token":"token-2","expires_in":3600}`))
+				return
+			}
+			w.Write([]byte(`{"access_token":"token-1","refresh_token":"refresh-1","expires_in":3600}`))
+		default:
+			tokens = append(tokens, r.Header.Get("Authorization"))
+			w.Write([]byte(`{"data":{"name":"INV-0001"}}`))
+		}
+	}))
+	defer server.Close()
+
+	auth := NewOAuth2Auth(OAuth2Config{TokenURL: server.URL + "/oauth/token", ClientID: "bridge", ClientSecret: "client-secret"}, nil)
+	now := time.Now()
+	auth.(*oauth2Auth).now = func() time.Time { return now }
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(server.URL, auth, 0, nil), "Invoices")
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The token is renewed with the refresh token shortly before it expires
+	now = now.Add(time.Hour)
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if strings.Join(grants, ",") != "client_credentials,refresh_token" {
+		t.Errorf("unexpected grants %v", grants)
+	}
+	if strings.Join(tokens, ",") != "Bearer token-1,Bearer token-1,Bearer token-2" {
+		t.Errorf("unexpected Authorization headers %v", tokens)
+	}
+}
+
+func TestFrappeOAuth2RenewsRejectedToken(t *testing.T) {
+	issued := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			issued++
+			w.Write([]byte(`{"access_token":"token-` + string(rune('0'+issued)) + `"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token-2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"data":{"name":"INV-0001"}}`))
+	}))
+	defer server.Close()
+
+	auth := NewOAuth2Auth(OAuth2Config{TokenURL: server.URL + "/oauth/token", ClientID: "bridge", ClientSecret: "client-secret"}, nil)
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(server.URL, auth, 0, nil), "Invoices")
+
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("expected the revoked token to be replaced, got %v", err)
+	}
+	if issued != 2 {
+		t.Errorf("expected 2 tokens issued, got %d", issued)
+	}
+}
+
+func TestFrappeOAuth2StaticToken(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":{"name":"INV-0001"}}`)
+	auth := NewOAuth2Auth(OAuth2Config{AccessToken: "static-token"}, nil)
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(fake.server.URL, auth, 0, nil), "Invoices")
+
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := fake.header.Get("Authorization"); got != "Bearer static-token" {
+		t.Errorf("unexpected Authorization header %q", got)
+	}
+
+	// A static token cannot be renewed: 401 is returned as is
+	fake.status = http.StatusUnauthorized
+	fake.respond = `{"exc_type":"AuthenticationError"}`
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+}
+
+func TestFrappeOAuth2StaticTokenRejectedOnce(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"exc_type":"AuthenticationError"}`))
+	}))
+	defer server.Close()
+
+	// Through the retrying client used in production
+	auth := NewOAuth2Auth(OAuth2Config{AccessToken: "static-token"}, nil)
+	httpClient := NewHTTPClient(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, nil)
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(server.URL, auth, time.Second, httpClient), "Invoices")
+
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected 401 error, got %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the rejected static token sent once, got %d requests", requests)
+	}
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err == nil {
+		t.Fatal("expected 401 error")
+	}
+	if requests != 2 {
+		t.Errorf("expected one request per call, got %d requests", requests)
+	}
+}
+
+func TestFrappeOAuth2FetchesTokenWithoutLock(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte(`{"access_token":"token-1"}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	auth := NewOAuth2Auth(OAuth2Config{TokenURL: server.URL, ClientID: "bridge", ClientSecret: "client-secret"}, nil)
+	go auth.(*oauth2Auth).token(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	// A slow token endpoint does not block the other users of the credentials
+	done := make(chan struct{})
+	go func() {
+		auth.Secrets()
+		auth.Invalidate()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the credentials to stay available while a token is fetched")
+	}
+}
+
+func TestFrappeSessionLoginAndRelogin(t *testing.T) {
+	logins := 0
+	validSID := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/method/login" {
+			logins++
+			validSID = "sid-" + string(rune('0'+logins))
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: validSID, Path: "/"})
+			http.SetCookie(w, &http.Cookie{Name: "user_id", Value: "bridge@example.com", Path: "/"})
+			w.Write([]byte(`{"message":"Logged In"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("unexpected Authorization header in session mode")
+		}
+		sid, err := r.Cookie("sid")
+		if err != nil || sid.Value != validSID {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"exc_type":"PermissionError"}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"name":"INV-0001"}}`))
+	}))
+	defer server.Close()
+
+	auth := NewSessionAuth(server.URL, "bridge@example.com", "user-password", nil)
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(server.URL, auth, 0, nil), "Invoices")
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if logins != 1 {
+		t.Fatalf("expected the session to be reused, got %d logins", logins)
+	}
+
+	// Session expired on the server: log in again and retry once
+	validSID = "expired"
+	if _, err := repo.GetInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logins != 2 {
+		t.Errorf("expected a new login, got %d logins", logins)
+	}
+}
+
+func TestFrappeSessionLoginFailureHidesPassword(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"exc_type":"AuthenticationError","message":"Invalid login user-password"}`))
+	}))
+	defer server.Close()
+
+	auth := NewSessionAuth(server.URL, "bridge@example.com", "user-password", nil)
+	repo := NewFrappeRepo(NewFrappeClientWithAuth(server.URL, auth, 0, nil), "Invoices")
+
+	_, err := repo.GetInvoice(context.Background(), "INV-0001")
+	if err == nil {
+		t.Fatal("expected login error")
+	}
+	if strings.Contains(err.Error(), "user-password") {
+		t.Errorf("password leaked in error: %v", err)
+	}
+}
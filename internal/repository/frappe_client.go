@@ -0,0 +1,371 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+// defaultFrappeTimeout bounds each Frappe call when no timeout is configured
+const defaultFrappeTimeout = 15 * time.Second
+
+// FrappeClient is a generic client for the Frappe REST API (/api/resource and
+// /api/method). Typed helpers such as FrappeRepository are built on top of it.
+type FrappeClient struct {
+	client  *http.Client
+	baseURL string
+	auth    FrappeAuth
+	timeout time.Duration // Per-call timeout, on top of the caller's context
+}
+
+// NewFrappeClient creates a Frappe client authenticated with an API key and
+// secret; timeout is the per-call timeout (defaults to 15s when zero) and
+// httpClient the shared Frappe client from NewHTTPClient (nil uses a plain client)
+func NewFrappeClient(baseURL, key, secret string, timeout time.Duration, httpClient *http.Client) *FrappeClient {
+	return NewFrappeClientWithAuth(baseURL, NewAPIKeyAuth(key, secret), timeout, httpClient)
+}
+
+// NewFrappeClientWithAuth creates a Frappe client with any authentication
+// mode (API key, OAuth2 bearer token or session login)
+func NewFrappeClientWithAuth(baseURL string, auth FrappeAuth, timeout time.Duration, httpClient *http.Client) *FrappeClient {
+	if timeout <= 0 {
+		timeout = defaultFrappeTimeout
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &FrappeClient{
+		client:  httpClient,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		auth:    auth,
+		timeout: timeout,
+	}
+}
+
+// Filter is a Frappe list filter: [field, operator, value]
+type Filter struct {
+	Field    string
+	Operator string // "=", "!=", ">", "<", ">=", "<=", "like", "in", "between", ...
+	Value    interface{}
+}
+
+func (f Filter) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{f.Field, f.Operator, f.Value})
+}
+
+// ListOptions selects the documents and fields returned by GetList
+type ListOptions struct {
+	Fields  []string // Defaults to ["name"] in Frappe
+	Filters []Filter
+	OrderBy string // e.g. "modified desc"
+	Start   int
+	Limit   int // 0 keeps Frappe's default page size (20), -1 returns everything
+}
+
+// FrappeError is a non-2xx answer from Frappe
+type FrappeError struct {
+	StatusCode int
+	ExcType    string // Python exception class (e.g. "DoesNotExistError")
+	Message    string
+}
+
+func (e *FrappeError) Error() string {
+	msg := fmt.Sprintf("frappe returned status: %d", e.StatusCode)
+	if e.ExcType != "" {
+		msg += ", " + e.ExcType
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// GetDoc fetches a document and decodes it into out
+func (c *FrappeClient) GetDoc(ctx context.Context, doctype, name string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, c.resourceURL(doctype, name), nil, "data", out, "get_doc")
+}
+
+// GetList lists documents of a DocType and decodes them into out (a slice pointer)
+func (c *FrappeClient) GetList(ctx context.Context, doctype string, opts ListOptions, out interface{}) error {
+	query := url.Values{}
+	if len(opts.Fields) > 0 {
+		fields, err := json.Marshal(opts.Fields)
+		if err != nil {
+			return fmt.Errorf("failed to encode fields: %w", err)
+		}
+		query.Set("fields", string(fields))
+	}
+	if len(opts.Filters) > 0 {
+		filters, err := json.Marshal(opts.Filters)
+		if err != nil {
+			return fmt.Errorf("failed to encode filters: %w", err)
+		}
+		query.Set("filters", string(filters))
+	}
+	if opts.OrderBy != "" {
+		query.Set("order_by", opts.OrderBy)
+	}
+	if opts.Start > 0 {
+		query.Set("limit_start", strconv.Itoa(opts.Start))
+	}
+	if opts.Limit != 0 {
+		query.Set("limit_page_length", strconv.Itoa(max(opts.Limit, 0)))
+	}
+
+	endpoint := c.resourceURL(doctype, "")
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return c.do(ctx, http.MethodGet, endpoint, nil, "data", out, "get_list")
+}
+
+// InsertDoc creates a document and decodes the saved document into out (may be nil)
+func (c *FrappeClient) InsertDoc(ctx context.Context, doctype string, doc interface{}, out interface{}) error {
+	return c.do(ctx, http.MethodPost, c.resourceURL(doctype, ""), doc, "data", out, "insert_doc")
+}
+
+// UpdateDoc updates the given fields of a document and decodes the saved
+// document into out (may be nil)
+func (c *FrappeClient) UpdateDoc(ctx context.Context, doctype, name string, data interface{}, out interface{}) error {
+	return c.do(ctx, http.MethodPut, c.resourceURL(doctype, name), data, "data", out, "update_doc")
+}
+
+// DeleteDoc deletes a document
+func (c *FrappeClient) DeleteDoc(ctx context.Context, doctype, name string) error {
+	return c.do(ctx, http.MethodDelete, c.resourceURL(doctype, name), nil, "", nil, "delete_doc")
+}
+
+// CallMethod calls a whitelisted server method (/api/method/<method>) and
+// decodes its "message" into out (may be nil)
+func (c *FrappeClient) CallMethod(ctx context.Context, method string, args interface{}, out interface{}) error {
+	endpoint := fmt.Sprintf("%s/api/method/%s", c.baseURL, method)
+	return c.do(ctx, http.MethodPost, endpoint, args, "message", out, "call_method")
+}
+
+// Ping calls frappe.auth.get_logged_user, a cheap authenticated request
+func (c *FrappeClient) Ping(ctx context.Context) error {
+	endpoint := fmt.Sprintf("%s/api/method/frappe.auth.get_logged_user", c.baseURL)
+	return c.do(ctx, http.MethodGet, endpoint, nil, "message", nil, "ping")
+}
+
+// FileUpload is a file attached to a document through upload_file
+type FileUpload struct {
+	DocType   string // Document the file is attached to
+	DocName   string
+	FieldName string // Optional Attach field of the document
+	FileName  string
+	Content   []byte
+	IsPrivate bool // Private files need a logged in user to be downloaded
+}
+
+// UploadFile uploads a file with the upload_file method and attaches it to a document
+func (c *FrappeClient) UploadFile(ctx context.Context, upload FileUpload) (*models.FrappeFile, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	fields := map[string]string{
+		"doctype":    upload.DocType,
+		"docname":    upload.DocName,
+		"file_name":  upload.FileName,
+		"is_private": "0",
+	}
+	if upload.IsPrivate {
+		fields["is_private"] = "1"
+	}
+	if upload.FieldName != "" {
+		fields["fieldname"] = upload.FieldName
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, fmt.Errorf("failed to build upload: %w", err)
+		}
+	}
+	part, err := form.CreateFormFile("file", upload.FileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+	if _, err := part.Write(upload.Content); err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+	if err := form.Close(); err != nil {
+		return nil, fmt.Errorf("failed to build upload: %w", err)
+	}
+
+	var file models.FrappeFile
+	endpoint := fmt.Sprintf("%s/api/method/upload_file", c.baseURL)
+	if err := c.send(ctx, http.MethodPost, endpoint, buf.Bytes(), form.FormDataContentType(), "message", &file, "upload_file"); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetDocAs fetches a document of any DocType as T
+func GetDocAs[T any](ctx context.Context, c *FrappeClient, doctype, name string) (*T, error) {
+	var doc T
+	if err := c.GetDoc(ctx, doctype, name, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// resourceURL builds /api/resource/<doctype>[/<name>], escaping spaces in
+// DocType names (e.g., "Brazil Invoice" -> "Brazil%20Invoice") and names
+func (c *FrappeClient) resourceURL(doctype, name string) string {
+	endpoint := fmt.Sprintf("%s/api/resource/%s", c.baseURL, url.PathEscape(doctype))
+	if name != "" {
+		endpoint += "/" + url.PathEscape(name)
+	}
+	return endpoint
+}
+
+// do sends the request and decodes the envelope key ("data" or "message") into
+// out. operation names the call in the upstream request metrics
+func (c *FrappeClient) do(ctx context.Context, method, endpoint string, payload interface{}, envelope string, out interface{}, operation string) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var body []byte
+	contentType := ""
+	if payload != nil {
+		jsonData, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		body = jsonData
+		contentType = "application/json"
+	}
+
+	return c.send(ctx, method, endpoint, body, contentType, envelope, out, operation)
+}
+
+// send performs an authenticated request with a prepared body. When Frappe
+// rejects the credentials (expired token or session) they are renewed and the
+// request is sent once more
+func (c *FrappeClient) send(ctx context.Context, method, endpoint string, body []byte, contentType string, envelope string, out interface{}, operation string) error {
+	resp, err := c.sendOnce(ctx, method, endpoint, body, contentType, operation)
+	if err != nil {
+		return err
+	}
+	if (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && c.auth.Invalidate() {
+		resp.Body.Close()
+		resp, err = c.sendOnce(ctx, method, endpoint, body, contentType, operation)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return newFrappeError(resp, c.auth.Secrets()...)
+	}
+
+	if out == nil || envelope == "" {
+		return nil
+	}
+
+	var result map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	raw, ok := result[envelope]
+	if !ok {
+		return fmt.Errorf("frappe response has no %q", envelope)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// sendOnce builds, authorizes and sends one request
+func (c *FrappeClient) sendOnce(ctx context.Context, method, endpoint string, body []byte, contentType string, operation string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if err := c.auth.Authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		metrics.ObserveRequest("frappe", operation, 0, start)
+		return nil, redactError(err, c.auth.Secrets()...)
+	}
+	metrics.ObserveRequest("frappe", operation, resp.StatusCode, start)
+	return resp, nil
+}
+
+// newFrappeError decodes a Frappe error answer (exc_type, exception and
+// _server_messages), hiding the given secrets
+func newFrappeError(resp *http.Response, secrets ...string) *FrappeError {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	frappeErr := &FrappeError{StatusCode: resp.StatusCode}
+	defer func() {
+		metrics.UpstreamErrors.WithLabelValues("frappe", errorCode(frappeErr.ExcType, frappeErr.StatusCode)).Inc()
+	}()
+
+	var decoded struct {
+		ExcType        string `json:"exc_type"`
+		Exception      string `json:"exception"`
+		Message        string `json:"message"`
+		ServerMessages string `json:"_server_messages"`
+	}
+	if err := json.Unmarshal(bodyBytes, &decoded); err != nil {
+		return frappeErr
+	}
+
+	frappeErr.ExcType = decoded.ExcType
+	switch {
+	case decoded.ServerMessages != "":
+		frappeErr.Message = serverMessages(decoded.ServerMessages)
+	case decoded.Exception != "":
+		frappeErr.Message = decoded.Exception
+	default:
+		frappeErr.Message = decoded.Message
+	}
+	frappeErr.Message = redactSecrets(frappeErr.Message, secrets...)
+	return frappeErr
+}
+
+// serverMessages flattens Frappe's _server_messages: a JSON list of JSON
+// encoded {"message": "..."} objects
+func serverMessages(raw string) string {
+	var encoded []string
+	if err := json.Unmarshal([]byte(raw), &encoded); err != nil {
+		return raw
+	}
+
+	var messages []string
+	for _, e := range encoded {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(e), &msg); err == nil && msg.Message != "" {
+			messages = append(messages, msg.Message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
@@ -0,0 +1,337 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+// fakeFrappe records the last request and answers with the configured body
+type fakeFrappe struct {
+	server  *httptest.Server
+	method  string
+	path    string
+	query   url.Values
+	header  http.Header
+	body    []byte
+	status  int
+	respond string
+}
+
+func newFakeFrappe(t *testing.T, respond string) *fakeFrappe {
+	t.Helper()
+	f := &fakeFrappe{status: http.StatusOK, respond: respond}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.method = r.Method
+		f.path = r.URL.EscapedPath()
+		f.query = r.URL.Query()
+		f.header = r.Header.Clone()
+		f.body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(f.status)
+		w.Write([]byte(f.respond))
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func TestFrappeRepoTimesOutHungCalls(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	repo := NewFrappeRepo(NewFrappeClient(server.URL, "key", "secret", 50*time.Millisecond, nil), "Invoices")
+
+	_, err := repo.GetInvoice(context.Background(), "INV-0001")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestFrappeRepoSendsTokenAuth(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":{"name":"INV-0001"}}`)
+
+	repo := NewFrappeRepo(NewFrappeClient(fake.server.URL, "key", "secret", 0, nil), "Invoices")
+	inv, err := repo.GetInvoice(context.Background(), "INV-0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inv.Name != "INV-0001" {
+		t.Errorf("expected INV-0001, got %s", inv.Name)
+	}
+	if got := fake.header.Get("Authorization"); got != "token key:secret" {
+		t.Errorf("unexpected Authorization header %q", got)
+	}
+}
+
+func TestFrappeRepoTypedHelpers(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":{}}`)
+	repo := NewFrappeRepo(NewFrappeClient(fake.server.URL, "key", "secret", 0, nil), "Brazil Invoice")
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		call   func() error
+		method string
+		path   string
+	}{
+		{"GetInvoice", func() error { _, err := repo.GetInvoice(ctx, "BR-0001"); return err }, http.MethodGet, "/api/resource/Brazil%20Invoice/BR-0001"},
+		{"GetTax", func() error { _, err := repo.GetTax(ctx, "ICMS 18%"); return err }, http.MethodGet, "/api/resource/Tax/ICMS%2018%25"},
+		{"GetCarrier", func() error { _, err := repo.GetCarrier(ctx, "Transportadora"); return err }, http.MethodGet, "/api/resource/Carrier/Transportadora"},
+		{"GetCustomer", func() error { _, err := repo.GetCustomer(ctx, "Cliente SA"); return err }, http.MethodGet, "/api/resource/Customer/Cliente%20SA"},
+		{"GetAddress", func() error { _, err := repo.GetAddress(ctx, "Cliente SA-Billing"); return err }, http.MethodGet, "/api/resource/Address/Cliente%20SA-Billing"},
+		{"GetItem", func() error { _, err := repo.GetItem(ctx, "INV-100"); return err }, http.MethodGet, "/api/resource/Item/INV-100"},
+		{"GetCompany", func() error { _, err := repo.GetCompany(ctx, "AnyGrid Matriz"); return err }, http.MethodGet, "/api/resource/Company/AnyGrid%20Matriz"},
+		{"UpdateInvoice", func() error {
+			return repo.UpdateInvoice(ctx, "BR-0001", map[string]interface{}{"invoice_id": "nfe-1"})
+		}, http.MethodPut, "/api/resource/Brazil%20Invoice/BR-0001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if fake.method != tt.method || fake.path != tt.path {
+				t.Errorf("expected %s %s, got %s %s", tt.method, tt.path, fake.method, fake.path)
+			}
+		})
+	}
+}
+
+func TestFrappeClientGetList(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":[{"name":"INV-0001","company":"AnyGrid"},{"name":"INV-0002","company":"AnyGrid"}]}`)
+	client := NewFrappeClient(fake.server.URL, "key", "secret", 0, nil)
+
+	var invoices []models.Invoices
+	err := client.GetList(context.Background(), "Invoices", ListOptions{
+		Fields:  []string{"name", "company"},
+		Filters: []Filter{{Field: "docstatus", Operator: "=", Value: 1}, {Field: "posting_date", Operator: "between", Value: []string{"2024-01-01", "2024-01-31"}}},
+		OrderBy: "modified desc",
+		Limit:   -1,
+	}, &invoices)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(invoices) != 2 || invoices[1].Name != "INV-0002" || invoices[1].Company != "AnyGrid" {
+		t.Errorf("unexpected list: %+v", invoices)
+	}
+	if fake.path != "/api/resource/Invoices" {
+		t.Errorf("unexpected path %s", fake.path)
+	}
+	if got := fake.query.Get("filters"); got != `[["docstatus","=",1],["posting_date","between",["2024-01-01","2024-01-31"]]]` {
+		t.Errorf("unexpected filters %s", got)
+	}
+	if fake.query.Get("fields") != `["name","company"]` || fake.query.Get("order_by") != "modified desc" || fake.query.Get("limit_page_length") != "0" {
+		t.Errorf("unexpected query %v", fake.query)
+	}
+}
+
+func TestFrappeClientInsertDeleteAndCallMethod(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":{"name":"CUST-0001","customer_name":"Cliente"}}`)
+	client := NewFrappeClient(fake.server.URL, "key", "secret", 0, nil)
+	ctx := context.Background()
+
+	var saved struct {
+		Name         string `json:"name"`
+		CustomerName string `json:"customer_name"`
+	}
+	if err := client.InsertDoc(ctx, "Customer", map[string]string{"customer_name": "Cliente"}, &saved); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.method != http.MethodPost || fake.path != "/api/resource/Customer" || saved.Name != "CUST-0001" {
+		t.Errorf("unexpected insert: %s %s -> %+v", fake.method, fake.path, saved)
+	}
+	if fake.header.Get("Content-Type") != "application/json" || string(fake.body) != `{"customer_name":"Cliente"}` {
+		t.Errorf("unexpected insert body %s", fake.body)
+	}
+
+	fake.respond = `{"message":"ok"}`
+	if err := client.DeleteDoc(ctx, "Customer", "CUST-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.method != http.MethodDelete || fake.path != "/api/resource/Customer/CUST-0001" {
+		t.Errorf("unexpected delete: %s %s", fake.method, fake.path)
+	}
+
+	fake.respond = `{"message":{"total":3}}`
+	var result map[string]int
+	if err := client.CallMethod(ctx, "erpnext.api.count", map[string]string{"doctype": "Invoices"}, &result); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.path != "/api/method/erpnext.api.count" || result["total"] != 3 {
+		t.Errorf("unexpected method call: %s -> %v", fake.path, result)
+	}
+	var args map[string]string
+	json.Unmarshal(fake.body, &args)
+	if args["doctype"] != "Invoices" {
+		t.Errorf("unexpected method args %s", fake.body)
+	}
+}
+
+func TestFrappeClientDecodesErrors(t *testing.T) {
+	fake := newFakeFrappe(t, `{"exc_type":"DoesNotExistError","_server_messages":"[\"{\\\"message\\\": \\\"Invoices INV-9 not found\\\"}\"]"}`)
+	fake.status = http.StatusNotFound
+	client := NewFrappeClient(fake.server.URL, "key", "secret", 0, nil)
+
+	type customer struct {
+		Name string `json:"name"`
+	}
+	_, err := GetDocAs[customer](context.Background(), client, "Customer", "INV-9")
+
+	var frappeErr *FrappeError
+	if !errors.As(err, &frappeErr) {
+		t.Fatalf("expected *FrappeError, got %T: %v", err, err)
+	}
+	if frappeErr.StatusCode != http.StatusNotFound || frappeErr.ExcType != "DoesNotExistError" || frappeErr.Message != "Invoices INV-9 not found" {
+		t.Errorf("unexpected error: %+v", frappeErr)
+	}
+	if err.Error() != "frappe returned status: 404, DoesNotExistError: Invoices INV-9 not found" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+}
+
+func TestFrappeRepoReplaceInvoiceAttachment(t *testing.T) {
+	var calls []string
+	var upload struct {
+		fields   map[string]string
+		fileName string
+		content  string
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, r.Method+" "+r.URL.EscapedPath())
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/resource/File":
+			w.Write([]byte(`{"data":[{"name":"old-xml","file_name":"NFe-123.xml"}]}`))
+		case r.URL.Path == "/api/method/upload_file":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("expected multipart upload: %v", err)
+			}
+			upload.fields = map[string]string{}
+			for k, v := range r.MultipartForm.Value {
+				upload.fields[k] = v[0]
+			}
+			file, header, _ := r.FormFile("file")
+			content, _ := io.ReadAll(file)
+			upload.fileName, upload.content = header.Filename, string(content)
+			w.Write([]byte(`{"message":{"name":"new-xml","file_name":"NFe-456.xml","file_url":"/private/files/NFe-456.xml","is_private":1}}`))
+		default:
+			w.Write([]byte(`{"message":"ok"}`))
+		}
+	}))
+	defer server.Close()
+
+	repo := NewFrappeRepo(NewFrappeClient(server.URL, "key", "secret", 0, nil), "Invoices")
+	file, err := repo.ReplaceInvoiceAttachment(context.Background(), "INV-0001", "NFe-456.xml", "NFe-", []byte("<nfeProc/>"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if file.FileURL != "/private/files/NFe-456.xml" {
+		t.Errorf("unexpected file %+v", file)
+	}
+	want := []string{"GET /api/resource/File", "POST /api/method/upload_file", "DELETE /api/resource/File/old-xml"}
+	if len(calls) != len(want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Errorf("call %d: expected %s, got %s", i, want[i], calls[i])
+		}
+	}
+	if upload.fields["doctype"] != "Invoices" || upload.fields["docname"] != "INV-0001" || upload.fields["is_private"] != "1" {
+		t.Errorf("unexpected upload fields %v", upload.fields)
+	}
+	if upload.fileName != "NFe-456.xml" || upload.content != "<nfeProc/>" {
+		t.Errorf("unexpected uploaded file %s: %q", upload.fileName, upload.content)
+	}
+}
+
+func TestFrappeRepoTimeline(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":{"name":"x"}}`)
+	repo := NewFrappeRepo(NewFrappeClient(fake.server.URL, "key", "secret", 0, nil), "Invoices")
+
+	if err := repo.AddInvoiceComment(context.Background(), "INV-0001", "NF-e issuance: NF-e nfe-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var comment map[string]string
+	json.Unmarshal(fake.body, &comment)
+	if fake.method != http.MethodPost || fake.path != "/api/resource/Comment" {
+		t.Errorf("unexpected request %s %s", fake.method, fake.path)
+	}
+	if comment["comment_type"] != "Comment" || comment["reference_doctype"] != "Invoices" || comment["reference_name"] != "INV-0001" || comment["content"] != "NF-e issuance: NF-e nfe-1" {
+		t.Errorf("unexpected comment %v", comment)
+	}
+
+	if err := repo.LogInvoiceError(context.Background(), "INV-0001", "NF-e issuance failed", "boom"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var errorLog map[string]string
+	json.Unmarshal(fake.body, &errorLog)
+	if fake.path != "/api/resource/Error%20Log" {
+		t.Errorf("unexpected path %s", fake.path)
+	}
+	if errorLog["method"] != "NF-e issuance failed" || errorLog["error"] != "boom" || errorLog["reference_name"] != "INV-0001" {
+		t.Errorf("unexpected error log %v", errorLog)
+	}
+}
+
+func TestFrappeRepoListInvoices(t *testing.T) {
+	fake := newFakeFrappe(t, `{"data":[{"name":"INV-0001","docstatus":1,"invoice_id":"nfe-1","total_tax":150.5}]}`)
+	repo := NewFrappeRepo(NewFrappeClient(fake.server.URL, "key", "secret", 0, nil), "Invoices")
+
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	invoices, err := repo.ListInvoices(context.Background(), from, from.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(invoices) != 1 || invoices[0].InvoiceID != "nfe-1" || invoices[0].TotalTax != 150.5 {
+		t.Errorf("unexpected invoices %+v", invoices)
+	}
+	if fake.path != "/api/resource/Invoices" {
+		t.Errorf("unexpected path %s", fake.path)
+	}
+	want := `[["docstatus","in",[1,2]],["creation",">=","2026-03-01 00:00:00"],["creation","<","2026-03-02 00:00:00"]]`
+	var got, expected interface{}
+	json.Unmarshal([]byte(fake.query.Get("filters")), &got)
+	json.Unmarshal([]byte(want), &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected filters %s, got %s", want, fake.query.Get("filters"))
+	}
+	if fake.query.Get("limit_page_length") != "500" || fake.query.Get("limit_start") != "" {
+		t.Errorf("expected the first page of 500, got %v", fake.query)
+	}
+}
+
+func TestFrappeRepoPing(t *testing.T) {
+	fake := newFakeFrappe(t, `{"message":"bridge@example.com"}`)
+	repo := NewFrappeRepo(NewFrappeClient(fake.server.URL, "key", "secret", 0, nil), "Invoices")
+
+	if err := repo.Ping(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.method != http.MethodGet || fake.path != "/api/method/frappe.auth.get_logged_user" || fake.header.Get("Authorization") != "token key:secret" {
+		t.Errorf("unexpected request %s %s %v", fake.method, fake.path, fake.header)
+	}
+
+	fake.status = http.StatusForbidden
+	fake.respond = `{"exc_type":"PermissionError"}`
+	if err := repo.Ping(context.Background()); err == nil {
+		t.Error("expected rejected credentials to fail the ping")
+	}
+}
@@ -0,0 +1,314 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+// IssuanceRepository records every issuance attempt (Frappe invoice, company,
+// payload, NFe.io answer and errors) in the embedded store. Used for
+// idempotency, reconciliation and reporting
+type IssuanceRepository interface {
+	Create(issuance *models.Issuance) error
+
+	// CreateExclusive stores a new attempt of issuance.InvoiceName unless
+	// another attempt of the invoice has one of the blocking statuses. The
+	// check and the insert run in one transaction; the blocking attempt is
+	// returned instead, with nothing stored
+	CreateExclusive(issuance *models.Issuance, blocking ...string) (*models.Issuance, error)
+
+	Update(issuance *models.Issuance) error
+
+	// Modify reads the attempt, applies change and saves it in one
+	// transaction; an error from change aborts without saving
+	Modify(id uint64, change func(issuance *models.Issuance) error) (*models.Issuance, error)
+
+	UpdateWithOutbox(issuance *models.Issuance, writeBacks ...*models.OutboxMessage) error
+	Get(id uint64) (*models.Issuance, error)
+	GetByNFeID(nfeID string) (*models.Issuance, error)
+	ListByInvoice(invoiceName string) ([]models.Issuance, error)
+	List(filter IssuanceFilter) ([]models.Issuance, error)
+
+	// ListDeadLetters returns the failed and rejected attempts not yet
+	// replayed or discarded, oldest first
+	ListDeadLetters() ([]models.Issuance, error)
+}
+
+// IssuanceFilter selects issuances in List; zero fields match everything
+type IssuanceFilter struct {
+	CompanyID string
+	Kind      string
+	Statuses  []string
+	Since     time.Time // Created at or after
+	Until     time.Time // Created before
+	Limit     int
+}
+
+type issuanceRepo struct {
+	store *Store
+	now   func() time.Time
+}
+
+// NewIssuanceRepo returns the issuance attempts kept in the embedded store
+func NewIssuanceRepo(store *Store) IssuanceRepository {
+	return &issuanceRepo{store: store, now: time.Now}
+}
+
+// Create stores a new attempt, assigning its ID and timestamps
+func (r *issuanceRepo) Create(issuance *models.Issuance) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		return r.create(tx, issuance)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record issuance: %w", err)
+	}
+	return nil
+}
+
+func (r *issuanceRepo) CreateExclusive(issuance *models.Issuance, blocking ...string) (*models.Issuance, error) {
+	var blocker *models.Issuance
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		previous, err := listByInvoice(tx, issuance.InvoiceName)
+		if err != nil {
+			return err
+		}
+		for i := range previous {
+			for _, status := range blocking {
+				if previous[i].Status == status {
+					blocker = &previous[i]
+					return nil
+				}
+			}
+		}
+		return r.create(tx, issuance)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record issuance: %w", err)
+	}
+	return blocker, nil
+}
+
+// create assigns the ID and timestamps of a new attempt and writes it
+func (r *issuanceRepo) create(tx *bolt.Tx, issuance *models.Issuance) error {
+	id, err := tx.Bucket(issuancesBucket).NextSequence()
+	if err != nil {
+		return err
+	}
+	issuance.ID = id
+	issuance.CreatedAt = r.now().UTC()
+	issuance.UpdatedAt = issuance.CreatedAt
+	if issuance.Status == "" {
+		issuance.Status = models.IssuanceStatusPending
+	}
+	return putIssuance(tx, issuance)
+}
+
+// Update saves an existing attempt
+func (r *issuanceRepo) Update(issuance *models.Issuance) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(issuancesBucket).Get(itob(issuance.ID)) == nil {
+			return fmt.Errorf("issuance %d: %w", issuance.ID, ErrNotFound)
+		}
+		issuance.UpdatedAt = r.now().UTC()
+		return putIssuance(tx, issuance)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update issuance: %w", err)
+	}
+	return nil
+}
+
+func (r *issuanceRepo) Modify(id uint64, change func(issuance *models.Issuance) error) (*models.Issuance, error) {
+	var issuance *models.Issuance
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if issuance, err = getIssuance(tx, itob(id)); err != nil {
+			return err
+		}
+		if err := change(issuance); err != nil {
+			return err
+		}
+		issuance.UpdatedAt = r.now().UTC()
+		return putIssuance(tx, issuance)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issuance, nil
+}
+
+// UpdateWithOutbox saves the attempt and enqueues its Frappe write-backs in a
+// single transaction: either both are stored or neither is
+func (r *issuanceRepo) UpdateWithOutbox(issuance *models.Issuance, writeBacks ...*models.OutboxMessage) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(issuancesBucket).Get(itob(issuance.ID)) == nil {
+			return fmt.Errorf("issuance %d: %w", issuance.ID, ErrNotFound)
+		}
+		now := r.now()
+		issuance.UpdatedAt = now.UTC()
+		if err := putIssuance(tx, issuance); err != nil {
+			return err
+		}
+		for _, msg := range writeBacks {
+			if err := enqueueOutbox(tx, msg, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update issuance: %w", err)
+	}
+	return nil
+}
+
+func (r *issuanceRepo) Get(id uint64) (*models.Issuance, error) {
+	var issuance *models.Issuance
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		issuance, err = getIssuance(tx, itob(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issuance, nil
+}
+
+func (r *issuanceRepo) GetByNFeID(nfeID string) (*models.Issuance, error) {
+	var issuance *models.Issuance
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		key := tx.Bucket(issuancesByNFeBucket).Get([]byte(nfeID))
+		if key == nil {
+			return fmt.Errorf("issuance of NF-e %s: %w", nfeID, ErrNotFound)
+		}
+		var err error
+		issuance, err = getIssuance(tx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return issuance, nil
+}
+
+// ListByInvoice returns the attempts of a Frappe invoice, oldest first
+func (r *issuanceRepo) ListByInvoice(invoiceName string) ([]models.Issuance, error) {
+	var issuances []models.Issuance
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		issuances, err = listByInvoice(tx, invoiceName)
+		return err
+	})
+	return issuances, err
+}
+
+// List returns the attempts matching the filter, oldest first
+func (r *issuanceRepo) List(filter IssuanceFilter) ([]models.Issuance, error) {
+	statuses := make(map[string]bool)
+	for _, status := range filter.Statuses {
+		statuses[status] = true
+	}
+
+	var issuances []models.Issuance
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(issuancesBucket).ForEach(func(k, v []byte) error {
+			if filter.Limit > 0 && len(issuances) >= filter.Limit {
+				return nil
+			}
+
+			var issuance models.Issuance
+			if err := json.Unmarshal(v, &issuance); err != nil {
+				return fmt.Errorf("failed to decode issuance %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			switch {
+			case filter.CompanyID != "" && issuance.CompanyID != filter.CompanyID,
+				filter.Kind != "" && issuance.Kind != filter.Kind,
+				len(statuses) > 0 && !statuses[issuance.Status],
+				!filter.Since.IsZero() && issuance.CreatedAt.Before(filter.Since),
+				!filter.Until.IsZero() && !issuance.CreatedAt.Before(filter.Until):
+				return nil
+			}
+			issuances = append(issuances, issuance)
+			return nil
+		})
+	})
+	return issuances, err
+}
+
+func (r *issuanceRepo) ListDeadLetters() ([]models.Issuance, error) {
+	var issuances []models.Issuance
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(k, _ []byte) error {
+			issuance, err := getIssuance(tx, k)
+			if err != nil {
+				return err
+			}
+			issuances = append(issuances, *issuance)
+			return nil
+		})
+	})
+	return issuances, err
+}
+
+// putIssuance writes the attempt and its NF-e, invoice and dead-letter indexes
+func putIssuance(tx *bolt.Tx, issuance *models.Issuance) error {
+	raw, err := json.Marshal(issuance)
+	if err != nil {
+		return err
+	}
+	key := itob(issuance.ID)
+	if err := tx.Bucket(issuancesBucket).Put(key, raw); err != nil {
+		return err
+	}
+	if issuance.NFeID != "" {
+		if err := tx.Bucket(issuancesByNFeBucket).Put([]byte(issuance.NFeID), key); err != nil {
+			return err
+		}
+	}
+	if issuance.InvoiceName != "" {
+		invoiceKey := append([]byte(issuance.InvoiceName+"\x00"), key...)
+		if err := tx.Bucket(issuancesByInvoiceBucket).Put(invoiceKey, nil); err != nil {
+			return err
+		}
+	}
+	if issuance.IsDeadLetter() {
+		return tx.Bucket(deadLettersBucket).Put(key, nil)
+	}
+	return tx.Bucket(deadLettersBucket).Delete(key)
+}
+
+// listByInvoice reads the attempts of a Frappe invoice, oldest first
+func listByInvoice(tx *bolt.Tx, invoiceName string) ([]models.Issuance, error) {
+	var issuances []models.Issuance
+	prefix := []byte(invoiceName + "\x00")
+	c := tx.Bucket(issuancesByInvoiceBucket).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		issuance, err := getIssuance(tx, k[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		issuances = append(issuances, *issuance)
+	}
+	return issuances, nil
+}
+
+// getIssuance reads the attempt stored under key
+func getIssuance(tx *bolt.Tx, key []byte) (*models.Issuance, error) {
+	raw := tx.Bucket(issuancesBucket).Get(key)
+	if raw == nil {
+		return nil, fmt.Errorf("issuance %d: %w", binary.BigEndian.Uint64(key), ErrNotFound)
+	}
+	var issuance models.Issuance
+	if err := json.Unmarshal(raw, &issuance); err != nil {
+		return nil, fmt.Errorf("failed to decode issuance: %w", err)
+	}
+	return &issuance, nil
+}
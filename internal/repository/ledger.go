@@ -0,0 +1,41 @@
+package repository
+
+import "sort"
+
+// LedgerRepository keeps the local issuance ledger: which numbers of each
+// serie were used per company, the first and last numbers handed out, and
+// which ranges were disabled at SEFAZ
+type LedgerRepository interface {
+	ReserveNextNumber(companyID string, serie int) (int, error)
+	LastNumber(companyID string, serie int) (int, error)
+
+	// FirstReservedNumber is the first number ReserveNextNumber handed out in
+	// the serie; 0 when NFe.io numbers it
+	FirstReservedNumber(companyID string, serie int) (int, error)
+
+	RecordNumber(companyID string, serie, number int) error
+	RecordDisabledRange(companyID string, serie, begin, end int) error
+	IssuedNumbers(companyID string, serie int) ([]int, error)
+	DisabledNumbers(companyID string, serie int) ([]int, error)
+	Series(companyID string) ([]int, error)
+}
+
+// ledgerSerie holds the numbers used in a single serie
+type ledgerSerie struct {
+	First    int   `json:"first,omitempty"` // First number reserved by the bridge
+	Last     int   `json:"last"`
+	Issued   []int `json:"issued"`
+	Disabled []int `json:"disabled"`
+}
+
+// insertNumber adds n to the sorted slice if it is not there yet
+func insertNumber(numbers []int, n int) []int {
+	i := sort.SearchInts(numbers, n)
+	if i < len(numbers) && numbers[i] == n {
+		return numbers
+	}
+	numbers = append(numbers, 0)
+	copy(numbers[i+1:], numbers[i:])
+	numbers[i] = n
+	return numbers
+}
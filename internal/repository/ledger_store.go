@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// storeLedgerRepo is the LedgerRepository kept in the embedded store, one
+// record per company and serie
+type storeLedgerRepo struct {
+	store *Store
+}
+
+// NewStoreLedgerRepo returns the ledger kept in the embedded store
+func NewStoreLedgerRepo(store *Store) LedgerRepository {
+	return &storeLedgerRepo{store: store}
+}
+
+// ledgerKey is "<companyID>\x00<serie>" so a company's series share a prefix
+func ledgerKey(companyID string, serie int) []byte {
+	return []byte(companyID + "\x00" + strconv.Itoa(serie))
+}
+
+func (r *storeLedgerRepo) ReserveNextNumber(companyID string, serie int) (int, error) {
+	var next int
+	err := r.update(companyID, serie, func(s *ledgerSerie) {
+		s.Last++
+		next = s.Last
+		if s.First == 0 {
+			s.First = next
+		}
+	})
+	return next, err
+}
+
+func (r *storeLedgerRepo) FirstReservedNumber(companyID string, serie int) (int, error) {
+	s, err := r.get(companyID, serie)
+	if err != nil {
+		return 0, err
+	}
+	return s.First, nil
+}
+
+func (r *storeLedgerRepo) LastNumber(companyID string, serie int) (int, error) {
+	s, err := r.get(companyID, serie)
+	if err != nil {
+		return 0, err
+	}
+	return s.Last, nil
+}
+
+func (r *storeLedgerRepo) RecordNumber(companyID string, serie, number int) error {
+	return r.update(companyID, serie, func(s *ledgerSerie) {
+		s.Issued = insertNumber(s.Issued, number)
+		if number > s.Last {
+			s.Last = number
+		}
+	})
+}
+
+func (r *storeLedgerRepo) RecordDisabledRange(companyID string, serie, begin, end int) error {
+	return r.update(companyID, serie, func(s *ledgerSerie) {
+		for n := begin; n <= end; n++ {
+			s.Disabled = insertNumber(s.Disabled, n)
+		}
+		if end > s.Last {
+			s.Last = end
+		}
+	})
+}
+
+func (r *storeLedgerRepo) IssuedNumbers(companyID string, serie int) ([]int, error) {
+	s, err := r.get(companyID, serie)
+	if err != nil {
+		return nil, err
+	}
+	return s.Issued, nil
+}
+
+func (r *storeLedgerRepo) DisabledNumbers(companyID string, serie int) ([]int, error) {
+	s, err := r.get(companyID, serie)
+	if err != nil {
+		return nil, err
+	}
+	return s.Disabled, nil
+}
+
+func (r *storeLedgerRepo) Series(companyID string) ([]int, error) {
+	var series []int
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(companyID + "\x00")
+		c := tx.Bucket(ledgerBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			serie, err := strconv.Atoi(string(k[len(prefix):]))
+			if err != nil {
+				return fmt.Errorf("invalid serie in ledger: %s", k[len(prefix):])
+			}
+			series = append(series, serie)
+		}
+		return nil
+	})
+	sort.Ints(series)
+	return series, err
+}
+
+// get reads the numbers of a serie (empty when the serie was never used)
+func (r *storeLedgerRepo) get(companyID string, serie int) (*ledgerSerie, error) {
+	s := &ledgerSerie{}
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(ledgerBucket).Get(ledgerKey(companyID, serie))
+		if raw == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, s)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %w", err)
+	}
+	return s, nil
+}
+
+// update changes the numbers of a serie in a single transaction
+func (r *storeLedgerRepo) update(companyID string, serie int, change func(s *ledgerSerie)) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(ledgerBucket)
+		key := ledgerKey(companyID, serie)
+
+		s := &ledgerSerie{}
+		if raw := bucket.Get(key); raw != nil {
+			if err := json.Unmarshal(raw, s); err != nil {
+				return err
+			}
+		}
+		change(s)
+
+		raw, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, raw)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write ledger: %w", err)
+	}
+	return nil
+}
@@ -2,37 +2,65 @@ package repository
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
 )
 
 // NFeRepository handles all NFe.io API operations
 // Adapted from docs/modules/nfeio.go
+// Every company scoped operation takes the NFe.io company ID (companyKey) as
+// its first parameter; only the access key consultation is account wide.
+// Non-2xx answers are returned as *APIError.
 type NFeRepository interface {
 	// Product Invoice operations
-	CreateProductInvoice(req *models.ProductInvoiceRequest) (*models.ProductInvoiceResponse, error)
-	GetInvoice(id, companyKey string) (*models.ProductInvoiceResponse, error)
-	GetInvoiceByAccessKey(accessKey string) (*models.ProductInvoiceResponse, error)
-	DeleteInvoice(id, companyKey string) error
+	CreateProductInvoice(ctx context.Context, companyKey string, req *models.ProductInvoiceRequest) (*models.ProductInvoiceResponse, error)
+	GetInvoice(ctx context.Context, companyKey, id string) (*models.ProductInvoiceResponse, error)
+	GetInvoiceByAccessKey(ctx context.Context, accessKey string) (*models.ProductInvoiceResponse, error)
+	DeleteInvoice(ctx context.Context, companyKey, id, reason string) error
+	ListInvoices(ctx context.Context, companyKey string, opts NFeListOptions) (*models.ProductInvoiceList, error)
 
 	// PDF and XML operations
-	GetInvoicePDF(id, companyKey string) ([]byte, error)
-	GetInvoiceXML(id, companyKey string) ([]byte, error)
+	GetInvoicePDF(ctx context.Context, companyKey, id string) ([]byte, error)
+	GetInvoiceXML(ctx context.Context, companyKey, id string) ([]byte, error)
 
 	// Correction letter operations
-	CreateCorrectionLetter(id, companyKey, reason string) (*models.ProductInvoiceResponse, error)
-	GetCorrectionLetterPDF(id, companyKey string) ([]byte, error)
-	GetCorrectionLetterXML(id, companyKey string) ([]byte, error)
+	CreateCorrectionLetter(ctx context.Context, companyKey, id, reason string) (*models.ProductInvoiceResponse, error)
+	GetCorrectionLetterPDF(ctx context.Context, companyKey, id string) ([]byte, error)
+	GetCorrectionLetterXML(ctx context.Context, companyKey, id string) ([]byte, error)
+
+	// Company operations
+	GetCompany(ctx context.Context, companyKey string) (*models.NFeCompany, error)
+	GetStateTaxes(ctx context.Context, companyKey string) ([]models.StateTax, error)
+
+	// Number range disablement (inutilização) operations
+	DisableNumberRange(ctx context.Context, companyKey string, req *models.DisablementRequest) (*models.DisablementResponse, error)
+	GetDisablement(ctx context.Context, companyKey, id string) (*models.DisablementResponse, error)
+}
+
+// NFeListOptions pages through the notes of a company, newest first
+type NFeListOptions struct {
+	StartingAfter string // ID of the last note of the previous page
+	Limit         int    // 0 keeps NFe.io's default page size
+	Environment   string // "Production" or "Test"; empty keeps NFe.io's default
 }
 
+// defaultNFeTimeout bounds each NFe.io call when no timeout is configured
+const defaultNFeTimeout = 30 * time.Second
+
 type nfeRepo struct {
 	apiKey          string
 	endpoint        string
 	endpointConsult string
+	timeout         time.Duration // Per-call timeout, on top of the caller's context
 	client          *http.Client
 }
 
@@ -40,39 +68,82 @@ type nfeRepo struct {
 // endpoint: base URL for NFe.io API (e.g., "https://api.nfe.io/v2")
 // endpointConsult: base URL for consultation API
 // apiKey: your NFe.io API key
-func NewNFeRepo(endpoint, endpointConsult, apiKey string) NFeRepository {
+// timeout: per-call timeout (defaults to 30s when zero)
+// client: shared NFe.io client from NewHTTPClient (retries, circuit breaker);
+// nil uses a plain client
+func NewNFeRepo(endpoint, endpointConsult, apiKey string, timeout time.Duration, client *http.Client) NFeRepository {
+	if timeout <= 0 {
+		timeout = defaultNFeTimeout
+	}
+	if client == nil {
+		client = &http.Client{}
+	}
 	return &nfeRepo{
 		apiKey:          apiKey,
 		endpoint:        endpoint,
 		endpointConsult: endpointConsult,
-		client:          &http.Client{},
+		timeout:         timeout,
+		client:          client,
 	}
 }
 
-// CreateProductInvoice creates a new product invoice
-func (r *nfeRepo) CreateProductInvoice(payload *models.ProductInvoiceRequest) (*models.ProductInvoiceResponse, error) {
-	url := fmt.Sprintf("%s/productinvoices?apiKey=%s", r.endpoint, r.apiKey)
+// newRequest builds a request authenticated with the API key in the
+// Authorization header, keeping the key out of URLs, proxies and logs
+func (r *nfeRepo) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", r.apiKey)
+	return req, nil
+}
+
+// do sends the request, recording its duration and status as the given operation
+func (r *nfeRepo) do(req *http.Request, operation string) (*http.Response, error) {
+	start := time.Now()
+	resp, err := r.client.Do(req)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	metrics.ObserveRequest("nfeio", operation, status, start)
+	return resp, err
+}
+
+// redact hides the API key in errors that are logged or returned to callers
+func (r *nfeRepo) redact(err error) error {
+	return redactError(err, r.apiKey)
+}
+
+// CreateProductInvoice creates a new product invoice for the company. It is
+// sent once: after a timeout or 5xx the note may exist at NFe.io, and the
+// attempt is left unknown until the reconciler finds the note or confirms it
+// was never created
+func (r *nfeRepo) CreateProductInvoice(ctx context.Context, companyKey string, payload *models.ProductInvoiceRequest) (*models.ProductInvoiceResponse, error) {
+	ctx, cancel := context.WithTimeout(withoutRetry(ctx), r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices", r.endpoint, companyKey)
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	req, err := r.newRequest(ctx, http.MethodPost, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := r.client.Do(req)
+	resp, err := r.do(req, "create_product_invoice")
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, r.redact(fmt.Errorf("failed to send request: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	var result models.ProductInvoiceResponse
@@ -84,18 +155,25 @@ func (r *nfeRepo) CreateProductInvoice(payload *models.ProductInvoiceRequest) (*
 }
 
 // GetInvoice retrieves an invoice by ID
-func (r *nfeRepo) GetInvoice(id, companyKey string) (*models.ProductInvoiceResponse, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s?apiKey=%s", r.endpoint, companyKey, id, r.apiKey)
+func (r *nfeRepo) GetInvoice(ctx context.Context, companyKey, id string) (*models.ProductInvoiceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
 
-	resp, err := r.client.Get(url)
+	url := fmt.Sprintf("%s/%s/productinvoices/%s", r.endpoint, companyKey, id)
+
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get invoice: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_invoice")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get invoice: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	var result models.ProductInvoiceResponse
@@ -106,19 +184,131 @@ func (r *nfeRepo) GetInvoice(id, companyKey string) (*models.ProductInvoiceRespo
 	return &result, nil
 }
 
+// ListInvoices retrieves a page of the notes of the company
+func (r *nfeRepo) ListInvoices(ctx context.Context, companyKey string, opts NFeListOptions) (*models.ProductInvoiceList, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	query := url.Values{}
+	if opts.StartingAfter != "" {
+		query.Set("startingAfter", opts.StartingAfter)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Environment != "" {
+		query.Set("environment", opts.Environment)
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/productinvoices", r.endpoint, companyKey)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := r.newRequest(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "list_invoices")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to list invoices: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, r.apiKey)
+	}
+
+	var result models.ProductInvoiceList
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// GetCompany retrieves the company registration, with its CNPJ
+func (r *nfeRepo) GetCompany(ctx context.Context, companyKey string) (*models.NFeCompany, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s", r.endpoint, companyKey)
+
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_company")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get company: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, r.apiKey)
+	}
+
+	var result models.NFeCompanyResource
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result.Company, nil
+}
+
+// GetStateTaxes retrieves the state tax registrations of the company, with the
+// SEFAZ environment each one issues in
+func (r *nfeRepo) GetStateTaxes(ctx context.Context, companyKey string) ([]models.StateTax, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/statetaxes", r.endpoint, companyKey)
+
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_state_taxes")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get state taxes: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, r.apiKey)
+	}
+
+	var result models.StateTaxList
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return result.StateTaxes, nil
+}
+
 // GetInvoiceByAccessKey retrieves an invoice by access key
-func (r *nfeRepo) GetInvoiceByAccessKey(accessKey string) (*models.ProductInvoiceResponse, error) {
-	url := fmt.Sprintf("%s/productinvoices/%s?apikey=%s", r.endpointConsult, accessKey, r.apiKey)
+func (r *nfeRepo) GetInvoiceByAccessKey(ctx context.Context, accessKey string) (*models.ProductInvoiceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/productinvoices/%s", r.endpointConsult, accessKey)
 
-	resp, err := r.client.Get(url)
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get invoice by access key: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_invoice_by_access_key")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get invoice by access key: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	var result models.ProductInvoiceResponse
@@ -129,43 +319,56 @@ func (r *nfeRepo) GetInvoiceByAccessKey(accessKey string) (*models.ProductInvoic
 	return &result, nil
 }
 
-// DeleteInvoice deletes (cancels) an invoice
-func (r *nfeRepo) DeleteInvoice(id, companyKey string) error {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s?apikey=%s", r.endpoint, companyKey, id, r.apiKey)
+// DeleteInvoice deletes (cancels) an invoice; the reason is the cancellation
+// justification (xJust) sent to SEFAZ
+func (r *nfeRepo) DeleteInvoice(ctx context.Context, companyKey, id, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
 
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	endpoint := fmt.Sprintf("%s/%s/productinvoices/%s", r.endpoint, companyKey, id)
+	if reason != "" {
+		endpoint += "?" + url.Values{"reason": {reason}}.Encode()
+	}
+
+	req, err := r.newRequest(ctx, http.MethodDelete, endpoint, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create delete request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := r.client.Do(req)
+	resp, err := r.do(req, "delete_invoice")
 	if err != nil {
-		return fmt.Errorf("failed to delete invoice: %w", err)
+		return r.redact(fmt.Errorf("failed to delete invoice: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return newAPIError(resp, r.apiKey)
 	}
 
 	return nil
 }
 
 // GetInvoicePDF retrieves the PDF of an invoice
-func (r *nfeRepo) GetInvoicePDF(id, companyKey string) ([]byte, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s/pdf?apikey=%s", r.endpoint, companyKey, id, r.apiKey)
+func (r *nfeRepo) GetInvoicePDF(ctx context.Context, companyKey, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/%s/pdf", r.endpoint, companyKey, id)
+
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
 
-	resp, err := r.client.Get(url)
+	resp, err := r.do(req, "get_invoice_pdf")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get invoice PDF: %w", err)
+		return nil, r.redact(fmt.Errorf("failed to get invoice PDF: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	pdfBytes, err := io.ReadAll(resp.Body)
@@ -177,18 +380,25 @@ func (r *nfeRepo) GetInvoicePDF(id, companyKey string) ([]byte, error) {
 }
 
 // GetInvoiceXML retrieves the XML of an invoice
-func (r *nfeRepo) GetInvoiceXML(id, companyKey string) ([]byte, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s/xml?apikey=%s", r.endpoint, companyKey, id, r.apiKey)
+func (r *nfeRepo) GetInvoiceXML(ctx context.Context, companyKey, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/%s/xml", r.endpoint, companyKey, id)
 
-	resp, err := r.client.Get(url)
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get invoice XML: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_invoice_xml")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get invoice XML: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	xmlBytes, err := io.ReadAll(resp.Body)
@@ -199,9 +409,13 @@ func (r *nfeRepo) GetInvoiceXML(id, companyKey string) ([]byte, error) {
 	return xmlBytes, nil
 }
 
-// CreateCorrectionLetter creates a correction letter for an invoice
-func (r *nfeRepo) CreateCorrectionLetter(id, companyKey, reason string) (*models.ProductInvoiceResponse, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter?apiKey=%s", r.endpoint, companyKey, id, r.apiKey)
+// CreateCorrectionLetter creates a correction letter for an invoice. The PUT
+// creates a new letter each time, so it is not retried
+func (r *nfeRepo) CreateCorrectionLetter(ctx context.Context, companyKey, id, reason string) (*models.ProductInvoiceResponse, error) {
+	ctx, cancel := context.WithTimeout(withoutRetry(ctx), r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter", r.endpoint, companyKey, id)
 
 	payload := map[string]string{"reason": reason}
 	body, err := json.Marshal(payload)
@@ -209,21 +423,20 @@ func (r *nfeRepo) CreateCorrectionLetter(id, companyKey, reason string) (*models
 		return nil, fmt.Errorf("failed to marshal reason: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(body))
+	req, err := r.newRequest(ctx, http.MethodPut, url, bytes.NewBuffer(body))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := r.client.Do(req)
+	resp, err := r.do(req, "create_correction_letter")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create correction letter: %w", err)
+		return nil, r.redact(fmt.Errorf("failed to create correction letter: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	var result models.ProductInvoiceResponse
@@ -235,18 +448,25 @@ func (r *nfeRepo) CreateCorrectionLetter(id, companyKey, reason string) (*models
 }
 
 // GetCorrectionLetterPDF retrieves the PDF of a correction letter
-func (r *nfeRepo) GetCorrectionLetterPDF(id, companyKey string) ([]byte, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter/pdf?apikey=%s", r.endpoint, companyKey, id, r.apiKey)
+func (r *nfeRepo) GetCorrectionLetterPDF(ctx context.Context, companyKey, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter/pdf", r.endpoint, companyKey, id)
 
-	resp, err := r.client.Get(url)
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get correction letter PDF: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_correction_letter_pdf")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get correction letter PDF: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	pdfBytes, err := io.ReadAll(resp.Body)
@@ -258,18 +478,25 @@ func (r *nfeRepo) GetCorrectionLetterPDF(id, companyKey string) ([]byte, error)
 }
 
 // GetCorrectionLetterXML retrieves the XML of a correction letter
-func (r *nfeRepo) GetCorrectionLetterXML(id, companyKey string) ([]byte, error) {
-	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter/xml?apikey=%s", r.endpoint, companyKey, id, r.apiKey)
+func (r *nfeRepo) GetCorrectionLetterXML(ctx context.Context, companyKey, id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/%s/correctionletter/xml", r.endpoint, companyKey, id)
 
-	resp, err := r.client.Get(url)
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get correction letter XML: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_correction_letter_xml")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get correction letter XML: %w", err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("nfe.io API error: status %d, body: %s", resp.StatusCode, string(bodyBytes))
+		return nil, newAPIError(resp, r.apiKey)
 	}
 
 	xmlBytes, err := io.ReadAll(resp.Body)
@@ -279,3 +506,69 @@ func (r *nfeRepo) GetCorrectionLetterXML(id, companyKey string) ([]byte, error)
 
 	return xmlBytes, nil
 }
+
+// DisableNumberRange disables (inutiliza) a range of unused numbers of a serie
+func (r *nfeRepo) DisableNumberRange(ctx context.Context, companyKey string, payload *models.DisablementRequest) (*models.DisablementResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/disablement", r.endpoint, companyKey)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	req, err := r.newRequest(ctx, http.MethodPost, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.do(req, "disable_number_range")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to disable number range: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, r.apiKey)
+	}
+
+	var result models.DisablementResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
+
+// GetDisablement retrieves the status of a number range disablement
+func (r *nfeRepo) GetDisablement(ctx context.Context, companyKey, id string) (*models.DisablementResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/%s/productinvoices/disablement/%s", r.endpoint, companyKey, id)
+
+	req, err := r.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := r.do(req, "get_disablement")
+	if err != nil {
+		return nil, r.redact(fmt.Errorf("failed to get disablement: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, newAPIError(resp, r.apiKey)
+	}
+
+	var result models.DisablementResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+)
+
+// APIError is a non-2xx answer from NFe.io, decoded from its error JSON
+type APIError struct {
+	StatusCode int      `json:"status_code"`
+	Code       string   `json:"code,omitempty"`     // NFe.io error code, when informed
+	Messages   []string `json:"messages,omitempty"` // Validation / error messages
+	Retryable  bool     `json:"retryable"`          // Worth retrying later (429, 5xx)
+	Body       string   `json:"-"`                  // Raw (redacted) response body
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("nfe.io API error: status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += fmt.Sprintf(", code %s", e.Code)
+	}
+	if len(e.Messages) > 0 {
+		return msg + ": " + strings.Join(e.Messages, "; ")
+	}
+	if e.Body != "" {
+		return msg + ", body: " + e.Body
+	}
+	return msg
+}
+
+// IsValidation reports whether NFe.io rejected the request content (the
+// invoice data must be fixed before trying again)
+func (e *APIError) IsValidation() bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusConflict, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// IsAuth reports whether the API key was refused
+func (e *APIError) IsAuth() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsRateLimited reports whether NFe.io throttled the call
+func (e *APIError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// nfeErrorBody covers the error layouts returned by NFe.io:
+// {"message": "..."}, {"code": 1, "message": "..."} and
+// {"errors": [{"code": "...", "message": "..."}]}
+type nfeErrorBody struct {
+	Code    json.RawMessage `json:"code"`
+	Message string          `json:"message"`
+	Errors  []struct {
+		Code    json.RawMessage `json:"code"`
+		Message string          `json:"message"`
+	} `json:"errors"`
+}
+
+// newAPIError reads and decodes an NFe.io error response, hiding the given secrets
+func newAPIError(resp *http.Response, secrets ...string) *APIError {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	body := redactSecrets(strings.TrimSpace(string(bodyBytes)), secrets...)
+
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Retryable:  resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500,
+		Body:       body,
+	}
+
+	defer func() {
+		metrics.UpstreamErrors.WithLabelValues("nfeio", errorCode(apiErr.Code, apiErr.StatusCode)).Inc()
+	}()
+
+	var decoded nfeErrorBody
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+		return apiErr
+	}
+
+	apiErr.Code = rawCode(decoded.Code)
+	if decoded.Message != "" {
+		apiErr.Messages = append(apiErr.Messages, decoded.Message)
+	}
+	for _, e := range decoded.Errors {
+		if apiErr.Code == "" {
+			apiErr.Code = rawCode(e.Code)
+		}
+		if e.Message != "" {
+			apiErr.Messages = append(apiErr.Messages, e.Message)
+		}
+	}
+	return apiErr
+}
+
+// errorCode is the metric label of an upstream error: its code, or the HTTP
+// status when the answer has none
+func errorCode(code string, status int) string {
+	if code == "" {
+		return "http_" + strconv.Itoa(status)
+	}
+	return code
+}
+
+// rawCode renders a numeric or string JSON code as text
+func rawCode(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// IsRetryable reports whether a failed call may succeed if tried again later:
+// retryable NFe.io answers, open circuits, timeouts and network errors.
+// Validation and authentication errors are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable
+	}
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,106 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestNFeRepoTypedAPIErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		code      string
+		messages  []string
+		retryable bool
+	}{
+		{
+			name:     "validation errors list",
+			status:   http.StatusBadRequest,
+			body:     `{"errors":[{"code":"1001","message":"buyer.federalTaxNumber is invalid"},{"code":"1002","message":"items[0].cfop is required"}]}`,
+			code:     "1001",
+			messages: []string{"buyer.federalTaxNumber is invalid", "items[0].cfop is required"},
+		},
+		{
+			name:     "numeric code with message",
+			status:   http.StatusUnprocessableEntity,
+			body:     `{"code":539,"message":"Duplicidade de NF-e"}`,
+			code:     "539",
+			messages: []string{"Duplicidade de NF-e"},
+		},
+		{
+			name:     "unauthorized",
+			status:   http.StatusUnauthorized,
+			body:     `{"message":"Unauthorized"}`,
+			messages: []string{"Unauthorized"},
+		},
+		{
+			name:      "rate limited",
+			status:    http.StatusTooManyRequests,
+			body:      `{"message":"Too many requests"}`,
+			messages:  []string{"Too many requests"},
+			retryable: true,
+		},
+		{
+			name:      "non JSON upstream failure",
+			status:    http.StatusServiceUnavailable,
+			body:      `<html>Service Unavailable</html>`,
+			retryable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 0, nil)
+			_, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{})
+
+			// Wrapped by a service, the typed error must still be reachable
+			wrapped := fmt.Errorf("failed to issue: %w", err)
+
+			var apiErr *APIError
+			if !errors.As(wrapped, &apiErr) {
+				t.Fatalf("expected *APIError, got %T: %v", err, err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.code || apiErr.Retryable != tt.retryable {
+				t.Errorf("unexpected error fields: %+v", apiErr)
+			}
+			if !reflect.DeepEqual(apiErr.Messages, tt.messages) {
+				t.Errorf("expected messages %v, got %v", tt.messages, apiErr.Messages)
+			}
+			if IsRetryable(wrapped) != tt.retryable {
+				t.Errorf("expected IsRetryable %v", tt.retryable)
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if IsRetryable(nil) {
+		t.Error("nil error is not retryable")
+	}
+	if !IsRetryable(fmt.Errorf("nfeio: %w", ErrCircuitOpen)) {
+		t.Error("open circuit should be retryable")
+	}
+	if !IsRetryable(fmt.Errorf("call: %w", context.DeadlineExceeded)) {
+		t.Error("timeouts should be retryable")
+	}
+	if IsRetryable(errors.New("invalid tax number")) {
+		t.Error("plain errors should not be retryable")
+	}
+	if IsRetryable(&APIError{StatusCode: http.StatusForbidden}) {
+		t.Error("auth errors should not be retryable")
+	}
+}
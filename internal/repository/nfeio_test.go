@@ -0,0 +1,420 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+const (
+	testCompanyKey = "company-123"
+	testAPIKey     = "secret-api-key"
+)
+
+// recordedRequest is what the fake NFe.io server saw for one call
+type recordedRequest struct {
+	Method string
+	URL    string
+	Path   string
+	Query  map[string][]string
+	Header http.Header
+	Body   []byte
+}
+
+// fakeNFeIO is a local stand-in for the NFe.io API that records every request
+type fakeNFeIO struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func newFakeNFeIO(t *testing.T) *fakeNFeIO {
+	t.Helper()
+	f := &fakeNFeIO{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.requests = append(f.requests, recordedRequest{
+			Method: r.Method,
+			URL:    r.URL.String(),
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header.Clone(),
+			Body:   body,
+		})
+		f.mu.Unlock()
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/pdf"), strings.HasSuffix(r.URL.Path, "/xml"):
+			w.Write([]byte("document"))
+		case strings.Contains(r.URL.Path, "/disablement"):
+			json.NewEncoder(w).Encode(models.DisablementResponse{ID: "dis-1", Status: "pending"})
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			json.NewEncoder(w).Encode(models.ProductInvoiceResponse{ID: "nfe-1", Status: "created"})
+		}
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeNFeIO) last(t *testing.T) recordedRequest {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		t.Fatal("no request reached the fake NFe.io server")
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+func TestNFeRepoContract(t *testing.T) {
+	fake := newFakeNFeIO(t)
+	repo := NewNFeRepo(fake.server.URL+"/v2", fake.server.URL+"/consult/v2", testAPIKey, 0, nil)
+
+	tests := []struct {
+		name        string
+		call        func() error
+		method      string
+		path        string
+		contentType string
+		query       map[string][]string
+	}{
+		{
+			name: "CreateProductInvoice",
+			call: func() error {
+				_, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{OperationNature: "Venda"})
+				return err
+			},
+			method:      http.MethodPost,
+			path:        "/v2/company-123/productinvoices",
+			contentType: "application/json",
+		},
+		{
+			name:   "GetInvoice",
+			call:   func() error { _, err := repo.GetInvoice(context.Background(), testCompanyKey, "nfe-1"); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/nfe-1",
+		},
+		{
+			name: "GetInvoiceByAccessKey",
+			call: func() error {
+				_, err := repo.GetInvoiceByAccessKey(context.Background(), "35240112345678000190550010000001231000001230")
+				return err
+			},
+			method: http.MethodGet,
+			path:   "/consult/v2/productinvoices/35240112345678000190550010000001231000001230",
+		},
+		{
+			name: "DeleteInvoice",
+			call: func() error {
+				return repo.DeleteInvoice(context.Background(), testCompanyKey, "nfe-1", "Pedido cancelado pelo cliente")
+			},
+			method:      http.MethodDelete,
+			path:        "/v2/company-123/productinvoices/nfe-1",
+			contentType: "application/json",
+			query:       map[string][]string{"reason": {"Pedido cancelado pelo cliente"}},
+		},
+		{
+			name:   "GetInvoicePDF",
+			call:   func() error { _, err := repo.GetInvoicePDF(context.Background(), testCompanyKey, "nfe-1"); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/nfe-1/pdf",
+		},
+		{
+			name:   "GetInvoiceXML",
+			call:   func() error { _, err := repo.GetInvoiceXML(context.Background(), testCompanyKey, "nfe-1"); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/nfe-1/xml",
+		},
+		{
+			name: "CreateCorrectionLetter",
+			call: func() error {
+				_, err := repo.CreateCorrectionLetter(context.Background(), testCompanyKey, "nfe-1", "Correção do endereço do destinatário")
+				return err
+			},
+			method:      http.MethodPut,
+			path:        "/v2/company-123/productinvoices/nfe-1/correctionletter",
+			contentType: "application/json",
+		},
+		{
+			name: "GetCorrectionLetterPDF",
+			call: func() error {
+				_, err := repo.GetCorrectionLetterPDF(context.Background(), testCompanyKey, "nfe-1")
+				return err
+			},
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/nfe-1/correctionletter/pdf",
+		},
+		{
+			name: "GetCorrectionLetterXML",
+			call: func() error {
+				_, err := repo.GetCorrectionLetterXML(context.Background(), testCompanyKey, "nfe-1")
+				return err
+			},
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/nfe-1/correctionletter/xml",
+		},
+		{
+			name:   "GetCompany",
+			call:   func() error { _, err := repo.GetCompany(context.Background(), testCompanyKey); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123",
+		},
+		{
+			name:   "GetStateTaxes",
+			call:   func() error { _, err := repo.GetStateTaxes(context.Background(), testCompanyKey); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123/statetaxes",
+		},
+		{
+			name: "DisableNumberRange",
+			call: func() error {
+				_, err := repo.DisableNumberRange(context.Background(), testCompanyKey, &models.DisablementRequest{Serie: 1, BeginNumber: 3, LastNumber: 4, Reason: "Falha no sistema emissor"})
+				return err
+			},
+			method:      http.MethodPost,
+			path:        "/v2/company-123/productinvoices/disablement",
+			contentType: "application/json",
+		},
+		{
+			name:   "GetDisablement",
+			call:   func() error { _, err := repo.GetDisablement(context.Background(), testCompanyKey, "dis-1"); return err },
+			method: http.MethodGet,
+			path:   "/v2/company-123/productinvoices/disablement/dis-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := fake.last(t)
+			if req.Method != tt.method {
+				t.Errorf("expected method %s, got %s", tt.method, req.Method)
+			}
+			if req.Path != tt.path {
+				t.Errorf("expected path %s, got %s", tt.path, req.Path)
+			}
+			if got := req.Header.Get("Authorization"); got != testAPIKey {
+				t.Errorf("expected API key in Authorization header, got %q", got)
+			}
+			if strings.Contains(req.URL, testAPIKey) {
+				t.Errorf("API key leaked in request URL %s", req.URL)
+			}
+			if len(req.Query) != len(tt.query) || (len(tt.query) > 0 && !reflect.DeepEqual(req.Query, tt.query)) {
+				t.Errorf("expected query parameters %v, got %v", tt.query, req.Query)
+			}
+			if got := req.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("expected Content-Type %q, got %q", tt.contentType, got)
+			}
+		})
+	}
+}
+
+func TestNFeRepoCreateProductInvoiceSendsPayload(t *testing.T) {
+	fake := newFakeNFeIO(t)
+	repo := NewNFeRepo(fake.server.URL, fake.server.URL, testAPIKey, 0, nil)
+
+	response, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{OperationNature: "Venda", Serie: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.ID != "nfe-1" {
+		t.Errorf("expected response ID nfe-1, got %s", response.ID)
+	}
+
+	var sent models.ProductInvoiceRequest
+	if err := json.Unmarshal(fake.last(t).Body, &sent); err != nil {
+		t.Fatalf("failed to decode sent payload: %v", err)
+	}
+	if sent.OperationNature != "Venda" || sent.Serie != 2 {
+		t.Errorf("unexpected payload sent: %+v", sent)
+	}
+}
+
+func TestNFeRepoReturnsAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"invalid buyer"}`))
+	}))
+	defer server.Close()
+
+	repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 0, nil)
+	_, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{})
+	if err == nil {
+		t.Fatal("expected error for status 400")
+	}
+	if !strings.Contains(err.Error(), "status 400") || !strings.Contains(err.Error(), "invalid buyer") {
+		t.Errorf("expected status and body in error, got %v", err)
+	}
+}
+
+func TestNFeRepoRecordsMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"InvalidBuyer","message":"invalid buyer"}`))
+	}))
+	defer server.Close()
+
+	before := testutil.ToFloat64(metrics.UpstreamErrors.WithLabelValues("nfeio", "InvalidBuyer"))
+
+	repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 0, nil)
+	if _, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{}); err == nil {
+		t.Fatal("expected error for status 400")
+	}
+
+	if got := testutil.ToFloat64(metrics.UpstreamErrors.WithLabelValues("nfeio", "InvalidBuyer")); got != before+1 {
+		t.Errorf("expected the error code to be counted once, got %v", got-before)
+	}
+	// The call is timed under its operation and status code
+	if testutil.CollectAndCount(metrics.UpstreamRequests) == 0 {
+		t.Error("expected the call duration to be recorded")
+	}
+}
+
+func TestNFeRepoRedactsAPIKeyFromErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Misbehaving upstream echoing the credentials back
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"invalid key ` + r.Header.Get("Authorization") + `"}`))
+	}))
+	defer server.Close()
+
+	repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 0, nil)
+	_, err := repo.GetInvoice(context.Background(), testCompanyKey, "nfe-1")
+	if err == nil {
+		t.Fatal("expected error for status 401")
+	}
+	if strings.Contains(err.Error(), testAPIKey) {
+		t.Errorf("API key leaked in error: %v", err)
+	}
+	if !strings.Contains(err.Error(), redactedPlaceholder) {
+		t.Errorf("expected redacted placeholder in error, got %v", err)
+	}
+}
+
+func TestNFeRepoRedactsAPIKeyFromTransportErrors(t *testing.T) {
+	// Unreachable endpoint whose URL happens to contain the key
+	repo := NewNFeRepo("http://127.0.0.1:0/"+testAPIKey, "http://127.0.0.1:0", testAPIKey, 0, nil)
+	_, err := repo.GetInvoice(context.Background(), testCompanyKey, "nfe-1")
+	if err == nil {
+		t.Fatal("expected transport error")
+	}
+	if strings.Contains(err.Error(), testAPIKey) {
+		t.Errorf("API key leaked in error: %v", err)
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("expected the transport error to stay unwrappable, got %T", err)
+	}
+}
+
+func TestNFeRepoTimesOutHungCalls(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 50*time.Millisecond, nil)
+
+	start := time.Now()
+	_, err := repo.GetInvoice(context.Background(), testCompanyKey, "nfe-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("call took %s, expected it to stop at the timeout", elapsed)
+	}
+}
+
+func TestNFeRepoStopsOnCanceledContext(t *testing.T) {
+	fake := newFakeNFeIO(t)
+	repo := NewNFeRepo(fake.server.URL, fake.server.URL, testAPIKey, 0, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := repo.CreateProductInvoice(ctx, testCompanyKey, &models.ProductInvoiceRequest{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	if len(fake.requests) != 0 {
+		t.Errorf("expected no request to reach NFe.io, got %d", len(fake.requests))
+	}
+}
+
+func TestNFeRepoDoesNotRetryCreates(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := NewHTTPClient(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, nil)
+	repo := NewNFeRepo(server.URL, server.URL, testAPIKey, 0, client)
+
+	if _, err := repo.CreateProductInvoice(context.Background(), testCompanyKey, &models.ProductInvoiceRequest{Serie: 1, Number: 42}); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := repo.CreateCorrectionLetter(context.Background(), testCompanyKey, "nfe-1", "Correção do endereço do destinatário"); err == nil {
+		t.Fatal("expected error")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected the create and the correction letter sent once each, got %d calls", calls.Load())
+	}
+
+	// Lookups are retried
+	calls.Store(0)
+	repo.GetInvoice(context.Background(), testCompanyKey, "nfe-1")
+	if calls.Load() != 3 {
+		t.Errorf("expected the lookup retried, got %d calls", calls.Load())
+	}
+}
+
+func TestNFeRepoListInvoicesPages(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		if r.URL.Path != "/v2/company-123/productinvoices" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"productInvoices":[{"id":"nfe-2","flowStatus":"Issued","totals":{"icms":{"invoiceAmount":150.5}}}],"hasMore":true}`))
+	}))
+	defer server.Close()
+
+	repo := NewNFeRepo(server.URL+"/v2", server.URL, testAPIKey, 0, nil)
+	page, err := repo.ListInvoices(context.Background(), testCompanyKey, NFeListOptions{StartingAfter: "nfe-3", Limit: 50})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !page.HasMore || len(page.ProductInvoices) != 1 || page.ProductInvoices[0].Totals.Icms.InvoiceAmount != 150.5 {
+		t.Errorf("unexpected page %+v", page)
+	}
+	if query.Get("startingAfter") != "nfe-3" || query.Get("limit") != "50" || query.Has("environment") {
+		t.Errorf("unexpected query %v", query)
+	}
+}
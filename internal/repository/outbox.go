@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+// OutboxRepository keeps the Frappe write-backs waiting for delivery in the
+// embedded store
+type OutboxRepository interface {
+	Enqueue(msg *models.OutboxMessage) error
+	Update(msg *models.OutboxMessage) error
+	Get(id uint64) (*models.OutboxMessage, error)
+	ListPending() ([]models.OutboxMessage, error)
+	List(status string) ([]models.OutboxMessage, error)
+}
+
+type outboxRepo struct {
+	store *Store
+	now   func() time.Time
+}
+
+// NewOutboxRepo returns the outbox kept in the embedded store
+func NewOutboxRepo(store *Store) OutboxRepository {
+	return &outboxRepo{store: store, now: time.Now}
+}
+
+// Enqueue stores a new pending message, assigning its ID
+func (r *outboxRepo) Enqueue(msg *models.OutboxMessage) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		return enqueueOutbox(tx, msg, r.now())
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue write-back: %w", err)
+	}
+	return nil
+}
+
+// Update saves the delivery state of a message
+func (r *outboxRepo) Update(msg *models.OutboxMessage) error {
+	err := r.store.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(outboxBucket).Get(itob(msg.ID)) == nil {
+			return fmt.Errorf("outbox message %d: %w", msg.ID, ErrNotFound)
+		}
+		msg.UpdatedAt = r.now().UTC()
+		return putOutbox(tx, msg)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update write-back: %w", err)
+	}
+	return nil
+}
+
+func (r *outboxRepo) Get(id uint64) (*models.OutboxMessage, error) {
+	var msg models.OutboxMessage
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(outboxBucket).Get(itob(id))
+		if raw == nil {
+			return fmt.Errorf("outbox message %d: %w", id, ErrNotFound)
+		}
+		return json.Unmarshal(raw, &msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ListPending returns the messages waiting for delivery in enqueue order
+func (r *outboxRepo) ListPending() ([]models.OutboxMessage, error) {
+	var messages []models.OutboxMessage
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxBucket)
+		return tx.Bucket(outboxPendingBucket).ForEach(func(k, _ []byte) error {
+			var msg models.OutboxMessage
+			if err := json.Unmarshal(outbox.Get(k), &msg); err != nil {
+				return fmt.Errorf("failed to decode write-back: %w", err)
+			}
+			messages = append(messages, msg)
+			return nil
+		})
+	})
+	return messages, err
+}
+
+// List returns the messages with the given status (every message when empty)
+// in enqueue order
+func (r *outboxRepo) List(status string) ([]models.OutboxMessage, error) {
+	var messages []models.OutboxMessage
+	err := r.store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+			var msg models.OutboxMessage
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return fmt.Errorf("failed to decode write-back: %w", err)
+			}
+			if status == "" || msg.Status == status {
+				messages = append(messages, msg)
+			}
+			return nil
+		})
+	})
+	return messages, err
+}
+
+// enqueueOutbox adds a pending message within tx, so it can be committed
+// together with the state change that produced it
+func enqueueOutbox(tx *bolt.Tx, msg *models.OutboxMessage, now time.Time) error {
+	id, err := tx.Bucket(outboxBucket).NextSequence()
+	if err != nil {
+		return err
+	}
+	msg.ID = id
+	msg.Status = models.OutboxStatusPending
+	msg.CreatedAt = now.UTC()
+	msg.UpdatedAt = msg.CreatedAt
+	if msg.NextAttemptAt.IsZero() {
+		msg.NextAttemptAt = msg.CreatedAt
+	}
+	return putOutbox(tx, msg)
+}
+
+// putOutbox writes the message and keeps it in the pending index while it
+// waits for delivery
+func putOutbox(tx *bolt.Tx, msg *models.OutboxMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := itob(msg.ID)
+	if err := tx.Bucket(outboxBucket).Put(key, raw); err != nil {
+		return err
+	}
+	if msg.Status == models.OutboxStatusPending {
+		return tx.Bucket(outboxPendingBucket).Put(key, nil)
+	}
+	return tx.Bucket(outboxPendingBucket).Delete(key)
+}
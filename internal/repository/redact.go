@@ -0,0 +1,40 @@
+package repository
+
+import "strings"
+
+// redactedPlaceholder replaces secrets in error messages
+const redactedPlaceholder = "[REDACTED]"
+
+// redactSecrets replaces every occurrence of the given secrets in s
+func redactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s = strings.ReplaceAll(s, secret, redactedPlaceholder)
+	}
+	return s
+}
+
+// redactedError hides secrets from the message of the wrapped error while
+// keeping it available to errors.Is / errors.As
+type redactedError struct {
+	err     error
+	secrets []string
+}
+
+func (e *redactedError) Error() string {
+	return redactSecrets(e.err.Error(), e.secrets...)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError wraps err so its message never exposes the given secrets
+func redactError(err error, secrets ...string) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err, secrets: secrets}
+}
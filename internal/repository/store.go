@@ -0,0 +1,170 @@
+package repository
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+// ErrNotFound is returned when a record does not exist in the local store
+var ErrNotFound = errors.New("not found")
+
+// Buckets of the local store
+var (
+	metaBucket               = []byte("meta")
+	ledgerBucket             = []byte("ledger")
+	issuancesBucket          = []byte("issuances")
+	issuancesByNFeBucket     = []byte("issuances_by_nfe")
+	issuancesByInvoiceBucket = []byte("issuances_by_invoice")
+	outboxBucket             = []byte("outbox")
+	outboxPendingBucket      = []byte("outbox_pending")
+	deadLettersBucket        = []byte("dead_letters")
+)
+
+var schemaVersionKey = []byte("schema_version")
+
+// migration upgrades the store by one schema version
+type migration func(tx *bolt.Tx) error
+
+// migrations are applied in order; the store remembers the last one applied.
+// Append new migrations, never change the existing ones
+var migrations = []migration{
+	// 1: numbering ledger and issuance attempts with their indexes
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{ledgerBucket, issuancesBucket, issuancesByNFeBucket, issuancesByInvoiceBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: outbox of Frappe write-backs and its pending index
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{outboxBucket, outboxPendingBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 3: dead-letter index of the failed and rejected attempts, including the
+	// ones recorded before it existed
+	func(tx *bolt.Tx) error {
+		deadLetters, err := tx.CreateBucketIfNotExists(deadLettersBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(issuancesBucket).ForEach(func(k, v []byte) error {
+			var issuance models.Issuance
+			if err := json.Unmarshal(v, &issuance); err != nil {
+				return err
+			}
+			if !issuance.IsDeadLetter() {
+				return nil
+			}
+			return deadLetters.Put(k, nil)
+		})
+	},
+}
+
+// Store is the embedded database (BoltDB) of the bridge: the numbering ledger,
+// the issuance attempts (and their dead-letter index) and the outbox live here
+// so they survive restarts
+type Store struct {
+	db *bolt.DB
+}
+
+// OpenStore opens (or creates) the database at path and applies pending migrations
+func OpenStore(path string) (*Store, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	s := &Store{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// SchemaVersion returns the number of migrations applied
+func (s *Store) SchemaVersion() (int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+// migrate applies the pending migrations in a single transaction
+func (s *Store) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return fmt.Errorf("failed to migrate store: %w", err)
+		}
+
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("store schema version %d is newer than this build (%d)", version, len(migrations))
+		}
+
+		for i := version; i < len(migrations); i++ {
+			if err := migrations[i](tx); err != nil {
+				return fmt.Errorf("failed to apply store migration %d: %w", i+1, err)
+			}
+		}
+		return meta.Put(schemaVersionKey, []byte(strconv.Itoa(len(migrations))))
+	})
+}
+
+// schemaVersion reads the last migration applied (0 for a new store)
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return 0, nil
+	}
+	raw := meta.Get(schemaVersionKey)
+	if raw == nil {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid store schema version %q", raw)
+	}
+	return version, nil
+}
+
+// itob encodes a sequence as a sortable key
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
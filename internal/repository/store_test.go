@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func openTestStore(t *testing.T) (*Store, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store, path
+}
+
+func TestStoreMigratesOnce(t *testing.T) {
+	store, path := openTestStore(t)
+	version, err := store.SchemaVersion()
+	if err != nil || version != len(migrations) {
+		t.Fatalf("expected schema version %d, got %d (%v)", len(migrations), version, err)
+	}
+
+	ledger := NewStoreLedgerRepo(store)
+	if _, err := ledger.ReserveNextNumber("company-1", 1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	store.Close()
+
+	// Reopening keeps the data and the version
+	reopened, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer reopened.Close()
+	if last, _ := NewStoreLedgerRepo(reopened).LastNumber("company-1", 1); last != 1 {
+		t.Errorf("expected last number 1 after reopening, got %d", last)
+	}
+}
+
+func TestStoreLedger(t *testing.T) {
+	store, _ := openTestStore(t)
+	ledger := NewStoreLedgerRepo(store)
+
+	for i := 1; i <= 3; i++ {
+		n, err := ledger.ReserveNextNumber("company-1", 1)
+		if err != nil || n != i {
+			t.Fatalf("expected number %d, got %d (%v)", i, n, err)
+		}
+	}
+	ledger.RecordNumber("company-1", 1, 3)
+	ledger.RecordNumber("company-1", 1, 1)
+	ledger.RecordDisabledRange("company-1", 1, 5, 6)
+	ledger.RecordNumber("company-1", 2, 10)
+	ledger.RecordNumber("company-10", 7, 1)
+
+	issued, _ := ledger.IssuedNumbers("company-1", 1)
+	disabled, _ := ledger.DisabledNumbers("company-1", 1)
+	last, _ := ledger.LastNumber("company-1", 1)
+	if first, _ := ledger.FirstReservedNumber("company-1", 1); first != 1 {
+		t.Errorf("expected first reserved number 1, got %d", first)
+	}
+	if first, _ := ledger.FirstReservedNumber("company-1", 2); first != 0 {
+		t.Errorf("expected no reserved number in a serie numbered by NFe.io, got %d", first)
+	}
+	if len(issued) != 2 || issued[0] != 1 || issued[1] != 3 {
+		t.Errorf("unexpected issued numbers %v", issued)
+	}
+	if len(disabled) != 2 || disabled[0] != 5 || disabled[1] != 6 || last != 6 {
+		t.Errorf("unexpected disabled numbers %v (last %d)", disabled, last)
+	}
+
+	series, _ := ledger.Series("company-1")
+	if len(series) != 2 || series[0] != 1 || series[1] != 2 {
+		t.Errorf("expected series [1 2] of company-1 only, got %v", series)
+	}
+}
+
+func TestIssuanceRepo(t *testing.T) {
+	store, _ := openTestStore(t)
+	repo := NewIssuanceRepo(store).(*issuanceRepo)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	repo.now = func() time.Time { return now }
+
+	first := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001", CompanyID: "company-1"}
+	if err := repo.Create(first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.ID != 1 || first.Status != models.IssuanceStatusPending || !first.CreatedAt.Equal(now) {
+		t.Errorf("unexpected created issuance %+v", first)
+	}
+
+	first.Status = models.IssuanceStatusRejected
+	first.Error = "CFOP inválido"
+	repo.Update(first)
+
+	now = now.Add(time.Hour)
+	second := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001", CompanyID: "company-1"}
+	repo.Create(second)
+	second.NFeID = "nfe-2"
+	second.Status = models.IssuanceStatusProcessing
+	repo.Update(second)
+
+	other := &models.Issuance{Kind: models.IssuanceKindReturn, CompanyID: "company-2", Status: models.IssuanceStatusProcessing}
+	repo.Create(other)
+
+	byInvoice, err := repo.ListByInvoice("INV-0001")
+	if err != nil || len(byInvoice) != 2 || byInvoice[0].ID != first.ID || byInvoice[1].ID != second.ID {
+		t.Fatalf("unexpected attempts of INV-0001: %+v (%v)", byInvoice, err)
+	}
+	if byInvoice[0].Error != "CFOP inválido" {
+		t.Errorf("expected the rejection kept, got %+v", byInvoice[0])
+	}
+
+	found, err := repo.GetByNFeID("nfe-2")
+	if err != nil || found.ID != second.ID {
+		t.Errorf("expected issuance %d by NF-e ID, got %+v (%v)", second.ID, found, err)
+	}
+	if _, err := repo.GetByNFeID("nfe-x"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := repo.Update(&models.Issuance{ID: 99}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing issuance, got %v", err)
+	}
+
+	processing, _ := repo.List(IssuanceFilter{Statuses: []string{models.IssuanceStatusProcessing}})
+	if len(processing) != 2 {
+		t.Errorf("expected 2 processing issuances, got %d", len(processing))
+	}
+	company, _ := repo.List(IssuanceFilter{CompanyID: "company-1", Since: now})
+	if len(company) != 1 || company[0].ID != second.ID {
+		t.Errorf("expected only the second attempt of company-1 since %s, got %+v", now, company)
+	}
+	limited, _ := repo.List(IssuanceFilter{Limit: 1})
+	if len(limited) != 1 || limited[0].ID != first.ID {
+		t.Errorf("expected the oldest issuance only, got %+v", limited)
+	}
+}
+
+func TestIssuanceCreateExclusive(t *testing.T) {
+	store, _ := openTestStore(t)
+	repo := NewIssuanceRepo(store)
+	blocking := []string{models.IssuanceStatusPending, models.IssuanceStatusIssued}
+
+	// Concurrent attempts of the same invoice: only one is stored
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			blocker, err := repo.CreateExclusive(&models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001"}, blocking...)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if blocker == nil {
+				created.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if created.Load() != 1 {
+		t.Fatalf("expected a single attempt created, got %d", created.Load())
+	}
+
+	// Once it no longer blocks, a new attempt is stored
+	attempts, _ := repo.ListByInvoice("INV-0001")
+	attempts[0].Status = models.IssuanceStatusRejected
+	repo.Update(&attempts[0])
+	if blocker, err := repo.CreateExclusive(&models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001"}, blocking...); blocker != nil || err != nil {
+		t.Errorf("expected the rejected attempt not to block, got %+v (%v)", blocker, err)
+	}
+}
+
+func TestIssuanceUpdateWithOutbox(t *testing.T) {
+	store, _ := openTestStore(t)
+	issuances := NewIssuanceRepo(store)
+	outbox := NewOutboxRepo(store)
+
+	issuance := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001"}
+	issuances.Create(issuance)
+	issuance.NFeID = "nfe-1"
+	issuance.Status = models.IssuanceStatusProcessing
+	msg := &models.OutboxMessage{InvoiceName: "INV-0001", Data: map[string]interface{}{"invoice_id": "nfe-1"}}
+	if err := issuances.UpdateWithOutbox(issuance, msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pending, err := outbox.ListPending()
+	if err != nil || len(pending) != 1 || pending[0].ID != msg.ID || pending[0].Data["invoice_id"] != "nfe-1" {
+		t.Fatalf("expected the write-back pending, got %+v (%v)", pending, err)
+	}
+	if found, _ := issuances.GetByNFeID("nfe-1"); found == nil || found.ID != issuance.ID {
+		t.Errorf("expected the issuance saved with its write-back, got %+v", found)
+	}
+
+	// Delivered messages leave the pending index but are kept
+	msg.Status = models.OutboxStatusDelivered
+	outbox.Update(msg)
+	if pending, _ := outbox.ListPending(); len(pending) != 0 {
+		t.Errorf("expected no pending write-back, got %+v", pending)
+	}
+	if delivered, _ := outbox.List(models.OutboxStatusDelivered); len(delivered) != 1 {
+		t.Errorf("expected 1 delivered write-back, got %+v", delivered)
+	}
+
+	// Nothing is enqueued when the issuance cannot be saved
+	orphan := &models.OutboxMessage{InvoiceName: "INV-0002"}
+	if err := issuances.UpdateWithOutbox(&models.Issuance{ID: 99}, orphan); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if all, _ := outbox.List(""); len(all) != 1 {
+		t.Errorf("expected the write-back of a missing issuance discarded, got %+v", all)
+	}
+}
+
+func TestIssuanceDeadLetters(t *testing.T) {
+	store, _ := openTestStore(t)
+	repo := NewIssuanceRepo(store)
+
+	failed := &models.Issuance{Kind: models.IssuanceKindReturn}
+	rejected := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001"}
+	issued := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0002"}
+	for _, issuance := range []*models.Issuance{failed, rejected, issued} {
+		repo.Create(issuance)
+	}
+	failed.Status = models.IssuanceStatusFailed
+	repo.Update(failed)
+	rejected.Status = models.IssuanceStatusRejected
+	repo.Update(rejected)
+	issued.Status = models.IssuanceStatusIssued
+	repo.Update(issued)
+
+	letters, err := repo.ListDeadLetters()
+	if err != nil || len(letters) != 2 || letters[0].ID != failed.ID || letters[1].ID != rejected.ID {
+		t.Fatalf("expected the failed and rejected attempts, got %+v (%v)", letters, err)
+	}
+
+	// Resolved letters leave the queue but are kept
+	failed.Resolution = models.IssuanceResolutionDiscarded
+	repo.Update(failed)
+	if letters, _ := repo.ListDeadLetters(); len(letters) != 1 || letters[0].ID != rejected.ID {
+		t.Errorf("expected only the rejected attempt left, got %+v", letters)
+	}
+	if found, err := repo.Get(failed.ID); err != nil || found.Resolution != models.IssuanceResolutionDiscarded {
+		t.Errorf("expected the discarded attempt kept, got %+v (%v)", found, err)
+	}
+}
@@ -0,0 +1,325 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+)
+
+// noRetryKey marks, in the request context, a call sent at most once
+type noRetryKey struct{}
+
+// withoutRetry marks a call that creates something upstream (an NF-e, a
+// correction letter): NFe.io does not promise to deduplicate them, so a retry
+// after a timeout or 5xx could create it twice
+func withoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+// ErrCircuitOpen is returned without calling the upstream while its breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// RetryPolicy controls the retries of outbound calls
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts, including the first one
+	BaseDelay   time.Duration // Backoff before the second attempt, doubled on each retry
+	MaxDelay    time.Duration // Upper bound of the backoff (Retry-After included)
+}
+
+// DefaultRetryPolicy is used when no policy is configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+}
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker stops calling an upstream after consecutive failures and lets
+// a single probe through once the cooldown has passed
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// BreakerStatus is a point-in-time view of a circuit breaker
+type BreakerStatus struct {
+	Name                string    `json:"name"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+}
+
+// NewCircuitBreaker opens after threshold consecutive failures and stays open for cooldown
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &CircuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     BreakerClosed,
+		now:       time.Now,
+	}
+}
+
+// Name returns the upstream guarded by the breaker
+func (b *CircuitBreaker) Name() string {
+	return b.name
+}
+
+// Allow reports whether a call may be made now
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		// Only one probe at a time
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Success closes the breaker
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure counts a failed call, opening the breaker at the threshold or when
+// the half-open probe fails
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Release ends a call that says nothing about the upstream (canceled by the
+// caller) without counting it, letting the next half-open probe through
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Status returns the current state of the breaker
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{
+		Name:                b.name,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+	}
+	if b.state != BreakerClosed {
+		status.OpenedAt = b.openedAt
+	}
+	return status
+}
+
+// NewHTTPClient returns the shared client for an upstream: retries with
+// jittered exponential backoff and a circuit breaker around every call
+func NewHTTPClient(policy RetryPolicy, breaker *CircuitBreaker) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			base:    http.DefaultTransport,
+			policy:  policy,
+			breaker: breaker,
+			sleep:   sleepContext,
+		},
+	}
+}
+
+// retryTransport retries idempotent requests on 429, 5xx and network errors
+type retryTransport struct {
+	base    http.RoundTripper
+	policy  RetryPolicy
+	breaker *CircuitBreaker
+	sleep   func(req *http.Request, d time.Duration) error
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := t.policy.MaxAttempts
+	if attempts < 1 || !isRetryable(req) {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		if t.breaker != nil && !t.breaker.Allow() {
+			return nil, fmt.Errorf("%s: %w", t.breaker.Name(), ErrCircuitOpen)
+		}
+
+		// RoundTrip must not modify the caller's request: retries send a clone
+		// with a fresh body
+		attemptReq := req
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(attemptReq)
+		t.record(req, resp, err)
+
+		if attempt >= attempts || !shouldRetry(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		if t.breaker != nil {
+			metrics.UpstreamRetries.WithLabelValues(t.breaker.Name()).Inc()
+		}
+		delay := t.backoff(attempt, resp)
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := t.sleep(req, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// record feeds the breaker: network errors and 5xx are upstream failures,
+// anything else (429 and 4xx included) means the upstream is answering. A call
+// canceled by the caller (client gone, shutdown) is not counted
+func (t *retryTransport) record(req *http.Request, resp *http.Response, err error) {
+	if t.breaker == nil {
+		return
+	}
+	if err != nil && (errors.Is(err, context.Canceled) || errors.Is(req.Context().Err(), context.Canceled)) {
+		t.breaker.Release()
+		return
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		t.breaker.Failure()
+		return
+	}
+	t.breaker.Success()
+}
+
+// backoff returns Retry-After when the upstream sent it, or a full jitter
+// exponential delay, both capped by MaxDelay
+func (t *retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return min(d, t.policy.MaxDelay)
+		}
+	}
+
+	return t.policy.Backoff(attempt)
+}
+
+// Backoff returns a full jitter exponential delay before the retry that
+// follows the given attempt (1-based), capped by MaxDelay
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay << (attempt - 1)
+	if ceiling <= 0 || ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(ceiling))) + 1
+}
+
+// isRetryable reports whether the request may be sent more than once: GET,
+// HEAD, PUT and DELETE are idempotent unless marked withoutRetry; POST is
+// never retried
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	if req.Context().Value(noRetryKey{}) != nil {
+		return false
+	}
+	return req.Body == nil || req.GetBody != nil
+}
+
+// shouldRetry reports whether the outcome is transient
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// parseRetryAfter reads Retry-After as seconds or an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// sleepContext waits for d unless the request is canceled first
+func sleepContext(req *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
@@ -0,0 +1,238 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTransportClient returns a client whose retries do not sleep and
+// records the requested delays
+func newTestTransportClient(policy RetryPolicy, breaker *CircuitBreaker, delays *[]time.Duration) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			base:    http.DefaultTransport,
+			policy:  policy,
+			breaker: breaker,
+			sleep: func(req *http.Request, d time.Duration) error {
+				*delays = append(*delays, d)
+				return nil
+			},
+		},
+	}
+}
+
+// flakyServer fails the first n calls with status, then answers 200 echoing the body
+func flakyServer(t *testing.T, n int32, status int, header http.Header) (*httptest.Server, *int32) {
+	t.Helper()
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) <= n {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestRetryTransportRetriesGetOn5xx(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusBadGateway, nil)
+	var delays []time.Duration
+	client := newTestTransportClient(DefaultRetryPolicy, nil, &delays)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || *calls != 3 {
+		t.Errorf("expected success on the 3rd attempt, got status %d after %d calls", resp.StatusCode, *calls)
+	}
+	for i, d := range delays {
+		if d <= 0 || d > DefaultRetryPolicy.BaseDelay<<i {
+			t.Errorf("delay %d out of the jitter window: %s", i, d)
+		}
+	}
+}
+
+func TestRetryTransportHonoursRetryAfter(t *testing.T) {
+	server, _ := flakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"2"}})
+	var delays []time.Duration
+	client := newTestTransportClient(DefaultRetryPolicy, nil, &delays)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(delays) != 1 || delays[0] != 2*time.Second {
+		t.Errorf("expected a single 2s delay from Retry-After, got %v", delays)
+	}
+}
+
+func TestRetryTransportGivesUpAfterMaxAttempts(t *testing.T) {
+	server, calls := flakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	var delays []time.Duration
+	client := newTestTransportClient(DefaultRetryPolicy, nil, &delays)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable || *calls != int32(DefaultRetryPolicy.MaxAttempts) {
+		t.Errorf("expected last 503 after %d calls, got %d after %d", DefaultRetryPolicy.MaxAttempts, resp.StatusCode, *calls)
+	}
+}
+
+func TestRetryTransportOnlyRetriesIdempotentCalls(t *testing.T) {
+	var delays []time.Duration
+	client := newTestTransportClient(DefaultRetryPolicy, nil, &delays)
+
+	server, calls := flakyServer(t, 1, http.StatusBadGateway, nil)
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || *calls != 1 {
+		t.Fatalf("expected POST not to be retried, got %d calls", *calls)
+	}
+
+	// A PUT that creates something upstream is sent once
+	server, calls = flakyServer(t, 1, http.StatusBadGateway, nil)
+	req, _ := http.NewRequestWithContext(withoutRetry(context.Background()), http.MethodPut, server.URL, strings.NewReader(`{"a":1}`))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || *calls != 1 {
+		t.Fatalf("expected the PUT marked withoutRetry not to be retried, got %d calls", *calls)
+	}
+
+	server, _ = flakyServer(t, 1, http.StatusBadGateway, nil)
+	req, _ = http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"a":1}`))
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != `{"a":1}` {
+		t.Errorf("expected retried PUT to resend the body, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRetryTransportStopsWhenContextCanceled(t *testing.T) {
+	server, calls := flakyServer(t, 10, http.StatusBadGateway, nil)
+	// Long delays: the jittered backoff can never fit in the deadline
+	client := NewHTTPClient(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+
+	_, err := client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded while backing off, got %v", err)
+	}
+	if *calls != 1 {
+		t.Errorf("expected a single call before the deadline, got %d", *calls)
+	}
+}
+
+func TestCircuitBreakerOpensAndRecovers(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker("nfeio", 2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	server, calls := flakyServer(t, 2, http.StatusInternalServerError, nil)
+	var delays []time.Duration
+	client := newTestTransportClient(RetryPolicy{MaxAttempts: 1}, breaker, &delays)
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if breaker.Status().State != BreakerOpen {
+		t.Fatalf("expected breaker open after 2 failures, got %+v", breaker.Status())
+	}
+
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if *calls != 2 {
+		t.Errorf("expected no call while open, got %d calls", *calls)
+	}
+
+	// After the cooldown a probe goes through and closes the breaker
+	now = now.Add(2 * time.Minute)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if status := breaker.Status(); status.State != BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected breaker closed after a successful probe, got %+v", status)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	breaker := NewCircuitBreaker("frappe", 1, time.Minute)
+	server, _ := flakyServer(t, 5, http.StatusNotFound, nil)
+	var delays []time.Duration
+	client := newTestTransportClient(DefaultRetryPolicy, breaker, &delays)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if breaker.Status().State != BreakerClosed || len(delays) != 0 {
+		t.Errorf("expected 404 to neither retry nor open the breaker, got %+v, %d retries", breaker.Status(), len(delays))
+	}
+}
+
+func TestCircuitBreakerIgnoresCanceledCalls(t *testing.T) {
+	breaker := NewCircuitBreaker("nfeio", 1, time.Minute)
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := NewHTTPClient(RetryPolicy{MaxAttempts: 1}, breaker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the call canceled, got %v", err)
+	}
+	if status := breaker.Status(); status.State != BreakerClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("expected a canceled call not to count as a failure, got %+v", status)
+	}
+}
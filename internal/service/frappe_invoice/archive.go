@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// flowStatusIssued is the NFe.io flow status of a note authorized by SEFAZ
+const flowStatusIssued = "Issued"
+
+// Attachment file name prefixes: an invoice keeps one XML and one DANFE, the
+// ones of its current NF-e
+const (
+	xmlAttachmentPrefix = "NFe-"
+	pdfAttachmentPrefix = "DANFE-"
+)
+
+// ArchiveService stores the authorized XML and the DANFE PDF of an NF-e as
+// private attachments of its Frappe Invoices document
+type ArchiveService interface {
+	ArchiveInvoiceDocuments(ctx context.Context, invoiceName string) (*ArchivedDocuments, error)
+}
+
+// ArchivedDocuments are the Frappe file URLs of the archived documents
+type ArchivedDocuments struct {
+	AccessKey string `json:"access_key"`
+	XMLURL    string `json:"xml_url"`
+	PDFURL    string `json:"pdf_url"`
+}
+
+type archiveService struct {
+	frappeRepo repository.FrappeRepository
+	companies  *CompanyRegistry
+	outbox     *OutboxDispatcher
+}
+
+func NewArchiveService(f repository.FrappeRepository, companies *CompanyRegistry, outbox *OutboxDispatcher) ArchiveService {
+	return &archiveService{
+		frappeRepo: f,
+		companies:  companies,
+		outbox:     outbox,
+	}
+}
+
+// ArchiveInvoiceDocuments downloads the XML and DANFE of the invoice's NF-e from
+// NFe.io and attaches them to the Frappe document, replacing the files of a
+// previous issuance
+func (s *archiveService) ArchiveInvoiceDocuments(ctx context.Context, invoiceName string) (*ArchivedDocuments, error) {
+	frappeInv, err := s.frappeRepo.GetInvoice(ctx, invoiceName)
+	if err != nil {
+		return nil, err
+	}
+	if frappeInv.InvoiceID == "" {
+		return nil, fmt.Errorf("invoice %s has no NF-e", invoiceName)
+	}
+
+	company, err := s.companies.Resolve(frappeInv.Company)
+	if err != nil {
+		return nil, err
+	}
+
+	nfe, err := company.NFeRepo.GetInvoice(ctx, company.NFeCompanyID, frappeInv.InvoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NF-e %s: %w", frappeInv.InvoiceID, err)
+	}
+	if nfe.FlowStatus != flowStatusIssued {
+		return nil, fmt.Errorf("NF-e %s is not authorized yet (flow status %s)", frappeInv.InvoiceID, nfe.FlowStatus)
+	}
+
+	key := nfe.Authorization.AccessKey
+	if key == "" {
+		key = nfe.ID
+	}
+
+	xml, err := company.NFeRepo.GetInvoiceXML(ctx, company.NFeCompanyID, nfe.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download XML: %w", err)
+	}
+	pdf, err := company.NFeRepo.GetInvoicePDF(ctx, company.NFeCompanyID, nfe.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download DANFE: %w", err)
+	}
+
+	xmlFile, err := s.frappeRepo.ReplaceInvoiceAttachment(ctx, invoiceName, xmlAttachmentPrefix+key+".xml", xmlAttachmentPrefix, xml)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach XML: %w", err)
+	}
+	pdfFile, err := s.frappeRepo.ReplaceInvoiceAttachment(ctx, invoiceName, pdfAttachmentPrefix+key+".pdf", pdfAttachmentPrefix, pdf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach DANFE: %w", err)
+	}
+
+	archived := &ArchivedDocuments{
+		AccessKey: nfe.Authorization.AccessKey,
+		XMLURL:    xmlFile.FileURL,
+		PDFURL:    pdfFile.FileURL,
+	}
+
+	// Don't fail if Frappe is unavailable now - the files are attached to the
+	// document and the outbox retries the links
+	s.outbox.writeBack(ctx, invoiceName, map[string]interface{}{
+		"invoice_xml": archived.XMLURL,
+		"invoice_pdf": archived.PDFURL,
+	})
+
+	return archived, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestArchiveInvoiceDocumentsReplacesPreviousFiles(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-old": {ID: "nfe-old", FlowStatus: flowStatusIssued, Authorization: models.Authorization{AccessKey: testOtherAccessKey}},
+		"nfe-new": {ID: "nfe-new", FlowStatus: flowStatusIssued, Authorization: models.Authorization{AccessKey: testAccessKey}},
+	}}
+	invoice := &models.Invoices{Name: "INV-0001", InvoiceID: "nfe-old"}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": invoice}}
+	svc := NewArchiveService(frappeRepo, newTestCompanies(t, nfeRepo), newTestOutbox(t, frappeRepo))
+
+	if _, err := svc.ArchiveInvoiceDocuments(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Re-issue: the invoice now points to another NF-e
+	invoice.InvoiceID = "nfe-new"
+	archived, err := svc.ArchiveInvoiceDocuments(context.Background(), "INV-0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	files := frappeRepo.attachments["INV-0001"]
+	if len(files) != 2 {
+		t.Fatalf("expected only the current XML and DANFE attached, got %d files", len(files))
+	}
+	for _, file := range files {
+		if file.IsPrivate != 1 {
+			t.Errorf("expected %s to be private", file.FileName)
+		}
+	}
+	if archived.XMLURL != "/private/files/NFe-"+testAccessKey+".xml" || archived.PDFURL != "/private/files/DANFE-"+testAccessKey+".pdf" {
+		t.Errorf("unexpected archived files: %+v", archived)
+	}
+	if got := string(frappeRepo.contents["NFe-"+testAccessKey+".xml"]); got != "<nfeProc>nfe-new</nfeProc>" {
+		t.Errorf("unexpected XML content %q", got)
+	}
+	if frappeRepo.updates["INV-0001"]["invoice_xml"] != archived.XMLURL || frappeRepo.updates["INV-0001"]["invoice_pdf"] != archived.PDFURL {
+		t.Errorf("expected file URLs written back, got %v", frappeRepo.updates["INV-0001"])
+	}
+}
+
+func TestArchiveInvoiceDocumentsRequiresAuthorizedNote(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-1": {ID: "nfe-1", FlowStatus: "WaitingReturn"},
+	}}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{
+		"INV-0001": {Name: "INV-0001", InvoiceID: "nfe-1"},
+		"INV-0002": {Name: "INV-0002"},
+	}}
+	svc := NewArchiveService(frappeRepo, newTestCompanies(t, nfeRepo), newTestOutbox(t, frappeRepo))
+
+	if _, err := svc.ArchiveInvoiceDocuments(context.Background(), "INV-0001"); err == nil {
+		t.Error("expected error for a note still waiting for SEFAZ")
+	}
+	if _, err := svc.ArchiveInvoiceDocuments(context.Background(), "INV-0002"); err == nil {
+		t.Error("expected error for an invoice without NF-e")
+	}
+	if len(frappeRepo.attachments) != 0 {
+		t.Errorf("expected nothing attached, got %v", frappeRepo.attachments)
+	}
+}
@@ -105,6 +105,18 @@ func (b *BuilderService) DetermineOperationType(operationType string) (string, i
 	}
 }
 
+// DetermineOperationDirection infers the operation type (entrada/saída) from the
+// natureza de operação. Natures received from the buyer are incoming, everything
+// else (sales, returns, warranty shipments) is outgoing.
+func (b *BuilderService) DetermineOperationDirection(operationNature string) string {
+	switch strings.ToLower(strings.TrimSpace(operationNature)) {
+	case "remessa para conserto", "troca em garantia", "bonificação", "compra":
+		return "incoming"
+	default:
+		return "outgoing"
+	}
+}
+
 // DetermineDestination determines if operation is internal or interstate
 // Adapted from docs/invoice/build.go destination method
 func (b *BuilderService) DetermineDestination(buyerState, issuerState string) (string, error) {
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// Tax regimes of the issuing company (CRT)
+const (
+	taxRegimeSimplesNacional = "simplesNacional"
+	taxRegimeNormal          = "normal"
+)
+
+// Company is a configured company with its NFe.io repository
+type Company struct {
+	config.CompanyConfig
+	NFeRepo repository.NFeRepository
+
+	mu        sync.Mutex
+	verified  bool   // Environment confirmed at NFe.io, see verifyEnvironment
+	taxNumber string // CNPJ registered at NFe.io, see federalTaxNumber
+}
+
+// NFeRepoFactory creates the NFe.io repository for a company API key
+type NFeRepoFactory func(apiKey string) repository.NFeRepository
+
+// CompanyRegistry resolves which NFe.io company issues each Frappe invoice
+type CompanyRegistry struct {
+	byName          map[string]*Company
+	byNFeID         map[string]*Company
+	defaultCompany  string
+	siteEnvironment string // Environment of the Frappe site, see SetSiteEnvironment
+}
+
+// NewCompanyRegistry builds a registry from company configurations
+func NewCompanyRegistry(configs []config.CompanyConfig, defaultCompany string, defaultAPIKey string, factory NFeRepoFactory) (*CompanyRegistry, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no company configured")
+	}
+
+	r := &CompanyRegistry{
+		byName:         make(map[string]*Company),
+		byNFeID:        make(map[string]*Company),
+		defaultCompany: defaultCompany,
+	}
+
+	for i, cfg := range configs {
+		if cfg.NFeCompanyID == "" {
+			return nil, fmt.Errorf("company %d (%s): missing nfe_company_id", i, cfg.Name)
+		}
+		if cfg.NFeAPIKey == "" {
+			cfg.NFeAPIKey = defaultAPIKey
+		}
+		if cfg.NFeAPIKey == "" {
+			return nil, fmt.Errorf("company %s: missing nfe_api_key", cfg.Name)
+		}
+		if cfg.TaxRegime == "" {
+			cfg.TaxRegime = taxRegimeNormal
+		}
+		if cfg.TaxRegime != taxRegimeNormal && cfg.TaxRegime != taxRegimeSimplesNacional {
+			return nil, fmt.Errorf("company %s: invalid tax_regime %s", cfg.Name, cfg.TaxRegime)
+		}
+		environment, err := normalizeEnvironment(cfg.Environment)
+		if err != nil {
+			return nil, fmt.Errorf("company %s: %v", cfg.Name, err)
+		}
+		cfg.Environment = environment
+		cfg.State = strings.ToUpper(strings.TrimSpace(cfg.State))
+		if _, exists := r.byName[cfg.Name]; exists {
+			return nil, fmt.Errorf("company %s configured twice", cfg.Name)
+		}
+
+		company := &Company{
+			CompanyConfig: cfg,
+			NFeRepo:       factory(cfg.NFeAPIKey),
+		}
+		r.byName[cfg.Name] = company
+		r.byNFeID[cfg.NFeCompanyID] = company
+	}
+
+	if defaultCompany != "" {
+		if _, ok := r.byName[defaultCompany]; !ok {
+			return nil, fmt.Errorf("default company %s is not configured", defaultCompany)
+		}
+	}
+
+	return r, nil
+}
+
+// Resolve returns the company issuing invoices for a Frappe company value
+func (r *CompanyRegistry) Resolve(frappeCompany string) (*Company, error) {
+	name := strings.TrimSpace(frappeCompany)
+	if name == "" {
+		name = r.defaultCompany
+	}
+
+	company, ok := r.byName[name]
+	if !ok {
+		if name == "" {
+			return nil, fmt.Errorf("invoice has no company and no default company is configured")
+		}
+		return nil, fmt.Errorf("company %s is not configured for NF-e issuance", name)
+	}
+	return company, nil
+}
+
+// ByNFeCompanyID returns the company registered with the given NFe.io company ID
+func (r *CompanyRegistry) ByNFeCompanyID(id string) (*Company, error) {
+	company, ok := r.byNFeID[id]
+	if !ok {
+		return nil, fmt.Errorf("NFe.io company %s is not configured", id)
+	}
+	return company, nil
+}
+
+// Companies returns every configured company ordered by name
+func (r *CompanyRegistry) Companies() []*Company {
+	companies := make([]*Company, 0, len(r.byName))
+	for _, company := range r.byName {
+		companies = append(companies, company)
+	}
+	sort.Slice(companies, func(i, j int) bool { return companies[i].Name < companies[j].Name })
+	return companies
+}
+
+// SeriesRules returns the company specific series rules scoped to their
+// NFe.io company ID, ready to be added to the SeriesPolicy
+func (r *CompanyRegistry) SeriesRules() []config.SeriesRule {
+	var rules []config.SeriesRule
+	for _, company := range r.Companies() {
+		for _, rule := range company.Series {
+			rule.Company = company.NFeCompanyID
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// federalTaxNumber returns the 14-digit CNPJ the company is registered with at
+// NFe.io, looked up once. The lookup runs without the lock
+func (c *Company) federalTaxNumber(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	taxNumber := c.taxNumber
+	c.mu.Unlock()
+	if taxNumber != "" {
+		return taxNumber, nil
+	}
+
+	registration, err := c.NFeRepo.GetCompany(ctx, c.NFeCompanyID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the CNPJ of company %s at NFe.io: %w", c.NFeCompanyID, err)
+	}
+	if registration.FederalTaxNumber <= 0 {
+		return "", fmt.Errorf("company %s has no CNPJ at NFe.io", c.NFeCompanyID)
+	}
+
+	taxNumber = fmt.Sprintf("%014d", registration.FederalTaxNumber)
+	c.mu.Lock()
+	c.taxNumber = taxNumber
+	c.mu.Unlock()
+	return taxNumber, nil
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestIssuerRoutesInvoiceToCompany(t *testing.T) {
+	matriz := &fakeNFeRepo{}
+	filial := &fakeNFeRepo{}
+	repos := map[string]*fakeNFeRepo{"key-matriz": matriz, "key-filial": filial}
+
+	companies, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Matriz", NFeCompanyID: "company-sp", NFeAPIKey: "key-matriz", State: "SP"},
+		{Name: "AnyGrid Filial RJ", NFeCompanyID: "company-rj", NFeAPIKey: "key-filial", State: "RJ", TaxRegime: "simplesNacional"},
+	}, "", "", func(apiKey string) repository.NFeRepository { return repos[apiKey] })
+	if err != nil {
+		t.Fatalf("failed to build company registry: %v", err)
+	}
+	companies.SetSiteEnvironment(EnvironmentProduction)
+
+	invoice := func(name, company string) *models.Invoices {
+		return &models.Invoices{
+			Name:           name,
+			Company:        company,
+			OperationType:  "Venda",
+			ClientName:     "Cliente Teste",
+			ClientIDNumber: "123.456.789-09",
+			DeliveryState:  "RJ",
+			InvoicesTable: []models.ItemInvoice{
+				{ItemName: "Inversor", Rate: 100, Quantity: 1, NCM: "85044090", ICMSRate: "18"},
+			},
+		}
+	}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{
+		"INV-SP":  invoice("INV-SP", "AnyGrid Matriz"),
+		"INV-RJ":  invoice("INV-RJ", "AnyGrid Filial RJ"),
+		"INV-XX":  invoice("INV-XX", "AnyGrid Filial MG"),
+		"INV-NIL": invoice("INV-NIL", ""),
+	}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, companies, numbering, issuances, outbox, nil)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-SP"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-RJ"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(matriz.created) != 1 || len(filial.created) != 1 {
+		t.Fatalf("expected one invoice per company, got matriz %d filial %d", len(matriz.created), len(filial.created))
+	}
+
+	if matriz.createdFor[0] != "company-sp" || filial.createdFor[0] != "company-rj" {
+		t.Errorf("expected invoices created for company-sp and company-rj, got %s and %s", matriz.createdFor[0], filial.createdFor[0])
+	}
+
+	sp := matriz.created[0]
+	if sp.Destination != "interstate_Operation" || sp.Items[0].Cfop != 6102 {
+		t.Errorf("expected interstate sale from SP, got %s CFOP %d", sp.Destination, sp.Items[0].Cfop)
+	}
+	rj := filial.created[0]
+	if rj.Destination != "internal_Operation" || rj.Items[0].Cfop != 5102 {
+		t.Errorf("expected internal sale from RJ, got %s CFOP %d", rj.Destination, rj.Items[0].Cfop)
+	}
+	if rj.Items[0].Tax.Icms.Csosn != "102" || rj.Items[0].Tax.Icms.Amount != 0 {
+		t.Errorf("expected Simples Nacional CSOSN 102 without ICMS, got %+v", rj.Items[0].Tax.Icms)
+	}
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-XX"); err == nil {
+		t.Error("expected error for a company that is not configured")
+	}
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-NIL"); err == nil {
+		t.Error("expected error for an invoice without company and no default")
+	}
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+const purposeComplement = "complement"
+
+// ComplementService builds and issues complementary invoices (nota complementar)
+// for notes whose price or taxes were underbilled
+type ComplementService interface {
+	BuildComplementInvoice(ctx context.Context, input ComplementInput) (*models.ProductInvoiceRequest, error)
+	IssueComplementInvoice(ctx context.Context, input ComplementInput) (*models.ProductInvoiceResponse, error)
+}
+
+// ComplementInput describes the original note and the missing values per item
+type ComplementInput struct {
+	Company               string           `json:"company"`      // Frappe company issuing the complement
+	InvoiceName           string           `json:"invoice_name"` // Frappe Invoices document of the original note
+	AccessKey             string           `json:"access_key"`
+	OperationNature       string           `json:"operation_nature"`
+	AdditionalInformation string           `json:"additional_information"`
+	Items                 []ComplementItem `json:"items"`
+}
+
+// ComplementItem holds the values missing from one item of the original note,
+// selected by its line or by a product code found on a single line
+type ComplementItem struct {
+	Item  int     `json:"item"`  // Line (nItem, 1-based) of the original NF-e
+	Code  string  `json:"code"`  // Item code as issued in the original NF-e, when item is not informed
+	Price float64 `json:"price"` // Missing product value
+	ICMS  float64 `json:"icms"`  // Missing ICMS amount
+	IPI   float64 `json:"ipi"`   // Missing IPI amount
+}
+
+type complementService struct {
+	frappeRepo repository.FrappeRepository
+	companies  *CompanyRegistry
+	numbering  *NumberingService
+	timeline   timeline
+	issuances  issuanceLog
+}
+
+func NewComplementService(f repository.FrappeRepository, companies *CompanyRegistry, numbering *NumberingService, issuances repository.IssuanceRepository, outbox *OutboxDispatcher) ComplementService {
+	return &complementService{
+		frappeRepo: f,
+		companies:  companies,
+		numbering:  numbering,
+		timeline:   timeline{frappeRepo: f},
+		issuances:  issuanceLog{repo: issuances, outbox: outbox, numbering: numbering},
+	}
+}
+
+// IssueComplementInvoice sends the complementary note to NFe.io and links it
+// back to the original Frappe invoice, recording the attempt in the local
+// issuance ledger and on the invoice timeline
+func (s *complementService) IssueComplementInvoice(ctx context.Context, input ComplementInput) (*models.ProductInvoiceResponse, error) {
+	issuance, err := s.issuances.start(models.IssuanceKindComplement, input.InvoiceName, input)
+	if err != nil {
+		return nil, err
+	}
+
+	response, payload, err := s.issueComplement(ctx, input, issuance)
+	if err != nil {
+		s.issuances.finish(issuance, nil, err)
+		s.timeline.failure(ctx, input.InvoiceName, eventComplement, err)
+		return nil, withAttempt(issuance, err)
+	}
+
+	s.timeline.success(ctx, input.InvoiceName, eventComplement, describeNote(response, payload.Serie, payload.Number))
+
+	return response, nil
+}
+
+func (s *complementService) issueComplement(ctx context.Context, input ComplementInput, issuance *models.Issuance) (*models.ProductInvoiceResponse, *models.ProductInvoiceRequest, error) {
+	company, err := s.companies.Resolve(input.Company)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.companies.checkEnvironment(ctx, company); err != nil {
+		return nil, nil, err
+	}
+
+	payload, err := s.BuildComplementInvoice(ctx, input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.numbering.Assign(company.NFeCompanyID, payload); err != nil {
+		return nil, nil, err
+	}
+
+	s.issuances.sending(issuance, company, payload)
+	response, err := company.NFeRepo.CreateProductInvoice(ctx, company.NFeCompanyID, payload)
+	if err != nil {
+		return nil, nil, createError(err)
+	}
+
+	if input.InvoiceName != "" {
+		s.issuances.complete(ctx, issuance, response, complementWriteBack(response))
+	} else {
+		s.issuances.finish(issuance, response, nil)
+	}
+
+	return response, payload, nil
+}
+
+// BuildComplementInvoice fetches the original note by access key and builds a
+// complement payload carrying only the missing values, referencing the original
+func (s *complementService) BuildComplementInvoice(ctx context.Context, input ComplementInput) (*models.ProductInvoiceRequest, error) {
+	company, err := s.companies.Resolve(input.Company)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAccessKey(input.AccessKey); err != nil {
+		return nil, err
+	}
+	if len(input.Items) == 0 {
+		return nil, fmt.Errorf("complementary invoice requires at least one item")
+	}
+
+	original, err := company.NFeRepo.GetInvoiceByAccessKey(ctx, input.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get original invoice: %w", err)
+	}
+
+	items, err := s.buildComplementItems(original.Items, input.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	operationNature := input.OperationNature
+	if operationNature == "" {
+		operationNature = original.OperationNature
+	}
+
+	payload := &models.ProductInvoiceRequest{
+		OperationNature: operationNature,
+		OperationType:   original.OperationType,
+		ConsumerType:    original.ConsumerType,
+		PurposeType:     purposeComplement,
+		Destination:     original.Destination,
+		Buyer:           original.Buyer,
+		Items:           items,
+		Payment: []models.Payment{
+			{
+				PaymentDetail: []models.PaymentDetail{
+					{Method: "withoutPayment", Amount: 0},
+				},
+			},
+		},
+		Transport: models.Transport{FreightModality: "noShipping"},
+		AdditionalInformation: &models.AdditionalInformation{
+			Taxpayer: input.AdditionalInformation,
+			TaxDocumentsReference: buildTaxDocumentsReference([]documentReference{
+				{AccessKey: input.AccessKey},
+			}),
+		},
+	}
+
+	if payload.ConsumerType == "" {
+		payload.ConsumerType = "normal"
+	}
+	company.applyEnvironment(payload)
+
+	payload.Serie, err = s.numbering.ResolveSerie(company.NFeCompanyID, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// buildComplementItems copies the identification of the original items and
+// fills only the complemented price and tax amounts (quantity is zero)
+func (s *complementService) buildComplementItems(originalItems []models.Items, complements []ComplementItem) ([]models.Items, error) {
+	var items []models.Items
+	for _, complement := range complements {
+		line, err := complementLine(originalItems, complement)
+		if err != nil {
+			return nil, err
+		}
+		original := originalItems[line-1]
+		if complement.Price < 0 || complement.ICMS < 0 || complement.IPI < 0 {
+			return nil, fmt.Errorf("complement values for item %d must not be negative", line)
+		}
+		if complement.Price == 0 && complement.ICMS == 0 && complement.IPI == 0 {
+			return nil, fmt.Errorf("no complement value informed for item %d", line)
+		}
+
+		tax := models.Tax{
+			Icms: models.Icms{
+				Origin:             original.Tax.Icms.Origin,
+				Cst:                original.Tax.Icms.Cst,
+				BaseTaxModality:    original.Tax.Icms.BaseTaxModality,
+				BaseTaxSTReduction: "0",
+				Rate:               original.Tax.Icms.Rate,
+				Amount:             roundAmount(complement.ICMS),
+			},
+			Pis:    models.Pis{Cst: original.Tax.Pis.Cst},
+			Cofins: models.Cofins{Cst: original.Tax.Cofins.Cst},
+			Ipi: models.Ipi{
+				Cst:    original.Tax.Ipi.Cst,
+				Rate:   original.Tax.Ipi.Rate,
+				Amount: roundAmount(complement.IPI),
+			},
+		}
+		if complement.ICMS > 0 && original.Tax.Icms.Rate > 0 {
+			tax.Icms.BaseTax = roundAmount(complement.ICMS / (original.Tax.Icms.Rate / 100))
+		}
+		tax.TotalTax = roundAmount(tax.Icms.Amount + tax.Ipi.Amount)
+
+		items = append(items, models.Items{
+			Code:        strconv.Itoa(len(items) + 1),
+			CodeGTIN:    original.CodeGTIN,
+			CodeTaxGTIN: original.CodeTaxGTIN,
+			Description: original.Description,
+			Ncm:         original.Ncm,
+			Cfop:        original.Cfop,
+			Unit:        original.Unit,
+			Quantity:    0,
+			UnitAmount:  0,
+			TotalAmount: roundAmount(complement.Price),
+			Tax:         tax,
+		})
+	}
+
+	return items, nil
+}
+
+// complementLine resolves the line (nItem) of the original note a complement
+// refers to. A code repeated on several lines is ambiguous: the line must be
+// informed
+func complementLine(originalItems []models.Items, complement ComplementItem) (int, error) {
+	if complement.Item != 0 {
+		if complement.Item < 1 || complement.Item > len(originalItems) {
+			return 0, fmt.Errorf("item %d not found in original invoice", complement.Item)
+		}
+		return complement.Item, nil
+	}
+
+	line := 0
+	for i, item := range originalItems {
+		if item.Code != complement.Code {
+			continue
+		}
+		if line != 0 {
+			return 0, fmt.Errorf("item code %s is on lines %d and %d of the original invoice, inform the item", complement.Code, line, i+1)
+		}
+		line = i + 1
+	}
+	if line == 0 {
+		return 0, fmt.Errorf("item %s not found in original invoice", complement.Code)
+	}
+	return line, nil
+}
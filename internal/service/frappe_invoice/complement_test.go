@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestIssueComplementInvoice(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byAccessKey: map[string]*models.ProductInvoiceResponse{
+		testAccessKey: {
+			OperationType:   "outgoing",
+			OperationNature: "Venda",
+			Destination:     "internal_Operation",
+			Items: []models.Items{
+				{
+					Code:        "1",
+					Description: "Inversor",
+					Cfop:        5102,
+					Quantity:    2,
+					Tax:         models.Tax{Icms: models.Icms{Cst: "00", Rate: 18}},
+				},
+			},
+		},
+	}}
+	frappeRepo := &fakeFrappeRepo{}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewComplementService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox)
+
+	resp, err := svc.IssueComplementInvoice(context.Background(), ComplementInput{
+		InvoiceName: "INV-0001",
+		AccessKey:   testAccessKey,
+		Items:       []ComplementItem{{Code: "1", Price: 50, ICMS: 9}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	payload := nfeRepo.created[0]
+	if payload.PurposeType != "complement" || payload.OperationType != "outgoing" {
+		t.Errorf("unexpected purpose/operation: %s/%s", payload.PurposeType, payload.OperationType)
+	}
+
+	item := payload.Items[0]
+	if item.Quantity != 0 || item.TotalAmount != 50 || item.Cfop != 5102 {
+		t.Errorf("unexpected complement item: %+v", item)
+	}
+	if item.Tax.Icms.Amount != 9 || item.Tax.Icms.BaseTax != 50 {
+		t.Errorf("unexpected ICMS complement: amount %.2f, base %.2f", item.Tax.Icms.Amount, item.Tax.Icms.BaseTax)
+	}
+
+	refs := payload.AdditionalInformation.TaxDocumentsReference
+	if len(refs) != 1 || refs[0].DocumentElectronicInvoice.AccessKey != testAccessKey {
+		t.Errorf("expected NFref to original access key, got %+v", refs)
+	}
+
+	if frappeRepo.updates["INV-0001"]["complementary_invoice_id"] != resp.ID {
+		t.Errorf("expected complementary invoice link written back to Frappe, got %+v", frappeRepo.updates)
+	}
+
+	if _, err := svc.BuildComplementInvoice(context.Background(), ComplementInput{
+		AccessKey: testAccessKey,
+		Items:     []ComplementItem{{Code: "9", Price: 10}},
+	}); err == nil {
+		t.Error("expected error for unknown item")
+	}
+}
+
+func TestComplementSelectsItemsByLine(t *testing.T) {
+	// The same product on two lines with different prices and ICMS rates
+	nfeRepo := &fakeNFeRepo{byAccessKey: map[string]*models.ProductInvoiceResponse{
+		testAccessKey: {
+			OperationType: "outgoing",
+			Items: []models.Items{
+				{Code: "INV-5K", Cfop: 5102, Quantity: 1, UnitAmount: 1000, Tax: models.Tax{Icms: models.Icms{Cst: "00", Rate: 18}}},
+				{Code: "INV-5K", Cfop: 6102, Quantity: 1, UnitAmount: 900, Tax: models.Tax{Icms: models.Icms{Cst: "00", Rate: 12}}},
+			},
+		},
+	}}
+	numbering, _ := newTestNumbering(t, nil)
+	svc := NewComplementService(&fakeFrappeRepo{}, newTestCompanies(t, nfeRepo), numbering, newTestIssuances(t), nil)
+
+	payload, err := svc.BuildComplementInvoice(context.Background(), ComplementInput{
+		AccessKey: testAccessKey,
+		Items:     []ComplementItem{{Item: 2, ICMS: 12}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	item := payload.Items[0]
+	if item.Cfop != 6102 || item.Tax.Icms.Rate != 12 || item.Tax.Icms.BaseTax != 100 {
+		t.Errorf("expected the second line (CFOP 6102, ICMS 12%%), got CFOP %d, rate %.2f, base %.2f", item.Cfop, item.Tax.Icms.Rate, item.Tax.Icms.BaseTax)
+	}
+
+	// The code alone does not tell the lines apart
+	if _, err := svc.BuildComplementInvoice(context.Background(), ComplementInput{
+		AccessKey: testAccessKey,
+		Items:     []ComplementItem{{Code: "INV-5K", ICMS: 12}},
+	}); err == nil || !strings.Contains(err.Error(), "lines 1 and 2") {
+		t.Errorf("expected an ambiguous code error, got %v", err)
+	}
+	if _, err := svc.BuildComplementInvoice(context.Background(), ComplementInput{
+		AccessKey: testAccessKey,
+		Items:     []ComplementItem{{Item: 3, ICMS: 12}},
+	}); err == nil {
+		t.Error("expected error for a line not in the original note")
+	}
+}
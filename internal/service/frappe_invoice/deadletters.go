@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// ErrNotDeadLetter is returned when replaying or discarding an attempt that
+// did not fail or was already resolved
+var ErrNotDeadLetter = errors.New("issuance is not a dead letter")
+
+// DeadLetterService lists the failed and rejected issuance attempts and lets
+// an operator replay (optionally after editing) or discard them
+type DeadLetterService interface {
+	List() ([]models.Issuance, error)
+	Get(id uint64) (*models.Issuance, error)
+	Replay(ctx context.Context, id uint64, edits ReplayEdits) (*models.ProductInvoiceResponse, error)
+	Discard(id uint64, reason string) (*models.Issuance, error)
+}
+
+// ReplayEdits are applied before a dead letter is issued again
+type ReplayEdits struct {
+	Fields map[string]interface{} `json:"fields"` // Frappe invoice fields to update first
+	Input  json.RawMessage        `json:"input"`  // Replaces the stored request of a complement or return
+}
+
+// invoiceInput is the request stored with the attempts of a Frappe invoice;
+// the invoice itself is fetched again on replay
+type invoiceInput struct {
+	InvoiceID string `json:"invoice_id"`
+}
+
+type deadLetterService struct {
+	frappeRepo  repository.FrappeRepository
+	issuances   repository.IssuanceRepository
+	issuer      IssuerService
+	returns     ReturnService
+	complements ComplementService
+	now         func() time.Time
+}
+
+func NewDeadLetterService(f repository.FrappeRepository, issuances repository.IssuanceRepository, issuer IssuerService, returns ReturnService, complements ComplementService) DeadLetterService {
+	return &deadLetterService{
+		frappeRepo:  f,
+		issuances:   issuances,
+		issuer:      issuer,
+		returns:     returns,
+		complements: complements,
+		now:         time.Now,
+	}
+}
+
+// List returns the unresolved dead letters, oldest first
+func (s *deadLetterService) List() ([]models.Issuance, error) {
+	return s.issuances.ListDeadLetters()
+}
+
+// Get returns an attempt with its full error and payload, resolved or not
+func (s *deadLetterService) Get(id uint64) (*models.Issuance, error) {
+	return s.issuances.Get(id)
+}
+
+// Replay issues the dead letter again. The edited fields are written to the
+// Frappe invoice first and invoices are re-fetched from Frappe, so fixes made
+// in ERPNext take effect. The letter is claimed before anything is sent, so
+// concurrent replays of it cannot both issue. The replay is a new attempt:
+// when it fails it becomes a dead letter itself, and this one is resolved
+// either way
+func (s *deadLetterService) Replay(ctx context.Context, id uint64, edits ReplayEdits) (*models.ProductInvoiceResponse, error) {
+	letter, err := s.claim(id, models.IssuanceResolutionReplaying, "")
+	if err != nil {
+		return nil, err
+	}
+
+	response, attempted, err := s.replay(ctx, letter, edits)
+	if !attempted {
+		// Refused before a new attempt was recorded: the letter goes back to the queue
+		if _, releaseErr := s.issuances.Modify(id, func(l *models.Issuance) error {
+			l.Resolution = ""
+			l.ResolvedAt = time.Time{}
+			return nil
+		}); releaseErr != nil {
+			fmt.Printf("Warning: Failed to release dead letter %d: %v\n", id, releaseErr)
+		}
+		return nil, err
+	}
+
+	note := "replay failed"
+	if err != nil {
+		note += ": " + err.Error()
+	} else {
+		note = "replayed as NF-e " + response.ID
+	}
+	if _, err := s.issuances.Modify(id, func(l *models.Issuance) error {
+		s.resolve(l, models.IssuanceResolutionReplayed, note)
+		return nil
+	}); err != nil {
+		fmt.Printf("Warning: Failed to resolve dead letter %d: %v\n", id, err)
+	}
+
+	return response, err
+}
+
+// replay applies the edits and issues the letter again; attempted is false
+// when it was refused before a new attempt was recorded
+func (s *deadLetterService) replay(ctx context.Context, letter *models.Issuance, edits ReplayEdits) (*models.ProductInvoiceResponse, bool, error) {
+	if len(edits.Fields) > 0 {
+		if letter.InvoiceName == "" {
+			return nil, false, fmt.Errorf("issuance %d has no Frappe invoice to edit", letter.ID)
+		}
+		if err := s.frappeRepo.UpdateInvoice(ctx, letter.InvoiceName, edits.Fields); err != nil {
+			return nil, false, fmt.Errorf("failed to update Frappe invoice: %w", err)
+		}
+	}
+
+	input := letter.Input
+	if len(edits.Input) > 0 {
+		input = edits.Input
+	}
+
+	var response *models.ProductInvoiceResponse
+	var err error
+	switch letter.Kind {
+	case models.IssuanceKindInvoice:
+		response, err = s.issuer.IssueNoteForFrappeInvoice(ctx, letter.InvoiceName)
+	case models.IssuanceKindComplement:
+		var complement ComplementInput
+		if err := decodeInput(input, &complement); err != nil {
+			return nil, false, fmt.Errorf("issuance %d: %v", letter.ID, err)
+		}
+		response, err = s.complements.IssueComplementInvoice(ctx, complement)
+	case models.IssuanceKindReturn:
+		var ret ReturnInput
+		if err := decodeInput(input, &ret); err != nil {
+			return nil, false, fmt.Errorf("issuance %d: %v", letter.ID, err)
+		}
+		response, err = s.returns.IssueReturnInvoice(ctx, ret)
+	default:
+		return nil, false, fmt.Errorf("issuance %d has unknown kind %q", letter.ID, letter.Kind)
+	}
+
+	if errors.Is(err, ErrAlreadyIssued) {
+		return nil, false, err
+	}
+	return response, true, err
+}
+
+// Discard drops the dead letter, recording why
+func (s *deadLetterService) Discard(id uint64, reason string) (*models.Issuance, error) {
+	if reason == "" {
+		return nil, fmt.Errorf("a reason is required to discard a dead letter")
+	}
+	return s.claim(id, models.IssuanceResolutionDiscarded, reason)
+}
+
+// claim resolves the attempt if it is still a dead letter, checking and
+// saving in one store transaction
+func (s *deadLetterService) claim(id uint64, resolution, note string) (*models.Issuance, error) {
+	return s.issuances.Modify(id, func(letter *models.Issuance) error {
+		if !letter.IsDeadLetter() {
+			return fmt.Errorf("%w: issuance %d is %s", ErrNotDeadLetter, id, describeResolution(letter))
+		}
+		s.resolve(letter, resolution, note)
+		return nil
+	})
+}
+
+func (s *deadLetterService) resolve(letter *models.Issuance, resolution, note string) {
+	letter.Resolution = resolution
+	letter.ResolutionNote = note
+	letter.ResolvedAt = s.now().UTC()
+}
+
+// decodeInput reads a stored or edited request
+func decodeInput(input json.RawMessage, v interface{}) error {
+	if len(input) == 0 {
+		return fmt.Errorf("no request recorded to replay")
+	}
+	if err := json.Unmarshal(input, v); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	return nil
+}
+
+func describeResolution(issuance *models.Issuance) string {
+	if issuance.Resolution != "" {
+		return "already " + issuance.Resolution
+	}
+	return issuance.Status
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestReplayDeadLetterRefetchesFrappe(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	companies := newTestCompanies(t, nfeRepo)
+	issuer := NewIssuerService(frappeRepo, companies, numbering, issuances, outbox, nil)
+	svc := NewDeadLetterService(frappeRepo, issuances, issuer,
+		NewReturnService(companies, numbering, issuances),
+		NewComplementService(frappeRepo, companies, numbering, issuances, outbox))
+
+	nfeRepo.createErr = &repository.APIError{StatusCode: 400, Code: "E-301", Messages: []string{"Nome do destinatário inválido"}}
+	if _, err := issuer.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err == nil {
+		t.Fatal("expected error")
+	}
+	nfeRepo.createErr = nil
+
+	letters, err := svc.List()
+	if err != nil || len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %+v (%v)", letters, err)
+	}
+	letter := letters[0]
+	if letter.Status != models.IssuanceStatusRejected || len(letter.Input) == 0 || !strings.Contains(letter.ErrorDetail, "NFe.io code: E-301") {
+		t.Errorf("expected the rejection with its request and NFe.io detail, got %+v", letter)
+	}
+
+	// Fixed in ERPNext after the rejection
+	frappeRepo.invoices["INV-0001"].ClientName = "Cliente Corrigido"
+	response, err := svc.Replay(context.Background(), letter.ID, ReplayEdits{Fields: map[string]interface{}{"client_email": "fiscal@cliente.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.ID != "nfe-1" || nfeRepo.created[0].Buyer.Name != "Cliente Corrigido" {
+		t.Errorf("expected the replay to issue the current Frappe data, got %+v", nfeRepo.created[0].Buyer)
+	}
+	if frappeRepo.updates["INV-0001"]["client_email"] != "fiscal@cliente.com" {
+		t.Errorf("expected the edited fields written to Frappe, got %+v", frappeRepo.updates["INV-0001"])
+	}
+
+	replayed, _ := svc.Get(letter.ID)
+	if replayed.Resolution != models.IssuanceResolutionReplayed || replayed.ResolutionNote != "replayed as NF-e nfe-1" {
+		t.Errorf("expected the letter resolved as replayed, got %+v", replayed)
+	}
+	if letters, _ := svc.List(); len(letters) != 0 {
+		t.Errorf("expected an empty dead-letter queue, got %+v", letters)
+	}
+	if _, err := svc.Replay(context.Background(), letter.ID, ReplayEdits{}); !errors.Is(err, ErrNotDeadLetter) {
+		t.Errorf("expected ErrNotDeadLetter replaying twice, got %v", err)
+	}
+}
+
+func TestReplayAndDiscardReturnDeadLetters(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byAccessKey: map[string]*models.ProductInvoiceResponse{}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances := newTestIssuances(t)
+	companies := newTestCompanies(t, nfeRepo)
+	returns := NewReturnService(companies, numbering, issuances)
+	svc := NewDeadLetterService(&fakeFrappeRepo{}, issuances, nil, returns, nil)
+
+	// The original note is unknown: both returns fail
+	for _, key := range []string{"key-1", "key-2"} {
+		if _, err := returns.IssueReturnInvoice(context.Background(), ReturnInput{AccessKey: key}); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	letters, _ := svc.List()
+	if len(letters) != 2 || letters[0].Status != models.IssuanceStatusFailed {
+		t.Fatalf("expected 2 failed returns in the queue, got %+v", letters)
+	}
+
+	if _, err := svc.Discard(letters[0].ID, ""); err == nil {
+		t.Error("expected a reason to be required")
+	}
+	discarded, err := svc.Discard(letters[0].ID, "duplicate request")
+	if err != nil || discarded.Resolution != models.IssuanceResolutionDiscarded || discarded.ResolvedAt.IsZero() {
+		t.Fatalf("expected the letter discarded, got %+v (%v)", discarded, err)
+	}
+
+	// A replay that fails again is a new dead letter and resolves the old one
+	if _, err := svc.Replay(context.Background(), letters[1].ID, ReplayEdits{Input: []byte(`{"access_key":"key-3"}`)}); err == nil {
+		t.Fatal("expected error")
+	}
+	old, _ := svc.Get(letters[1].ID)
+	if old.Resolution != models.IssuanceResolutionReplayed || !strings.HasPrefix(old.ResolutionNote, "replay failed: ") {
+		t.Errorf("expected the failed replay recorded, got %+v", old)
+	}
+	letters, _ = svc.List()
+	if len(letters) != 1 || !strings.Contains(string(letters[0].Input), "key-3") {
+		t.Errorf("expected only the replay with the edited request left, got %+v", letters)
+	}
+
+	// A letter claimed by a replay in progress cannot be replayed again; one
+	// refused before issuing goes back to the queue
+	claimed := letters[0]
+	issuances.Modify(claimed.ID, func(l *models.Issuance) error {
+		l.Resolution = models.IssuanceResolutionReplaying
+		return nil
+	})
+	if _, err := svc.Replay(context.Background(), claimed.ID, ReplayEdits{}); !errors.Is(err, ErrNotDeadLetter) {
+		t.Errorf("expected ErrNotDeadLetter for a letter being replayed, got %v", err)
+	}
+	issuances.Modify(claimed.ID, func(l *models.Issuance) error {
+		l.Resolution = ""
+		return nil
+	})
+	if _, err := svc.Replay(context.Background(), claimed.ID, ReplayEdits{Input: []byte(`{`)}); err == nil {
+		t.Fatal("expected an invalid request to be refused")
+	}
+	if released, _ := svc.Get(claimed.ID); !released.IsDeadLetter() {
+		t.Errorf("expected the refused replay to release the letter, got %+v", released)
+	}
+
+	if _, err := svc.Get(99); !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// SEFAZ requires the disablement justification (xJust) to have 15 to 255 characters
+const (
+	minDisablementReason = 15
+	maxDisablementReason = 255
+)
+
+// NumberRange is a closed range of NF-e numbers of a serie
+type NumberRange struct {
+	Serie int `json:"serie"`
+	Begin int `json:"begin"`
+	End   int `json:"end"`
+}
+
+// DisablementService detects gaps in the numbering and disables (inutiliza)
+// number ranges at SEFAZ through NFe.io
+type DisablementService interface {
+	DetectGaps(companyID string) ([]NumberRange, error)
+	DisableRange(ctx context.Context, companyID string, numbers NumberRange, reason string) (*models.DisablementResponse, error)
+}
+
+type disablementService struct {
+	companies  *CompanyRegistry
+	ledgerRepo repository.LedgerRepository
+	issuances  repository.IssuanceRepository // Notes not recorded in the ledger yet
+}
+
+func NewDisablementService(companies *CompanyRegistry, l repository.LedgerRepository, issuances repository.IssuanceRepository) DisablementService {
+	return &disablementService{
+		companies:  companies,
+		ledgerRepo: l,
+		issuances:  issuances,
+	}
+}
+
+// DetectGaps lists, for every serie used by the company, the ranges up to the
+// last number handed out that were neither issued nor disabled, from the first
+// number the ledger reserved (explicit numbering) or else from the lowest
+// known number. Numbers of the issuance attempts accepted by NFe.io count as
+// issued, even when the ledger missed them
+func (s *disablementService) DetectGaps(companyID string) ([]NumberRange, error) {
+	series, err := s.ledgerRepo.Series(companyID)
+	if err != nil {
+		return nil, err
+	}
+	attempts, err := s.attempts(companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var gaps []NumberRange
+	for _, serie := range series {
+		issued, err := s.ledgerRepo.IssuedNumbers(companyID, serie)
+		if err != nil {
+			return nil, err
+		}
+		disabled, err := s.ledgerRepo.DisabledNumbers(companyID, serie)
+		if err != nil {
+			return nil, err
+		}
+
+		first, err := s.ledgerRepo.FirstReservedNumber(companyID, serie)
+		if err != nil {
+			return nil, err
+		}
+		last, err := s.ledgerRepo.LastNumber(companyID, serie)
+		if err != nil {
+			return nil, err
+		}
+
+		used := append(issued, disabled...)
+		for _, attempt := range attempts {
+			if attempt.Serie == serie && attempt.Number > 0 && usesNumber(&attempt) {
+				used = append(used, attempt.Number)
+			}
+		}
+
+		gaps = append(gaps, findGaps(serie, used, first, last)...)
+	}
+
+	return gaps, nil
+}
+
+// DisableRange validates the range and justification, disables it at SEFAZ and
+// records it in the ledger so it is no longer reported as a gap. Ranges holding
+// a number issued according to the ledger or the issuance attempts are
+// refused, and so is any range while a note of the serie waits for the number
+// NFe.io will assign it
+func (s *disablementService) DisableRange(ctx context.Context, companyID string, numbers NumberRange, reason string) (*models.DisablementResponse, error) {
+	reason = strings.TrimSpace(reason)
+
+	company, err := s.companies.ByNFeCompanyID(companyID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.companies.checkEnvironment(ctx, company); err != nil {
+		return nil, err
+	}
+	if numbers.Serie < 0 || numbers.Begin <= 0 || numbers.End < numbers.Begin {
+		return nil, fmt.Errorf("invalid number range: serie %d, %d-%d", numbers.Serie, numbers.Begin, numbers.End)
+	}
+	if len([]rune(reason)) < minDisablementReason || len([]rune(reason)) > maxDisablementReason {
+		return nil, fmt.Errorf("justification must have between %d and %d characters", minDisablementReason, maxDisablementReason)
+	}
+
+	issued, err := s.ledgerRepo.IssuedNumbers(companyID, numbers.Serie)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range issued {
+		if n >= numbers.Begin && n <= numbers.End {
+			return nil, fmt.Errorf("number %d of serie %d was already issued", n, numbers.Serie)
+		}
+	}
+	attempts, err := s.attempts(companyID)
+	if err != nil {
+		return nil, err
+	}
+	for _, attempt := range attempts {
+		if attempt.Serie != numbers.Serie {
+			continue
+		}
+		switch {
+		case attempt.Number == 0 && !attempt.IsFinal():
+			return nil, fmt.Errorf("issuance %d of serie %d is waiting for its number from NFe.io", attempt.ID, numbers.Serie)
+		case attempt.Number >= numbers.Begin && attempt.Number <= numbers.End && (usesNumber(&attempt) || !attempt.IsFinal()):
+			return nil, fmt.Errorf("number %d of serie %d is used by issuance %d (%s)", attempt.Number, numbers.Serie, attempt.ID, attempt.Status)
+		}
+	}
+
+	response, err := company.NFeRepo.DisableNumberRange(ctx, companyID, &models.DisablementRequest{
+		Serie:       numbers.Serie,
+		BeginNumber: numbers.Begin,
+		LastNumber:  numbers.End,
+		Reason:      reason,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ledgerRepo.RecordDisabledRange(companyID, numbers.Serie, numbers.Begin, numbers.End); err != nil {
+		// Log error but don't fail - the range was disabled at SEFAZ
+		fmt.Printf("Warning: Failed to record disabled range in ledger: %v\n", err)
+	}
+
+	return response, nil
+}
+
+// attempts returns the issuance attempts of the company sent to NFe.io
+func (s *disablementService) attempts(companyID string) ([]models.Issuance, error) {
+	if companyID == "" {
+		return nil, nil
+	}
+	return s.issuances.List(repository.IssuanceFilter{CompanyID: companyID})
+}
+
+// findGaps returns the missing ranges up to last, starting at first when the
+// bridge numbered the serie (numbers it reserved and burnt below the lowest
+// used one are gaps too) and at the lowest used number otherwise
+func findGaps(serie int, used []int, first, last int) []NumberRange {
+	if first > 0 {
+		used = append(used, first-1)
+	}
+	if len(used) == 0 {
+		if last > 0 {
+			return []NumberRange{{Serie: serie, Begin: 1, End: last}}
+		}
+		return nil
+	}
+	sort.Ints(used)
+	if last > used[len(used)-1] {
+		used = append(used, last+1)
+	}
+
+	var gaps []NumberRange
+	for i := 1; i < len(used); i++ {
+		if used[i]-used[i-1] > 1 {
+			gaps = append(gaps, NumberRange{
+				Serie: serie,
+				Begin: used[i-1] + 1,
+				End:   used[i] - 1,
+			})
+		}
+	}
+	return gaps
+}
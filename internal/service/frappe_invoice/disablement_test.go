@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestDisablementGaps(t *testing.T) {
+	ledger := repository.NewStoreLedgerRepo(newTestStore(t))
+	for _, n := range []int{1, 2, 5, 6, 9} {
+		if err := ledger.RecordNumber("company-1", 1, n); err != nil {
+			t.Fatalf("failed to record number: %v", err)
+		}
+	}
+
+	nfeRepo := &fakeNFeRepo{}
+	svc := NewDisablementService(newTestCompanies(t, nfeRepo), ledger, newTestIssuances(t))
+
+	gaps, err := svc.DetectGaps("company-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gaps) != 2 || gaps[0] != (NumberRange{Serie: 1, Begin: 3, End: 4}) || gaps[1] != (NumberRange{Serie: 1, Begin: 7, End: 8}) {
+		t.Fatalf("unexpected gaps: %+v", gaps)
+	}
+
+	if _, err := svc.DisableRange(context.Background(), "company-1", gaps[0], "curta"); err == nil {
+		t.Error("expected error for short justification")
+	}
+	if _, err := svc.DisableRange(context.Background(), "company-1", NumberRange{Serie: 1, Begin: 4, End: 5}, "Falha no sistema de emissão"); err == nil {
+		t.Error("expected error when range contains an issued number")
+	}
+
+	if _, err := svc.DisableRange(context.Background(), "company-1", gaps[0], "Falha no sistema de emissão"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nfeRepo.disablements) != 1 || nfeRepo.disablements[0].BeginNumber != 3 || nfeRepo.disablements[0].LastNumber != 4 {
+		t.Errorf("unexpected disablement request: %+v", nfeRepo.disablements)
+	}
+
+	gaps, err = svc.DetectGaps("company-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gaps) != 1 || gaps[0].Begin != 7 {
+		t.Errorf("expected only the 7-8 gap after disablement, got %+v", gaps)
+	}
+}
+
+func TestDisablementChecksIssuanceAttempts(t *testing.T) {
+	ledger := repository.NewStoreLedgerRepo(newTestStore(t))
+	for _, n := range []int{1, 5} {
+		ledger.RecordNumber("company-1", 1, n)
+	}
+	issuances := newTestIssuances(t)
+	nfeRepo := &fakeNFeRepo{}
+	svc := NewDisablementService(newTestCompanies(t, nfeRepo), ledger, issuances)
+
+	// Authorized note the ledger missed, and a rejection that freed its number
+	issuances.Create(&models.Issuance{CompanyID: "company-1", Serie: 1, Number: 3, Status: models.IssuanceStatusIssued})
+	issuances.Create(&models.Issuance{CompanyID: "company-1", Serie: 1, Number: 4, Status: models.IssuanceStatusRejected})
+
+	gaps, err := svc.DetectGaps("company-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gaps) != 2 || gaps[0] != (NumberRange{Serie: 1, Begin: 2, End: 2}) || gaps[1] != (NumberRange{Serie: 1, Begin: 4, End: 4}) {
+		t.Fatalf("expected gaps 2 and 4 only, got %+v", gaps)
+	}
+	if _, err := svc.DisableRange(context.Background(), "company-1", NumberRange{Serie: 1, Begin: 2, End: 3}, "Falha no sistema de emissão"); err == nil {
+		t.Error("expected error when range contains an authorized number")
+	}
+
+	// A note waiting for the number NFe.io will assign blocks any range of its serie
+	waiting := &models.Issuance{CompanyID: "company-1", Serie: 1, Status: models.IssuanceStatusProcessing}
+	issuances.Create(waiting)
+	if _, err := svc.DisableRange(context.Background(), "company-1", NumberRange{Serie: 1, Begin: 4, End: 4}, "Falha no sistema de emissão"); err == nil {
+		t.Error("expected error while a note waits for its number")
+	}
+	waiting.Status = models.IssuanceStatusRejected
+	issuances.Update(waiting)
+	if _, err := svc.DisableRange(context.Background(), "company-1", NumberRange{Serie: 1, Begin: 4, End: 4}, "Falha no sistema de emissão"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nfeRepo.disablements) != 1 {
+		t.Errorf("expected a single disablement, got %+v", nfeRepo.disablements)
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// SEFAZ environments a company issues in
+const (
+	EnvironmentProduction   = "production"
+	EnvironmentHomologation = "homologation"
+)
+
+// homologationBuyerName is the buyer name (xNome) SEFAZ requires on every note
+// issued in homologation
+const homologationBuyerName = "NF-E EMITIDA EM AMBIENTE DE HOMOLOGACAO - SEM VALOR FISCAL"
+
+// ErrProductionBlocked is returned when a non-production Frappe site tries to
+// issue, cancel or disable numbers with a production company
+var ErrProductionBlocked = errors.New("production NF-e operations are not allowed from a non-production Frappe site")
+
+// ErrEnvironmentMismatch is returned when NFe.io issues the notes of a company
+// in another SEFAZ environment than the configured one
+var ErrEnvironmentMismatch = errors.New("company environment does not match NFe.io")
+
+// IsHomologation reports whether the company issues in SEFAZ homologation
+func (c *Company) IsHomologation() bool {
+	return c.Environment == EnvironmentHomologation
+}
+
+// nfeEnvironment is the company environment as NFe.io names it
+func (c *Company) nfeEnvironment() string {
+	if c.IsHomologation() {
+		return "Test"
+	}
+	return "Production"
+}
+
+// applyEnvironment enforces the rules of the company environment on a payload
+// about to be sent to NFe.io
+func (c *Company) applyEnvironment(payload *models.ProductInvoiceRequest) {
+	if c.IsHomologation() {
+		payload.Buyer.Name = homologationBuyerName
+	}
+}
+
+// verifyEnvironment confirms at NFe.io that the state registration of the
+// company issues in the configured environment, so a production key labelled
+// homologation cannot issue real notes. The registration of the company state
+// is checked, or the only one when the company has a single registration. A
+// confirmed company is not checked again
+func (c *Company) verifyEnvironment(ctx context.Context) error {
+	return c.verifyEnvironmentWith(ctx, c.NFeRepo)
+}
+
+// verifyEnvironmentWith verifies the environment looking the company up
+// through nfeRepo
+func (c *Company) verifyEnvironmentWith(ctx context.Context, nfeRepo repository.NFeRepository) error {
+	// NFe.io is called without the lock, so a slow answer does not hold back
+	// the other operations of the company; only the result is stored under it
+	c.mu.Lock()
+	verified := c.verified
+	c.mu.Unlock()
+	if verified {
+		return nil
+	}
+
+	stateTaxes, err := nfeRepo.GetStateTaxes(ctx, c.NFeCompanyID)
+	if err != nil {
+		return fmt.Errorf("failed to check the environment of company %s at NFe.io: %w", c.NFeCompanyID, err)
+	}
+	var stateTax *models.StateTax
+	for i := range stateTaxes {
+		if strings.EqualFold(stateTaxes[i].Code, c.State) || len(stateTaxes) == 1 {
+			stateTax = &stateTaxes[i]
+			break
+		}
+	}
+	if stateTax == nil {
+		return fmt.Errorf("%w: company %s has no state registration in %s at NFe.io", ErrEnvironmentMismatch, c.NFeCompanyID, c.State)
+	}
+
+	var environment string
+	switch strings.ToLower(stateTax.EnvironmentType) {
+	case "production":
+		environment = EnvironmentProduction
+	case "test":
+		environment = EnvironmentHomologation
+	default:
+		return fmt.Errorf("%w: state registration %s of company %s has no SEFAZ environment (%q)", ErrEnvironmentMismatch, stateTax.TaxNumber, c.NFeCompanyID, stateTax.EnvironmentType)
+	}
+	if environment != c.Environment {
+		return fmt.Errorf("%w: company %s is configured for %s but NFe.io issues its notes in %s", ErrEnvironmentMismatch, c.NFeCompanyID, c.Environment, environment)
+	}
+
+	c.mu.Lock()
+	c.verified = true
+	c.mu.Unlock()
+	return nil
+}
+
+// VerifyEnvironments checks the environment of every company at NFe.io,
+// reporting every company that could not be confirmed
+func (r *CompanyRegistry) VerifyEnvironments(ctx context.Context) error {
+	var errs []error
+	for _, company := range r.Companies() {
+		if err := company.verifyEnvironment(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// normalizeEnvironment validates a configured environment; empty means production
+func normalizeEnvironment(environment string) (string, error) {
+	switch env := strings.ToLower(strings.TrimSpace(environment)); env {
+	case "", EnvironmentProduction:
+		return EnvironmentProduction, nil
+	case EnvironmentHomologation:
+		return env, nil
+	default:
+		return "", fmt.Errorf("invalid environment %s (production or homologation)", environment)
+	}
+}
+
+// SetSiteEnvironment records the environment of the Frappe site the bridge
+// serves (e.g. "production", "staging"). Only a site explicitly set to
+// production may use production companies
+func (r *CompanyRegistry) SetSiteEnvironment(environment string) {
+	r.siteEnvironment = strings.ToLower(strings.TrimSpace(environment))
+}
+
+// checkEnvironment refuses operations with a company whose environment NFe.io
+// does not confirm, and production operations from a non-production site, so
+// a staging copy of ERPNext can never issue or cancel real notes
+func (r *CompanyRegistry) checkEnvironment(ctx context.Context, company *Company) error {
+	if err := company.verifyEnvironment(ctx); err != nil {
+		return err
+	}
+	if company.IsHomologation() || r.siteEnvironment == EnvironmentProduction {
+		return nil
+	}
+	if r.siteEnvironment == "" {
+		return fmt.Errorf("%w: company %s is in production and the environment of the Frappe site is not set", ErrProductionBlocked, company.Name)
+	}
+	return fmt.Errorf("%w: company %s is in production and the Frappe site is %s", ErrProductionBlocked, company.Name, r.siteEnvironment)
+}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestHomologationCompany(t *testing.T) {
+	production := &fakeNFeRepo{}
+	homologation := &fakeNFeRepo{stateTaxes: []models.StateTax{{Code: "SP", TaxNumber: "123456789", EnvironmentType: "Test"}}}
+	repos := map[string]*fakeNFeRepo{"key-prod": production, "key-homolog": homologation}
+
+	companies, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Matriz", NFeCompanyID: "company-prod", NFeAPIKey: "key-prod", State: "SP"},
+		{Name: "AnyGrid Testes", NFeCompanyID: "company-homolog", NFeAPIKey: "key-homolog", State: "SP", Environment: "Homologation"},
+	}, "", "", func(apiKey string) repository.NFeRepository { return repos[apiKey] })
+	if err != nil {
+		t.Fatalf("failed to build company registry: %v", err)
+	}
+	companies.SetSiteEnvironment("staging")
+
+	prodInv := newTimelineInvoice("INV-PROD")
+	prodInv.Company = "AnyGrid Matriz"
+	testInv := newTimelineInvoice("INV-TEST")
+	testInv.Company = "AnyGrid Testes"
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-PROD": prodInv, "INV-TEST": testInv}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, companies, numbering, issuances, outbox, nil)
+
+	// A staging site issues in homologation with the buyer name SEFAZ requires
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-TEST"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(homologation.created) != 1 || homologation.created[0].Buyer.Name != homologationBuyerName {
+		t.Fatalf("expected the homologation buyer name, got %+v", homologation.created)
+	}
+	if env := frappeRepo.updates["INV-TEST"]["invoice_environment"]; env != EnvironmentHomologation {
+		t.Errorf("expected the environment written back to Frappe, got %v", env)
+	}
+	if attempts, _ := issuances.ListByInvoice("INV-TEST"); len(attempts) != 1 || attempts[0].Environment != EnvironmentHomologation {
+		t.Errorf("expected the environment recorded with the attempt, got %+v", attempts)
+	}
+
+	// ...but never in production
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-PROD"); !errors.Is(err, ErrProductionBlocked) {
+		t.Fatalf("expected ErrProductionBlocked, got %v", err)
+	}
+	if len(production.created) != 0 {
+		t.Errorf("expected no production NF-e, got %d", len(production.created))
+	}
+
+	// ...nor from a site whose environment is not set
+	companies.SetSiteEnvironment("")
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-PROD"); !errors.Is(err, ErrProductionBlocked) {
+		t.Fatalf("expected ErrProductionBlocked without a site environment, got %v", err)
+	}
+
+	// The production site keeps the real buyer name
+	companies.SetSiteEnvironment("production")
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-PROD"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if production.created[0].Buyer.Name != "Cliente Teste" {
+		t.Errorf("expected the buyer name kept in production, got %s", production.created[0].Buyer.Name)
+	}
+	if env := frappeRepo.updates["INV-PROD"]["invoice_environment"]; env != EnvironmentProduction {
+		t.Errorf("expected production written back to Frappe, got %v", env)
+	}
+
+	if _, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Matriz", NFeCompanyID: "company-prod", NFeAPIKey: "key-prod", Environment: "sandbox"},
+	}, "", "", func(apiKey string) repository.NFeRepository { return production }); err == nil {
+		t.Error("expected an invalid environment to be refused")
+	}
+}
+
+func TestEnvironmentVerifiedAtNFeIO(t *testing.T) {
+	// A production key labelled homologation
+	nfeRepo := &fakeNFeRepo{}
+	companies, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Testes", NFeCompanyID: "company-homolog", NFeAPIKey: "key-prod", State: "SP", Environment: "Homologation"},
+	}, "AnyGrid Testes", "", func(apiKey string) repository.NFeRepository { return nfeRepo })
+	if err != nil {
+		t.Fatalf("failed to build company registry: %v", err)
+	}
+	companies.SetSiteEnvironment("staging")
+
+	if err := companies.VerifyEnvironments(context.Background()); !errors.Is(err, ErrEnvironmentMismatch) {
+		t.Fatalf("expected ErrEnvironmentMismatch at startup, got %v", err)
+	}
+
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-TEST": newTimelineInvoice("INV-TEST")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, companies, numbering, issuances, outbox, nil)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-TEST"); !errors.Is(err, ErrEnvironmentMismatch) {
+		t.Fatalf("expected ErrEnvironmentMismatch, got %v", err)
+	}
+	if len(nfeRepo.created) != 0 {
+		t.Errorf("expected no NF-e created, got %d", len(nfeRepo.created))
+	}
+
+	// Once NFe.io reports the homologation environment the company issues
+	nfeRepo.stateTaxes = []models.StateTax{{Code: "SP", EnvironmentType: "Test"}}
+	if err := companies.VerifyEnvironments(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
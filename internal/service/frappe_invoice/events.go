@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// SEFAZ requires the correction letter text (xCorrecao) to have 15 to 1000
+// characters and the cancellation justification (xJust) 15 to 255
+const (
+	minCorrectionReason   = 15
+	maxCorrectionReason   = 1000
+	minCancellationReason = 15
+	maxCancellationReason = 255
+)
+
+// InvoiceEventService registers events (cancellation, correction letter)
+// against the NF-e of a Frappe invoice, recording each one on its timeline
+type InvoiceEventService interface {
+	CancelInvoice(ctx context.Context, invoiceName, reason string) error
+	IssueCorrectionLetter(ctx context.Context, invoiceName, correction string) (*models.ProductInvoiceResponse, error)
+}
+
+type invoiceEventService struct {
+	frappeRepo repository.FrappeRepository
+	companies  *CompanyRegistry
+	timeline   timeline
+	issuances  repository.IssuanceRepository
+}
+
+func NewInvoiceEventService(f repository.FrappeRepository, companies *CompanyRegistry, issuances repository.IssuanceRepository) InvoiceEventService {
+	return &invoiceEventService{
+		frappeRepo: f,
+		companies:  companies,
+		timeline:   timeline{frappeRepo: f},
+		issuances:  issuances,
+	}
+}
+
+// CancelInvoice cancels the NF-e of the invoice at SEFAZ through NFe.io with
+// the reason as justification, also kept on the timeline
+func (s *invoiceEventService) CancelInvoice(ctx context.Context, invoiceName, reason string) error {
+	reason = strings.TrimSpace(reason)
+	nfeID, err := s.cancel(ctx, invoiceName, reason)
+	if err != nil {
+		s.timeline.failure(ctx, invoiceName, eventCancellation, err)
+		return err
+	}
+
+	s.timeline.success(ctx, invoiceName, eventCancellation, "NF-e "+nfeID+" sent for cancellation ("+reason+")")
+
+	return nil
+}
+
+func (s *invoiceEventService) cancel(ctx context.Context, invoiceName, reason string) (string, error) {
+	if len([]rune(reason)) < minCancellationReason || len([]rune(reason)) > maxCancellationReason {
+		return "", fmt.Errorf("justification must have between %d and %d characters", minCancellationReason, maxCancellationReason)
+	}
+
+	frappeInv, company, err := s.resolveNote(ctx, invoiceName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := company.NFeRepo.DeleteInvoice(ctx, company.NFeCompanyID, frappeInv.InvoiceID, reason); err != nil {
+		return "", err
+	}
+
+	// The cancellation is asynchronous at SEFAZ; NFe.io's flow status confirms it later
+	issuance, err := s.issuances.GetByNFeID(frappeInv.InvoiceID)
+	if err == nil {
+		issuance.Status = models.IssuanceStatusCancelling
+		err = s.issuances.Update(issuance)
+	}
+	if err != nil {
+		fmt.Printf("Warning: Failed to record cancellation in issuance ledger: %v\n", err)
+	}
+
+	return frappeInv.InvoiceID, nil
+}
+
+// IssueCorrectionLetter registers a correction letter (CC-e) for the NF-e of
+// the invoice
+func (s *invoiceEventService) IssueCorrectionLetter(ctx context.Context, invoiceName, correction string) (*models.ProductInvoiceResponse, error) {
+	response, err := s.correct(ctx, invoiceName, strings.TrimSpace(correction))
+	if err != nil {
+		s.timeline.failure(ctx, invoiceName, eventCorrectionLetter, err)
+		return nil, err
+	}
+
+	detail := "NF-e " + response.ID
+	if response.Status != "" {
+		detail += ", status " + response.Status
+	}
+	s.timeline.success(ctx, invoiceName, eventCorrectionLetter, detail+": "+strings.TrimSpace(correction))
+
+	return response, nil
+}
+
+func (s *invoiceEventService) correct(ctx context.Context, invoiceName, correction string) (*models.ProductInvoiceResponse, error) {
+	if len([]rune(correction)) < minCorrectionReason || len([]rune(correction)) > maxCorrectionReason {
+		return nil, fmt.Errorf("correction must have between %d and %d characters", minCorrectionReason, maxCorrectionReason)
+	}
+
+	frappeInv, company, err := s.resolveNote(ctx, invoiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	return company.NFeRepo.CreateCorrectionLetter(ctx, company.NFeCompanyID, frappeInv.InvoiceID, correction)
+}
+
+// resolveNote loads the invoice and the company that issued its NF-e
+func (s *invoiceEventService) resolveNote(ctx context.Context, invoiceName string) (*models.Invoices, *Company, error) {
+	frappeInv, err := s.frappeRepo.GetInvoice(ctx, invoiceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if frappeInv.InvoiceID == "" {
+		return nil, nil, fmt.Errorf("invoice %s has no NF-e", invoiceName)
+	}
+
+	company, err := s.companies.Resolve(frappeInv.Company)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.companies.checkEnvironment(ctx, company); err != nil {
+		return nil, nil, err
+	}
+
+	return frappeInv, company, nil
+}
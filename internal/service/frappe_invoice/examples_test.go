@@ -155,7 +155,7 @@ func ExampleIssuerService_CompleteFlow() {
 	// issuerService := service.NewIssuerService(frappeRepo, nfeRepo, "companyID")
 
 	// 3. Issue invoice
-	// response, err := issuerService.IssueNoteForFrappeInvoice("INV-001")
+	// response, err := issuerService.IssueNoteForFrappeInvoice(context.Background(), "INV-001")
 	// if err != nil {
 	//     log.Fatal(err)
 	// }
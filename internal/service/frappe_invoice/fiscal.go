@@ -0,0 +1,94 @@
+package service
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+)
+
+// defaultTaxDefaults are the historical codes: taxed ICMS, national origin,
+// taxable PIS/COFINS and IPI outside the incidence
+var defaultTaxDefaults = config.TaxDefaults{
+	CSTICMS:     "00",
+	OrigemICMS:  "0",
+	ModDetermBC: "3",
+	CSTPis:      "01",
+	CSTCofins:   "01",
+	CSTIPI:      "50",
+}
+
+// withTaxDefaults fills the codes left empty with the historical ones
+func withTaxDefaults(d config.TaxDefaults) config.TaxDefaults {
+	fill := func(value *string, fallback string) {
+		if *value == "" {
+			*value = fallback
+		}
+	}
+	fill(&d.CSTICMS, defaultTaxDefaults.CSTICMS)
+	fill(&d.OrigemICMS, defaultTaxDefaults.OrigemICMS)
+	fill(&d.ModDetermBC, defaultTaxDefaults.ModDetermBC)
+	fill(&d.CSTPis, defaultTaxDefaults.CSTPis)
+	fill(&d.CSTCofins, defaultTaxDefaults.CSTCofins)
+	fill(&d.CSTIPI, defaultTaxDefaults.CSTIPI)
+	return d
+}
+
+// FiscalRules holds the configurable CFOP rules and tax defaults of the issuer.
+// They can be replaced while the server runs (configuration reload)
+type FiscalRules struct {
+	mu          sync.RWMutex
+	cfop        []config.CFOPRule
+	taxDefaults config.TaxDefaults
+}
+
+// NewFiscalRules validates the rules; empty tax codes use the historical ones
+func NewFiscalRules(cfop []config.CFOPRule, taxDefaults config.TaxDefaults) (*FiscalRules, error) {
+	r := &FiscalRules{}
+	if err := r.Update(cfop, taxDefaults); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Update replaces the rules after validating them
+func (r *FiscalRules) Update(cfop []config.CFOPRule, taxDefaults config.TaxDefaults) error {
+	if err := config.ValidateCFOPRules(cfop); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cfop = cfop
+	r.taxDefaults = withTaxDefaults(taxDefaults)
+	return nil
+}
+
+// TaxDefaults returns the tax codes used without a tax template
+func (r *FiscalRules) TaxDefaults() config.TaxDefaults {
+	if r == nil {
+		return defaultTaxDefaults
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.taxDefaults
+}
+
+// resolveCFOP returns the configured CFOP (or template) of the natureza, if any
+func (r *FiscalRules) resolveCFOP(operationNature, operationType string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.cfop {
+		if rule.OperationType != "" && rule.OperationType != operationType {
+			continue
+		}
+		if strings.EqualFold(strings.TrimSpace(rule.OperationNature), strings.TrimSpace(operationNature)) {
+			return strings.ToLower(rule.CFOP), true
+		}
+	}
+	return "", false
+}
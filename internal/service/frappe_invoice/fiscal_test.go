@@ -0,0 +1,45 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestFiscalRulesOverrideCFOPAndTaxDefaults(t *testing.T) {
+	rules, err := NewFiscalRules([]config.CFOPRule{
+		{OperationNature: "venda", OperationType: operationOutgoing, CFOP: "x403"},
+	}, config.TaxDefaults{CSTPis: "07"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inv := newTimelineInvoice("INV-0001")
+	inv.DeliveryState = "RJ"
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": inv}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, rules)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	item := nfeRepo.created[0].Items[0]
+	if item.Cfop != 6403 {
+		t.Errorf("expected the configured interstate CFOP 6403, got %d", item.Cfop)
+	}
+	if item.Tax.Pis.Cst != "07" || item.Tax.Cofins.Cst != "01" {
+		t.Errorf("expected the configured PIS CST and the default COFINS CST, got %q and %q", item.Tax.Pis.Cst, item.Tax.Cofins.Cst)
+	}
+
+	// A reload replaces the rules; invalid ones are refused and the current kept
+	if err := rules.Update([]config.CFOPRule{{OperationNature: "venda", CFOP: "51"}}, config.TaxDefaults{}); err == nil {
+		t.Fatal("expected an invalid CFOP to be refused")
+	}
+	if cfop, ok := rules.resolveCFOP("Venda", operationOutgoing); !ok || cfop != "x403" {
+		t.Errorf("expected the previous rule to be kept, got %q", cfop)
+	}
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// ErrAlreadyIssued is returned when an invoice already has an NF-e that is
+// authorized or still being processed; issuing again would duplicate it
+var ErrAlreadyIssued = errors.New("invoice already has an NF-e")
+
+// ErrOutcomeUnknown is returned when a note was sent to NFe.io without an
+// explicit answer (network error, timeout, cancelled request or 5xx). The note
+// may exist: the attempt blocks the invoice until the reconciler finds it at
+// NFe.io or confirms it was never created
+var ErrOutcomeUnknown = errors.New("NF-e outcome unknown, it must be reconciled before issuing again")
+
+// OutcomeUnknownError carries ErrOutcomeUnknown with the attempt to reconcile
+type OutcomeUnknownError struct {
+	IssuanceID uint64
+	Err        error
+}
+
+func (e *OutcomeUnknownError) Error() string {
+	return fmt.Sprintf("issuance %d: %v", e.IssuanceID, e.Err)
+}
+
+func (e *OutcomeUnknownError) Unwrap() error {
+	return e.Err
+}
+
+// issuanceLog records each attempt in the local issuance ledger, the numbers
+// used in the numbering ledger and hands the resulting Frappe write-backs to
+// the outbox
+type issuanceLog struct {
+	repo      repository.IssuanceRepository
+	outbox    *OutboxDispatcher
+	numbering *NumberingService
+}
+
+// inFlightStatuses are the statuses of an attempt that block a new one of the
+// same invoice: its NF-e is authorized, being processed or being cancelled, or
+// NFe.io has not answered yet (a crash mid-call leaves the attempt pending
+// until an operator checks it in GET /issuances/pending; a call without an
+// answer leaves it unknown until the reconciler looks it up)
+var inFlightStatuses = []string{
+	models.IssuanceStatusPending,
+	models.IssuanceStatusUnknown,
+	models.IssuanceStatusProcessing,
+	models.IssuanceStatusIssued,
+	models.IssuanceStatusCancelling,
+}
+
+// start records a new attempt before anything is sent to NFe.io, keeping the
+// request that started it so a dead letter can be replayed
+func (l issuanceLog) start(kind, invoiceName string, input interface{}) (*models.Issuance, error) {
+	issuance := newIssuance(kind, invoiceName, input)
+	if err := l.repo.Create(issuance); err != nil {
+		return nil, err
+	}
+	observeStatus(issuance, "", "")
+	return issuance, nil
+}
+
+// startExclusive records a new attempt like start, refusing it with
+// ErrAlreadyIssued when the invoice has one in flight. The check and the
+// insert are one store transaction, so concurrent webhooks or replays of the
+// same invoice cannot both issue
+func (l issuanceLog) startExclusive(kind, invoiceName string, input interface{}) (*models.Issuance, error) {
+	issuance := newIssuance(kind, invoiceName, input)
+	blocker, err := l.repo.CreateExclusive(issuance, inFlightStatuses...)
+	if err != nil {
+		return nil, err
+	}
+	if blocker != nil {
+		return nil, alreadyIssued(invoiceName, blocker)
+	}
+	observeStatus(issuance, "", "")
+	return issuance, nil
+}
+
+func newIssuance(kind, invoiceName string, input interface{}) *models.Issuance {
+	issuance := &models.Issuance{
+		Kind:        kind,
+		InvoiceName: invoiceName,
+		Status:      models.IssuanceStatusPending,
+	}
+	if raw, err := json.Marshal(input); err == nil {
+		issuance.Input = raw
+	}
+	return issuance
+}
+
+// sending stores the company, its environment and the payload right before the
+// NFe.io call, so an attempt interrupted mid-call can still be identified
+func (l issuanceLog) sending(issuance *models.Issuance, company *Company, payload *models.ProductInvoiceRequest) {
+	issuance.CompanyID = company.NFeCompanyID
+	issuance.Environment = company.Environment
+	issuance.Serie = payload.Serie
+	issuance.Number = payload.Number
+	if raw, err := json.Marshal(payload); err == nil {
+		issuance.Payload = raw
+	}
+
+	if err := l.repo.Update(issuance); err != nil {
+		fmt.Printf("Warning: Failed to record issuance payload: %v\n", err)
+	}
+}
+
+// finish stores the NFe.io answer (or the error) of the attempt. Only errors
+// before the call or explicit refusals from NFe.io end the attempt; a call
+// without an answer (ErrOutcomeUnknown) leaves it unknown
+func (l issuanceLog) finish(issuance *models.Issuance, response *models.ProductInvoiceResponse, err error) {
+	if err != nil {
+		previous := issuance.Status
+		switch {
+		case errors.Is(err, ErrOutcomeUnknown):
+			issuance.Status = models.IssuanceStatusUnknown
+		case isRejection(err):
+			issuance.Status = models.IssuanceStatusRejected
+		default:
+			issuance.Status = models.IssuanceStatusFailed
+		}
+		issuance.Error = err.Error()
+		issuance.ErrorDetail = describeError(err)
+		observeStatus(issuance, previous, validationReason(err))
+	} else {
+		applyResponse(issuance, response)
+		l.numbering.Record(issuance)
+	}
+
+	if err := l.repo.Update(issuance); err != nil {
+		fmt.Printf("Warning: Failed to record issuance result: %v\n", err)
+	}
+}
+
+// withAttempt names the attempt in an ErrOutcomeUnknown error, so callers can
+// follow it up; other errors are returned as is
+func withAttempt(issuance *models.Issuance, err error) error {
+	if errors.Is(err, ErrOutcomeUnknown) {
+		return &OutcomeUnknownError{IssuanceID: issuance.ID, Err: err}
+	}
+	return err
+}
+
+// createError marks the error of a create call as ErrOutcomeUnknown unless
+// NFe.io explicitly refused the note (4xx other than a request timeout) or the
+// open circuit kept it from being sent
+func createError(err error) error {
+	var apiErr *repository.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusRequestTimeout {
+		return err
+	}
+	if errors.Is(err, repository.ErrCircuitOpen) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrOutcomeUnknown, err)
+}
+
+// complete stores the NFe.io answer of an accepted attempt together with the
+// Frappe write-back (one transaction), then delivers the write-back right away.
+// A failed delivery is retried by the background dispatcher
+func (l issuanceLog) complete(ctx context.Context, issuance *models.Issuance, response *models.ProductInvoiceResponse, data map[string]interface{}) {
+	applyResponse(issuance, response)
+	l.numbering.Record(issuance)
+
+	msg := &models.OutboxMessage{InvoiceName: issuance.InvoiceName, Data: data}
+	if err := l.repo.UpdateWithOutbox(issuance, msg); err != nil {
+		// The store is unavailable: write to Frappe directly
+		fmt.Printf("Warning: Failed to record issuance result: %v\n", err)
+		if l.outbox == nil {
+			return
+		}
+		if err := l.outbox.frappeRepo.UpdateInvoice(ctx, issuance.InvoiceName, data); err != nil {
+			fmt.Printf("Warning: Failed to update Frappe invoice: %v\n", err)
+		}
+		return
+	}
+
+	if l.outbox == nil {
+		return
+	}
+	if err := l.outbox.Flush(ctx, issuance.InvoiceName); err != nil {
+		fmt.Printf("Warning: Failed to update Frappe invoice, will retry: %v\n", err)
+	}
+}
+
+// invoiceWriteBack is the Frappe update of an invoice issued as the given note
+// in the given environment
+func invoiceWriteBack(response *models.ProductInvoiceResponse, serie, number int, environment string) map[string]interface{} {
+	data := map[string]interface{}{
+		"invoice_id":    response.ID,
+		"invoice_serie": serie,
+		"invoice_link":  response.PdfUrl,
+	}
+	if environment != "" {
+		data["invoice_environment"] = environment
+	}
+	if response.Number > 0 {
+		number = response.Number
+	}
+	if number > 0 {
+		data["invoice_number"] = number
+	}
+	return data
+}
+
+// complementWriteBack is the Frappe update of an invoice complemented by the
+// given note
+func complementWriteBack(response *models.ProductInvoiceResponse) map[string]interface{} {
+	return map[string]interface{}{
+		"complementary_invoice_id":   response.ID,
+		"complementary_invoice_link": response.PdfUrl,
+	}
+}
+
+// applyResponse copies an NFe.io answer into the attempt and derives its status
+func applyResponse(issuance *models.Issuance, response *models.ProductInvoiceResponse) {
+	previous := issuance.Status
+	defer func() { observeStatus(issuance, previous, sefazReason(response.FlowMessage)) }()
+
+	issuance.NFeID = response.ID
+	issuance.FlowStatus = response.FlowStatus
+	if response.Serie > 0 {
+		issuance.Serie = response.Serie
+	}
+	if response.Number > 0 {
+		issuance.Number = response.Number
+	}
+	if response.Authorization.AccessKey != "" {
+		issuance.AccessKey = response.Authorization.AccessKey
+	}
+
+	cancelling := issuance.Status == models.IssuanceStatusCancelling
+	switch {
+	case response.FlowStatus == flowStatusCancelled:
+		issuance.Status = models.IssuanceStatusCancelled
+	case response.FlowStatus == flowStatusCancelFailed:
+		// SEFAZ refused the cancellation: the note stays authorized
+		issuance.Status = models.IssuanceStatusIssued
+		issuance.Error = response.FlowMessage
+	case cancelling:
+		// The note still reads as authorized until SEFAZ confirms the cancellation
+	case response.FlowStatus == flowStatusIssued:
+		issuance.Status = models.IssuanceStatusIssued
+		issuance.Error = ""
+	case response.FlowStatus == flowStatusIssueFailed:
+		issuance.Status = models.IssuanceStatusRejected
+		issuance.Error = response.FlowMessage
+	default:
+		issuance.Status = models.IssuanceStatusProcessing
+	}
+}
+
+// observeStatus counts the attempt reaching a new status; rejections are also
+// counted by reason
+func observeStatus(issuance *models.Issuance, previous, rejectionReason string) {
+	if issuance.Status == previous {
+		return
+	}
+	company := metrics.Label(issuance.CompanyID)
+	metrics.Issuances.WithLabelValues(issuance.Kind, company, issuance.Status).Inc()
+	if issuance.Status == models.IssuanceStatusRejected {
+		metrics.SefazRejections.WithLabelValues(company, rejectionReason).Inc()
+	}
+}
+
+// sefazStatusCode finds the SEFAZ status code (cStat) in a rejection message,
+// e.g. "Rejeição 539: Duplicidade de NF-e"
+var sefazStatusCode = regexp.MustCompile(`(?:^|\D)(\d{3})(?:\D|$)`)
+
+// sefazReason is the rejection reason label of an NFe.io flow message
+func sefazReason(message string) string {
+	if match := sefazStatusCode.FindStringSubmatch(message); match != nil {
+		return "sefaz_" + match[1]
+	}
+	return "sefaz_unknown"
+}
+
+// validationReason is the rejection reason label of an NFe.io validation error
+func validationReason(err error) string {
+	var apiErr *repository.APIError
+	if !errors.As(err, &apiErr) {
+		return "unknown"
+	}
+	if apiErr.Code == "" {
+		return fmt.Sprintf("nfeio_http_%d", apiErr.StatusCode)
+	}
+	return "nfeio_" + apiErr.Code
+}
+
+// checkNotIssued reports whether a previous attempt of the invoice is in
+// flight. Only the preview uses it; issuing checks with startExclusive
+func (l issuanceLog) checkNotIssued(invoiceName string) error {
+	issuances, err := l.repo.ListByInvoice(invoiceName)
+	if err != nil {
+		return err
+	}
+	for i := range issuances {
+		for _, status := range inFlightStatuses {
+			if issuances[i].Status == status {
+				return alreadyIssued(invoiceName, &issuances[i])
+			}
+		}
+	}
+	return nil
+}
+
+func alreadyIssued(invoiceName string, issuance *models.Issuance) error {
+	if issuance.NFeID == "" {
+		return fmt.Errorf("%w: %s has attempt %d %s", ErrAlreadyIssued, invoiceName, issuance.ID, issuance.Status)
+	}
+	return fmt.Errorf("%w: %s is %s as NF-e %s", ErrAlreadyIssued, invoiceName, issuance.Status, issuance.NFeID)
+}
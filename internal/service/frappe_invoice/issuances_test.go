@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestIssuerRecordsAttemptsAndRefusesDuplicates(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	// A rejected attempt is recorded and does not block a new one
+	nfeRepo.createErr = &repository.APIError{StatusCode: 400, Messages: []string{"CFOP inválido"}}
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err == nil {
+		t.Fatal("expected error")
+	}
+	nfeRepo.createErr = nil
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	attempts, err := issuances.ListByInvoice("INV-0001")
+	if err != nil || len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d (%v)", len(attempts), err)
+	}
+	if attempts[0].Status != models.IssuanceStatusRejected || attempts[0].Error == "" {
+		t.Errorf("expected the first attempt rejected with its error, got %+v", attempts[0])
+	}
+	second := attempts[1]
+	if second.Status != models.IssuanceStatusProcessing || second.NFeID != "nfe-1" || second.CompanyID != "company-1" || len(second.Payload) == 0 {
+		t.Errorf("expected the second attempt processing as nfe-1 with its payload, got %+v", second)
+	}
+
+	// The NF-e is still processing: issuing again would duplicate it
+	_, err = svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001")
+	if !errors.Is(err, ErrAlreadyIssued) {
+		t.Fatalf("expected ErrAlreadyIssued, got %v", err)
+	}
+	if len(nfeRepo.created) != 1 {
+		t.Errorf("expected a single NF-e created, got %d", len(nfeRepo.created))
+	}
+
+	// An attempt not answered by NFe.io yet also blocks a new one
+	frappeRepo.invoices["INV-0002"] = newTimelineInvoice("INV-0002")
+	issuances.Create(&models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0002"})
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0002"); !errors.Is(err, ErrAlreadyIssued) {
+		t.Fatalf("expected the pending attempt to block, got %v", err)
+	}
+	if len(nfeRepo.created) != 1 {
+		t.Errorf("expected no NF-e created for INV-0002, got %d", len(nfeRepo.created)-1)
+	}
+}
+
+func TestIssuerRefusesNewAttemptAfterTimeout(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	// The call timed out: the note may exist at NFe.io
+	nfeRepo.createErr = fmt.Errorf("failed to send request: %w", context.DeadlineExceeded)
+	_, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001")
+	var unknown *OutcomeUnknownError
+	if !errors.Is(err, ErrOutcomeUnknown) || !errors.As(err, &unknown) {
+		t.Fatalf("expected ErrOutcomeUnknown with the attempt, got %v", err)
+	}
+	attempts, _ := issuances.ListByInvoice("INV-0001")
+	if len(attempts) != 1 || attempts[0].Status != models.IssuanceStatusUnknown || attempts[0].IsDeadLetter() {
+		t.Fatalf("expected one unknown attempt outside the dead letters, got %+v", attempts)
+	}
+	if unknown.IssuanceID != attempts[0].ID {
+		t.Errorf("expected the error to name attempt %d, got %d", attempts[0].ID, unknown.IssuanceID)
+	}
+
+	// NFe.io answers again, but the unknown attempt must be reconciled first
+	nfeRepo.createErr = nil
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); !errors.Is(err, ErrAlreadyIssued) {
+		t.Fatalf("expected the unknown attempt to block, got %v", err)
+	}
+	if len(nfeRepo.created) != 0 {
+		t.Errorf("expected no NF-e created, got %d", len(nfeRepo.created))
+	}
+
+	// A 5xx is no answer either, an explicit 4xx is
+	for status, want := range map[int]bool{503: true, 408: true, 422: false} {
+		err := createError(&repository.APIError{StatusCode: status})
+		if errors.Is(err, ErrOutcomeUnknown) != want {
+			t.Errorf("status %d: expected unknown %v, got %v", status, want, err)
+		}
+	}
+}
+
+func TestCancelInvoiceMarksIssuanceCancelling(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": {Name: "INV-0001", InvoiceID: "nfe-1"}}}
+	issuances := newTestIssuances(t)
+	issuance := &models.Issuance{Kind: models.IssuanceKindInvoice, InvoiceName: "INV-0001", NFeID: "nfe-1", Status: models.IssuanceStatusIssued}
+	issuances.Create(issuance)
+
+	svc := NewInvoiceEventService(frappeRepo, newTestCompanies(t, nfeRepo), issuances)
+	if err := svc.CancelInvoice(context.Background(), "INV-0001", "Pedido cancelado pelo cliente"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, _ := issuances.GetByNFeID("nfe-1")
+	if got.Status != models.IssuanceStatusCancelling {
+		t.Errorf("expected cancelling, got %s", got.Status)
+	}
+}
+
+func TestIssuanceMetrics(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	counter := func(status string) float64 {
+		return testutil.ToFloat64(metrics.Issuances.WithLabelValues(models.IssuanceKindInvoice, "company-1", status))
+	}
+	rejectedBefore, processingBefore := counter(models.IssuanceStatusRejected), counter(models.IssuanceStatusProcessing)
+	validationBefore := testutil.ToFloat64(metrics.SefazRejections.WithLabelValues("company-1", "nfeio_InvalidCFOP"))
+	sefazBefore := testutil.ToFloat64(metrics.SefazRejections.WithLabelValues("company-1", "sefaz_539"))
+
+	// Refused by NFe.io validation, then accepted for processing
+	nfeRepo.createErr = &repository.APIError{StatusCode: 400, Code: "InvalidCFOP"}
+	svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001")
+	nfeRepo.createErr = nil
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := counter(models.IssuanceStatusRejected) - rejectedBefore; got != 1 {
+		t.Errorf("expected 1 rejected attempt, got %v", got)
+	}
+	if got := counter(models.IssuanceStatusProcessing) - processingBefore; got != 1 {
+		t.Errorf("expected 1 attempt processing, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.SefazRejections.WithLabelValues("company-1", "nfeio_InvalidCFOP")) - validationBefore; got != 1 {
+		t.Errorf("expected the validation code to be counted, got %v", got)
+	}
+
+	// SEFAZ rejects the note later: counted by cStat, once however often it is looked up
+	attempts, _ := issuances.ListByInvoice("INV-0001")
+	issuance := &attempts[1]
+	response := &models.ProductInvoiceResponse{ID: "nfe-1", FlowStatus: flowStatusIssueFailed, FlowMessage: "Rejeição 539: Duplicidade de NF-e"}
+	applyResponse(issuance, response)
+	applyResponse(issuance, response)
+	if got := testutil.ToFloat64(metrics.SefazRejections.WithLabelValues("company-1", "sefaz_539")) - sefazBefore; got != 1 {
+		t.Errorf("expected the SEFAZ rejection to be counted once, got %v", got)
+	}
+	if reason := sefazReason("Lote em processamento"); reason != "sefaz_unknown" {
+		t.Errorf("expected an unknown reason, got %s", reason)
+	}
+}
@@ -1,11 +1,14 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
 	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
 )
@@ -21,81 +24,170 @@ const (
 )
 
 type IssuerService interface {
-	IssueNoteForFrappeInvoice(invoiceID string) (*models.ProductInvoiceResponse, error)
+	IssueNoteForFrappeInvoice(ctx context.Context, invoiceID string) (*models.ProductInvoiceResponse, error)
+	PreviewNoteForFrappeInvoice(ctx context.Context, invoiceID string) (*InvoicePreview, error)
 }
 
 type issuerService struct {
-	frappeRepo repository.FrappeRepository
-	nfeRepo    repository.NFeRepository
-	taxService *TaxService
-	companyID  string // Your Company ID in NFe.io
+	frappeRepo     repository.FrappeRepository
+	companies      *CompanyRegistry // Routes each invoice to its NFe.io company
+	numbering      *NumberingService
+	archive        ArchiveService
+	timeline       timeline
+	issuances      issuanceLog
+	taxService     *TaxService
+	builderService *BuilderService
+	rules          *FiscalRules // Configured CFOP rules and tax defaults
 }
 
-func NewIssuerService(f repository.FrappeRepository, n repository.NFeRepository, companyID string) IssuerService {
+func NewIssuerService(f repository.FrappeRepository, companies *CompanyRegistry, numbering *NumberingService, issuances repository.IssuanceRepository, outbox *OutboxDispatcher, rules *FiscalRules) IssuerService {
 	return &issuerService{
-		frappeRepo: f,
-		nfeRepo:    n,
-		taxService: NewTaxService(),
-		companyID:  companyID,
+		frappeRepo:     f,
+		companies:      companies,
+		numbering:      numbering,
+		archive:        NewArchiveService(f, companies, outbox),
+		timeline:       timeline{frappeRepo: f},
+		issuances:      issuanceLog{repo: issuances, outbox: outbox, numbering: numbering},
+		taxService:     NewTaxService(),
+		builderService: NewBuilderService(),
+		rules:          rules,
 	}
 }
 
-func (s *issuerService) IssueNoteForFrappeInvoice(invoiceID string) (*models.ProductInvoiceResponse, error) {
-	// 1. Get Data from ERPNext/Frappe
-	frappeInv, err := s.frappeRepo.GetInvoice(invoiceID)
+// IssueNoteForFrappeInvoice issues the NF-e of a Frappe invoice, recording the
+// attempt in the local issuance ledger and on the invoice timeline. Invoices
+// with an attempt in flight (pending, unknown, processing, authorized or
+// cancelling) are refused
+func (s *issuerService) IssueNoteForFrappeInvoice(ctx context.Context, invoiceID string) (*models.ProductInvoiceResponse, error) {
+	issuance, err := s.issuances.startExclusive(models.IssuanceKindInvoice, invoiceID, invoiceInput{InvoiceID: invoiceID})
 	if err != nil {
 		return nil, err
 	}
+	start := time.Now()
+	defer func() {
+		metrics.IssuanceDuration.WithLabelValues(metrics.Label(issuance.CompanyID), issuance.Status).Observe(time.Since(start).Seconds())
+	}()
+
+	response, payload, err := s.issueNote(ctx, invoiceID, issuance)
+	if err != nil {
+		s.issuances.finish(issuance, nil, err)
+		s.timeline.failure(ctx, invoiceID, eventIssuance, err)
+		return nil, withAttempt(issuance, err)
+	}
+
+	if response.FlowStatus == flowStatusIssueFailed {
+		s.timeline.failure(ctx, invoiceID, eventIssuance, fmt.Errorf("rejected by SEFAZ: %s", describeNote(response, payload.Serie, payload.Number)))
+	} else {
+		s.timeline.success(ctx, invoiceID, eventIssuance, describeNote(response, payload.Serie, payload.Number))
+	}
+
+	return response, nil
+}
+
+func (s *issuerService) issueNote(ctx context.Context, invoiceID string, issuance *models.Issuance) (*models.ProductInvoiceResponse, *models.ProductInvoiceRequest, error) {
+	// 1. Get Data from ERPNext/Frappe
+	frappeInv, err := s.frappeRepo.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 2-5. Resolve the company, fetch the linked documents and map the invoice
+	company, nfePayload, err := s.prepareNote(ctx, frappeInv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 6. Assign serie (and number, for explicit numbering) from the series policy
+	if err := s.numbering.Assign(company.NFeCompanyID, nfePayload); err != nil {
+		return nil, nil, err
+	}
+
+	// 7. Send to NFe.io
+	s.issuances.sending(issuance, company, nfePayload)
+	response, err := company.NFeRepo.CreateProductInvoice(ctx, company.NFeCompanyID, nfePayload)
+	if err != nil {
+		return nil, nil, createError(err)
+	}
+
+	// 8. Record the answer and the number used (gap detection), and update the
+	// Frappe invoice through the outbox so the NF-e is never orphaned when
+	// Frappe is unavailable
+	s.issuances.complete(ctx, issuance, response, invoiceWriteBack(response, nfePayload.Serie, nfePayload.Number, company.Environment))
+
+	// 9. Archive XML and DANFE in Frappe when SEFAZ already authorized the note
+	if response.FlowStatus == flowStatusIssued {
+		if _, err := s.archive.ArchiveInvoiceDocuments(ctx, invoiceID); err != nil {
+			fmt.Printf("Warning: Failed to archive NF-e documents: %v\n", err)
+		}
+	}
+
+	return response, nfePayload, nil
+}
+
+// prepareNote resolves the issuing company of the invoice, fetches its tax
+// template, carrier and referenced notes and maps it to the NFe.io payload.
+// Serie and number are not assigned yet
+func (s *issuerService) prepareNote(ctx context.Context, frappeInv *models.Invoices) (*Company, *models.ProductInvoiceRequest, error) {
+	// Resolve the issuing company (matriz/filial) of this invoice
+	company, err := s.companies.Resolve(frappeInv.Company)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.companies.checkEnvironment(ctx, company); err != nil {
+		return nil, nil, err
+	}
 
 	// 2. Get Tax Template if specified
 	var taxTemplate *models.FrappeTax
 	if frappeInv.TaxTemplate != "" {
-		taxTemplate, err = s.frappeRepo.GetTax(frappeInv.TaxTemplate)
+		taxTemplate, err = s.frappeRepo.GetTax(ctx, frappeInv.TaxTemplate)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get tax template: %v", err)
+			return nil, nil, fmt.Errorf("failed to get tax template: %v", err)
 		}
 	}
 
 	// 3. Get Carrier if specified
 	var carrier *models.Carrier
 	if frappeInv.Carrier != "" {
-		carrier, err = s.frappeRepo.GetCarrier(frappeInv.Carrier)
+		carrier, err = s.frappeRepo.GetCarrier(ctx, frappeInv.Carrier)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get carrier: %v", err)
+			return nil, nil, fmt.Errorf("failed to get carrier: %v", err)
 		}
 	}
 
-	// 4. Map ERPNext -> NFe.io
-	nfePayload, err := s.mapFrappeToNFe(frappeInv, taxTemplate, carrier)
-	if err != nil {
-		return nil, err
-	}
-
-	// 5. Send to NFe.io
-	response, err := s.nfeRepo.CreateProductInvoice(nfePayload)
+	// 4. Collect referenced NF-e (returns, warranty exchanges, complementary notes)
+	// and make sure each one exists at NFe.io
+	refs, err := s.collectReferences(frappeInv)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	// 6. Update Frappe invoice with NFe.io response
-	updateData := map[string]interface{}{
-		"invoice_id":    response.ID,
-		"invoice_serie": nfePayload.Serie,
-		"invoice_link":  response.PdfUrl,
+	if err := s.validateReferences(ctx, company.NFeRepo, refs); err != nil {
+		return nil, nil, err
 	}
 
-	err = s.frappeRepo.UpdateInvoice(invoiceID, updateData)
+	// 5. Map ERPNext -> NFe.io
+	nfePayload, err := s.mapFrappeToNFe(frappeInv, company, taxTemplate, carrier, refs)
 	if err != nil {
-		// Log error but don't fail - invoice was created successfully
-		fmt.Printf("Warning: Failed to update Frappe invoice: %v\n", err)
+		return nil, nil, err
 	}
+	company.applyEnvironment(nfePayload)
 
-	return response, nil
+	return company, nfePayload, nil
 } // Mapper Function (Pure Logic) - Adapted from docs/invoice/index.go
-func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, taxTemplate *models.FrappeTax, carrier *models.Carrier) (*models.ProductInvoiceRequest, error) {
+func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, company *Company, taxTemplate *models.FrappeTax, carrier *models.Carrier, refs []documentReference) (*models.ProductInvoiceRequest, error) {
 	var items []models.Items
 
+	// Determine operation type (entrada/saída) from the natureza
+	operationType := s.builderService.DetermineOperationDirection(inv.OperationType)
+
+	// Determine CFOP from the natureza and the issuer/buyer states
+	cfop, err := s.determineItemCFOP(inv, company, operationType)
+	if err != nil {
+		return nil, err
+	}
+
 	// Map items with tax calculations
+	defaults := s.rules.TaxDefaults()
 	for i, item := range inv.InvoicesTable {
 		// Use tax template values if available, otherwise use item-specific values
 		var taxInput TaxInput
@@ -125,17 +217,18 @@ func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, taxTemplate *models
 				ItemValue:      item.Rate,
 				Quantity:       float64(item.Quantity),
 				AliqICMS:       icmsRate,
-				CSTICMS:        "00",
-				OrigemICMS:     "0",
-				ModDetermBC:    "3",
+				CSTICMS:        defaults.CSTICMS,
+				OrigemICMS:     defaults.OrigemICMS,
+				ModDetermBC:    defaults.ModDetermBC,
 				AliquotaPis:    pisRate,
-				CSTPis:         "01",
+				CSTPis:         defaults.CSTPis,
 				AliquotaCofins: cofinsRate,
-				CSTCofins:      "01",
+				CSTCofins:      defaults.CSTCofins,
 				AliquotaIPI:    ipiRate,
-				CSTIPI:         "50",
+				CSTIPI:         defaults.CSTIPI,
 			}
 		}
+		taxInput.SimplesNacional = company.TaxRegime == taxRegimeSimplesNacional
 
 		calculatedTax := s.taxService.CalculateTax(taxInput)
 
@@ -145,7 +238,7 @@ func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, taxTemplate *models
 			CodeTaxGTIN: "SEM GTIN",
 			Description: item.ItemName,
 			Ncm:         item.NCM,
-			Cfop:        5102, // Default, should be determined based on operation
+			Cfop:        cfop,
 			Unit:        "UN",
 			Quantity:    item.Quantity,
 			UnitAmount:  item.Rate,
@@ -169,27 +262,19 @@ func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, taxTemplate *models
 	transport := s.buildTransport(inv, carrier)
 
 	// Determine destination (internal or interstate)
-	destination := s.determineDestination(inv)
-
-	// Determine operation type based on Frappe data
-	operationType := "outgoing"
-	if inv.OperationType != "" {
-		// Aqui tem que dar um erro caso o OperationType seja vazio ou invalido
-		// Somente outgoing & ongoing que sao validos.
-		// Map Frappe operation type to NFe.io format if needed
-		operationType = "outgoing"
-	}
+	destination := s.determineDestination(inv, company)
 
+	// Serie and number are assigned afterwards by the NumberingService
 	payload := &models.ProductInvoiceRequest{
-		Serie:         1, // Configure based on operation type
-		OperationType: operationType,
-		ConsumerType:  s.determineConsumerType(inv),
-		PurposeType:   "normal",
-		Destination:   destination,
-		Buyer:         *buyer,
-		Items:         items,
-		Payment:       payment,
-		Transport:     transport,
+		OperationNature: inv.OperationType,
+		OperationType:   operationType,
+		ConsumerType:    s.determineConsumerType(inv),
+		PurposeType:     "normal",
+		Destination:     destination,
+		Buyer:           *buyer,
+		Items:           items,
+		Payment:         payment,
+		Transport:       transport,
 	}
 
 	// Add additional information if present
@@ -199,6 +284,14 @@ func (s *issuerService) mapFrappeToNFe(inv *models.Invoices, taxTemplate *models
 		}
 	}
 
+	// Add referenced documents group (NFref) if present
+	if len(refs) > 0 {
+		if payload.AdditionalInformation == nil {
+			payload.AdditionalInformation = &models.AdditionalInformation{}
+		}
+		payload.AdditionalInformation.TaxDocumentsReference = buildTaxDocumentsReference(refs)
+	}
+
 	return payload, nil
 }
 
@@ -353,10 +446,32 @@ func (s *issuerService) buildPayment() []models.Payment {
 
 // determineDestination determines if it's internal or interstate operation
 // Adapted from docs/invoice/build.go destination method
-func (s *issuerService) determineDestination(inv *models.Invoices) string {
-	// This should compare buyer's state with issuer's state
-	// For now, returning a default value
-	return "interstate_Operation"
+func (s *issuerService) determineDestination(inv *models.Invoices, company *Company) string {
+	// Without the issuer state we keep the historical default
+	if company.State == "" || inv.DeliveryState == "" {
+		return "interstate_Operation"
+	}
+	destination, _ := s.builderService.DetermineDestination(strings.ToUpper(inv.DeliveryState), company.State)
+	return destination
+}
+
+// determineItemCFOP resolves the CFOP of the items from the natureza, operation
+// type and the buyer/issuer states
+func (s *issuerService) determineItemCFOP(inv *models.Invoices, company *Company, operationType string) (int, error) {
+	unknownStates := company.State == "" || inv.DeliveryState == ""
+
+	// Configured rules first; without the states a template is resolved as an
+	// operation within the state
+	if cfop, ok := s.rules.resolveCFOP(inv.OperationType, operationType); ok {
+		sameState := unknownStates || strings.EqualFold(inv.DeliveryState, company.State)
+		return s.builderService.resolveCFOPCode(cfop, sameState, operationType == operationOutgoing), nil
+	}
+
+	// Without the issuer state we keep the historical default
+	if unknownStates {
+		return 5102, nil
+	}
+	return s.builderService.DetermineCFOP(inv.OperationType, operationType, strings.ToUpper(inv.DeliveryState), company.State)
 }
 
 // determineConsumerType determines if it's final consumer or normal
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// newTestCompanies returns a registry with a single default company
+// ("company-1", issuing from SP) backed by the given fake repository,
+// serving a production Frappe site
+func newTestCompanies(t *testing.T, nfeRepo repository.NFeRepository) *CompanyRegistry {
+	t.Helper()
+	companies, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Matriz", NFeCompanyID: "company-1", NFeAPIKey: "key-1", State: "SP"},
+	}, "AnyGrid Matriz", "", func(apiKey string) repository.NFeRepository { return nfeRepo })
+	if err != nil {
+		t.Fatalf("failed to build company registry: %v", err)
+	}
+	companies.SetSiteEnvironment(EnvironmentProduction)
+	return companies
+}
+
+// newTestNumbering returns a NumberingService backed by a ledger in a
+// temporary store
+func newTestNumbering(t *testing.T, policy *SeriesPolicy) (*NumberingService, repository.LedgerRepository) {
+	t.Helper()
+	ledger := repository.NewStoreLedgerRepo(newTestStore(t))
+	return NewNumberingService(policy, ledger), ledger
+}
+
+// newTestStore opens an embedded store in a temporary directory
+func newTestStore(t *testing.T) *repository.Store {
+	t.Helper()
+	store, err := repository.OpenStore(filepath.Join(t.TempDir(), "bridge.db"))
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newTestIssuances opens an issuance ledger in a temporary store
+func newTestIssuances(t *testing.T) repository.IssuanceRepository {
+	t.Helper()
+	return repository.NewIssuanceRepo(newTestStore(t))
+}
+
+// newTestOutbox returns a dispatcher delivering to the fake Frappe repository
+// from a temporary store
+func newTestOutbox(t *testing.T, f repository.FrappeRepository) *OutboxDispatcher {
+	t.Helper()
+	return NewOutboxDispatcher(f, repository.NewOutboxRepo(newTestStore(t)), repository.RetryPolicy{}, 0)
+}
+
+// newTestWriteBacks returns an issuance ledger and an outbox dispatcher sharing
+// one temporary store, as the issuance flows record both in one transaction
+func newTestWriteBacks(t *testing.T, f repository.FrappeRepository) (repository.IssuanceRepository, *OutboxDispatcher) {
+	t.Helper()
+	store := newTestStore(t)
+	outbox := NewOutboxDispatcher(f, repository.NewOutboxRepo(store), repository.RetryPolicy{}, 0)
+	return repository.NewIssuanceRepo(store), outbox
+}
+
+// fakeNFeRepo is an in-memory NFeRepository used by the service tests
+type fakeNFeRepo struct {
+	byID          map[string]*models.ProductInvoiceResponse
+	byAccessKey   map[string]*models.ProductInvoiceResponse
+	created       []*models.ProductInvoiceRequest
+	createdFor    []string // companyKey of each created invoice
+	disablements  []*models.DisablementRequest
+	createErr     error                           // Returned by CreateProductInvoice when set
+	deleted       []string                        // Ids of canceled invoices
+	deleteReasons []string                        // Justifications of the cancellations
+	deleteErr     error                           // Returned by DeleteInvoice when set
+	listed        []models.ProductInvoiceResponse // Notes returned by ListInvoices, newest first
+	listErr       error                           // Returned by ListInvoices when set
+	listCalls     int                             // Calls of ListInvoices
+	stateTaxes    []models.StateTax               // Returned by GetStateTaxes; a production registration in SP when nil
+}
+
+func (f *fakeNFeRepo) CreateProductInvoice(ctx context.Context, companyKey string, req *models.ProductInvoiceRequest) (*models.ProductInvoiceResponse, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	f.created = append(f.created, req)
+	f.createdFor = append(f.createdFor, companyKey)
+	return &models.ProductInvoiceResponse{ID: fmt.Sprintf("nfe-%d", len(f.created)), Status: "created"}, nil
+}
+
+func (f *fakeNFeRepo) GetInvoice(ctx context.Context, companyKey, id string) (*models.ProductInvoiceResponse, error) {
+	if inv, ok := f.byID[id]; ok {
+		return inv, nil
+	}
+	return nil, &repository.APIError{StatusCode: 404, Messages: []string{"invoice " + id + " not found"}}
+}
+
+func (f *fakeNFeRepo) GetInvoiceByAccessKey(ctx context.Context, accessKey string) (*models.ProductInvoiceResponse, error) {
+	if inv, ok := f.byAccessKey[accessKey]; ok {
+		return inv, nil
+	}
+	return nil, fmt.Errorf("nfe.io API error: status 404")
+}
+
+func (f *fakeNFeRepo) DeleteInvoice(ctx context.Context, companyKey, id, reason string) error {
+	if f.deleteErr != nil {
+		return f.deleteErr
+	}
+	f.deleted = append(f.deleted, id)
+	f.deleteReasons = append(f.deleteReasons, reason)
+	return nil
+}
+
+func (f *fakeNFeRepo) ListInvoices(ctx context.Context, companyKey string, opts repository.NFeListOptions) (*models.ProductInvoiceList, error) {
+	f.listCalls++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	start := 0
+	for i, note := range f.listed {
+		if note.ID == opts.StartingAfter {
+			start = i + 1
+		}
+	}
+	end := len(f.listed)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+	return &models.ProductInvoiceList{ProductInvoices: f.listed[start:end], HasMore: end < len(f.listed)}, nil
+}
+
+func (f *fakeNFeRepo) GetInvoicePDF(ctx context.Context, companyKey, id string) ([]byte, error) {
+	return []byte("%PDF " + id), nil
+}
+
+func (f *fakeNFeRepo) GetInvoiceXML(ctx context.Context, companyKey, id string) ([]byte, error) {
+	return []byte("<nfeProc>" + id + "</nfeProc>"), nil
+}
+
+func (f *fakeNFeRepo) CreateCorrectionLetter(ctx context.Context, companyKey, id, reason string) (*models.ProductInvoiceResponse, error) {
+	return &models.ProductInvoiceResponse{ID: id}, nil
+}
+
+func (f *fakeNFeRepo) GetCorrectionLetterPDF(ctx context.Context, companyKey, id string) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeNFeRepo) GetCorrectionLetterXML(ctx context.Context, companyKey, id string) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeNFeRepo) GetCompany(ctx context.Context, companyKey string) (*models.NFeCompany, error) {
+	return &models.NFeCompany{ID: companyKey, FederalTaxNumber: 12345678000190}, nil
+}
+
+func (f *fakeNFeRepo) GetStateTaxes(ctx context.Context, companyKey string) ([]models.StateTax, error) {
+	if f.stateTaxes == nil {
+		return []models.StateTax{{Code: "SP", TaxNumber: "123456789", EnvironmentType: "Production"}}, nil
+	}
+	return f.stateTaxes, nil
+}
+
+func (f *fakeNFeRepo) DisableNumberRange(ctx context.Context, companyKey string, req *models.DisablementRequest) (*models.DisablementResponse, error) {
+	f.disablements = append(f.disablements, req)
+	return &models.DisablementResponse{ID: fmt.Sprintf("dis-%d", len(f.disablements)), Status: "pending"}, nil
+}
+
+func (f *fakeNFeRepo) GetDisablement(ctx context.Context, companyKey, id string) (*models.DisablementResponse, error) {
+	return &models.DisablementResponse{ID: id}, nil
+}
+
+// fakeFrappeRepo is an in-memory FrappeRepository used by the service tests
+type fakeFrappeRepo struct {
+	invoices    map[string]*models.Invoices
+	updates     map[string]map[string]interface{}
+	attachments map[string][]*models.FrappeFile // Attachments per invoice
+	contents    map[string][]byte               // Content per file name
+	comments    map[string][]string             // Timeline comments per invoice
+	errorLogs   map[string][]string             // Error Log titles per invoice
+	updateErrs  int                             // UpdateInvoice fails this many times first
+	pingErr     error                           // Returned by Ping when set
+}
+
+func (f *fakeFrappeRepo) GetInvoice(ctx context.Context, id string) (*models.Invoices, error) {
+	if inv, ok := f.invoices[id]; ok {
+		return inv, nil
+	}
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetTax(ctx context.Context, id string) (*models.FrappeTax, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetCarrier(ctx context.Context, id string) (*models.Carrier, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetCustomer(ctx context.Context, id string) (*models.FrappeCustomer, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetAddress(ctx context.Context, id string) (*models.FrappeAddress, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetItem(ctx context.Context, id string) (*models.FrappeItem, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) GetCompany(ctx context.Context, id string) (*models.FrappeCompany, error) {
+	return nil, fmt.Errorf("frappe returned status: 404")
+}
+
+func (f *fakeFrappeRepo) UpdateInvoice(ctx context.Context, id string, data map[string]interface{}) error {
+	if f.updateErrs > 0 {
+		f.updateErrs--
+		return fmt.Errorf("frappe returned status: 503")
+	}
+	if f.updates == nil {
+		f.updates = make(map[string]map[string]interface{})
+	}
+	if f.updates[id] == nil {
+		f.updates[id] = make(map[string]interface{})
+	}
+	for k, v := range data {
+		f.updates[id][k] = v
+	}
+	return nil
+}
+
+// ListInvoices returns the submitted and cancelled invoices ordered by name;
+// the range is not filtered
+func (f *fakeFrappeRepo) ListInvoices(ctx context.Context, from, to time.Time) ([]models.Invoices, error) {
+	var invoices []models.Invoices
+	for _, inv := range f.invoices {
+		if inv.DocStatus > 0 {
+			invoices = append(invoices, *inv)
+		}
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].Name < invoices[j].Name })
+	return invoices, nil
+}
+
+func (f *fakeFrappeRepo) ReplaceInvoiceAttachment(ctx context.Context, id, fileName, replacePrefix string, content []byte) (*models.FrappeFile, error) {
+	if f.attachments == nil {
+		f.attachments = make(map[string][]*models.FrappeFile)
+		f.contents = make(map[string][]byte)
+	}
+
+	var kept []*models.FrappeFile
+	for _, file := range f.attachments[id] {
+		if !strings.HasPrefix(file.FileName, replacePrefix) {
+			kept = append(kept, file)
+		}
+	}
+
+	file := &models.FrappeFile{
+		Name:              fmt.Sprintf("file-%d", len(f.contents)+1),
+		FileName:          fileName,
+		FileURL:           "/private/files/" + fileName,
+		IsPrivate:         1,
+		AttachedToDoctype: "Invoices",
+		AttachedToName:    id,
+	}
+	f.attachments[id] = append(kept, file)
+	f.contents[fileName] = content
+	return file, nil
+}
+
+func (f *fakeFrappeRepo) AddInvoiceComment(ctx context.Context, id, content string) error {
+	if f.comments == nil {
+		f.comments = make(map[string][]string)
+	}
+	f.comments[id] = append(f.comments[id], content)
+	return nil
+}
+
+func (f *fakeFrappeRepo) Ping(ctx context.Context) error {
+	return f.pingErr
+}
+
+func (f *fakeFrappeRepo) LogInvoiceError(ctx context.Context, id, title, message string) error {
+	if f.errorLogs == nil {
+		f.errorLogs = make(map[string][]string)
+	}
+	f.errorLogs[id] = append(f.errorLogs[id], title)
+	return nil
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// defaultOutboxRetry is used when no outbox policy is configured: about an
+// hour and a half of attempts before a write-back is dead-lettered
+var defaultOutboxRetry = repository.RetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   10 * time.Second,
+	MaxDelay:    15 * time.Minute,
+}
+
+// OutboxDispatcher delivers the Frappe write-backs kept in the outbox. The
+// messages of one invoice are delivered in order: a message waiting for a
+// retry holds back the newer ones of the same invoice. After the policy's
+// MaxAttempts a message is dead-lettered
+type OutboxDispatcher struct {
+	frappeRepo repository.FrappeRepository
+	outbox     repository.OutboxRepository
+	policy     repository.RetryPolicy
+	interval   time.Duration // Pause between background dispatch rounds
+
+	mu   sync.Mutex // One round at a time keeps the per-invoice order
+	wake chan struct{}
+	now  func() time.Time
+}
+
+// NewOutboxDispatcher creates the dispatcher; a zero policy uses 10 attempts
+// with 10s-15m backoff and a zero interval polls every 5s
+func NewOutboxDispatcher(f repository.FrappeRepository, outbox repository.OutboxRepository, policy repository.RetryPolicy, interval time.Duration) *OutboxDispatcher {
+	if policy.MaxAttempts <= 0 {
+		policy = defaultOutboxRetry
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &OutboxDispatcher{
+		frappeRepo: f,
+		outbox:     outbox,
+		policy:     policy,
+		interval:   interval,
+		wake:       make(chan struct{}, 1),
+		now:        time.Now,
+	}
+}
+
+// Enqueue stores a write-back for the invoice
+func (d *OutboxDispatcher) Enqueue(invoiceName string, data map[string]interface{}) error {
+	return d.outbox.Enqueue(&models.OutboxMessage{InvoiceName: invoiceName, Data: data})
+}
+
+// Flush delivers the due messages of one invoice right away, so Frappe is
+// updated before the request that produced them returns. Whatever fails is
+// left to the background dispatcher, which is also woken instead when it is
+// in the middle of a round
+func (d *OutboxDispatcher) Flush(ctx context.Context, invoiceName string) error {
+	if !d.mu.TryLock() {
+		d.Notify()
+		return nil
+	}
+	defer d.mu.Unlock()
+	return d.dispatch(ctx, invoiceName)
+}
+
+// DispatchOnce delivers every due message once
+func (d *OutboxDispatcher) DispatchOnce(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dispatch(ctx, "")
+}
+
+// Run dispatches in the background until ctx is canceled
+func (d *OutboxDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.DispatchOnce(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Warning: Outbox dispatch failed: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Notify wakes the background dispatcher without waiting for the next tick
+func (d *OutboxDispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers the due pending messages, of a single invoice when
+// invoiceName is set. The first failure of an invoice stops its later
+// messages. Callers hold mu
+func (d *OutboxDispatcher) dispatch(ctx context.Context, invoiceName string) error {
+	pending, err := d.outbox.ListPending()
+	if err != nil {
+		return err
+	}
+
+	blocked := make(map[string]bool)
+	var failures int
+	for i := range pending {
+		msg := &pending[i]
+		if invoiceName != "" && msg.InvoiceName != invoiceName {
+			continue
+		}
+		if blocked[msg.InvoiceName] || d.now().Before(msg.NextAttemptAt) {
+			blocked[msg.InvoiceName] = true
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !d.deliver(ctx, msg) {
+			blocked[msg.InvoiceName] = true
+			failures++
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d write-back(s) failed and will be retried", failures)
+	}
+	return nil
+}
+
+// deliver writes one message to Frappe and records the outcome
+func (d *OutboxDispatcher) deliver(ctx context.Context, msg *models.OutboxMessage) bool {
+	err := d.frappeRepo.UpdateInvoice(ctx, msg.InvoiceName, msg.Data)
+	msg.Attempts++
+
+	delivered := err == nil
+	switch {
+	case delivered:
+		msg.Status = models.OutboxStatusDelivered
+		msg.LastError = ""
+	case msg.Attempts >= d.policy.MaxAttempts:
+		msg.Status = models.OutboxStatusDead
+		msg.LastError = err.Error()
+		fmt.Printf("Warning: Write-back %d of %s dead-lettered after %d attempts: %v\n", msg.ID, msg.InvoiceName, msg.Attempts, err)
+	default:
+		msg.LastError = err.Error()
+		msg.NextAttemptAt = d.now().Add(d.policy.Backoff(msg.Attempts))
+	}
+
+	if err := d.outbox.Update(msg); err != nil {
+		fmt.Printf("Warning: Failed to record write-back %d: %v\n", msg.ID, err)
+		return false
+	}
+	// A dead message no longer holds back the newer ones of its invoice
+	return delivered || msg.Status == models.OutboxStatusDead
+}
+
+// writeBack enqueues the fields of the invoice and delivers them right away
+// (used outside the issuance flow, e.g. archived document URLs)
+func (d *OutboxDispatcher) writeBack(ctx context.Context, invoiceName string, data map[string]interface{}) {
+	if err := d.Enqueue(invoiceName, data); err != nil {
+		// The store is unavailable: write to Frappe directly
+		fmt.Printf("Warning: Failed to enqueue write-back: %v\n", err)
+		if err := d.frappeRepo.UpdateInvoice(ctx, invoiceName, data); err != nil {
+			fmt.Printf("Warning: Failed to update Frappe invoice: %v\n", err)
+		}
+		return
+	}
+	if err := d.Flush(ctx, invoiceName); err != nil {
+		fmt.Printf("Warning: Failed to update Frappe invoice, will retry: %v\n", err)
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestOutboxKeepsOrderPerInvoice(t *testing.T) {
+	frappeRepo := &fakeFrappeRepo{updateErrs: 1}
+	outboxRepo := repository.NewOutboxRepo(newTestStore(t))
+	dispatcher := NewOutboxDispatcher(frappeRepo, outboxRepo, repository.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Minute}, 0)
+	now := time.Now().Add(time.Second) // Past the enqueue time
+	dispatcher.now = func() time.Time { return now }
+
+	dispatcher.Enqueue("INV-0001", map[string]interface{}{"invoice_id": "nfe-1"})
+	dispatcher.Enqueue("INV-0001", map[string]interface{}{"invoice_xml": "/private/files/nfe-1.xml"})
+	dispatcher.Enqueue("INV-0002", map[string]interface{}{"invoice_id": "nfe-2"})
+
+	// The first write-back of INV-0001 fails: its second one waits, INV-0002 is delivered
+	if err := dispatcher.DispatchOnce(context.Background()); err == nil {
+		t.Fatal("expected the failed delivery reported")
+	}
+	if frappeRepo.updates["INV-0001"] != nil || frappeRepo.updates["INV-0002"]["invoice_id"] != "nfe-2" {
+		t.Fatalf("unexpected updates %v", frappeRepo.updates)
+	}
+	first, _ := outboxRepo.Get(1)
+	if first.Attempts != 1 || first.LastError == "" || !first.NextAttemptAt.After(now) {
+		t.Errorf("expected the first write-back scheduled for a retry, got %+v", first)
+	}
+
+	// Nothing is due before the backoff elapses
+	dispatcher.DispatchOnce(context.Background())
+	if frappeRepo.updates["INV-0001"] != nil {
+		t.Fatal("expected no delivery before the retry is due")
+	}
+
+	now = now.Add(time.Minute)
+	if err := dispatcher.DispatchOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frappeRepo.updates["INV-0001"]["invoice_id"] != "nfe-1" || frappeRepo.updates["INV-0001"]["invoice_xml"] == nil {
+		t.Errorf("expected both write-backs of INV-0001 delivered, got %v", frappeRepo.updates["INV-0001"])
+	}
+	if pending, _ := outboxRepo.ListPending(); len(pending) != 0 {
+		t.Errorf("expected an empty outbox, got %+v", pending)
+	}
+}
+
+func TestOutboxDeadLettersAfterMaxAttempts(t *testing.T) {
+	frappeRepo := &fakeFrappeRepo{updateErrs: 5}
+	outboxRepo := repository.NewOutboxRepo(newTestStore(t))
+	dispatcher := NewOutboxDispatcher(frappeRepo, outboxRepo, repository.RetryPolicy{MaxAttempts: 2}, 0)
+	now := time.Now().Add(time.Second) // Past the enqueue time
+	dispatcher.now = func() time.Time { return now }
+
+	dispatcher.Enqueue("INV-0001", map[string]interface{}{"invoice_id": "nfe-1"})
+	dispatcher.Enqueue("INV-0001", map[string]interface{}{"invoice_xml": "/private/files/nfe-1.xml"})
+	for i := 0; i < 2; i++ {
+		dispatcher.DispatchOnce(context.Background())
+		now = now.Add(time.Hour)
+	}
+
+	dead, _ := outboxRepo.List(models.OutboxStatusDead)
+	if len(dead) != 1 || dead[0].ID != 1 || dead[0].Attempts != 2 {
+		t.Fatalf("expected the first write-back dead after 2 attempts, got %+v", dead)
+	}
+
+	// A dead write-back no longer holds back the next one
+	frappeRepo.updateErrs = 0
+	dispatcher.DispatchOnce(context.Background())
+	if frappeRepo.updates["INV-0001"]["invoice_xml"] == nil {
+		t.Errorf("expected the second write-back delivered, got %v", frappeRepo.updates)
+	}
+}
+
+func TestIssuerWriteBackSurvivesFrappeFailure(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{
+		invoices:   map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")},
+		updateErrs: 1,
+	}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	now := time.Now().Add(time.Second)
+	outbox.now = func() time.Time { return now }
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frappeRepo.updates["INV-0001"] != nil {
+		t.Fatalf("expected the first write-back to fail, got %v", frappeRepo.updates)
+	}
+
+	// The background dispatcher delivers it once the retry is due
+	now = now.Add(time.Hour)
+	if err := outbox.DispatchOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frappeRepo.updates["INV-0001"]["invoice_id"] != "nfe-1" {
+		t.Errorf("expected the NF-e ID written back, got %v", frappeRepo.updates["INV-0001"])
+	}
+}
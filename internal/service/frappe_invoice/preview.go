@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+var ncmPattern = regexp.MustCompile(`^\d{8}$`)
+
+// InvoicePreview is what issuing a Frappe invoice would send to NFe.io. Errors
+// would stop the issuance; warnings would not but deserve a look
+type InvoicePreview struct {
+	Invoice  string                        `json:"invoice"`
+	Company  string                        `json:"company,omitempty"` // NFe.io company
+	Valid    bool                          `json:"valid"`
+	Payload  *models.ProductInvoiceRequest `json:"payload,omitempty"`
+	Totals   *PreviewTotals                `json:"totals,omitempty"`
+	Errors   []string                      `json:"errors,omitempty"`
+	Warnings []string                      `json:"warnings,omitempty"`
+}
+
+// PreviewTotals are the note totals computed from the mapped items
+type PreviewTotals struct {
+	Products float64 `json:"products"` // vProd
+	ICMSBase float64 `json:"icms_base"`
+	ICMS     float64 `json:"icms"`
+	IPI      float64 `json:"ipi"`
+	PIS      float64 `json:"pis"`
+	COFINS   float64 `json:"cofins"`
+	Taxes    float64 `json:"taxes"`
+	Invoice  float64 `json:"invoice"` // vNF: products plus IPI
+}
+
+// PreviewNoteForFrappeInvoice maps the Frappe invoice, calculates its taxes
+// and validates it exactly as IssueNoteForFrappeInvoice would, without
+// reserving a number or calling NFe.io to create the note
+func (s *issuerService) PreviewNoteForFrappeInvoice(ctx context.Context, invoiceID string) (*InvoicePreview, error) {
+	frappeInv, err := s.frappeRepo.GetInvoice(ctx, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &InvoicePreview{Invoice: invoiceID}
+	if err := s.issuances.checkNotIssued(invoiceID); err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+
+	company, payload, err := s.prepareNote(ctx, frappeInv)
+	if err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+		return preview, nil
+	}
+	preview.Company = company.NFeCompanyID
+
+	// The serie comes from the policy; the number is only reserved on issuance
+	serie, err := s.numbering.ResolveSerie(company.NFeCompanyID, payload)
+	if err != nil {
+		preview.Errors = append(preview.Errors, err.Error())
+	}
+	payload.Serie = serie
+
+	preview.Payload = payload
+	preview.Totals = previewTotals(payload)
+	preview.Warnings = previewWarnings(frappeInv, payload, preview.Totals)
+	preview.Valid = len(preview.Errors) == 0
+
+	return preview, nil
+}
+
+func previewTotals(payload *models.ProductInvoiceRequest) *PreviewTotals {
+	totals := &PreviewTotals{}
+	for _, item := range payload.Items {
+		totals.Products += item.TotalAmount
+		totals.ICMSBase += item.Tax.Icms.BaseTax
+		totals.ICMS += item.Tax.Icms.Amount
+		totals.IPI += item.Tax.Ipi.Amount
+		totals.PIS += item.Tax.Pis.Amount
+		totals.COFINS += item.Tax.Cofins.Amount
+		totals.Taxes += item.Tax.TotalTax
+	}
+	totals.Invoice = totals.Products + totals.IPI
+	return totals
+}
+
+// previewWarnings flags what NFe.io accepts but is likely a mistake in the
+// Frappe invoice
+func previewWarnings(inv *models.Invoices, payload *models.ProductInvoiceRequest, totals *PreviewTotals) []string {
+	var warnings []string
+
+	if len(payload.Items) == 0 {
+		warnings = append(warnings, "the invoice has no items")
+	}
+	for i, item := range payload.Items {
+		if !ncmPattern.MatchString(item.Ncm) {
+			warnings = append(warnings, fmt.Sprintf("item %d (%s): NCM %q should have 8 digits", i+1, item.Description, item.Ncm))
+		}
+		if item.Quantity <= 0 || item.UnitAmount <= 0 {
+			warnings = append(warnings, fmt.Sprintf("item %d (%s): quantity and rate should be positive", i+1, item.Description))
+		}
+	}
+
+	if inv.TaxTemplate == "" {
+		warnings = append(warnings, "no tax template: rates taken from the items with default CSTs")
+	}
+	if inv.DeliveryAddress == "" {
+		warnings = append(warnings, "no delivery address: the buyer address is left out of the NF-e")
+	}
+	if payload.Buyer.Email == "" {
+		warnings = append(warnings, "no client email: NFe.io will not send the DANFE to the buyer")
+	}
+
+	if inv.Total > 0 && math.Abs(inv.Total-totals.Products) > amountTolerance {
+		warnings = append(warnings, fmt.Sprintf("invoice total %.2f differs from the NF-e products total %.2f", inv.Total, totals.Products))
+	}
+	if inv.TotalTax > 0 && math.Abs(inv.TotalTax-totals.Invoice) > amountTolerance {
+		warnings = append(warnings, fmt.Sprintf("invoice total with taxes %.2f differs from the NF-e total %.2f", inv.TotalTax, totals.Invoice))
+	}
+
+	return warnings
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestPreviewNoteForFrappeInvoice(t *testing.T) {
+	inv := newTimelineInvoice("INV-0001")
+	inv.InvoicesTable = append(inv.InvoicesTable, models.ItemInvoice{ItemName: "Cabo", Rate: 25, Quantity: 2, NCM: "8544"})
+	inv.Total = 150
+	broken := newTimelineInvoice("INV-0002")
+	broken.ClientIDNumber = "123"
+
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": inv, "INV-0002": broken}}
+	numbering, ledger := newTestNumbering(t, &SeriesPolicy{Rules: []config.SeriesRule{
+		{OperationType: "outgoing", Serie: 2, ExplicitNumbering: true},
+	}})
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	preview, err := svc.PreviewNoteForFrappeInvoice(context.Background(), "INV-0001")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !preview.Valid || preview.Company != "company-1" || preview.Payload == nil || preview.Payload.Serie != 2 || preview.Payload.Number != 0 {
+		t.Fatalf("expected a valid preview on serie 2 without a number, got %+v", preview)
+	}
+	if preview.Totals.Products != 150 || preview.Totals.Invoice < preview.Totals.Products {
+		t.Errorf("unexpected totals %+v", preview.Totals)
+	}
+	warnings := strings.Join(preview.Warnings, "\n")
+	if !strings.Contains(warnings, `item 2 (Cabo): NCM "8544"`) || !strings.Contains(warnings, "no tax template") || strings.Contains(warnings, "invoice total 150.00") {
+		t.Errorf("unexpected warnings %v", preview.Warnings)
+	}
+
+	// Nothing was sent, reserved or recorded
+	if len(nfeRepo.created) != 0 {
+		t.Errorf("expected no NF-e created, got %d", len(nfeRepo.created))
+	}
+	if last, _ := ledger.LastNumber("company-1", 2); last != 0 {
+		t.Errorf("expected no number reserved, got %d", last)
+	}
+	if attempts, _ := issuances.ListByInvoice("INV-0001"); len(attempts) != 0 {
+		t.Errorf("expected no issuance recorded, got %+v", attempts)
+	}
+
+	// Mapping errors are reported instead of failing the request
+	preview, err = svc.PreviewNoteForFrappeInvoice(context.Background(), "INV-0002")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if preview.Valid || len(preview.Errors) != 1 || !strings.Contains(preview.Errors[0], "invalid tax number length") || preview.Payload != nil {
+		t.Errorf("expected the invalid tax number reported, got %+v", preview)
+	}
+}
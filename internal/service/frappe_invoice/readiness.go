@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// upstreamCheckTTL is how long the result of a Frappe or NFe.io check is
+// reused: probes come every few seconds from each replica and load balancer,
+// and must not turn into a steady load on the upstreams
+const upstreamCheckTTL = 15 * time.Second
+
+// ReadinessCheck is the result of one dependency check
+type ReadinessCheck struct {
+	Name     string `json:"name"`
+	Ready    bool   `json:"ready"`
+	Detail   string `json:"detail,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Readiness tells whether the bridge can take new issuances
+type Readiness struct {
+	Ready    bool             `json:"ready"`
+	Draining bool             `json:"draining"` // Shutting down: no new requests
+	Checks   []ReadinessCheck `json:"checks"`
+}
+
+// ReadinessService checks Frappe and NFe.io reachability, the local store and
+// the depth of the Frappe write-back queue. The upstreams are probed through
+// repositories of their own, without retries or circuit breaker, so a check
+// answers within the timeout and never counts toward opening a circuit. NFe.io
+// is probed once per API key, and upstream results are reused for
+// upstreamCheckTTL
+type ReadinessService struct {
+	frappeRepo    repository.FrappeRepository
+	companies     *CompanyRegistry
+	nfeRepos      map[string]repository.NFeRepository // Probe of each API key
+	store         *repository.Store
+	outbox        repository.OutboxRepository
+	maxQueueDepth int           // Pending write-backs above which the bridge is not ready (0: no limit)
+	timeout       time.Duration // Each check
+	draining      atomic.Bool
+
+	mu     sync.Mutex
+	cached map[string]upstreamResult // Last upstream results, by check name
+	now    func() time.Time
+}
+
+// upstreamResult is the cached result of an upstream check
+type upstreamResult struct {
+	detail string
+	err    error
+	at     time.Time
+}
+
+// NewReadinessService creates the checks; f and the repositories of
+// nfeRepoFactory are the probes, built on plain HTTP clients
+func NewReadinessService(f repository.FrappeRepository, companies *CompanyRegistry, nfeRepoFactory NFeRepoFactory, store *repository.Store, outbox repository.OutboxRepository, maxQueueDepth int, timeout time.Duration) *ReadinessService {
+	nfeRepos := make(map[string]repository.NFeRepository)
+	for _, company := range companies.Companies() {
+		if _, ok := nfeRepos[company.NFeAPIKey]; !ok {
+			nfeRepos[company.NFeAPIKey] = nfeRepoFactory(company.NFeAPIKey)
+		}
+	}
+	return &ReadinessService{
+		frappeRepo:    f,
+		companies:     companies,
+		nfeRepos:      nfeRepos,
+		store:         store,
+		outbox:        outbox,
+		maxQueueDepth: maxQueueDepth,
+		timeout:       timeout,
+		cached:        make(map[string]upstreamResult),
+		now:           time.Now,
+	}
+}
+
+// Drain marks the bridge as shutting down; it is not ready from then on
+func (s *ReadinessService) Drain() {
+	s.draining.Store(true)
+}
+
+// Check runs every check concurrently
+func (s *ReadinessService) Check(ctx context.Context) Readiness {
+	checks := map[string]func(context.Context) (string, error){
+		"frappe": s.upstream("frappe", func(ctx context.Context) (string, error) {
+			return "", s.frappeRepo.Ping(ctx)
+		}),
+		"store": func(context.Context) (string, error) {
+			version, err := s.store.SchemaVersion()
+			return fmt.Sprintf("schema version %d", version), err
+		},
+		"outbox": s.checkQueueDepth,
+	}
+
+	// One NFe.io check per API key, named after the companies sharing it
+	byKey := make(map[string][]*Company)
+	var keys []string
+	for _, company := range s.companies.Companies() {
+		if _, ok := byKey[company.NFeAPIKey]; !ok {
+			keys = append(keys, company.NFeAPIKey)
+		}
+		byKey[company.NFeAPIKey] = append(byKey[company.NFeAPIKey], company)
+	}
+	for _, key := range keys {
+		companies := byKey[key]
+		names := make([]string, len(companies))
+		for i, company := range companies {
+			names[i] = company.Name
+			if names[i] == "" {
+				names[i] = company.NFeCompanyID // Single company from NFE_COMPANY_ID
+			}
+		}
+		name := "nfeio:" + strings.Join(names, ",")
+		nfeRepo := s.nfeRepos[key]
+		checks[name] = s.upstream(name, func(ctx context.Context) (string, error) {
+			for _, company := range companies {
+				if err := company.verifyEnvironmentWith(ctx, nfeRepo); err != nil {
+					return "", err
+				}
+			}
+			_, err := nfeRepo.ListInvoices(ctx, companies[0].NFeCompanyID, repository.NFeListOptions{
+				Limit:       1,
+				Environment: companies[0].nfeEnvironment(),
+			})
+			return "", err
+		})
+	}
+
+	readiness := Readiness{Ready: true, Draining: s.draining.Load()}
+	if readiness.Draining {
+		readiness.Ready = false
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) (string, error)) {
+			defer wg.Done()
+			result := s.run(ctx, name, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Checks = append(readiness.Checks, result)
+			if !result.Ready {
+				readiness.Ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	sort.Slice(readiness.Checks, func(i, j int) bool { return readiness.Checks[i].Name < readiness.Checks[j].Name })
+	return readiness
+}
+
+// upstream reuses the last result of an upstream check taken less than
+// upstreamCheckTTL ago; the check runs again once it is older
+func (s *ReadinessService) upstream(name string, check func(context.Context) (string, error)) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		s.mu.Lock()
+		last, ok := s.cached[name]
+		s.mu.Unlock()
+		if ok && s.now().Sub(last.at) < upstreamCheckTTL {
+			return last.detail, last.err
+		}
+
+		detail, err := check(ctx)
+		// A probe canceled by its caller says nothing about the upstream
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return detail, err
+		}
+		s.mu.Lock()
+		s.cached[name] = upstreamResult{detail: detail, err: err, at: s.now()}
+		s.mu.Unlock()
+		return detail, err
+	}
+}
+
+func (s *ReadinessService) run(ctx context.Context, name string, check func(context.Context) (string, error)) ReadinessCheck {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	detail, err := check(ctx)
+	result := ReadinessCheck{Name: name, Ready: err == nil, Detail: detail, Duration: time.Since(start).Round(time.Millisecond).String()}
+	if err != nil {
+		result.Detail = err.Error()
+	}
+	return result
+}
+
+// checkQueueDepth reports the write-backs waiting for delivery to Frappe
+func (s *ReadinessService) checkQueueDepth(context.Context) (string, error) {
+	pending, err := s.outbox.ListPending()
+	if err != nil {
+		return "", err
+	}
+	if s.maxQueueDepth > 0 && len(pending) > s.maxQueueDepth {
+		return "", fmt.Errorf("%d write-backs pending, more than %d", len(pending), s.maxQueueDepth)
+	}
+	return fmt.Sprintf("%d write-backs pending", len(pending)), nil
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func TestReadinessChecksDependencies(t *testing.T) {
+	store := newTestStore(t)
+	outboxRepo := repository.NewOutboxRepo(store)
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{}
+	// NFe.io is probed through its own repository, not the retrying one of the company
+	companies := newTestCompanies(t, &fakeNFeRepo{listErr: errors.New("retrying repository used")})
+	probe := func(string) repository.NFeRepository { return nfeRepo }
+	svc := NewReadinessService(frappeRepo, companies, probe, store, outboxRepo, 1, time.Second)
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+
+	readiness := svc.Check(context.Background())
+	if !readiness.Ready || len(readiness.Checks) != 4 {
+		t.Fatalf("expected every check to pass, got %+v", readiness)
+	}
+	for i, name := range []string{"frappe", "nfeio:AnyGrid Matriz", "outbox", "store"} {
+		if readiness.Checks[i].Name != name {
+			t.Errorf("expected check %d to be %s, got %s", i, name, readiness.Checks[i].Name)
+		}
+	}
+
+	// Unreachable upstreams and a queue above the limit; the upstream results
+	// are reused until they are upstreamCheckTTL old
+	frappeRepo.pingErr = errors.New("connection refused")
+	nfeRepo.listErr = errors.New("circuit open")
+	for i := 0; i < 2; i++ {
+		if err := outboxRepo.Enqueue(&models.OutboxMessage{InvoiceName: "INV-0001"}); err != nil {
+			t.Fatalf("failed to enqueue: %v", err)
+		}
+	}
+	readiness = svc.Check(context.Background())
+	for _, check := range readiness.Checks {
+		if check.Ready != (check.Name != "outbox") {
+			t.Errorf("expected the cached upstream results, got %s: %+v", check.Name, check)
+		}
+	}
+	if nfeRepo.listCalls != 1 {
+		t.Errorf("expected NFe.io probed once within the TTL, got %d calls", nfeRepo.listCalls)
+	}
+	now = now.Add(upstreamCheckTTL)
+	readiness = svc.Check(context.Background())
+	if readiness.Ready {
+		t.Fatal("expected the bridge not to be ready")
+	}
+	for _, check := range readiness.Checks {
+		if check.Ready != (check.Name == "store") {
+			t.Errorf("unexpected result of %s: %+v", check.Name, check)
+		}
+	}
+
+	// Draining fails readiness even with healthy dependencies
+	frappeRepo.pingErr, nfeRepo.listErr = nil, nil
+	svc = NewReadinessService(frappeRepo, companies, probe, store, outboxRepo, 0, time.Second)
+	svc.Drain()
+	if readiness := svc.Check(context.Background()); readiness.Ready || !readiness.Draining {
+		t.Errorf("expected a draining bridge not to be ready, got %+v", readiness)
+	}
+}
+
+func TestReadinessProbesNFeIOOncePerAPIKey(t *testing.T) {
+	store := newTestStore(t)
+	repos := map[string]*fakeNFeRepo{"key-1": {}, "key-2": {}}
+	companies, err := NewCompanyRegistry([]config.CompanyConfig{
+		{Name: "AnyGrid Matriz", NFeCompanyID: "company-sp", NFeAPIKey: "key-1", State: "SP"},
+		{Name: "AnyGrid Filial MG", NFeCompanyID: "company-mg", NFeAPIKey: "key-1", State: "SP"},
+		{Name: "AnyGrid Filial RJ", NFeCompanyID: "company-rj", NFeAPIKey: "key-2", State: "SP"},
+	}, "", "", func(apiKey string) repository.NFeRepository { return repos[apiKey] })
+	if err != nil {
+		t.Fatalf("failed to build company registry: %v", err)
+	}
+	probe := func(apiKey string) repository.NFeRepository { return repos[apiKey] }
+	svc := NewReadinessService(&fakeFrappeRepo{}, companies, probe, store, repository.NewOutboxRepo(store), 0, time.Second)
+
+	readiness := svc.Check(context.Background())
+	if !readiness.Ready {
+		t.Fatalf("expected every check to pass, got %+v", readiness)
+	}
+	var names []string
+	for _, check := range readiness.Checks {
+		names = append(names, check.Name)
+	}
+	if got := strings.Join(names, "|"); got != "frappe|nfeio:AnyGrid Filial MG,AnyGrid Matriz|nfeio:AnyGrid Filial RJ|outbox|store" {
+		t.Errorf("expected one NFe.io check per API key, got %s", got)
+	}
+	if repos["key-1"].listCalls != 1 || repos["key-2"].listCalls != 1 {
+		t.Errorf("expected one probe per API key, got %d and %d", repos["key-1"].listCalls, repos["key-2"].listCalls)
+	}
+}
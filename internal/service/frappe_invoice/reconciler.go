@@ -0,0 +1,344 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// defaultReconcileBackoff spaces the NFe.io lookups of a note still waiting
+// for SEFAZ: from 30s up to 30m between lookups
+var defaultReconcileBackoff = repository.RetryPolicy{
+	BaseDelay: 30 * time.Second,
+	MaxDelay:  30 * time.Minute,
+}
+
+// unknownSettle is how long a note sent without an answer is looked for at
+// NFe.io before the attempt is considered never created
+const unknownSettle = 15 * time.Minute
+
+// unknownClockSkew widens the search for a note sent without an answer to
+// notes NFe.io dated slightly before the attempt
+const unknownClockSkew = time.Minute
+
+// Reconciler polls NFe.io for the notes the issuance ledger still has without
+// a final status (authorization and cancellation are asynchronous and webhooks
+// can be lost) and applies their outcome: ledger status, Frappe write-back,
+// archived documents and timeline. Notes sent without an answer are searched
+// among the notes of their company
+type Reconciler struct {
+	companies    *CompanyRegistry
+	issuances    issuanceLog
+	archive      ArchiveService
+	timeline     timeline
+	backoff      repository.RetryPolicy // Delay between lookups of the same note
+	interval     time.Duration          // Pause between background rounds
+	pendingAfter time.Duration          // Age from which a pending note is reported
+	now          func() time.Time
+}
+
+// ReconcileResult summarizes one reconciliation round
+type ReconcileResult struct {
+	Checked int `json:"checked"` // Notes looked up at NFe.io
+	Changed int `json:"changed"` // Notes whose status changed
+	Failed  int `json:"failed"`  // Lookups that failed, retried later
+}
+
+// PendingNote is a note waiting longer than the reconciler threshold
+type PendingNote struct {
+	models.Issuance
+	Age string `json:"age"`
+}
+
+// NewReconciler creates the reconciler; a zero backoff uses 30s-30m, a
+// zero interval polls every minute and a zero pendingAfter reports notes
+// pending for an hour. Numbers assigned by NFe.io on authorization are
+// recorded in the numbering ledger
+func NewReconciler(f repository.FrappeRepository, companies *CompanyRegistry, issuances repository.IssuanceRepository, outbox *OutboxDispatcher, numbering *NumberingService, backoff repository.RetryPolicy, interval, pendingAfter time.Duration) *Reconciler {
+	if backoff.BaseDelay <= 0 || backoff.MaxDelay <= 0 {
+		backoff = defaultReconcileBackoff
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if pendingAfter <= 0 {
+		pendingAfter = time.Hour
+	}
+	return &Reconciler{
+		companies:    companies,
+		issuances:    issuanceLog{repo: issuances, outbox: outbox, numbering: numbering},
+		archive:      NewArchiveService(f, companies, outbox),
+		timeline:     timeline{frappeRepo: f},
+		backoff:      backoff,
+		interval:     interval,
+		pendingAfter: pendingAfter,
+		now:          time.Now,
+	}
+}
+
+// Run reconciles in the background until ctx is canceled, warning about the
+// notes pending longer than the threshold
+func (s *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.ReconcileOnce(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Warning: Reconciliation failed: %v\n", err)
+		}
+		if pending, err := s.PendingNotes(0); err == nil && len(pending) > 0 {
+			fmt.Printf("Warning: %d NF-e pending for more than %s\n", len(pending), s.pendingAfter)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileOnce looks up at NFe.io every note waiting for SEFAZ or sent
+// without an answer whose backoff elapsed and applies the status changes
+func (s *Reconciler) ReconcileOnce(ctx context.Context) (*ReconcileResult, error) {
+	waiting, err := s.issuances.repo.List(repository.IssuanceFilter{
+		Statuses: []string{models.IssuanceStatusUnknown, models.IssuanceStatusProcessing, models.IssuanceStatusCancelling},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReconcileResult{}
+	for i := range waiting {
+		issuance := &waiting[i]
+		if (issuance.NFeID == "" && issuance.Status != models.IssuanceStatusUnknown) || s.now().Before(issuance.NextPollAt) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+
+		result.Checked++
+		changed, err := s.reconcile(ctx, issuance)
+		switch {
+		case err != nil:
+			result.Failed++
+			fmt.Printf("Warning: Failed to reconcile issuance %d: %v\n", issuance.ID, err)
+		case changed:
+			result.Changed++
+		}
+	}
+
+	return result, nil
+}
+
+// PendingNotes reports the notes without a final status created more than
+// olderThan ago (the reconciler threshold when zero), oldest first
+func (s *Reconciler) PendingNotes(olderThan time.Duration) ([]PendingNote, error) {
+	if olderThan <= 0 {
+		olderThan = s.pendingAfter
+	}
+
+	now := s.now()
+	issuances, err := s.issuances.repo.List(repository.IssuanceFilter{
+		Statuses: []string{models.IssuanceStatusPending, models.IssuanceStatusUnknown, models.IssuanceStatusProcessing, models.IssuanceStatusCancelling},
+		Until:    now.Add(-olderThan),
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(issuances, func(i, j int) bool {
+		return issuances[i].CreatedAt.Before(issuances[j].CreatedAt)
+	})
+
+	pending := make([]PendingNote, 0, len(issuances))
+	for _, issuance := range issuances {
+		pending = append(pending, PendingNote{
+			Issuance: issuance,
+			Age:      now.Sub(issuance.CreatedAt).Truncate(time.Second).String(),
+		})
+	}
+	return pending, nil
+}
+
+// reconcile looks the note up and applies its outcome when the status changed;
+// otherwise the next lookup is pushed back. A note sent without an answer and
+// still missing at NFe.io after unknownSettle was never created
+func (s *Reconciler) reconcile(ctx context.Context, issuance *models.Issuance) (bool, error) {
+	previous := issuance.Status
+	response, lookupErr := s.lookup(ctx, issuance)
+	switch {
+	case lookupErr != nil:
+	case response != nil:
+		applyResponse(issuance, response)
+	case s.now().Sub(issuance.CreatedAt) >= unknownSettle:
+		return true, s.notCreated(issuance)
+	}
+	if lookupErr != nil || issuance.Status == previous {
+		issuance.Polls++
+		issuance.NextPollAt = s.now().Add(s.backoff.Backoff(issuance.Polls))
+		if err := s.issuances.repo.Update(issuance); err != nil {
+			return false, err
+		}
+		return false, lookupErr
+	}
+
+	issuance.Polls = 0
+	issuance.NextPollAt = time.Time{}
+	s.apply(ctx, issuance, previous, response)
+	return true, nil
+}
+
+// lookup fetches the note of the attempt; nil when a note sent without an
+// answer is not at NFe.io (yet)
+func (s *Reconciler) lookup(ctx context.Context, issuance *models.Issuance) (*models.ProductInvoiceResponse, error) {
+	company, err := s.companies.ByNFeCompanyID(issuance.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+	if issuance.NFeID == "" {
+		return s.find(ctx, company, issuance)
+	}
+	return company.NFeRepo.GetInvoice(ctx, company.NFeCompanyID, issuance.NFeID)
+}
+
+// find looks for the note of an attempt sent without an answer among the notes
+// of its company created since the attempt, skipping notes recorded by other
+// attempts
+func (s *Reconciler) find(ctx context.Context, company *Company, issuance *models.Issuance) (*models.ProductInvoiceResponse, error) {
+	var payload models.ProductInvoiceRequest
+	if err := json.Unmarshal(issuance.Payload, &payload); err != nil {
+		return nil, fmt.Errorf("failed to decode the payload of issuance %d: %w", issuance.ID, err)
+	}
+
+	since := issuance.CreatedAt.Add(-unknownClockSkew)
+	opts := repository.NFeListOptions{Limit: nfeListPage, Environment: company.nfeEnvironment()}
+	for {
+		page, err := company.NFeRepo.ListInvoices(ctx, company.NFeCompanyID, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list notes of company %s: %w", company.NFeCompanyID, err)
+		}
+
+		for i := range page.ProductInvoices {
+			note := &page.ProductInvoices[i]
+			if !note.CreatedOn.IsZero() && note.CreatedOn.Before(since) {
+				return nil, nil
+			}
+			if !sameNote(&payload, note) {
+				continue
+			}
+			_, err := s.issuances.repo.GetByNFeID(note.ID)
+			if errors.Is(err, repository.ErrNotFound) {
+				return note, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !page.HasMore || len(page.ProductInvoices) == 0 {
+			return nil, nil
+		}
+		opts.StartingAfter = page.ProductInvoices[len(page.ProductInvoices)-1].ID
+	}
+}
+
+// sameNote reports whether an NFe.io note is the one sent with the payload:
+// same serie and number when the bridge numbered it, otherwise same buyer,
+// natureza and item amounts
+func sameNote(payload *models.ProductInvoiceRequest, note *models.ProductInvoiceResponse) bool {
+	if payload.Number > 0 {
+		return note.Serie == payload.Serie && note.Number == payload.Number
+	}
+	if note.Buyer.FederalTaxNumber != payload.Buyer.FederalTaxNumber || !strings.EqualFold(note.OperationNature, payload.OperationNature) {
+		return false
+	}
+
+	if len(note.Items) == 0 {
+		total := 0.0
+		for _, item := range payload.Items {
+			total += item.TotalAmount
+		}
+		return math.Abs(note.Totals.Icms.ProductAmount-total) <= amountTolerance
+	}
+	if len(note.Items) != len(payload.Items) {
+		return false
+	}
+	for i := range payload.Items {
+		if math.Abs(note.Items[i].TotalAmount-payload.Items[i].TotalAmount) > amountTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// notCreated ends an attempt sent without an answer whose note never showed
+// up at NFe.io: it becomes a dead letter that may be replayed
+func (s *Reconciler) notCreated(issuance *models.Issuance) error {
+	previous := issuance.Status
+	issuance.Status = models.IssuanceStatusFailed
+	issuance.Error = "not created at NFe.io: " + issuance.Error
+	issuance.Polls = 0
+	issuance.NextPollAt = time.Time{}
+	observeStatus(issuance, previous, "")
+	return s.issuances.repo.Update(issuance)
+}
+
+// apply records the new status and does what the issuance flow does when
+// NFe.io answers with it right away
+func (s *Reconciler) apply(ctx context.Context, issuance *models.Issuance, previous string, response *models.ProductInvoiceResponse) {
+	event := eventIssuance
+	if issuance.Kind == models.IssuanceKindComplement {
+		event = eventComplement
+	}
+
+	switch {
+	case previous == models.IssuanceStatusUnknown && issuance.Status == models.IssuanceStatusProcessing:
+		// Found at NFe.io: link it to the invoice as an answered call would
+		s.writeBack(ctx, issuance, response)
+	case previous == models.IssuanceStatusCancelling && issuance.Status == models.IssuanceStatusIssued:
+		s.issuances.finish(issuance, response, nil)
+		s.timeline.failure(ctx, issuance.InvoiceName, eventCancellation, fmt.Errorf("refused by SEFAZ: %s", describeNote(response, issuance.Serie, issuance.Number)))
+	case issuance.Status == models.IssuanceStatusIssued:
+		s.writeBack(ctx, issuance, response)
+		s.timeline.success(ctx, issuance.InvoiceName, event, describeNote(response, issuance.Serie, issuance.Number))
+		if issuance.Kind == models.IssuanceKindInvoice && issuance.InvoiceName != "" {
+			if _, err := s.archive.ArchiveInvoiceDocuments(ctx, issuance.InvoiceName); err != nil {
+				fmt.Printf("Warning: Failed to archive NF-e documents: %v\n", err)
+			}
+		}
+	case issuance.Status == models.IssuanceStatusRejected:
+		s.issuances.finish(issuance, response, nil)
+		s.timeline.failure(ctx, issuance.InvoiceName, event, fmt.Errorf("rejected by SEFAZ: %s", describeNote(response, issuance.Serie, issuance.Number)))
+	case issuance.Status == models.IssuanceStatusCancelled:
+		s.issuances.finish(issuance, response, nil)
+		s.timeline.success(ctx, issuance.InvoiceName, eventCancellation, "NF-e "+issuance.NFeID+" cancelled at SEFAZ")
+	default:
+		s.issuances.finish(issuance, response, nil)
+	}
+}
+
+// writeBack sends the Frappe update of an authorized note through the outbox
+func (s *Reconciler) writeBack(ctx context.Context, issuance *models.Issuance, response *models.ProductInvoiceResponse) {
+	var data map[string]interface{}
+	switch issuance.Kind {
+	case models.IssuanceKindInvoice:
+		data = invoiceWriteBack(response, issuance.Serie, issuance.Number, issuance.Environment)
+	case models.IssuanceKindComplement:
+		data = complementWriteBack(response)
+	}
+
+	if data == nil || issuance.InvoiceName == "" {
+		s.issuances.finish(issuance, response, nil)
+		return
+	}
+	s.issuances.complete(ctx, issuance, response, data)
+}
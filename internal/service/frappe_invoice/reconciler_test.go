@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// newTestReconciler returns a reconciler over a fresh ledger holding one note
+// of INV-0001 waiting for SEFAZ as NF-e nfe-1
+func newTestReconciler(t *testing.T, nfeRepo *fakeNFeRepo, frappeRepo *fakeFrappeRepo, status string) (*Reconciler, repository.IssuanceRepository) {
+	t.Helper()
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	issuances.Create(&models.Issuance{
+		Kind:        models.IssuanceKindInvoice,
+		InvoiceName: "INV-0001",
+		CompanyID:   "company-1",
+		NFeID:       "nfe-1",
+		Serie:       1,
+		Number:      42,
+		Status:      status,
+	})
+	reconciler := NewReconciler(frappeRepo, newTestCompanies(t, nfeRepo), issuances, outbox, nil, repository.RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour}, 0, 0)
+	return reconciler, issuances
+}
+
+func TestReconcilerAppliesAuthorization(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-1": {ID: "nfe-1", FlowStatus: flowStatusIssued, PdfUrl: "https://api.nfe.io/nfe-1.pdf", Authorization: models.Authorization{AccessKey: testAccessKey}},
+	}}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": {Name: "INV-0001", InvoiceID: "nfe-1"}}}
+	reconciler, issuances := newTestReconciler(t, nfeRepo, frappeRepo, models.IssuanceStatusProcessing)
+
+	result, err := reconciler.ReconcileOnce(context.Background())
+	if err != nil || result.Checked != 1 || result.Changed != 1 {
+		t.Fatalf("expected one note changed, got %+v (%v)", result, err)
+	}
+
+	issuance, _ := issuances.GetByNFeID("nfe-1")
+	if issuance.Status != models.IssuanceStatusIssued || issuance.AccessKey != testAccessKey {
+		t.Errorf("expected the note issued, got %+v", issuance)
+	}
+	update := frappeRepo.updates["INV-0001"]
+	if update["invoice_link"] != "https://api.nfe.io/nfe-1.pdf" || fmt.Sprint(update["invoice_number"]) != "42" || update["invoice_xml"] == nil {
+		t.Errorf("expected the link, number and archived XML written back, got %v", update)
+	}
+	if comments := frappeRepo.comments["INV-0001"]; len(comments) != 1 || !strings.Contains(comments[0], "flow status Issued") {
+		t.Errorf("expected an authorization comment, got %v", comments)
+	}
+
+	// Nothing is left to reconcile
+	if result, _ := reconciler.ReconcileOnce(context.Background()); result.Checked != 0 {
+		t.Errorf("expected no lookup of a final note, got %+v", result)
+	}
+}
+
+func TestReconcilerRecordsNumberAssignedByNFeIO(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-1": {ID: "nfe-1", FlowStatus: flowStatusIssued, Serie: 1, Number: 57},
+	}}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": {Name: "INV-0001", InvoiceID: "nfe-1"}}}
+	reconciler, _ := newTestReconciler(t, nfeRepo, frappeRepo, models.IssuanceStatusProcessing)
+	numbering, ledger := newTestNumbering(t, nil)
+	reconciler.issuances.numbering = numbering
+
+	if _, err := reconciler.ReconcileOnce(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if issued, _ := ledger.IssuedNumbers("company-1", 1); len(issued) != 1 || issued[0] != 57 {
+		t.Errorf("expected number 57 recorded on authorization, got %v", issued)
+	}
+}
+
+func TestReconcilerBacksOffWhilePending(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-1": {ID: "nfe-1", FlowStatus: "WaitingReturn"},
+	}}
+	frappeRepo := &fakeFrappeRepo{}
+	reconciler, issuances := newTestReconciler(t, nfeRepo, frappeRepo, models.IssuanceStatusProcessing)
+	now := time.Now().Add(time.Second)
+	reconciler.now = func() time.Time { return now }
+
+	result, _ := reconciler.ReconcileOnce(context.Background())
+	if result.Checked != 1 || result.Changed != 0 {
+		t.Fatalf("expected one unchanged note, got %+v", result)
+	}
+	issuance, _ := issuances.GetByNFeID("nfe-1")
+	if issuance.Polls != 1 || !issuance.NextPollAt.After(now) || issuance.NextPollAt.After(now.Add(time.Minute)) {
+		t.Errorf("expected the next lookup within a minute, got %+v", issuance)
+	}
+
+	if result, _ := reconciler.ReconcileOnce(context.Background()); result.Checked != 0 {
+		t.Errorf("expected no lookup before the backoff elapsed, got %+v", result)
+	}
+
+	// The note is reported once it is older than the threshold
+	if pending, _ := reconciler.PendingNotes(0); len(pending) != 0 {
+		t.Errorf("expected no note pending for an hour yet, got %+v", pending)
+	}
+	now = now.Add(2 * time.Hour)
+	pending, err := reconciler.PendingNotes(0)
+	if err != nil || len(pending) != 1 || pending[0].NFeID != "nfe-1" {
+		t.Errorf("expected nfe-1 reported as pending, got %+v (%v)", pending, err)
+	}
+	if result, _ := reconciler.ReconcileOnce(context.Background()); result.Checked != 1 {
+		t.Errorf("expected a new lookup after the backoff, got %+v", result)
+	}
+}
+
+func TestReconcilerConfirmsCancellation(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{byID: map[string]*models.ProductInvoiceResponse{
+		"nfe-1": {ID: "nfe-1", FlowStatus: flowStatusIssued},
+	}}
+	frappeRepo := &fakeFrappeRepo{}
+	reconciler, issuances := newTestReconciler(t, nfeRepo, frappeRepo, models.IssuanceStatusCancelling)
+
+	// Still authorized at SEFAZ: the cancellation is not confirmed yet
+	reconciler.ReconcileOnce(context.Background())
+	if issuance, _ := issuances.GetByNFeID("nfe-1"); issuance.Status != models.IssuanceStatusCancelling {
+		t.Fatalf("expected the note still cancelling, got %s", issuance.Status)
+	}
+
+	nfeRepo.byID["nfe-1"].FlowStatus = flowStatusCancelled
+	reconciler.now = func() time.Time { return time.Now().Add(time.Hour) }
+	reconciler.ReconcileOnce(context.Background())
+	if issuance, _ := issuances.GetByNFeID("nfe-1"); issuance.Status != models.IssuanceStatusCancelled {
+		t.Errorf("expected the note cancelled, got %s", issuance.Status)
+	}
+	if comments := frappeRepo.comments["INV-0001"]; len(comments) != 1 || !strings.HasPrefix(comments[0], eventCancellation+": ") {
+		t.Errorf("expected a cancellation comment, got %v", comments)
+	}
+}
+
+func TestReconcilerResolvesUnknownAttempts(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{
+		"INV-0001": newTimelineInvoice("INV-0001"),
+		"INV-0002": newTimelineInvoice("INV-0002"),
+	}}
+	frappeRepo.invoices["INV-0002"].ClientIDNumber = "987.654.321-00"
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	companies := newTestCompanies(t, nfeRepo)
+	svc := NewIssuerService(frappeRepo, companies, numbering, issuances, outbox, nil)
+	reconciler := NewReconciler(frappeRepo, companies, issuances, outbox, numbering, repository.RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Hour}, 0, 0)
+
+	// Both calls time out; only the note of INV-0001 reached NFe.io
+	nfeRepo.createErr = fmt.Errorf("failed to send request: %w", context.DeadlineExceeded)
+	svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001")
+	svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0002")
+	nfeRepo.createErr = nil
+	nfeRepo.listed = []models.ProductInvoiceResponse{
+		{ID: "nfe-9", FlowStatus: "WaitingSend", OperationNature: "Venda", CreatedOn: time.Now(),
+			Buyer: models.Buyer{FederalTaxNumber: 12345678909}, Items: []models.Items{{TotalAmount: 100}}},
+		{ID: "nfe-8", FlowStatus: flowStatusIssued, OperationNature: "Venda", CreatedOn: time.Now().Add(-time.Hour),
+			Buyer: models.Buyer{FederalTaxNumber: 98765432100}, Items: []models.Items{{TotalAmount: 100}}},
+	}
+
+	result, err := reconciler.ReconcileOnce(context.Background())
+	if err != nil || result.Checked != 2 || result.Changed != 1 {
+		t.Fatalf("expected one of two unknown attempts found, got %+v (%v)", result, err)
+	}
+	found, err := issuances.GetByNFeID("nfe-9")
+	if err != nil || found.InvoiceName != "INV-0001" || found.Status != models.IssuanceStatusProcessing {
+		t.Fatalf("expected INV-0001 processing as nfe-9, got %+v (%v)", found, err)
+	}
+	if frappeRepo.updates["INV-0001"]["invoice_id"] != "nfe-9" {
+		t.Errorf("expected nfe-9 written back, got %v", frappeRepo.updates["INV-0001"])
+	}
+
+	// The older note of the same buyer predates the attempt: INV-0002 stays
+	// unknown until unknownSettle, then becomes a dead letter
+	attempts, _ := issuances.ListByInvoice("INV-0002")
+	if attempts[0].Status != models.IssuanceStatusUnknown {
+		t.Fatalf("expected INV-0002 still unknown, got %s", attempts[0].Status)
+	}
+	reconciler.now = func() time.Time { return time.Now().Add(unknownSettle + time.Hour) }
+	if result, _ := reconciler.ReconcileOnce(context.Background()); result.Changed != 1 {
+		t.Fatalf("expected INV-0002 resolved, got %+v", result)
+	}
+	attempts, _ = issuances.ListByInvoice("INV-0002")
+	if !attempts[0].IsDeadLetter() || !strings.HasPrefix(attempts[0].Error, "not created at NFe.io") {
+		t.Errorf("expected INV-0002 failed as a dead letter, got %+v", attempts[0])
+	}
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0002"); err != nil {
+		t.Errorf("expected INV-0002 issued again, got %v", err)
+	}
+}
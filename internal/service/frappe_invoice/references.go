@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// accessKeyLength is the fixed size of an NF-e access key (chave de acesso)
+const accessKeyLength = 44
+
+// documentReference is a single referenced NF-e (NFref) collected from Frappe
+type documentReference struct {
+	AccessKey string
+	Serie     string
+	Number    string
+}
+
+// collectReferences gathers every referenced NF-e from the Frappe invoice,
+// starting with the header fields and followed by the nf_references child table.
+// Duplicated access keys are dropped so the same note is only referenced once.
+func (s *issuerService) collectReferences(inv *models.Invoices) ([]documentReference, error) {
+	var refs []documentReference
+	seen := make(map[string]bool)
+
+	add := func(accessKey, serie, number string) error {
+		key := s.cleanTaxNumber(accessKey)
+		if key == "" {
+			if serie != "" || number != "" {
+				return fmt.Errorf("referenced NF-e %s/%s has no access key", serie, number)
+			}
+			return nil
+		}
+		if err := validateAccessKey(key); err != nil {
+			return err
+		}
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		refs = append(refs, documentReference{
+			AccessKey: key,
+			Serie:     strings.TrimSpace(serie),
+			Number:    strings.TrimSpace(number),
+		})
+		return nil
+	}
+
+	if err := add(inv.NfRefAccessKey, inv.NfRefSerie, inv.NfRefNum); err != nil {
+		return nil, err
+	}
+	for _, ref := range inv.NfReferences {
+		if err := add(ref.AccessKey, ref.Serie, ref.Number); err != nil {
+			return nil, err
+		}
+	}
+
+	if inv.NfDeRetorno == 1 && len(refs) == 0 {
+		return nil, fmt.Errorf("return invoice %s requires at least one referenced NF-e access key", inv.Name)
+	}
+
+	return refs, nil
+}
+
+// validateReferences pulls each referenced note from NFe.io by access key to make
+// sure it exists, and cross-checks serie/number when they were informed in Frappe
+func (s *issuerService) validateReferences(ctx context.Context, nfeRepo repository.NFeRepository, refs []documentReference) error {
+	for _, ref := range refs {
+		original, err := nfeRepo.GetInvoiceByAccessKey(ctx, ref.AccessKey)
+		if err != nil {
+			return fmt.Errorf("referenced NF-e %s not found: %w", ref.AccessKey, err)
+		}
+
+		if ref.Serie != "" && original.Serie != 0 && ref.Serie != strconv.Itoa(original.Serie) {
+			return fmt.Errorf("referenced NF-e %s has serie %d, Frappe informs %s", ref.AccessKey, original.Serie, ref.Serie)
+		}
+		if ref.Number != "" && original.Number != 0 && ref.Number != strconv.Itoa(original.Number) {
+			return fmt.Errorf("referenced NF-e %s has number %d, Frappe informs %s", ref.AccessKey, original.Number, ref.Number)
+		}
+	}
+	return nil
+}
+
+// buildTaxDocumentsReference maps the collected references to the NFref group
+func buildTaxDocumentsReference(refs []documentReference) []models.TaxDocumentsReference {
+	var docs []models.TaxDocumentsReference
+	for _, ref := range refs {
+		docs = append(docs, models.TaxDocumentsReference{
+			DocumentElectronicInvoice: &models.DocumentElectronicInvoice{
+				AccessKey: ref.AccessKey,
+			},
+		})
+	}
+	return docs
+}
+
+// validateAccessKey checks the length and the modulo 11 check digit of an access key
+func validateAccessKey(accessKey string) error {
+	if len(accessKey) != accessKeyLength {
+		return fmt.Errorf("invalid access key length: %d", len(accessKey))
+	}
+
+	sum, weight := 0, 2
+	for i := accessKeyLength - 2; i >= 0; i-- {
+		digit := int(accessKey[i] - '0')
+		if digit < 0 || digit > 9 {
+			return fmt.Errorf("invalid access key: %s", accessKey)
+		}
+		sum += digit * weight
+		weight++
+		if weight > 9 {
+			weight = 2
+		}
+	}
+
+	checkDigit := 11 - sum%11
+	if checkDigit >= 10 {
+		checkDigit = 0
+	}
+	if int(accessKey[accessKeyLength-1]-'0') != checkDigit {
+		return fmt.Errorf("invalid access key check digit: %s", accessKey)
+	}
+
+	return nil
+}
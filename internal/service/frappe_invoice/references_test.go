@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+const (
+	testAccessKey      = "35240112345678000190550010000001231000001230"
+	testOtherAccessKey = "35240112345678000190550010000001241000001245"
+)
+
+func TestValidateAccessKey(t *testing.T) {
+	if err := validateAccessKey(testAccessKey); err != nil {
+		t.Fatalf("expected valid access key, got %v", err)
+	}
+	if err := validateAccessKey(testAccessKey[:43] + "9"); err == nil {
+		t.Error("expected check digit error")
+	}
+	if err := validateAccessKey("123"); err == nil {
+		t.Error("expected length error")
+	}
+}
+
+func TestCollectReferences(t *testing.T) {
+	s := &issuerService{}
+
+	inv := &models.Invoices{
+		Name:           "INV-0001",
+		NfRefAccessKey: testAccessKey,
+		NfReferences: []models.InvoiceReference{
+			{AccessKey: testAccessKey},
+			{AccessKey: testOtherAccessKey, Serie: "1", Number: "124"},
+		},
+	}
+
+	refs, err := s.collectReferences(inv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(refs) != 2 {
+		t.Fatalf("expected 2 references, got %d", len(refs))
+	}
+
+	docs := buildTaxDocumentsReference(refs)
+	if docs[1].DocumentElectronicInvoice.AccessKey != testOtherAccessKey {
+		t.Errorf("unexpected access key %s", docs[1].DocumentElectronicInvoice.AccessKey)
+	}
+
+	if _, err := s.collectReferences(&models.Invoices{Name: "INV-0002", NfDeRetorno: 1}); err == nil {
+		t.Error("expected error for return invoice without references")
+	}
+}
@@ -0,0 +1,413 @@
+package service
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// Kinds of discrepancy between Frappe and NFe.io
+const (
+	DiscrepancyMissingNFe     = "missing_nfe"     // Submitted invoice without an NF-e at NFe.io
+	DiscrepancyMissingInvoice = "missing_invoice" // NF-e not referenced by any invoice
+	DiscrepancyStatusMismatch = "status_mismatch" // Invoice and NF-e disagree on being in force
+	DiscrepancyAmountMismatch = "amount_mismatch" // Invoice total differs from the NF-e total
+)
+
+// discrepancyKinds lists every kind, so a kind absent from a report reads 0
+var discrepancyKinds = []string{DiscrepancyMissingNFe, DiscrepancyMissingInvoice, DiscrepancyStatusMismatch, DiscrepancyAmountMismatch}
+
+// reportDateLayout is the layout of the report range parameters
+const reportDateLayout = "2006-01-02"
+
+// amountTolerance absorbs rounding differences between Frappe and the NF-e
+const amountTolerance = 0.01
+
+// nfeListPage is the page size used to list the notes of a company
+const nfeListPage = 100
+
+// ReconciliationReport lists the discrepancies between the Frappe invoices and
+// the NFe.io notes created in [From, To)
+type ReconciliationReport struct {
+	From           time.Time     `json:"from"`
+	To             time.Time     `json:"to"`
+	GeneratedAt    time.Time     `json:"generated_at"`
+	FrappeInvoices int           `json:"frappe_invoices"`
+	NFeInvoices    int           `json:"nfe_invoices"`
+	Matched        int           `json:"matched"`
+	Discrepancies  []Discrepancy `json:"discrepancies"`
+}
+
+// Discrepancy is one mismatch found by the reconciliation
+type Discrepancy struct {
+	Kind         string  `json:"kind"`
+	InvoiceName  string  `json:"invoice_name,omitempty"`
+	CompanyID    string  `json:"company_id,omitempty"` // NFe.io company
+	NFeID        string  `json:"nfe_id,omitempty"`
+	AccessKey    string  `json:"access_key,omitempty"`
+	FrappeStatus string  `json:"frappe_status,omitempty"`
+	NFeStatus    string  `json:"nfe_status,omitempty"` // NFe.io flow status
+	FrappeAmount float64 `json:"frappe_amount,omitempty"`
+	NFeAmount    float64 `json:"nfe_amount,omitempty"`
+	Detail       string  `json:"detail"`
+}
+
+// WriteCSV writes the discrepancies as CSV, one per line after a header
+func (r *ReconciliationReport) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"kind", "invoice_name", "company_id", "nfe_id", "access_key", "frappe_status", "nfe_status", "frappe_amount", "nfe_amount", "detail"})
+	for _, d := range r.Discrepancies {
+		cw.Write([]string{
+			d.Kind, d.InvoiceName, d.CompanyID, d.NFeID, d.AccessKey, d.FrappeStatus, d.NFeStatus,
+			formatAmount(d.FrappeAmount), formatAmount(d.NFeAmount), d.Detail,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ReportRange parses the report range from inclusive dates (YYYY-MM-DD) in the
+// local time zone. Missing dates default to the day before now
+func ReportRange(from, to string, now time.Time) (time.Time, time.Time, error) {
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.Local)
+
+	start, end := yesterday, yesterday
+	var err error
+	if from != "" {
+		if start, err = time.ParseInLocation(reportDateLayout, from, time.Local); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date %q (expected YYYY-MM-DD)", from)
+		}
+		end = start
+	}
+	if to != "" {
+		if end, err = time.ParseInLocation(reportDateLayout, to, time.Local); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date %q (expected YYYY-MM-DD)", to)
+		}
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to date %s is before from date %s", to, from)
+	}
+
+	return start, end.AddDate(0, 0, 1), nil
+}
+
+// ReportService reconciles the Frappe invoices with the notes at NFe.io
+type ReportService interface {
+	Reconcile(ctx context.Context, from, to time.Time) (*ReconciliationReport, error)
+}
+
+type reportService struct {
+	frappeRepo repository.FrappeRepository
+	companies  *CompanyRegistry
+	issuances  repository.IssuanceRepository
+	now        func() time.Time
+}
+
+func NewReportService(f repository.FrappeRepository, companies *CompanyRegistry, issuances repository.IssuanceRepository) ReportService {
+	return &reportService{
+		frappeRepo: f,
+		companies:  companies,
+		issuances:  issuances,
+		now:        time.Now,
+	}
+}
+
+// companyNote is an NFe.io note with the company that issued it
+type companyNote struct {
+	note      models.ProductInvoiceResponse
+	companyID string
+}
+
+// Reconcile lists the Frappe invoices and the notes of every company created
+// in [from, to) and matches them by NF-e ID, falling back to the access key
+// of the archived XML. Notes referenced outside the range are looked up
+// individually, so a note created the day after its invoice is not reported
+func (s *reportService) Reconcile(ctx context.Context, from, to time.Time) (*ReconciliationReport, error) {
+	invoices, err := s.frappeRepo.ListInvoices(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := s.listNotes(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconciliationReport{
+		From:           from,
+		To:             to,
+		GeneratedAt:    s.now(),
+		FrappeInvoices: len(invoices),
+		NFeInvoices:    len(notes),
+		Discrepancies:  []Discrepancy{},
+	}
+
+	byID := make(map[string]*companyNote, len(notes))
+	byAccessKey := make(map[string]*companyNote, len(notes))
+	for i := range notes {
+		byID[notes[i].note.ID] = &notes[i]
+		if key := notes[i].note.Authorization.AccessKey; key != "" {
+			byAccessKey[key] = &notes[i]
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for i := range invoices {
+		inv := &invoices[i]
+		if inv.ComplementaryInvoiceID != "" {
+			referenced[inv.ComplementaryInvoiceID] = true
+		}
+		if inv.InvoiceID == "" {
+			if inv.DocStatus == 1 {
+				report.add(Discrepancy{Kind: DiscrepancyMissingNFe, InvoiceName: inv.Name, FrappeStatus: docStatusName(inv.DocStatus), FrappeAmount: inv.TotalTax, Detail: "submitted invoice has no NF-e"})
+			}
+			continue
+		}
+		referenced[inv.InvoiceID] = true
+
+		note := byID[inv.InvoiceID]
+		if note == nil {
+			note = byAccessKey[attachmentAccessKey(inv.InvoiceXML)]
+		}
+		if note == nil {
+			if note, err = s.lookupNote(ctx, inv); err != nil {
+				return nil, err
+			}
+		}
+		if note == nil {
+			report.add(Discrepancy{Kind: DiscrepancyMissingNFe, InvoiceName: inv.Name, NFeID: inv.InvoiceID, FrappeStatus: docStatusName(inv.DocStatus), FrappeAmount: inv.TotalTax, Detail: "NF-e " + inv.InvoiceID + " not found at NFe.io"})
+			continue
+		}
+		referenced[note.note.ID] = true
+		report.compare(inv, note)
+	}
+
+	for i := range notes {
+		note := &notes[i]
+		if referenced[note.note.ID] || !inForce(note.note.FlowStatus) {
+			continue
+		}
+		if err := s.matchOutsideRange(ctx, report, note); err != nil {
+			return nil, err
+		}
+	}
+
+	report.observe()
+	return report, nil
+}
+
+// listNotes pages through the notes of every company, newest first, keeping
+// the ones created in [from, to)
+func (s *reportService) listNotes(ctx context.Context, from, to time.Time) ([]companyNote, error) {
+	var notes []companyNote
+	seen := make(map[string]bool)
+	for _, company := range s.companies.Companies() {
+		if seen[company.NFeCompanyID] {
+			continue
+		}
+		seen[company.NFeCompanyID] = true
+
+		opts := repository.NFeListOptions{Limit: nfeListPage, Environment: company.nfeEnvironment()}
+		for {
+			page, err := company.NFeRepo.ListInvoices(ctx, company.NFeCompanyID, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list notes of company %s: %w", company.NFeCompanyID, err)
+			}
+
+			older := false
+			for _, note := range page.ProductInvoices {
+				switch {
+				case note.CreatedOn.IsZero():
+				case !note.CreatedOn.Before(to):
+					continue
+				case note.CreatedOn.Before(from):
+					older = true
+					continue
+				}
+				notes = append(notes, companyNote{note: note, companyID: company.NFeCompanyID})
+			}
+
+			if !page.HasMore || older || len(page.ProductInvoices) == 0 {
+				break
+			}
+			opts.StartingAfter = page.ProductInvoices[len(page.ProductInvoices)-1].ID
+		}
+	}
+	return notes, nil
+}
+
+// lookupNote fetches a note created outside the range; nil when NFe.io does
+// not know it
+func (s *reportService) lookupNote(ctx context.Context, inv *models.Invoices) (*companyNote, error) {
+	company, err := s.companies.Resolve(inv.Company)
+	if err != nil {
+		return nil, err
+	}
+
+	note, err := company.NFeRepo.GetInvoice(ctx, company.NFeCompanyID, inv.InvoiceID)
+	var apiErr *repository.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NF-e %s of %s: %w", inv.InvoiceID, inv.Name, err)
+	}
+	return &companyNote{note: *note, companyID: company.NFeCompanyID}, nil
+}
+
+// matchOutsideRange looks for the invoice of a note not referenced by the
+// invoices of the range, using the issuance ledger. Return notes have no
+// invoice of their own
+func (s *reportService) matchOutsideRange(ctx context.Context, report *ReconciliationReport, note *companyNote) error {
+	missing := Discrepancy{
+		Kind:      DiscrepancyMissingInvoice,
+		CompanyID: note.companyID,
+		NFeID:     note.note.ID,
+		AccessKey: note.note.Authorization.AccessKey,
+		NFeStatus: note.note.FlowStatus,
+		NFeAmount: note.note.Totals.Icms.InvoiceAmount,
+		Detail:    "NF-e is not referenced by any invoice",
+	}
+
+	issuance, err := s.issuances.GetByNFeID(note.note.ID)
+	if errors.Is(err, repository.ErrNotFound) {
+		report.add(missing)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if issuance.Kind == models.IssuanceKindReturn {
+		return nil
+	}
+	if issuance.InvoiceName == "" {
+		report.add(missing)
+		return nil
+	}
+
+	missing.InvoiceName = issuance.InvoiceName
+	inv, err := s.frappeRepo.GetInvoice(ctx, issuance.InvoiceName)
+	if err != nil {
+		var frappeErr *repository.FrappeError
+		if errors.As(err, &frappeErr) && frappeErr.StatusCode == http.StatusNotFound {
+			missing.Detail = "NF-e was issued for " + issuance.InvoiceName + ", which no longer exists"
+			report.add(missing)
+			return nil
+		}
+		return err
+	}
+
+	switch note.note.ID {
+	case inv.InvoiceID:
+		report.compare(inv, note)
+	case inv.ComplementaryInvoiceID:
+		report.Matched++
+	default:
+		missing.Detail = "NF-e was issued for " + inv.Name + ", which references " + valueOr(inv.InvoiceID, "no NF-e")
+		report.add(missing)
+	}
+	return nil
+}
+
+// compare counts a matched pair and reports status and amount mismatches
+func (r *ReconciliationReport) compare(inv *models.Invoices, note *companyNote) {
+	r.Matched++
+	d := Discrepancy{
+		InvoiceName:  inv.Name,
+		CompanyID:    note.companyID,
+		NFeID:        note.note.ID,
+		AccessKey:    note.note.Authorization.AccessKey,
+		FrappeStatus: docStatusName(inv.DocStatus),
+		NFeStatus:    note.note.FlowStatus,
+		FrappeAmount: inv.TotalTax,
+		NFeAmount:    note.note.Totals.Icms.InvoiceAmount,
+	}
+
+	cancelled := inv.DocStatus == 2
+	switch {
+	case cancelled && note.note.FlowStatus != flowStatusCancelled:
+		d.Kind, d.Detail = DiscrepancyStatusMismatch, "invoice is cancelled but the NF-e is not"
+		r.add(d)
+	case !cancelled && note.note.FlowStatus == flowStatusCancelled:
+		d.Kind, d.Detail = DiscrepancyStatusMismatch, "NF-e is cancelled but the invoice is not"
+		r.add(d)
+	case !cancelled && note.note.FlowStatus == flowStatusIssueFailed:
+		d.Kind, d.Detail = DiscrepancyStatusMismatch, "NF-e was rejected by SEFAZ"
+		r.add(d)
+	}
+
+	if d.FrappeAmount > 0 && d.NFeAmount > 0 && math.Abs(d.FrappeAmount-d.NFeAmount) > amountTolerance {
+		d.Kind = DiscrepancyAmountMismatch
+		d.Detail = fmt.Sprintf("invoice total %s differs from NF-e total %s", formatAmount(d.FrappeAmount), formatAmount(d.NFeAmount))
+		r.add(d)
+	}
+}
+
+func (r *ReconciliationReport) add(d Discrepancy) {
+	r.Discrepancies = append(r.Discrepancies, d)
+}
+
+// observe exposes the discrepancies of the report by kind
+func (r *ReconciliationReport) observe() {
+	counts := make(map[string]int)
+	for _, d := range r.Discrepancies {
+		counts[d.Kind]++
+	}
+	for _, kind := range discrepancyKinds {
+		metrics.ReconciliationDiscrepancies.WithLabelValues(kind).Set(float64(counts[kind]))
+	}
+}
+
+// inForce reports whether a note has (or may still get) fiscal effect:
+// rejected and cancelled notes need no invoice
+func inForce(flowStatus string) bool {
+	return flowStatus != flowStatusIssueFailed && flowStatus != flowStatusCancelled
+}
+
+// attachmentAccessKey extracts the access key from the URL of an archived XML
+// (NFe-<access key>.xml)
+func attachmentAccessKey(fileURL string) string {
+	name := path.Base(fileURL)
+	if !strings.HasPrefix(name, xmlAttachmentPrefix) || !strings.HasSuffix(name, ".xml") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(name, xmlAttachmentPrefix), ".xml")
+}
+
+func docStatusName(docStatus int) string {
+	switch docStatus {
+	case 0:
+		return "Draft"
+	case 1:
+		return "Submitted"
+	case 2:
+		return "Cancelled"
+	default:
+		return strconv.Itoa(docStatus)
+	}
+}
+
+func formatAmount(amount float64) string {
+	if amount == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/metrics"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestReportRange(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 0, 0, 0, time.Local)
+
+	from, to, err := ReportRange("", "", now)
+	if err != nil || !from.Equal(time.Date(2026, 3, 9, 0, 0, 0, 0, time.Local)) || !to.Equal(time.Date(2026, 3, 10, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("expected yesterday by default, got %s-%s (%v)", from, to, err)
+	}
+	from, to, _ = ReportRange("2026-02-01", "2026-02-28", now)
+	if !from.Equal(time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)) || !to.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("expected February with the last day included, got %s-%s", from, to)
+	}
+	if _, _, err := ReportRange("2026-02-10", "2026-02-01", now); err == nil {
+		t.Error("expected an error for a reversed range")
+	}
+	if _, _, err := ReportRange("01/02/2026", "", now); err == nil {
+		t.Error("expected an error for an invalid date")
+	}
+}
+
+func TestReconciliationReport(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 0, 1)
+	day := from.Add(12 * time.Hour)
+	note := func(id, flowStatus string, amount float64, createdOn time.Time) models.ProductInvoiceResponse {
+		n := models.ProductInvoiceResponse{ID: id, FlowStatus: flowStatus, CreatedOn: createdOn}
+		n.Totals.Icms.InvoiceAmount = amount
+		return n
+	}
+
+	nfeRepo := &fakeNFeRepo{
+		listed: []models.ProductInvoiceResponse{
+			note("nfe-next-day", flowStatusIssued, 100, to.Add(time.Hour)),
+			note("nfe-1", flowStatusIssued, 100, day),
+			note("nfe-3", flowStatusIssued, 100, day),
+			note("nfe-4", flowStatusIssued, 210, day),
+			note("nfe-5", flowStatusIssued, 100, day),
+			note("nfe-6", flowStatusIssueFailed, 100, day),
+			note("nfe-7", flowStatusIssued, 100, day),
+			note("nfe-old", flowStatusIssued, 100, from.Add(-time.Hour)),
+		},
+		byID: map[string]*models.ProductInvoiceResponse{
+			"nfe-prev": {ID: "nfe-prev", FlowStatus: flowStatusIssued},
+		},
+	}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{
+		"INV-0001": {Name: "INV-0001", DocStatus: 1, InvoiceID: "nfe-1", TotalTax: 100},
+		"INV-0002": {Name: "INV-0002", DocStatus: 1},
+		"INV-0003": {Name: "INV-0003", DocStatus: 2, InvoiceID: "nfe-3", TotalTax: 100},
+		"INV-0004": {Name: "INV-0004", DocStatus: 1, InvoiceID: "nfe-4", TotalTax: 200},
+		"INV-0005": {Name: "INV-0005", DocStatus: 1, InvoiceID: "nfe-prev", TotalTax: 100},
+		"INV-0006": {Name: "INV-0006", DocStatus: 1, InvoiceID: "nfe-gone", TotalTax: 100},
+		"INV-0007": {Name: "INV-0007", DocStatus: 0},
+	}}
+	issuances := newTestIssuances(t)
+	issuances.Create(&models.Issuance{Kind: models.IssuanceKindReturn, NFeID: "nfe-7", CompanyID: "company-1"})
+
+	svc := NewReportService(frappeRepo, newTestCompanies(t, nfeRepo), issuances)
+	report, err := svc.Reconcile(context.Background(), from, to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if report.FrappeInvoices != 6 || report.NFeInvoices != 6 || report.Matched != 4 {
+		t.Errorf("expected 6 invoices, 6 notes and 4 matches, got %d, %d and %d", report.FrappeInvoices, report.NFeInvoices, report.Matched)
+	}
+
+	want := []Discrepancy{
+		{Kind: DiscrepancyMissingNFe, InvoiceName: "INV-0002"},
+		{Kind: DiscrepancyStatusMismatch, InvoiceName: "INV-0003", NFeID: "nfe-3"},
+		{Kind: DiscrepancyAmountMismatch, InvoiceName: "INV-0004", NFeID: "nfe-4"},
+		{Kind: DiscrepancyMissingNFe, InvoiceName: "INV-0006", NFeID: "nfe-gone"},
+		{Kind: DiscrepancyMissingInvoice, NFeID: "nfe-5"},
+	}
+	if len(report.Discrepancies) != len(want) {
+		t.Fatalf("expected %d discrepancies, got %+v", len(want), report.Discrepancies)
+	}
+	for i, w := range want {
+		got := report.Discrepancies[i]
+		if got.Kind != w.Kind || got.InvoiceName != w.InvoiceName || got.NFeID != w.NFeID || got.Detail == "" {
+			t.Errorf("discrepancy %d: expected %s of %s/%s, got %+v", i, w.Kind, w.InvoiceName, w.NFeID, got)
+		}
+	}
+
+	// The gauge holds the last report: a second run does not add up
+	if _, err := svc.Reconcile(context.Background(), from, to); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for kind, count := range map[string]float64{DiscrepancyMissingNFe: 2, DiscrepancyMissingInvoice: 1, DiscrepancyStatusMismatch: 1, DiscrepancyAmountMismatch: 1} {
+		if got := testutil.ToFloat64(metrics.ReconciliationDiscrepancies.WithLabelValues(kind)); got != count {
+			t.Errorf("expected %v %s discrepancies, got %v", count, kind, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := report.WriteCSV(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(rows) != len(want)+1 || rows[0][0] != "kind" || rows[3][7] != "200.00" || rows[3][8] != "210.00" {
+		t.Errorf("unexpected CSV %v (%v)", rows, err)
+	}
+}
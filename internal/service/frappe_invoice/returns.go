@@ -0,0 +1,346 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+const (
+	purposeDevolution = "devolution"
+	operationOutgoing = "outgoing"
+	operationIncoming = "incoming"
+)
+
+// ReturnService builds and issues return (devolução) invoices mirroring an
+// original NF-e. Used by the warranty flows ("retorno de remessa para conserto",
+// "troca em garantia") and regular sales returns.
+type ReturnService interface {
+	BuildReturnInvoice(ctx context.Context, input ReturnInput) (*models.ProductInvoiceRequest, error)
+	IssueReturnInvoice(ctx context.Context, input ReturnInput) (*models.ProductInvoiceResponse, error)
+}
+
+// ReturnInput describes which note is being returned and which quantities
+type ReturnInput struct {
+	Company               string       `json:"company"` // Frappe company issuing the return
+	AccessKey             string       `json:"access_key"`
+	OperationNature       string       `json:"operation_nature"`
+	AdditionalInformation string       `json:"additional_information"`
+	Items                 []ReturnItem `json:"items"` // Empty means the whole note is returned
+}
+
+// ReturnItem is a returned quantity of one item of the original note
+type ReturnItem struct {
+	Item     int `json:"item"` // Line of the item in the original NF-e (nItem), from 1
+	Quantity int `json:"quantity"`
+}
+
+type returnService struct {
+	companies      *CompanyRegistry
+	builderService *BuilderService
+	numbering      *NumberingService
+	issuances      issuanceLog
+}
+
+func NewReturnService(companies *CompanyRegistry, numbering *NumberingService, issuances repository.IssuanceRepository) ReturnService {
+	return &returnService{
+		companies:      companies,
+		builderService: NewBuilderService(),
+		numbering:      numbering,
+		issuances:      issuanceLog{repo: issuances, numbering: numbering},
+	}
+}
+
+// IssueReturnInvoice builds the return note and sends it to NFe.io, recording
+// the attempt in the local issuance ledger
+func (s *returnService) IssueReturnInvoice(ctx context.Context, input ReturnInput) (*models.ProductInvoiceResponse, error) {
+	issuance, err := s.issuances.start(models.IssuanceKindReturn, "", input)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.issueReturn(ctx, input, issuance)
+	s.issuances.finish(issuance, response, err)
+	if err != nil {
+		return nil, withAttempt(issuance, err)
+	}
+
+	return response, nil
+}
+
+func (s *returnService) issueReturn(ctx context.Context, input ReturnInput, issuance *models.Issuance) (*models.ProductInvoiceResponse, error) {
+	company, err := s.companies.Resolve(input.Company)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.companies.checkEnvironment(ctx, company); err != nil {
+		return nil, err
+	}
+
+	payload, err := s.BuildReturnInvoice(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.numbering.Assign(company.NFeCompanyID, payload); err != nil {
+		return nil, err
+	}
+
+	s.issuances.sending(issuance, company, payload)
+	response, err := company.NFeRepo.CreateProductInvoice(ctx, company.NFeCompanyID, payload)
+	if err != nil {
+		return nil, createError(err)
+	}
+
+	return response, nil
+}
+
+// BuildReturnInvoice fetches the original note by access key and mirrors it
+// into a devolution payload going the opposite way of the original operation,
+// with the return CFOPs of the original ones
+func (s *returnService) BuildReturnInvoice(ctx context.Context, input ReturnInput) (*models.ProductInvoiceRequest, error) {
+	company, err := s.companies.Resolve(input.Company)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAccessKey(input.AccessKey); err != nil {
+		return nil, err
+	}
+
+	original, err := company.NFeRepo.GetInvoiceByAccessKey(ctx, input.AccessKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get original invoice: %w", err)
+	}
+	if len(original.Items) == 0 {
+		return nil, fmt.Errorf("original invoice %s has no items", input.AccessKey)
+	}
+
+	ownNote, err := issuedBy(ctx, company, input.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+	operationType, err := returnOperationType(original.OperationType, ownNote)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.buildReturnItems(original.Items, input.Items, operationType == operationOutgoing)
+	if err != nil {
+		return nil, err
+	}
+
+	// The return goes back to the other party of the original note: its buyer
+	// when the company issued it, its issuer otherwise
+	buyer := original.Buyer
+	if !ownNote {
+		if buyer, err = issuerAsBuyer(original.Issuer, input.AccessKey); err != nil {
+			return nil, err
+		}
+	}
+
+	operationNature := input.OperationNature
+	if operationNature == "" {
+		operationNature = "Devolução de mercadoria"
+	}
+
+	payload := &models.ProductInvoiceRequest{
+		OperationNature: operationNature,
+		OperationType:   operationType,
+		ConsumerType:    original.ConsumerType,
+		PurposeType:     purposeDevolution,
+		Destination:     original.Destination,
+		Buyer:           buyer,
+		Items:           items,
+		Payment: []models.Payment{
+			{
+				PaymentDetail: []models.PaymentDetail{
+					{Method: "withoutPayment", Amount: 0},
+				},
+			},
+		},
+		Transport: models.Transport{FreightModality: "noShipping"},
+		AdditionalInformation: &models.AdditionalInformation{
+			Taxpayer: input.AdditionalInformation,
+			TaxDocumentsReference: buildTaxDocumentsReference([]documentReference{
+				{AccessKey: input.AccessKey},
+			}),
+		},
+	}
+
+	if payload.ConsumerType == "" {
+		payload.ConsumerType = "normal"
+	}
+	company.applyEnvironment(payload)
+
+	payload.Serie, err = s.numbering.ResolveSerie(company.NFeCompanyID, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// buildReturnItems copies the original items (by line, nItem) with the
+// returned quantities, return CFOP and taxes proportional to the returned share
+// of each item
+func (s *returnService) buildReturnItems(originalItems []models.Items, returned []ReturnItem, outgoing bool) ([]models.Items, error) {
+	quantities := make(map[int]int)
+	if len(returned) == 0 {
+		for i, item := range originalItems {
+			quantities[i+1] = item.Quantity
+		}
+	}
+	for _, item := range returned {
+		if item.Item < 1 || item.Item > len(originalItems) {
+			return nil, fmt.Errorf("item %d not found in original invoice", item.Item)
+		}
+		if item.Quantity <= 0 {
+			return nil, fmt.Errorf("invalid return quantity for item %d: %d", item.Item, item.Quantity)
+		}
+		quantities[item.Item] += item.Quantity
+	}
+
+	var items []models.Items
+	for i, original := range originalItems {
+		qty, ok := quantities[i+1]
+		if !ok {
+			continue
+		}
+
+		if qty > original.Quantity {
+			return nil, fmt.Errorf("return quantity %d exceeds original quantity %d for item %d", qty, original.Quantity, i+1)
+		}
+
+		cfop, err := s.determineReturnCFOP(original.Cfop, outgoing)
+		if err != nil {
+			return nil, err
+		}
+
+		ratio := float64(qty) / float64(original.Quantity)
+
+		item := original
+		item.Code = strconv.Itoa(len(items) + 1)
+		item.Cfop = cfop
+		item.Quantity = qty
+		item.TotalAmount = roundAmount(original.UnitAmount * float64(qty))
+		item.Tax = scaleTax(original.Tax, ratio)
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// determineReturnCFOP maps the CFOP of the original note to its return
+// counterpart in the direction of the return; the state digit is kept since
+// both notes travel between the same two states. The counterparts read from
+// either side: 5102 is returned with 1202 by the seller and 5202 by the buyer
+func (s *returnService) determineReturnCFOP(originalCFOP int, outgoing bool) (int, error) {
+	cfop := strconv.Itoa(originalCFOP)
+	if len(cfop) != 4 || !strings.ContainsRune("1256", rune(cfop[0])) {
+		return 0, fmt.Errorf("invalid original CFOP: %d", originalCFOP)
+	}
+
+	returnCodes := map[string]string{
+		"101": "x201", // Venda de produção / compra para industrialização
+		"102": "x202", // Venda de mercadoria adquirida / compra para comercialização
+		"401": "x410", // Venda de produção / compra para industrialização em ST
+		"403": "x411", // Venda de mercadoria adquirida / compra para comercialização em ST
+		"405": "x411", // Venda de mercadoria adquirida em ST (substituído)
+		"915": "x916", // Remessa para conserto
+	}
+
+	template, exists := returnCodes[cfop[1:]]
+	if !exists {
+		return 0, fmt.Errorf("no return CFOP for original CFOP: %d", originalCFOP)
+	}
+
+	isSameState := cfop[0] == '1' || cfop[0] == '5'
+
+	return s.builderService.resolveCFOPCode(template, isSameState, outgoing), nil
+}
+
+// returnOperationType is the direction of the return note. A note issued by
+// the company is returned the opposite way; a note issued by a third party
+// (its sale or remessa, received by the company) is already the opposite of
+// the company's side and is returned the same way
+func returnOperationType(operationType string, ownNote bool) (string, error) {
+	if operationType != operationOutgoing && operationType != operationIncoming {
+		return "", fmt.Errorf("invalid original operation type: %s", operationType)
+	}
+	if !ownNote {
+		return operationType, nil
+	}
+	if operationType == operationOutgoing {
+		return operationIncoming, nil
+	}
+	return operationOutgoing, nil
+}
+
+// issuedBy reports whether the note of the access key was issued by the
+// company: the key embeds the issuer CNPJ (digits 7 to 20)
+func issuedBy(ctx context.Context, company *Company, accessKey string) (bool, error) {
+	taxNumber, err := company.federalTaxNumber(ctx)
+	if err != nil {
+		return false, err
+	}
+	return accessKey[6:20] == taxNumber, nil
+}
+
+// issuerAsBuyer addresses the return of a third-party note to the issuer of
+// that note; the CNPJ is taken from the access key when NFe.io omits it
+func issuerAsBuyer(issuer models.InvoiceIssuer, accessKey string) (models.Buyer, error) {
+	taxNumber := issuer.FederalTaxNumber
+	if taxNumber == 0 {
+		taxNumber, _ = strconv.Atoi(accessKey[6:20])
+	}
+	if issuer.Name == "" || taxNumber == 0 {
+		return models.Buyer{}, fmt.Errorf("original invoice %s has no issuer to return it to", accessKey)
+	}
+
+	buyer := models.Buyer{
+		Name:                    issuer.Name,
+		TradeName:               issuer.TradeName,
+		FederalTaxNumber:        taxNumber,
+		Email:                   issuer.Email,
+		Address:                 issuer.Address,
+		Type:                    legalEntity,
+		StateTaxNumberIndicator: nonTaxPayer,
+	}
+	if issuer.StateTaxNumber != "" {
+		buyer.StateTaxNumber = issuer.StateTaxNumber
+		buyer.StateTaxNumberIndicator = taxPayer
+	}
+	return buyer, nil
+}
+
+// scaleTax applies the returned share to every base and amount of the original taxes
+func scaleTax(tax models.Tax, ratio float64) models.Tax {
+	scaled := tax
+
+	scaled.Icms.BaseTax = roundAmount(tax.Icms.BaseTax * ratio)
+	scaled.Icms.Amount = roundAmount(tax.Icms.Amount * ratio)
+
+	scaled.Pis.BaseTax = roundAmount(tax.Pis.BaseTax * ratio)
+	scaled.Pis.Amount = roundAmount(tax.Pis.Amount * ratio)
+
+	scaled.Cofins.BaseTax = roundAmount(tax.Cofins.BaseTax * ratio)
+	scaled.Cofins.Amount = roundAmount(tax.Cofins.Amount * ratio)
+
+	scaled.Ipi.Base = roundAmount(tax.Ipi.Base * ratio)
+	scaled.Ipi.Amount = roundAmount(tax.Ipi.Amount * ratio)
+
+	scaled.TotalTax = roundAmount(scaled.Icms.Amount + scaled.Pis.Amount + scaled.Cofins.Amount + scaled.Ipi.Amount)
+
+	return scaled
+}
+
+// roundAmount rounds a monetary value to 2 decimal places
+func roundAmount(value float64) float64 {
+	return math.Round(value*100) / 100
+}
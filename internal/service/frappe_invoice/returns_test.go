@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestBuildReturnInvoice(t *testing.T) {
+	repo := &fakeNFeRepo{byAccessKey: map[string]*models.ProductInvoiceResponse{
+		testAccessKey: {
+			OperationType: "outgoing",
+			ConsumerType:  "finalConsumer",
+			Destination:   "interstate_Operation",
+			Buyer:         models.Buyer{Name: "Cliente Teste", FederalTaxNumber: 12345678900},
+			Items: []models.Items{
+				{
+					Code:        "1",
+					Cfop:        6102,
+					Quantity:    4,
+					UnitAmount:  100,
+					TotalAmount: 400,
+					Tax: models.Tax{
+						TotalTax: 100,
+						Icms:     models.Icms{BaseTax: 400, Rate: 18, Amount: 72},
+						Pis:      models.Pis{BaseTax: 400, Rate: 1.65, Amount: 6.6},
+						Cofins:   models.Cofins{BaseTax: 400, Rate: 5.35, Amount: 21.4},
+					},
+				},
+				{Code: "2", Cfop: 6915, Quantity: 1, UnitAmount: 50, TotalAmount: 50},
+			},
+		},
+	}}
+	numbering, _ := newTestNumbering(t, &SeriesPolicy{Rules: []config.SeriesRule{
+		{OperationNature: "Devolução de mercadoria", Serie: 20},
+	}})
+	svc := NewReturnService(newTestCompanies(t, repo), numbering, newTestIssuances(t))
+
+	payload, err := svc.BuildReturnInvoice(context.Background(), ReturnInput{
+		AccessKey: testAccessKey,
+		Items:     []ReturnItem{{Item: 1, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if payload.PurposeType != "devolution" || payload.OperationType != "incoming" {
+		t.Errorf("unexpected purpose/operation: %s/%s", payload.PurposeType, payload.OperationType)
+	}
+	if payload.Serie != 20 {
+		t.Errorf("expected dedicated return serie 20, got %d", payload.Serie)
+	}
+	// Our own sale goes back from the customer it was sold to
+	if payload.Buyer.Name != "Cliente Teste" || payload.Buyer.FederalTaxNumber != 12345678900 {
+		t.Errorf("expected the original buyer as recipient, got %+v", payload.Buyer)
+	}
+	if len(payload.Items) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(payload.Items))
+	}
+
+	item := payload.Items[0]
+	if item.Cfop != 2202 {
+		t.Errorf("expected CFOP 2202, got %d", item.Cfop)
+	}
+	if item.TotalAmount != 100 || item.Tax.Icms.Amount != 18 || item.Tax.Icms.BaseTax != 100 {
+		t.Errorf("unexpected proportional values: total %.2f, icms %.2f, base %.2f", item.TotalAmount, item.Tax.Icms.Amount, item.Tax.Icms.BaseTax)
+	}
+
+	refs := payload.AdditionalInformation.TaxDocumentsReference
+	if len(refs) != 1 || refs[0].DocumentElectronicInvoice.AccessKey != testAccessKey {
+		t.Errorf("expected NFref to original access key, got %+v", refs)
+	}
+
+	full, err := svc.BuildReturnInvoice(context.Background(), ReturnInput{AccessKey: testAccessKey})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(full.Items) != 2 || full.Items[1].Cfop != 2916 {
+		t.Errorf("expected full return with CFOP 2916 for repair remessa, got %+v", full.Items)
+	}
+
+	if _, err := svc.BuildReturnInvoice(context.Background(), ReturnInput{
+		AccessKey: testAccessKey,
+		Items:     []ReturnItem{{Item: 1, Quantity: 5}},
+	}); err == nil {
+		t.Error("expected error when returning more than the original quantity")
+	}
+}
+
+func TestBuildReturnOfThirdPartyNote(t *testing.T) {
+	// A customer in RJ sends two units of the same product for repair with its
+	// own note, on two lines
+	const customerAccessKey = "35240198765432000110550010000004561000004560"
+	repo := &fakeNFeRepo{byAccessKey: map[string]*models.ProductInvoiceResponse{
+		customerAccessKey: {
+			OperationType: "outgoing",
+			Destination:   "interstate_Operation",
+			Issuer: models.InvoiceIssuer{
+				Name:             "Cliente RJ Ltda",
+				FederalTaxNumber: 98765432000110,
+				StateTaxNumber:   "87654321",
+				Address:          models.Address{State: "RJ", City: models.City{Name: "Rio de Janeiro"}},
+			},
+			Buyer: models.Buyer{Name: "AnyGrid Matriz", FederalTaxNumber: 12345678000190},
+			Items: []models.Items{
+				{Code: "INV-5K", Cfop: 6915, Quantity: 1, UnitAmount: 50, TotalAmount: 50},
+				{Code: "INV-5K", Cfop: 6915, Quantity: 1, UnitAmount: 50, TotalAmount: 50},
+				{Code: "CABO", Cfop: 6915, Quantity: 3, UnitAmount: 10, TotalAmount: 30},
+			},
+		},
+	}}
+	numbering, _ := newTestNumbering(t, nil)
+	svc := NewReturnService(newTestCompanies(t, repo), numbering, newTestIssuances(t))
+
+	payload, err := svc.BuildReturnInvoice(context.Background(), ReturnInput{
+		AccessKey: customerAccessKey,
+		Items:     []ReturnItem{{Item: 1, Quantity: 1}, {Item: 2, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The repaired goods go back out to the customer, not to ourselves
+	if payload.OperationType != "outgoing" {
+		t.Errorf("expected an outgoing return, got %s", payload.OperationType)
+	}
+	buyer := payload.Buyer
+	if buyer.Name != "Cliente RJ Ltda" || buyer.FederalTaxNumber != 98765432000110 || buyer.StateTaxNumber != "87654321" || buyer.Address.State != "RJ" {
+		t.Errorf("expected the issuer of the original note as recipient, got %+v", buyer)
+	}
+	if len(payload.Items) != 2 {
+		t.Fatalf("expected both lines of the repeated product, got %d", len(payload.Items))
+	}
+	for _, item := range payload.Items {
+		if item.Cfop != 6916 {
+			t.Errorf("expected CFOP 6916 for goods received for repair, got %d", item.Cfop)
+		}
+	}
+
+	if _, err := svc.BuildReturnInvoice(context.Background(), ReturnInput{
+		AccessKey: customerAccessKey,
+		Items:     []ReturnItem{{Item: 4, Quantity: 1}},
+	}); err == nil {
+		t.Error("expected error for a line not in the original note")
+	}
+}
+
+func TestReturnOperationType(t *testing.T) {
+	tests := []struct {
+		original string
+		ownNote  bool
+		want     string
+	}{
+		{"outgoing", true, "incoming"},  // Sale returned by the customer
+		{"incoming", true, "outgoing"},  // Own entry note returned to the supplier
+		{"outgoing", false, "outgoing"}, // Supplier sale or customer remessa
+		{"incoming", false, "incoming"},
+	}
+	for _, tt := range tests {
+		if got, err := returnOperationType(tt.original, tt.ownNote); err != nil || got != tt.want {
+			t.Errorf("returnOperationType(%s, %v) = %s, %v; want %s", tt.original, tt.ownNote, got, err, tt.want)
+		}
+	}
+	if _, err := returnOperationType("", true); err == nil {
+		t.Error("expected error for an unknown operation type")
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// SeriesPolicy is the ordered list of serie rules. The most specific matching
+// rule wins (natureza over company over operation type, first rule on ties);
+// without a match the legacy BuilderService series are used.
+type SeriesPolicy struct {
+	Rules []config.SeriesRule
+}
+
+// NewSeriesPolicy validates the rules and returns them as a policy
+func NewSeriesPolicy(rules []config.SeriesRule) (*SeriesPolicy, error) {
+	if err := config.ValidateSeriesRules(rules); err != nil {
+		return nil, err
+	}
+
+	return &SeriesPolicy{Rules: rules}, nil
+}
+
+// Resolve returns the rule matching the invoice, if any
+func (p *SeriesPolicy) Resolve(companyID, operationType, operationNature string) (*config.SeriesRule, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	var best *config.SeriesRule
+	bestScore := -1
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		score := 0
+
+		if rule.Company != "" {
+			if rule.Company != companyID {
+				continue
+			}
+			score += 2
+		}
+		if rule.OperationType != "" {
+			if rule.OperationType != operationType {
+				continue
+			}
+			score++
+		}
+		if rule.OperationNature != "" {
+			if !strings.EqualFold(strings.TrimSpace(rule.OperationNature), strings.TrimSpace(operationNature)) {
+				continue
+			}
+			score += 4
+		}
+
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+
+	return best, best != nil
+}
+
+// NumberingService assigns serie and (optionally) number to outgoing payloads
+// and keeps the local ledger up to date
+type NumberingService struct {
+	mu             sync.RWMutex // Guards policy, replaced on configuration reload
+	policy         *SeriesPolicy
+	ledgerRepo     repository.LedgerRepository
+	builderService *BuilderService
+}
+
+func NewNumberingService(policy *SeriesPolicy, l repository.LedgerRepository) *NumberingService {
+	return &NumberingService{
+		policy:         policy,
+		ledgerRepo:     l,
+		builderService: NewBuilderService(),
+	}
+}
+
+// SetPolicy replaces the series policy (configuration reload); numbers already
+// reserved in the ledger are kept
+func (n *NumberingService) SetPolicy(policy *SeriesPolicy) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.policy = policy
+}
+
+func (n *NumberingService) currentPolicy() *SeriesPolicy {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.policy
+}
+
+// ResolveSerie returns the serie for the payload without touching the ledger
+func (n *NumberingService) ResolveSerie(companyID string, payload *models.ProductInvoiceRequest) (int, error) {
+	return n.resolveSerie(n.currentPolicy(), companyID, payload)
+}
+
+func (n *NumberingService) resolveSerie(policy *SeriesPolicy, companyID string, payload *models.ProductInvoiceRequest) (int, error) {
+	if rule, ok := policy.Resolve(companyID, payload.OperationType, payload.OperationNature); ok {
+		return rule.Serie, nil
+	}
+
+	_, serie, err := n.builderService.DetermineOperationType(payload.OperationType)
+	return serie, err
+}
+
+// Assign sets Serie on the payload from the policy and, for explicit numbering
+// rules, reserves the next number of the serie in the ledger. A Number already
+// set on the payload is kept. The policy is read once, so a reload cannot pick
+// the serie from one policy and the numbering from another
+func (n *NumberingService) Assign(companyID string, payload *models.ProductInvoiceRequest) error {
+	policy := n.currentPolicy()
+	serie, err := n.resolveSerie(policy, companyID, payload)
+	if err != nil {
+		return err
+	}
+	payload.Serie = serie
+
+	rule, ok := policy.Resolve(companyID, payload.OperationType, payload.OperationNature)
+	if ok && rule.ExplicitNumbering && payload.Number == 0 {
+		number, err := n.ledgerRepo.ReserveNextNumber(companyID, payload.Serie)
+		if err != nil {
+			return fmt.Errorf("failed to reserve number: %v", err)
+		}
+		payload.Number = number
+	}
+
+	return nil
+}
+
+// Record stores the number of a note accepted by NFe.io in the ledger. Notes
+// numbered by NFe.io only know their number once authorized, so it is called
+// on every answer of the attempt, including the reconciler's lookups
+func (n *NumberingService) Record(issuance *models.Issuance) {
+	if n == nil || issuance.CompanyID == "" || issuance.Number == 0 || !usesNumber(issuance) {
+		return
+	}
+
+	if err := n.ledgerRepo.RecordNumber(issuance.CompanyID, issuance.Serie, issuance.Number); err != nil {
+		fmt.Printf("Warning: Failed to record number in ledger: %v\n", err)
+	}
+}
+
+// usesNumber reports whether the attempt holds its number at SEFAZ: accepted
+// by NFe.io, authorized or cancelled. Rejected and failed attempts do not
+func usesNumber(issuance *models.Issuance) bool {
+	switch issuance.Status {
+	case models.IssuanceStatusProcessing, models.IssuanceStatusIssued, models.IssuanceStatusCancelling, models.IssuanceStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/config"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+)
+
+func TestNumberingAssign(t *testing.T) {
+	policy := &SeriesPolicy{Rules: []config.SeriesRule{
+		{OperationType: "outgoing", Serie: 1},
+		{Company: "company-1", OperationType: "outgoing", Serie: 2, ExplicitNumbering: true},
+		{Company: "company-1", OperationNature: "retorno de remessa para conserto", Serie: 3},
+	}}
+	numbering, ledger := newTestNumbering(t, policy)
+
+	cases := []struct {
+		company, operationType, nature string
+		serie, number                  int
+	}{
+		{"company-2", "outgoing", "Venda", 1, 0},
+		{"company-1", "outgoing", "Venda", 2, 1},
+		{"company-1", "outgoing", "Venda", 2, 2},
+		{"company-1", "outgoing", "Retorno de remessa para conserto", 3, 0},
+		{"company-2", "incoming", "Remessa para conserto", 10, 0}, // legacy BuilderService serie
+	}
+
+	for _, c := range cases {
+		payload := &models.ProductInvoiceRequest{OperationType: c.operationType, OperationNature: c.nature}
+		if err := numbering.Assign(c.company, payload); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if payload.Serie != c.serie || payload.Number != c.number {
+			t.Errorf("%s/%s/%s: expected serie %d number %d, got %d/%d", c.company, c.operationType, c.nature, c.serie, c.number, payload.Serie, payload.Number)
+		}
+	}
+
+	// Number 1 was reserved but never accepted by NFe.io: it must show up as a gap
+	numbering.Record(&models.Issuance{CompanyID: "company-1", Serie: 2, Number: 2, Status: models.IssuanceStatusProcessing})
+	gaps, err := NewDisablementService(newTestCompanies(t, &fakeNFeRepo{}), ledger, newTestIssuances(t)).DetectGaps("company-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(gaps) != 1 || gaps[0] != (NumberRange{Serie: 2, Begin: 1, End: 1}) {
+		t.Errorf("expected gap 1-1 in serie 2, got %+v", gaps)
+	}
+
+	payload := &models.ProductInvoiceRequest{OperationType: "outgoing"}
+	if err := numbering.Assign("company-1", payload); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	numbering.Record(&models.Issuance{CompanyID: "company-1", Serie: payload.Serie, Number: 4, Status: models.IssuanceStatusIssued})
+	gaps, _ = NewDisablementService(newTestCompanies(t, &fakeNFeRepo{}), ledger, newTestIssuances(t)).DetectGaps("company-1")
+	if len(gaps) != 2 || gaps[0] != (NumberRange{Serie: 2, Begin: 1, End: 1}) || gaps[1] != (NumberRange{Serie: 2, Begin: 3, End: 3}) {
+		t.Errorf("expected gaps 1-1 and 3-3 in serie 2, got %+v", gaps)
+	}
+}
@@ -47,6 +47,9 @@ type TaxInput struct {
 
 	AliquotaIPI float64
 	CSTIPI      string
+
+	// Simples Nacional issuers report ICMS with CSOSN instead of CST
+	SimplesNacional bool
 }
 
 // CalculateTax calculates all taxes for an item and returns a Tax struct
@@ -85,6 +88,10 @@ func (s *TaxService) calculateICMS(input TaxInput, baseTax float64) models.Icms
 		origin = input.OrigemICMS[:1]
 	}
 
+	if input.SimplesNacional {
+		return s.calculateICMSSimplesNacional(input, origin, baseTax, amount)
+	}
+
 	cst := "00"
 	if len(input.CSTICMS) >= 2 {
 		cst = input.CSTICMS[:2]
@@ -106,6 +113,34 @@ func (s *TaxService) calculateICMS(input TaxInput, baseTax float64) models.Icms
 	}
 }
 
+// calculateICMSSimplesNacional builds the ICMS group for Simples Nacional issuers.
+// A 3 digit CSOSN may come in CSTICMS; otherwise 102 (sem permissão de crédito).
+// Only CSOSN 900 carries the ICMS base and amount.
+func (s *TaxService) calculateICMSSimplesNacional(input TaxInput, origin string, baseTax, amount float64) models.Icms {
+	csosn := "102"
+	if len(input.CSTICMS) == 3 {
+		csosn = input.CSTICMS
+	}
+
+	modality := "3"
+	if len(input.ModDetermBC) > 0 {
+		modality = input.ModDetermBC[:1]
+	}
+
+	icms := models.Icms{
+		Origin:             origin,   // Origem da mercadoria
+		Csosn:              csosn,    // Código de Situação da Operação no Simples Nacional
+		BaseTaxModality:    modality, // Modalidade de determinação da BC
+		BaseTaxSTReduction: "0",
+	}
+	if csosn == "900" {
+		icms.BaseTax = baseTax
+		icms.Rate = input.AliqICMS
+		icms.Amount = amount
+	}
+	return icms
+}
+
 // calculatePIS calculates PIS tax
 func (s *TaxService) calculatePIS(input TaxInput, baseTax float64) models.Pis {
 	amount := s.calcSimpleTax(input.AliquotaPis, baseTax)
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+// Fiscal events recorded on the Invoices timeline
+const (
+	eventIssuance         = "NF-e issuance"
+	eventComplement       = "Complementary NF-e issuance"
+	eventCancellation     = "NF-e cancellation"
+	eventCorrectionLetter = "Correction letter (CC-e)"
+)
+
+// NFe.io flow statuses of a note rejected by SEFAZ, of a cancelled note and
+// of a cancellation refused by SEFAZ
+const (
+	flowStatusIssueFailed  = "IssueFailed"
+	flowStatusCancelled    = "Cancelled"
+	flowStatusCancelFailed = "CancelFailed"
+)
+
+// timelineTimeout bounds each timeline write. The writes outlive the request
+// context so a timed out request still leaves its failure on the timeline
+const timelineTimeout = 10 * time.Second
+
+// timeline records fiscal events as Comments on the Frappe Invoices document
+// and failures as Error Log entries, so fiscal staff can follow the history
+// inside ERPNext. Write failures are only logged: the fiscal operation itself
+// already succeeded or failed at this point
+type timeline struct {
+	frappeRepo repository.FrappeRepository
+}
+
+// success comments the outcome of an event on the invoice timeline
+func (t timeline) success(ctx context.Context, invoiceName, event, detail string) {
+	if invoiceName == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timelineTimeout)
+	defer cancel()
+
+	if err := t.frappeRepo.AddInvoiceComment(ctx, invoiceName, event+": "+detail); err != nil {
+		fmt.Printf("Warning: Failed to add timeline comment: %v\n", err)
+	}
+}
+
+// failure comments a failed event on the invoice timeline and creates an
+// Error Log entry with the full error
+func (t timeline) failure(ctx context.Context, invoiceName, event string, err error) {
+	if invoiceName == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timelineTimeout)
+	defer cancel()
+
+	title := event + " failed"
+	if isRejection(err) {
+		title = event + " rejected"
+	}
+
+	if err := t.frappeRepo.AddInvoiceComment(ctx, invoiceName, title+": "+err.Error()); err != nil {
+		fmt.Printf("Warning: Failed to add timeline comment: %v\n", err)
+	}
+	if err := t.frappeRepo.LogInvoiceError(ctx, invoiceName, title, describeError(err)); err != nil {
+		fmt.Printf("Warning: Failed to create Error Log: %v\n", err)
+	}
+}
+
+// isRejection reports whether NFe.io refused the request because of its data
+func isRejection(err error) bool {
+	var apiErr *repository.APIError
+	return errors.As(err, &apiErr) && apiErr.IsValidation()
+}
+
+// describeError is the Error Log body: the error plus NFe.io's code and
+// messages when the failure came from NFe.io
+func describeError(err error) string {
+	message := err.Error()
+
+	var apiErr *repository.APIError
+	if errors.As(err, &apiErr) {
+		message += fmt.Sprintf("\n\nNFe.io status: %d", apiErr.StatusCode)
+		if apiErr.Code != "" {
+			message += "\nNFe.io code: " + apiErr.Code
+		}
+		for _, m := range apiErr.Messages {
+			message += "\n- " + m
+		}
+	}
+
+	return message
+}
+
+// describeNote summarizes an NFe.io response for a timeline comment
+func describeNote(response *models.ProductInvoiceResponse, serie, number int) string {
+	if response.Serie > 0 {
+		serie = response.Serie
+	}
+	if response.Number > 0 {
+		number = response.Number
+	}
+
+	detail := fmt.Sprintf("NF-e %s, serie %d", response.ID, serie)
+	if number > 0 {
+		detail += fmt.Sprintf(", number %d", number)
+	}
+	if response.FlowStatus != "" {
+		detail += ", flow status " + response.FlowStatus
+	} else if response.Status != "" {
+		detail += ", status " + response.Status
+	}
+	if response.FlowMessage != "" {
+		detail += " (" + response.FlowMessage + ")"
+	}
+
+	return detail
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/models"
+	"github.com/AnyGridTech/frappe-nfe-bridge/internal/repository"
+)
+
+func newTimelineInvoice(name string) *models.Invoices {
+	return &models.Invoices{
+		Name:           name,
+		OperationType:  "Venda",
+		ClientName:     "Cliente Teste",
+		ClientIDNumber: "123.456.789-09",
+		InvoicesTable: []models.ItemInvoice{
+			{ItemName: "Inversor", Rate: 100, Quantity: 1, NCM: "85044090"},
+		},
+	}
+}
+
+func TestIssuerRecordsIssuanceOnTimeline(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	comments := frappeRepo.comments["INV-0001"]
+	if len(comments) != 1 || !strings.HasPrefix(comments[0], eventIssuance+": NF-e nfe-1, serie") {
+		t.Errorf("expected an issuance comment, got %v", comments)
+	}
+	if len(frappeRepo.errorLogs["INV-0001"]) != 0 {
+		t.Errorf("expected no Error Log, got %v", frappeRepo.errorLogs["INV-0001"])
+	}
+}
+
+func TestIssuerRecordsRejectionOnTimeline(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{createErr: &repository.APIError{StatusCode: 400, Messages: []string{"CFOP inválido"}}}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{"INV-0001": newTimelineInvoice("INV-0001")}}
+	numbering, _ := newTestNumbering(t, nil)
+	issuances, outbox := newTestWriteBacks(t, frappeRepo)
+	svc := NewIssuerService(frappeRepo, newTestCompanies(t, nfeRepo), numbering, issuances, outbox, nil)
+
+	if _, err := svc.IssueNoteForFrappeInvoice(context.Background(), "INV-0001"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	comments := frappeRepo.comments["INV-0001"]
+	if len(comments) != 1 || !strings.HasPrefix(comments[0], eventIssuance+" rejected: ") {
+		t.Errorf("expected a rejection comment, got %v", comments)
+	}
+	if logs := frappeRepo.errorLogs["INV-0001"]; len(logs) != 1 || logs[0] != eventIssuance+" rejected" {
+		t.Errorf("expected a rejection Error Log, got %v", logs)
+	}
+}
+
+func TestInvoiceEventsRecordOnTimeline(t *testing.T) {
+	nfeRepo := &fakeNFeRepo{}
+	frappeRepo := &fakeFrappeRepo{invoices: map[string]*models.Invoices{
+		"INV-0001": {Name: "INV-0001", InvoiceID: "nfe-1"},
+		"INV-0002": {Name: "INV-0002"},
+	}}
+	svc := NewInvoiceEventService(frappeRepo, newTestCompanies(t, nfeRepo), newTestIssuances(t))
+
+	if err := svc.CancelInvoice(context.Background(), "INV-0001", "Pedido cancelado pelo cliente"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nfeRepo.deleted) != 1 || nfeRepo.deleted[0] != "nfe-1" || nfeRepo.deleteReasons[0] != "Pedido cancelado pelo cliente" {
+		t.Errorf("expected nfe-1 canceled with the reason, got %v %v", nfeRepo.deleted, nfeRepo.deleteReasons)
+	}
+	if _, err := svc.IssueCorrectionLetter(context.Background(), "INV-0001", "Correção do endereço de entrega"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	comments := frappeRepo.comments["INV-0001"]
+	if len(comments) != 2 ||
+		comments[0] != eventCancellation+": NF-e nfe-1 sent for cancellation (Pedido cancelado pelo cliente)" ||
+		comments[1] != eventCorrectionLetter+": NF-e nfe-1: Correção do endereço de entrega" {
+		t.Errorf("unexpected timeline %v", comments)
+	}
+
+	// Failures are commented and logged
+	if _, err := svc.IssueCorrectionLetter(context.Background(), "INV-0001", "curta"); err == nil {
+		t.Error("expected error for a correction shorter than 15 characters")
+	}
+	if err := svc.CancelInvoice(context.Background(), "INV-0002", "Pedido cancelado pelo cliente"); err == nil {
+		t.Error("expected error for an invoice without NF-e")
+	}
+	if logs := frappeRepo.errorLogs["INV-0001"]; len(logs) != 1 || logs[0] != eventCorrectionLetter+" failed" {
+		t.Errorf("expected a correction letter Error Log, got %v", logs)
+	}
+	if logs := frappeRepo.errorLogs["INV-0002"]; len(logs) != 1 || logs[0] != eventCancellation+" failed" {
+		t.Errorf("expected a cancellation Error Log, got %v", logs)
+	}
+
+	// SEFAZ justification length
+	if err := svc.CancelInvoice(context.Background(), "INV-0001", "curta"); err == nil {
+		t.Error("expected error for a justification shorter than 15 characters")
+	}
+	if err := svc.CancelInvoice(context.Background(), "INV-0001", strings.Repeat("a", 256)); err == nil {
+		t.Error("expected error for a justification longer than 255 characters")
+	}
+	if len(nfeRepo.deleted) != 1 {
+		t.Errorf("expected invalid justifications not sent to NFe.io, got %v", nfeRepo.deleted)
+	}
+}